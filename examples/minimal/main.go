@@ -26,6 +26,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -51,9 +52,6 @@ func main() {
 		ClientId:                   primitives.PrimitiveString(clientId),
 		Username:                   "not-used",
 		Password:                   "supersecurepassword",
-		WillRetain:                 false,
-		WillQos:                    0,
-		Will:                       "",
 		CleanSession:               false,
 		KeepAlive:                  30,
 		SessionExpiryInterval:      primitives.PrimitiveUint32((time.Minute * 5).Minutes()),
@@ -90,40 +88,17 @@ restart:
 	defer cancel()
 
 	// Attempt to connect
-	if err = client.Connect(ctx, connectPacket); err != nil {
+	if _, err = client.Connect(ctx, connectPacket); err != nil {
 		log.Fatalln(err)
 	}
 
-	donePolling := make(chan struct{}, 1)
-
-	// Begin polling
-	go func(done <-chan struct{}) {
-		// Use ticker to send periodic keep-alive control packets
-		ticker := time.NewTicker(client.KeepAliveInterval())
-
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				if err := client.KeepAlive(); err != nil {
-					log.Println("Keep Alive Error:", err)
-					return
-				}
-			default:
-				// Set a deadline of 1 second for polling for incoming messages
-				ctx, cancel = context.WithTimeout(context.Background(), time.Second)
-
-				// Poll for incoming messages
-				if err := client.Poll(ctx); err != nil {
-					cancel()
-					log.Printf("Poll error: %v\n", err)
-					return
-				}
-				cancel()
-			}
+	// Run processes incoming control packets and keeps the connection alive until the run context is cancelled
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	go func() {
+		if err := client.Run(runCtx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Println("Run error:", err)
 		}
-	}(donePolling)
+	}()
 
 	// Create an additional event channel receive only the events for the subscription
 	topicEvents := client.CreateEventChannel(10)
@@ -139,7 +114,7 @@ restart:
 			case <-publishTicker.C:
 				// Publish a random number of messages all at once
 				for i := 0; i < rand.Intn(15); i++ {
-					if err = client.Publish(context.Background(), packets.Publish{
+					if err = client.Publish(context.Background(), &packets.Publish{
 						Retain:  false,
 						QoS:     packets.QoS0,
 						Topic:   "/test/ping",
@@ -228,9 +203,8 @@ restart:
 	timer := time.NewTimer(time.Second * 30)
 	select {
 	case <-timer.C:
-		// Close the conn and goto to the restart label
-		donePolling <- struct{}{}
-		conn.Close()
+		// Stop the run loop, which also closes the conn, and goto to the restart label
+		stopRunning()
 
 		// Close the event channel
 		client.CloseEventChannel(events)
@@ -238,6 +212,4 @@ restart:
 
 		goto restart
 	}
-
-	select {}
 }
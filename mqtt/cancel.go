@@ -0,0 +1,85 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// opError wraps err in an OpError naming the operation if the operation failed because ctx is done. I/O deadlines are
+// taken from ctx, so an elapsed deadline is reported as the error of ctx as well.
+func opError(op string, ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	var opErr *OpError
+	if errors.As(err, &opErr) {
+		return err
+	}
+
+	if errors.Is(err, ctx.Err()) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return &OpError{Op: op, Err: ctx.Err()}
+	}
+	return err
+}
+
+// interruptOnDone unblocks pending I/O on conn once ctx is done by moving its deadline into the past. Only the write
+// deadline is moved if writeOnly is true. The returned function stops watching ctx and must be called before the
+// deadline is set again. It may be called more than once.
+func interruptOnDone(ctx context.Context, conn net.Conn, writeOnly bool) (stop func()) {
+	if ctx.Done() == nil {
+		// ctx can never be cancelled
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			if writeOnly {
+				conn.SetWriteDeadline(time.Unix(1, 0))
+			} else {
+				conn.SetDeadline(time.Unix(1, 0))
+			}
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-exited
+		})
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage/memory"
+)
+
+// expectOpError fails the test unless err is an OpError for the operation wrapping want.
+func expectOpError(t *testing.T, err error, op string, want error) {
+	t.Helper()
+
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Op != op || !errors.Is(err, want) {
+		t.Errorf("error = %v, want %s: %v", err, op, want)
+	}
+}
+
+func TestClient_CancelConnect(t *testing.T) {
+	c, s := newTestClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(ctx, &packets.Connect{Version: packets.MQTT5, ClientId: "test"})
+		errChan <- err
+	}()
+
+	// Never respond with CONNACK
+	s.expect(packets.CONNECT)
+	cancel()
+
+	expectOpError(t, <-errChan, "connect", context.Canceled)
+	if c.IsConnected() {
+		t.Error("client is connected after Connect was cancelled")
+	}
+}
+
+func TestClient_CancelSubscribe(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		topic := Topic{}
+		topic.SetFilter("test/topic")
+		errChan <- c.Subscribe(ctx, []Topic{topic})
+	}()
+
+	// Never respond with SUBACK
+	s.expect(packets.SUBSCRIBE)
+	cancel()
+	expectOpError(t, <-errChan, "subscribe", context.Canceled)
+
+	go func() {
+		errChan <- c.Unsubscribe(ctx, []string{"test/topic"})
+	}()
+	expectOpError(t, <-errChan, "unsubscribe", context.Canceled)
+
+	// The pending responses are cleaned up
+	c.mutex.RLock()
+	pending := len(c.responseChan)
+	c.mutex.RUnlock()
+	if pending != 0 {
+		t.Errorf("%d responses are still pending", pending)
+	}
+}
+
+func TestClient_CancelPublish(t *testing.T) {
+	c, s := newTestClient(t)
+	store := memory.NewStorage()
+	c.SetStorage(store)
+	s.connect(c)
+
+	// The send quota is exhausted so the publish waits for an acknowledgement that never arrives
+	c.sendQuota.reset(1)
+	c.sendQuota.consume(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	pub := &packets.Publish{QoS: packets.QoS1, PacketIdentifier: 7, Topic: "test/topic", Payload: []byte("hello")}
+	expectOpError(t, c.Publish(ctx, pub), "publish", context.DeadlineExceeded)
+
+	// The publish was never sent so it is not resent later
+	if _, err := store.Get(7); err == nil {
+		t.Error("cancelled publish is still stored")
+	}
+
+	// A write that blocks because the server is not reading is interrupted as well
+	ctx, cancel = context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.Publish(ctx, &packets.Publish{Topic: "test/topic", Payload: []byte("hello")})
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	expectOpError(t, <-errChan, "publish", context.Canceled)
+}
@@ -25,7 +25,6 @@
 package mqtt
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -33,11 +32,13 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/waj334/tinygo-mqtt/mqtt/packets"
 	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
 	"github.com/waj334/tinygo-mqtt/mqtt/storage"
+	"github.com/waj334/tinygo-mqtt/mqtt/trie"
 )
 
 type Client struct {
@@ -45,30 +46,80 @@ type Client struct {
 	connMutex sync.Mutex
 	mutex     sync.RWMutex
 
+	// dialer opens new connections for Connect and Reconnect. connectPacket is the last CONNECT control packet sent so
+	// that Reconnect can repeat it.
+	dialer        Dialer
+	connectPacket *packets.Connect
+	broker        string
+
 	storage storage.Storage
 
 	isConnected           bool
+	sharedSubscriptions   bool
+	retainAvailable       bool
 	keepAliveInterval     time.Duration
 	pingRespDeadline      time.Time
 	sessionExpiryInterval uint32
 
-	clientReceiveMaximum uint16
-	serverReceiveMaximum uint16
+	// sendQuota limits the QoS 1 and QoS 2 publishes sent to the server to its Receive Maximum
+	sendQuota quotaSemaphore
+
+	// inbound tracks the QoS 1 and QoS 2 publishes received from the server against the client's Receive Maximum
+	inbound inboundFlow
 
 	eventChans map[int]EventChannel
-	topicChans map[string]EventChannel
+	topicSubs  map[string]*subscription
+
+	// restoreSubscriptions is set when the server did not keep the session so that the subscriptions in topicSubs
+	// must be sent again.
+	restoreSubscriptions bool
+
+	// subscriptions routes incoming publishes to the event channels bound to matching topic filters. routeBuf is reused
+	// between publishes and is guarded by connMutex.
+	subscriptions *trie.Trie[EventChannel]
+	routeBuf      []EventChannel
 
 	responseChan map[int]chan any
 
 	evChanIdCounter int
 	eventMutex      sync.Mutex
 
-	sendQuota    uint16
-	receiveQuota uint16
-
 	rngFn func() uint32
 
-	pendingSendSemaphore chan struct{}
+	// writeBuf and readBuf are reused between control packets in order to avoid allocating a new buffer for every
+	// packet sent or received. Both are guarded by connMutex.
+	writeBuf []byte
+	readBuf  []byte
+
+	// lastSent and pingSent are the times, in Unix nanoseconds, at which the last control packet and the outstanding
+	// PINGREQ were sent. pingSent is zero if no PINGREQ is awaiting a response.
+	lastSent atomic.Int64
+	pingSent atomic.Int64
+
+	// stopped is closed when the run loop exits so that pending operations can fail instead of waiting forever.
+	stopped chan struct{}
+
+	// outbound is the queue drained by the writer goroutine. It is nil unless the run loop is active.
+	outbound atomic.Pointer[outboundQueue]
+
+	// offline holds publishes while the client is disconnected.
+	offline *OfflineQueue
+
+	// retained caches incoming retained messages by topic name.
+	retained *RetainedCache
+
+	// expiredMessages counts outgoing publishes discarded due to their message expiry interval.
+	expiredMessages atomic.Uint64
+
+	// strictValidation enables strict validation of the control packets received from the server.
+	strictValidation atomic.Bool
+
+	// session is the session established by the last successful call to Connect.
+	session *Session
+
+	// inflight holds the packet identifiers of the QoS 1 and QoS 2 publishes sent to the server that have not been
+	// acknowledged yet along with the delivery token of those sent by PublishWithToken.
+	inflight map[uint16]*DeliveryToken
 }
 
 type Topic struct {
@@ -82,14 +133,18 @@ func (t *Topic) SetEventChannel(channel EventChannel) *Topic {
 }
 
 func NewClient(conn net.Conn) *Client {
-	return &Client{
+	c := &Client{
 		conn:            conn,
 		eventChans:      make(map[int]EventChannel),
-		topicChans:      make(map[string]EventChannel),
+		topicSubs:       make(map[string]*subscription),
+		subscriptions:   trie.New[EventChannel](),
 		responseChan:    make(map[int]chan any),
+		inflight:        make(map[uint16]*DeliveryToken),
 		evChanIdCounter: 1,
 		rngFn:           rand.Uint32,
 	}
+	c.sendQuota.reset(0)
+	return c
 }
 
 // SetStorage sets the storage implementation that will be used to support the control packet persistence required for
@@ -108,10 +163,29 @@ func (c *Client) SetRngFn(fn func() uint32) {
 	c.rngFn = fn
 }
 
+// SetStrictValidation enables or disables strict validation of the control packets received from the server. When
+// enabled, control packets with properties that are not allowed for their type, duplicate properties, reserved flags
+// that are not set to their specified values or remaining lengths that do not match their fields are treated as
+// malformed. Strict validation is disabled by default and only applies to this client.
+func (c *Client) SetStrictValidation(on bool) {
+	c.strictValidation.Store(on)
+}
+
 // CreateEventChannel creates an event channel struct that the client will use to notify when events (connect,
 // disconnect, publish, subscribe, etc...) occur. /Consumers must consume a pending event before any incoming events can
 // be received./ Prior events will not be signalled on the new channel.
 func (c *Client) CreateEventChannel(n int) EventChannel {
+	return c.createEventChannel(n, false)
+}
+
+// CreateSubscriptionChannel creates an event channel that only receives the publishes routed to it by the topic filters
+// it is bound to through Subscribe. Unlike a channel created by CreateEventChannel, it never receives general events,
+// not even after it is unbound from its last topic filter.
+func (c *Client) CreateSubscriptionChannel(n int) EventChannel {
+	return c.createEventChannel(n, true)
+}
+
+func (c *Client) createEventChannel(n int, routed bool) EventChannel {
 	c.eventMutex.Lock()
 	defer c.eventMutex.Unlock()
 
@@ -131,10 +205,13 @@ func (c *Client) CreateEventChannel(n int) EventChannel {
 
 		channel: channel,
 		done:    done,
+		routed:  routed,
 	}
 
 	// Track this chan so fanout signalling can occur later
-	c.eventChans[c.evChanIdCounter] = result
+	if !routed {
+		c.eventChans[c.evChanIdCounter] = result
+	}
 	c.evChanIdCounter++
 
 	return result
@@ -142,6 +219,9 @@ func (c *Client) CreateEventChannel(n int) EventChannel {
 
 // CloseEventChannel closes the event channel. No further events will be signalled on the channel.
 func (c *Client) CloseEventChannel(channel EventChannel) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	c.eventMutex.Lock()
 	defer c.eventMutex.Unlock()
 
@@ -158,11 +238,7 @@ func (c *Client) closeEventChannelInternal(channel EventChannel) {
 
 	// Remove channel from maps
 	delete(c.eventChans, channel.id)
-	for key, topicChan := range c.topicChans {
-		if topicChan.id == channel.id {
-			delete(c.topicChans, key)
-		}
-	}
+	c.removeChannel(channel)
 }
 
 // signal signals on all event channels in a fanout fashion. This function is only meant to be called by the client
@@ -207,11 +283,33 @@ func (c *Client) signal(packetType packets.PacketType, data any, channel chan<-
 }
 
 // Connect sends the CONNECT packet to the server and waits for the server to send the acknowledgement (CONNACK) packet
-// back to the client. If the acknowledgement contains a failure reason, then a ReasonCode error is returned.
-func (c *Client) Connect(ctx context.Context, packet *packets.Connect) (err error) {
+// back to the client. If the acknowledgement contains a failure reason, then a ReasonCode error is returned. A client
+// created with a dialer opens its connection first if it does not have one.
+//
+// The returned Session holds the client identifier and the other parameters provided by the server. If the CONNECT
+// packet does not specify a client identifier, later calls to Connect and Reconnect send the identifier that the
+// server assigned so that the session can be resumed.
+func (c *Client) Connect(ctx context.Context, packet *packets.Connect) (session *Session, err error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	defer func() {
+		if err = opError("connect", ctx, err); err != nil && ctx.Err() != nil && c.conn != nil && c.dialer != nil {
+			// The connection was left in the middle of the handshake. Open a new one upon the next attempt to connect.
+			c.conn.Close()
+			c.conn = nil
+		}
+	}()
+
+	if c.conn == nil {
+		if err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	c.connectPacket = packet
+	packet = c.resume(packet)
+
 	var deadline time.Time
 	var ok bool
 	if deadline, ok = ctx.Deadline(); !ok {
@@ -224,23 +322,27 @@ func (c *Client) Connect(ctx context.Context, packet *packets.Connect) (err erro
 
 	// Set I/O deadline
 	if err = c.conn.SetDeadline(deadline); err != nil {
-		return err
+		return nil, err
 	}
 
+	// Stop waiting for the CONNACK control packet once ctx is done
+	stop := interruptOnDone(ctx, c.conn, false)
+	defer stop()
+
 	// Send connect packet
 	if err = c.send(packet); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Receive response header
-	header := packets.FixedHeader{}
+	header := packets.FixedHeader{Strict: c.strictValidation.Load()}
 	if _, err = header.ReadFrom(c.conn); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Response must be CONNACK
 	if header.GetType() != packets.CONNACK {
-		return ErrUnexpectedPacketTypeReceived
+		return nil, ErrUnexpectedPacketTypeReceived
 	}
 
 	// Create the Connack packet
@@ -249,10 +351,16 @@ func (c *Client) Connect(ctx context.Context, packet *packets.Connect) (err erro
 	}
 
 	// Receive the CONNACK response
-	if _, err = connack.ReadFrom(c.conn); err != nil {
-		return err
+	if err = c.receive(header, connack.DecodeFrom); err != nil {
+		return nil, err
 	}
 
+	stop()
+
+	// The deadline of ctx only applies to the handshake
+	if err = c.conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
 	unlockConn.Do(c.connMutex.Unlock)
 
 	// Did the server send an error response?
@@ -261,40 +369,45 @@ func (c *Client) Connect(ctx context.Context, packet *packets.Connect) (err erro
 	if connack.ReasonCode >= 128 {
 		// Close the connection
 		if err = c.conn.Close(); err != nil {
-			return
+			return nil, err
+		}
+
+		if c.dialer != nil {
+			// Open a new connection upon the next attempt to connect
+			c.conn = nil
+
+			// Follow any server redirection upon the next attempt to connect
+			if !c.redirect(ReasonCode(connack.ReasonCode), string(connack.ServerReference)) {
+				// Otherwise let the dialer move on to another server
+				if r, ok := c.dialer.(rejecter); ok {
+					r.Reject(ReasonCode(connack.ReasonCode))
+				}
+			}
 		}
 
 		// Error the ACK as the error
-		return ReasonCode(connack.ReasonCode)
+		return nil, ReasonCode(connack.ReasonCode)
 	}
 
-	// Handle server keep alive specification
-	if connack.ServerKeepAlive > 0 {
-		// Use the keep alive interval returned by the server
-		// SPEC: If the Server returns a Server Keep Alive on the CONNACK packet, the Client MUST use that value instead
-		//       of the value it sent as the Keep Alive. [MQTT-3.1.2-21]
-		c.keepAliveInterval = time.Second * time.Duration(connack.ServerKeepAlive)
-	} else if packet.KeepAlive > 0 {
-		// Use the keep alive interval defined in the CONNECT packet
-		c.keepAliveInterval = time.Second * time.Duration(packet.KeepAlive)
+	// Keep the client identifier assigned by the server so that later connections can resume the session. The keep
+	// alive interval is the Server Keep Alive if the server sent one.
+	session = newSession(packet, connack)
+	if packet != c.connectPacket {
+		// The client identifier was assigned by the server on an earlier connection
+		session.Assigned = true
 	}
+	c.keepAliveInterval = session.KeepAlive
 
-	// Store receive maximum reported by the connect packet and CONNACK received from the server
-	c.serverReceiveMaximum = connack.ReceiveMaximum.Value()
-
-	if packet.ReceiveMaximum == 0 {
-		// Default to that of the server
-		c.clientReceiveMaximum = c.serverReceiveMaximum
-	} else {
-		// Use the value from the connect control packet
-		c.clientReceiveMaximum = packet.ReceiveMaximum.Value()
-	}
+	// Limit the publishes in flight to the receive maximum reported by the CONNACK received from the server
+	c.sendQuota.reset(connack.ReceiveMaximum.Value())
 
-	// Initialize quotas
-	c.sendQuota = c.serverReceiveMaximum
-	c.receiveQuota = c.clientReceiveMaximum
+	// QoS 2 publishes awaiting PUBREL remain in flight if the server kept the session
+	c.inbound.reset(packet.ReceiveMaximum.Value(), connack.SessionPresent)
 
-	c.pendingSendSemaphore = make(chan struct{}) //, c.sendQuota)
+	// SPEC: If the Server does not support Shared Subscriptions and receives a SUBSCRIBE packet containing Shared
+	//       Subscriptions, it uses DISCONNECT with Reason Code 0x9E (Shared Subscriptions not supported).
+	c.sharedSubscriptions = connack.SharedSubscriptions != 0
+	c.retainAvailable = connack.RetainAvailable != 0
 
 	// Set the ping response deadline
 	c.pingRespDeadline = time.Now().Add(c.keepAliveInterval * 2)
@@ -303,15 +416,39 @@ func (c *Client) Connect(ctx context.Context, packet *packets.Connect) (err erro
 	// set up correctly later.
 	// SPEC: If the Session Expiry Interval in the CONNECT packet was zero, then it is a Protocol Error to set a
 	//       non-zero Session Expiry Interval in the DISCONNECT packet sent by the Client.
-	c.sessionExpiryInterval = uint32(packet.SessionExpiryInterval)
+	c.sessionExpiryInterval = session.SessionExpiryInterval
+
+	// SPEC: If the Server accepts a connection with Clean Start set to 1, the Server MUST set Session Present to 0 in
+	//       the CONNACK packet in addition to setting a 0x00 (Success) Reason Code in the CONNACK packet
+	//       [MQTT-3.2.2-2].
+	// The subscriptions made through Subscribe are gone if the server did not keep the session
+	c.restoreSubscriptions = !connack.SessionPresent && len(c.topicSubs) > 0
+
+	// Publishes that were in flight can no longer be acknowledged if the server did not keep the session
+	if !connack.SessionPresent {
+		c.failTokens(ErrSessionLost)
+	}
+
+	// Resend unacknowledged publishes if the server kept the session
+	if connack.SessionPresent {
+		c.connMutex.Lock()
+		err = c.redeliver()
+		c.connMutex.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Successful connection!
 	c.isConnected = true
+	c.session = session
 
 	// Signal CONNACK event
 	c.signal(packets.CONNACK, connack, nil)
+	c.signalBrokerChange()
 
-	return
+	return session.copy(), nil
 }
 
 // IsConnected returns true if the client is currently in the connected state. Otherwise, it returns false if the client
@@ -338,23 +475,12 @@ func (c *Client) DisconnectWithSessionExpiry(ctx context.Context, publishWill bo
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if c.isConnected {
-		return ErrClientNotConnected
-	}
-
-	var deadline time.Time
-	var ok bool
-	if deadline, ok = ctx.Deadline(); !ok {
-		deadline = time.Time{}
-	}
-
-	var unlockConn sync.Once
-	c.connMutex.Lock()
-	defer unlockConn.Do(c.connMutex.Unlock)
+	defer func() {
+		err = opError("disconnect", ctx, err)
+	}()
 
-	// Set I/O deadline
-	if err = c.conn.SetDeadline(deadline); err != nil {
-		return err
+	if !c.isConnected {
+		return ErrClientNotConnected
 	}
 
 	disconnect := &packets.Disconnect{}
@@ -373,20 +499,18 @@ func (c *Client) DisconnectWithSessionExpiry(ctx context.Context, publishWill bo
 		disconnect.SessionExpiryInterval = primitives.PrimitiveUint32(sessionExpiryInterval)
 	}
 
-	// Send the DISCONNECT packet to the server
-	if err = c.send(disconnect); err != nil {
+	// Send the DISCONNECT packet to the server after any queued publishes
+	if err = c.write(ctx, disconnect, priorityBulk); err != nil {
 		return err
 	}
 
 	// Close the connection to the server
 	// SPEC: MUST NOT send any more MQTT Control Packets on that Network Connection [MQTT-3.14.4-1].
 	//       MUST close the Network Connection [MQTT-3.14.4-2].
+	c.isConnected = false
 	if err = c.conn.Close(); err != nil {
 		return
 	}
-	unlockConn.Do(c.connMutex.Unlock)
-
-	c.isConnected = false
 
 	// Signal disconnect
 	c.signal(packets.DISCONNECT, disconnect, nil)
@@ -394,60 +518,54 @@ func (c *Client) DisconnectWithSessionExpiry(ctx context.Context, publishWill bo
 	return nil
 }
 
-func (c *Client) disconnectWithReason(ctx context.Context, reason primitives.PrimitiveByte) (err error) {
-	if c.isConnected {
-		return ErrClientNotConnected
-	}
-
-	var deadline time.Time
-	var ok bool
-	if deadline, ok = ctx.Deadline(); !ok {
-		deadline = time.Time{}
-	}
-
-	var unlockConn sync.Once
-	c.connMutex.Lock()
-	defer unlockConn.Do(c.connMutex.Unlock)
+// disconnectWithReason sends the DISCONNECT control packet with the specified reason code ahead of any queued publishes
+// and closes the network connection. It is used when the server violates the protocol. The caller must hold connMutex.
+func (c *Client) disconnectWithReason(ctx context.Context, reason ReasonCode) (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	// Set I/O deadline
-	if err = c.conn.SetDeadline(deadline); err != nil {
-		return err
+	if !c.isConnected {
+		return ErrClientNotConnected
 	}
 
 	disconnect := &packets.Disconnect{
-		ReasonCode: reason,
+		ReasonCode: primitives.PrimitiveByte(reason),
 	}
 
-	// Only allow specifying the session expiry interval if it was set to a non-zero value in the CONNECT control
-	// packet.
-	// SPEC: If the Session Expiry Interval in the CONNECT packet was zero, then it is a Protocol Error to set a
-	//       non-zero Session Expiry Interval in the DISCONNECT packet sent by the Client.
-	//if c.sessionExpiryInterval != 0 {
-	//	disconnect.SessionExpiryInterval = primitives.PrimitiveUint32(sessionExpiryInterval)
-	//}
-
 	// Send the DISCONNECT packet to the server
-	if err = c.send(disconnect); err != nil {
-		return err
+	if q := c.outbound.Load(); q != nil {
+		err = q.send(ctx, disconnect, priorityControl)
+	} else {
+		var deadline time.Time
+		var ok bool
+		if deadline, ok = ctx.Deadline(); !ok {
+			deadline = time.Time{}
+		}
+
+		// Set I/O deadline
+		if err = c.conn.SetWriteDeadline(deadline); err == nil {
+			stop := interruptOnDone(ctx, c.conn, true)
+			err = c.send(disconnect)
+			stop()
+		}
 	}
 
-	// Close the connection to the server
+	// Close the connection to the server even if DISCONNECT could not be sent
 	// SPEC: MUST NOT send any more MQTT Control Packets on that Network Connection [MQTT-3.14.4-1].
 	//       MUST close the Network Connection [MQTT-3.14.4-2].
-	if err = c.conn.Close(); err != nil {
-		return
-	}
-	unlockConn.Do(c.connMutex.Unlock)
-
 	c.isConnected = false
+	c.conn.Close()
 
 	// Signal disconnect
 	c.signal(packets.DISCONNECT, disconnect, nil)
 
-	return
+	return err
 }
 
-// Subscribe sends the SUBSCRIBE control packet to the server with the specified topic filters and options.
+// Subscribe sends the SUBSCRIBE control packet to the server with the specified topic filters and options. Any number
+// of event channels may subscribe to the same topic filter. The SUBSCRIBE control packet only contains the topic
+// filters that are not subscribed yet or that are requested with a higher maximum QoS than before. The first failure
+// reason code returned by the server is returned as a ReasonCode error after the accepted topic filters are recorded.
 func (c *Client) Subscribe(ctx context.Context, topics []Topic) (err error) {
 	// Do nothing if topics list is empty
 	if len(topics) == 0 {
@@ -458,30 +576,67 @@ func (c *Client) Subscribe(ctx context.Context, topics []Topic) (err error) {
 		return ErrClientNotConnected
 	}
 
-	var deadline time.Time
-	var ok bool
-	if deadline, ok = ctx.Deadline(); !ok {
-		deadline = time.Time{}
+	c.mutex.RLock()
+	var _topics []packets.Topic
+	for index := range topics {
+		// Do not send shared subscriptions to a server that does not support them
+		if !c.sharedSubscriptions && packets.IsSharedSubscription(topics[index].Filter()) {
+			c.mutex.RUnlock()
+			return ReasonCode(0x9E)
+		}
+
+		if c.needsSubscribe(topics[index].Topic) {
+			_topics = append(_topics, topics[index].Topic)
+		}
 	}
+	c.mutex.RUnlock()
 
-	var unlockConn sync.Once
-	c.connMutex.Lock()
-	defer unlockConn.Do(c.connMutex.Unlock)
+	var suback *packets.Suback
+	if len(_topics) > 0 {
+		if suback, err = c.subscribe(ctx, _topics); err != nil {
+			return err
+		}
+	}
 
-	// Set I/O deadline
-	if err = c.conn.SetDeadline(deadline); err != nil {
-		return err
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Record the topic filters accepted by the server
+	if suback != nil {
+		for i, code := range suback.ReasonCodes {
+			if i >= len(_topics) {
+				break
+			}
+
+			if code >= 0x80 {
+				if err == nil {
+					err = ReasonCode(code)
+				}
+				continue
+			}
+			c.register(_topics[i])
+		}
 	}
 
-	var _topics []packets.Topic
+	// Bind the event channels to the accepted topic filters
 	for index := range topics {
-		_topics = append(_topics, topics[index].Topic)
+		c.addSubscriber(topics[index])
 	}
 
+	return err
+}
+
+// subscribe sends the SUBSCRIBE control packet with the specified topic filters and waits for the SUBACK control
+// packet.
+func (c *Client) subscribe(ctx context.Context, topics []packets.Topic) (suback *packets.Suback, err error) {
+	defer func() {
+		err = opError("subscribe", ctx, err)
+	}()
+
 	c.mutex.Lock()
 	subscribe := &packets.Subscribe{
 		PacketIdentifier: primitives.PrimitiveUint16(c.rngFn()),
-		Topics:           _topics,
+		Topics:           topics,
 
 		// TODO: Use context to set these optional parameters
 		//SubscriptionIdentifier: 0,
@@ -491,84 +646,86 @@ func (c *Client) Subscribe(ctx context.Context, topics []Topic) (err error) {
 	// Create channel to receive the response on
 	respChan := make(chan any, 1)
 	c.responseChan[int(subscribe.PacketIdentifier)] = respChan
+	stopped := c.stopped
+	c.mutex.Unlock()
 
-	// Send the SUBSCRIBE control packet
-	if err = c.send(subscribe); err != nil {
+	// Remove the channel from the map once done
+	defer func() {
+		c.mutex.Lock()
+		delete(c.responseChan, int(subscribe.PacketIdentifier))
 		c.mutex.Unlock()
-		return err
-	}
+	}()
 
-	unlockConn.Do(c.connMutex.Unlock)
-	c.mutex.Unlock()
+	// Send the SUBSCRIBE control packet
+	if err = c.write(ctx, subscribe, priorityRequest); err != nil {
+		return nil, err
+	}
 
 	// Wait for the acknowledgement
 	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-stopped:
+		return nil, ErrClientStopped
 	case resp := <-respChan:
-		suback := resp.(*packets.Suback)
-
-		// Check all reason codes
-		for i, code := range suback.ReasonCodes {
-			if code >= 0x80 {
-				// TODO: Return all failure reason codes to caller somehow
-				return ReasonCode(code)
-			} else {
-				// TODO: Consider session retention details here
-
-				if chanid := topics[i].channel.id; chanid != 0 {
-					// Map the event channel to the topic
-					c.mutex.Lock()
-					c.topicChans[topics[i].Topic.Filter()] = c.eventChans[chanid]
-
-					// Remove this channel from the general event channel map
-					delete(c.eventChans, chanid)
-					c.mutex.Unlock()
-				}
-			}
-		}
+		return resp.(*packets.Suback), nil
 	}
-
-	// Close the chan
-	close(respChan)
-
-	c.mutex.Lock()
-	// Remove the channel from the map
-	delete(c.responseChan, int(subscribe.PacketIdentifier))
-	c.mutex.Unlock()
-
-	return
 }
 
-// Unsubscribe sends the UNSUBSCRIBE control packet to the server with the specified topic filters. Any event channels
-// bound to topics specified by the topics parameter will not receive any further publishes from said topics.
+// Unsubscribe sends the UNSUBSCRIBE control packet to the server with the specified topic filters. All event channels
+// bound to topics specified by the topics parameter are closed and will not receive any further publishes. Use
+// UnsubscribeChannel to remove a single subscriber instead.
 func (c *Client) Unsubscribe(ctx context.Context, topics []string) (err error) {
 	// Do nothing if topics list is empty
 	if len(topics) == 0 {
 		return ErrInvalidArgument
 	}
 
-	c.mutex.Lock()
-
 	if !c.isConnected {
 		return ErrClientNotConnected
 	}
 
-	var deadline time.Time
-	var ok bool
-	if deadline, ok = ctx.Deadline(); !ok {
-		deadline = time.Time{}
+	if err = c.unsubscribe(ctx, topics); err != nil {
+		return err
 	}
 
-	// Set I/O deadline
-	if err = c.conn.SetDeadline(deadline); err != nil {
-		return err
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Close any event channels bound to the topics
+	c.eventMutex.Lock()
+	defer c.eventMutex.Unlock()
+	for _, topic := range topics {
+		if sub, ok := c.topicSubs[topic]; ok {
+			for _, channel := range append([]EventChannel(nil), sub.subscribers...) {
+				if channel.id != 0 && c.isBound(channel) {
+					c.closeEventChannelInternal(channel)
+				}
+			}
+		}
+
+		delete(c.topicSubs, topic)
+		c.subscriptions.RemoveAll(topic)
 	}
 
+	return
+}
+
+// unsubscribe sends the UNSUBSCRIBE control packet with the specified topic filters and waits for the UNSUBACK control
+// packet.
+func (c *Client) unsubscribe(ctx context.Context, topics []string) (err error) {
+	defer func() {
+		err = opError("unsubscribe", ctx, err)
+	}()
+
 	var _topics []packets.Topic
 	for index := range topics {
 		t := packets.Topic{}
 		t.SetFilter(topics[index])
 		_topics = append(_topics, t)
 	}
+
+	c.mutex.Lock()
 	unsubscribe := &packets.Unsubscribe{
 		PacketIdentifier: primitives.PrimitiveUint16(c.rngFn()),
 		Topics:           _topics,
@@ -580,71 +737,102 @@ func (c *Client) Unsubscribe(ctx context.Context, topics []string) (err error) {
 	// Create channel to receive the response on
 	respChan := make(chan any, 1)
 	c.responseChan[int(unsubscribe.PacketIdentifier)] = respChan
+	stopped := c.stopped
+	c.mutex.Unlock()
+
+	// Remove the channel from the map once done
+	defer func() {
+		c.mutex.Lock()
+		delete(c.responseChan, int(unsubscribe.PacketIdentifier))
+		c.mutex.Unlock()
+	}()
 
 	// Send the UNSUBSCRIBE control packet
-	if err = c.send(unsubscribe); err != nil {
+	if err = c.write(ctx, unsubscribe, priorityRequest); err != nil {
 		return err
 	}
 
-	c.mutex.Unlock()
-
 	// Wait for the acknowledgement
 	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stopped:
+		return ErrClientStopped
 	case <-respChan:
-		c.mutex.Lock()
-		// Close any event channels bound to the topics
-		for _, topic := range topics {
-			if channel, ok := c.topicChans[topic]; ok {
-				c.closeEventChannelInternal(channel)
-			}
-		}
-		c.mutex.Unlock()
+		return nil
 	}
+}
 
-	c.mutex.Lock()
-	// Remove the channel from the map
-	delete(c.responseChan, int(unsubscribe.PacketIdentifier))
-	c.mutex.Unlock()
+// Publish sends PUBLISH control packet to the server. The publish is queued instead if the client is disconnected and
+// has an offline queue.
+func (c *Client) Publish(ctx context.Context, pub *packets.Publish) (err error) {
+	if c.offline != nil {
+		if queued, err := c.offline.push(pub, c.isConnected); queued || err != nil {
+			return err
+		}
+	}
 
-	return
+	return c.publish(ctx, pub, nil)
 }
 
-// Publish sends PUBLISH control packet to the server.
-func (c *Client) Publish(ctx context.Context, pub *packets.Publish) (err error) {
+// publish sends the PUBLISH control packet to the server. token is resolved once a QoS 1 or QoS 2 publish has been
+// acknowledged and may be nil.
+func (c *Client) publish(ctx context.Context, pub *packets.Publish, token *DeliveryToken) (err error) {
 	if !c.isConnected {
 		return ErrClientNotConnected
 	}
 
-	var deadline time.Time
-	var ok bool
-	if deadline, ok = ctx.Deadline(); !ok {
-		deadline = time.Time{}
-	}
-
-	var unlockConn sync.Once
-	c.connMutex.Lock()
-	defer unlockConn.Do(c.connMutex.Unlock)
+	defer func() {
+		err = opError("publish", ctx, err)
+	}()
 
-	// Set I/O deadline
-	if err = c.conn.SetDeadline(deadline); err != nil {
-		return err
+	// SPEC: If the Server included Retain Available in its CONNACK response to a Client with its value set to 0 and it
+	//       receives a PUBLISH packet with the RETAIN flag is set to 1, then it uses the DISCONNECT Reason Code of 0x9A
+	//       (Retain not supported) as described in section 4.13.
+	if pub.Retain && !c.retainAvailable {
+		return ReasonCode(0x9A)
 	}
 
 	// Perform preflight packet persistence operations
 	if pub.QoS > 0 {
-		// Assign a packet identifier if none is set
+		// Assign a packet identifier if none is set. Identifiers of publishes that are still in flight are not reused so
+		// that an acknowledgement cannot complete the wrong publish.
 		c.mutex.Lock()
-		if pub.PacketIdentifier == 0 {
-			pub.PacketIdentifier = primitives.PrimitiveUint16(c.rngFn())
+		for attempts := 0; ; attempts++ {
+			if attempts > 0xFFFF {
+				c.mutex.Unlock()
+				return storage.ErrDuplicateEntry
+			}
+
+			if _, ok := c.inflight[uint16(pub.PacketIdentifier)]; ok || pub.PacketIdentifier == 0 {
+				pub.PacketIdentifier = primitives.PrimitiveUint16(c.rngFn())
+				continue
+			}
+
+			if c.storage != nil {
+				// Store this publish control packet along with the time it was stored so that its message expiry
+				// interval can be reduced if it is resent later
+				err = c.storage.Store(uint16(pub.PacketIdentifier), &StoredPublish{Publish: pub, Stored: time.Now()})
+				if err == storage.ErrDuplicateEntry {
+					pub.PacketIdentifier = primitives.PrimitiveUint16(c.rngFn())
+					continue
+				} else if err != nil {
+					c.mutex.Unlock()
+					return err
+				}
+			}
+			break
 		}
 
-		if c.storage != nil {
-			// Store this publish control packet
-			if err = c.storage.Store(uint16(pub.PacketIdentifier), pub); err != nil {
+		// Register the publish before writing as the acknowledgement may arrive before the write returns
+		c.inflight[uint16(pub.PacketIdentifier)] = token
+		defer func() {
+			if err != nil {
+				c.mutex.Lock()
+				c.takeToken(uint16(pub.PacketIdentifier))
 				c.mutex.Unlock()
-				return err
 			}
-		}
+		}()
 		c.mutex.Unlock()
 	}
 
@@ -655,60 +843,70 @@ func (c *Client) Publish(ctx context.Context, pub *packets.Publish) (err error)
 	//       It MAY continue to send PUBLISH packets with QoS 0, or it MAY choose to suspend sending these as well. The
 	//       Client and Server MUST continue to process and respond to all other MQTT Control Packets even if the quota
 	//       is zero [MQTT-4.9.0-3].
-	if c.sendQuota == 0 && pub.QoS > 0 {
+	if pub.QoS > 0 {
 		// Delay sending this publish until one of the unacknowledged publishes is acknowledged
-		c.connMutex.Unlock()
-		c.pendingSendSemaphore <- struct{}{}
-		c.connMutex.Lock()
+		c.mutex.RLock()
+		stopped := c.stopped
+		c.mutex.RUnlock()
+
+		if err = c.sendQuota.acquire(ctx, 1, stopped); err != nil {
+			if ctx.Err() != nil {
+				c.discard(pub)
+			}
+			return err
+		}
 	}
+
 	// Write the publish
-	if err = c.send(pub); err != nil {
+	if err = c.write(ctx, pub, priorityBulk); err != nil {
+		if pub.QoS > 0 {
+			// The publish is resent upon reconnecting if it is still stored
+			c.sendQuota.release(1)
+		}
+		if ctx.Err() != nil {
+			c.discard(pub)
+		}
 		return err
 	}
 
-	unlockConn.Do(c.connMutex.Unlock)
+	return
+}
 
-	if pub.QoS > 0 {
-		c.mutex.Lock()
-		// Decrement the send quota counter
-		c.sendQuota--
-		c.mutex.Unlock()
+// discard removes a publish that was never sent from storage so that it is not resent later.
+func (c *Client) discard(pub *packets.Publish) {
+	if pub.QoS == 0 {
+		return
 	}
 
-	return
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.storage != nil {
+		c.storage.Drop(uint16(pub.PacketIdentifier))
+	}
 }
 
 // sendPuback will send the PUBACK control packet to the server. This API is only accessible via Publish when it is
-// RECEIVED from the server during the Poll method.
-func (c *Client) sendPuback(ctx context.Context, publish *packets.Publish) (err error) {
+// RECEIVED from the server during the Poll method. A reasonCode of 0x80 or greater rejects the publish.
+func (c *Client) sendPuback(ctx context.Context, publish *packets.Publish, reasonCode primitives.PrimitiveByte) (err error) {
 	// The packet identifier MUST be set
 	if publish.PacketIdentifier == 0 {
 		return packets.ErrControlPacketIsMalformed
 	}
 
-	var deadline time.Time
-	var ok bool
-	if deadline, ok = ctx.Deadline(); !ok {
-		deadline = time.Time{}
-	}
-
-	// Set I/O deadline
-	if err = c.conn.SetDeadline(deadline); err != nil {
-		return err
-	}
-
 	puback := &packets.Puback{
 		PacketIdentifier: publish.PacketIdentifier,
+		ReasonCode:       reasonCode,
 	}
 
 	// Send the PUBACK control packet to the server
-	if err = c.send(puback); err != nil {
+	if err = c.writeControl(ctx, puback); err != nil {
 		return err
 	}
 
-	// Increment the receive quota counter so that more publishes (QoS > 0) can be received
+	// The server may send another publish (QoS > 0) once PUBACK is sent
 	c.mutex.Lock()
-	c.receiveQuota++
+	c.inbound.acknowledged(publish.PacketIdentifier.Value(), packets.QoS1, ReasonCode(puback.ReasonCode))
 	c.mutex.Unlock()
 
 	// No response to wait for
@@ -717,35 +915,30 @@ func (c *Client) sendPuback(ctx context.Context, publish *packets.Publish) (err
 }
 
 // sendPubrec will send the PUBREC control packet to the server. This API is only accessible via Publish when it is
-// RECEIVED from the server during the Poll method.
-func (c *Client) sendPubrec(ctx context.Context, publish *packets.Publish) (err error) {
+// RECEIVED from the server during the Poll method. A reasonCode of 0x80 or greater rejects the publish.
+func (c *Client) sendPubrec(ctx context.Context, publish *packets.Publish, reasonCode primitives.PrimitiveByte) (err error) {
 	// The packet identifier MUST be set
 	if publish.PacketIdentifier == 0 {
 		return packets.ErrControlPacketIsMalformed
 	}
 
-	var deadline time.Time
-	var ok bool
-	if deadline, ok = ctx.Deadline(); !ok {
-		deadline = time.Time{}
-	}
-
-	// Set I/O deadline
-	if err = c.conn.SetDeadline(deadline); err != nil {
-		return err
-	}
-
 	pubrec := &packets.Pubrec{
 		Puback: packets.Puback{
 			PacketIdentifier: publish.PacketIdentifier,
+			ReasonCode:       reasonCode,
 		},
 	}
 
 	// Send the PUBREC control packet to the server
-	if err = c.send(pubrec); err != nil {
+	if err = c.writeControl(ctx, pubrec); err != nil {
 		return err
 	}
 
+	// The publish remains in flight until PUBCOMP is sent
+	c.mutex.Lock()
+	c.inbound.acknowledged(publish.PacketIdentifier.Value(), packets.QoS2, ReasonCode(pubrec.ReasonCode))
+	c.mutex.Unlock()
+
 	// No response to wait for
 
 	return
@@ -759,7 +952,7 @@ func (c *Client) KeepAliveInterval() time.Duration {
 
 // KeepAlive sends the PINGREQ control packet to the server and then waits for the PINGRESP packet to be received.
 // An error will be returned if any control packet other than PINGRESP is received by the client or the transmission
-// timed out.
+// timed out. KeepAlive is not needed when using Run.
 // SPEC: If Keep Alive is non-zero and in the absence of sending any other MQTT Control Packets, the Client MUST send a
 //
 //	PINGREQ packet. [MQTT-3.1.2-20]
@@ -778,31 +971,11 @@ func (c *Client) KeepAlive() (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(c.keepAliveInterval.Seconds()*1.5))
 	defer cancel()
 
-	var deadline time.Time
-	var ok bool
-	if deadline, ok = ctx.Deadline(); !ok {
-		deadline = time.Time{}
-	}
-
-	var unlockConn sync.Once
-	c.connMutex.Lock()
-	defer unlockConn.Do(c.connMutex.Unlock)
-
-	// Set I/O deadline
-	if err = c.conn.SetDeadline(deadline); err != nil {
-		return err
-	}
-
 	// Send the PINGREQ control packet
-	header := &packets.FixedHeader{}
-	header.SetType(packets.PINGREQ)
-
-	if err = c.send(header); err != nil {
+	if err = c.write(ctx, &packets.Pingreq{}, priorityControl); err != nil {
 		return err
 	}
 
-	unlockConn.Do(c.connMutex.Unlock)
-
 	// NOTE: Poll handles receiving the response and disconnecting if no response has been sent within twice the keep
 	// alive interval.
 	return
@@ -811,7 +984,7 @@ func (c *Client) KeepAlive() (err error) {
 // Poll polls for incoming control packets from the server. Incoming messages will be pushed to the back of the message
 // queue and a single message at the front of the queue will be processed. This function should be called repeatedly. No
 // call to the Publish method should take place on the same goroutine that a call to Poll takes place on as this could
-// potentially cause a deadlock.
+// potentially cause a deadlock. Run performs polling and keep alive on its own and is preferred.
 func (c *Client) Poll(ctx context.Context) (err error) {
 	if !c.isConnected {
 		return ErrClientNotConnected
@@ -846,20 +1019,29 @@ func (c *Client) Poll(ctx context.Context) (err error) {
 		return err
 	}
 
+	// Stop waiting for a control packet once ctx is cancelled
+	stop := interruptOnDone(ctx, c.conn, false)
+	defer stop()
+
 	// Set I/O deadline to 10ms initially so that polling doesn't tie up the conn for too long
 	//if err = c.conn.SetDeadline(time.Now().Add(time.Millisecond * 10)); err != nil {
 	//	return
 	//}
 
 	// Attempt to receive a control packet header
-	header := packets.FixedHeader{}
+	header := packets.FixedHeader{Strict: c.strictValidation.Load()}
 	if _, err = header.ReadFrom(c.conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return opError("poll", ctx, err)
+		}
+
 		// No incoming data
 		return nil
 	} else if err != nil {
 		// Some other error occurred. Return it
 		return
 	}
+	stop()
 
 	if !deadline.IsZero() {
 		// Extend I/O deadline
@@ -871,131 +1053,144 @@ func (c *Client) Poll(ctx context.Context) (err error) {
 		c.conn.SetDeadline(time.Time{})
 	}
 
+	return c.handle(ctx, header)
+}
+
+// handle receives the remainder of the control packet described by header and processes it. The caller must hold
+// connMutex.
+func (c *Client) handle(ctx context.Context, header packets.FixedHeader) (err error) {
 	// Read control packet
 	switch header.GetType() {
 	case packets.PUBLISH:
 		publish := &packets.Publish{Header: header}
-		if _, err = publish.ReadFrom(c.conn); err != nil {
+		if err = c.receive(header, publish.DecodeFrom); err != nil {
 			return
 		}
 
+		var duplicate bool
 		c.mutex.Lock()
-		if c.receiveQuota == 0 && publish.QoS > 0 {
-			// The server has sent more publishes than this client is willing to accept. Send disconnect.
-			// SPEC: The Server MUST NOT send more than Receive Maximum QoS 1 and QoS 2 PUBLISH packets for which it has
-			//       not received PUBACK, PUBCOMP, or PUBREC with a Reason Code of 128 or greater from the Client
-			//       [MQTT-3.3.4-9]. If it receives more than Receive Maximum QoS 1 and QoS 2 PUBLISH packets where it
-			//       has not sent a PUBACK or PUBCOMP in response, the Client uses DISCONNECT with Reason Code 0x93
-			//       (Receive Maximum exceeded) as described in section 4.13 Handling errors.
-			if err = c.disconnectWithReason(ctx, 0x93); err != nil {
-				c.mutex.Unlock()
-				return err
-			}
-		} else {
-			// Decrement the receive quota counter
-			c.receiveQuota--
-		}
+		duplicate, err = c.inbound.receive(publish.PacketIdentifier.Value(), publish.QoS)
 		c.mutex.Unlock()
 
+		if err != nil {
+			// The server has sent more publishes than this client is willing to accept. The publish is discarded and
+			// the session is torn down regardless of whether DISCONNECT could be sent.
+			c.disconnectWithReason(ctx, err.(ReasonCode))
+			return err
+		}
+
+		// Reject payloads that do not match the payload format indicator without tearing down the session, since the
+		// server would deliver the same publish again upon reconnecting.
+		// SPEC: A receiver (Client or Server) MAY validate that the Payload is of the format indicated, and if it is
+		//       not send a PUBACK, PUBREC, or DISCONNECT with Reason Code of 0x99 (Payload format invalid).
+		var reasonCode primitives.PrimitiveByte
+		if publish.ValidatePayload() != nil {
+			reasonCode = 0x99
+		}
+
 		// Send the respective acknowledgement control packet type for the QoS level of the incoming publish.
 		if publish.QoS == packets.QoS1 {
-			if err = c.sendPuback(ctx, publish); err != nil {
+			if err = c.sendPuback(ctx, publish, reasonCode); err != nil {
 				return err
 			}
 		} else if publish.QoS == packets.QoS2 {
-			if err = c.sendPubrec(ctx, publish); err != nil {
+			if err = c.sendPubrec(ctx, publish, reasonCode); err != nil {
 				return err
 			}
 		}
 
-		// Route the PUBLISH to the correct event channels as configured by the Subscribe API
-		for filter, channel := range c.topicChans {
-			// Does the topic match any known filter?
-			if c.matchTopic(publish.Topic.String(), filter) {
-				// Signal the publish on this channel
-				c.signal(packets.PUBLISH, publish, channel.channel)
-			}
+		if duplicate || reasonCode != 0 {
+			// The QoS 2 publish was already delivered and only PUBREC is sent again, or the publish was rejected
+			return nil
 		}
 
-		// Create a Pubrec control packet and store it. This might be used later during the message delivery retry flow.
-		// It will be removed when a PUBREL control packet comes in.
+		// Keep the latest retained message of the topic
 		c.mutex.RLock()
-		if publish.QoS > 0 && c.storage != nil {
-			pubrec := &packets.Pubrec{
-				Puback: packets.Puback{
-					PacketIdentifier: publish.PacketIdentifier,
-				},
-			}
-			c.storage.Store(pubrec.PacketIdentifier.Value(), pubrec)
+		if publish.Retain && c.retained != nil {
+			c.retained.store(publish)
 		}
 		c.mutex.RUnlock()
 
+		// Route the PUBLISH to the correct event channels as configured by the Subscribe API
+		c.routeBuf = c.subscriptions.Match(publish.Topic.String(), c.routeBuf[:0])
+		for _, channel := range c.routeBuf {
+			// Signal the publish on this channel
+			c.signal(packets.PUBLISH, publish, channel.channel)
+		}
+
 		c.signal(packets.PUBLISH, publish, nil)
 	case packets.PUBACK:
 		puback := &packets.Puback{Header: header}
-		if _, err = puback.ReadFrom(c.conn); err != nil {
+		if err = c.receive(header, puback.DecodeFrom); err != nil {
 			return err
 		}
 
-		// Perform rate limiting related operations
-		c.mutex.Lock()
-		if c.sendQuota < c.serverReceiveMaximum {
-			// Increment the sent publish counter
-			c.sendQuota++
+		// Allow a blocked call to Publish to continue
+		// SPEC: The send quota is incremented by 1: Each time a PUBACK or PUBCOMP packet is received, regardless of
+		//       whether the PUBACK or PUBCOMP carried an error code.
+		c.sendQuota.release(1)
 
-			// Potentially allow a blocked call to Publish to continue.
-			// NOTE: This is the reason why calls to Publish and Poll should not occur within the same goroutine.
-			select {
-			case <-c.pendingSendSemaphore: // Unblock a pending call to Publish
-			default: // No call to Publish is pending
-			}
-		}
+		c.mutex.Lock()
 
 		// Drop any persisted publish with the same packet identifier
-		if c.storage != nil {
-			if err = c.storage.Drop(puback.PacketIdentifier.Value()); err != nil {
-				return err
-			}
+		if err = c.dropStored(puback.PacketIdentifier.Value()); err != nil {
+			c.mutex.Unlock()
+			return err
 		}
+		token := c.takeToken(puback.PacketIdentifier.Value())
 		c.mutex.Unlock()
 
+		token.complete(ReasonCode(puback.ReasonCode), string(puback.ReasonString), nil)
 		c.signal(packets.PUBACK, puback, nil)
 	case packets.PUBREC:
 		pubrec := &packets.Pubrec{}
 		pubrec.Header = header
-		if _, err = pubrec.ReadFrom(c.conn); err != nil {
+		if err = c.receive(header, pubrec.DecodeFrom); err != nil {
 			return err
 		}
 
 		// Increment the send quota counter if it contains a failure reason code
 		// SPEC: Each time a PUBREC packet is received with a Return Code of 0x80 or greater.
 		c.mutex.Lock()
-		if pubrec.ReasonCode > 0x80 {
-			if c.sendQuota < c.serverReceiveMaximum {
-				c.sendQuota++
-			}
+		if pubrec.ReasonCode >= 0x80 {
+			c.sendQuota.release(1)
+
+			// The QoS 2 flow ends with the rejected publish
+			// SPEC: MUST send a PUBREL packet when it receives a PUBREC packet from the receiver with a Reason Code value
+			//       less than 0x80 [MQTT-4.3.3-4].
+			c.dropStored(pubrec.PacketIdentifier.Value())
+			token := c.takeToken(pubrec.PacketIdentifier.Value())
+			c.mutex.Unlock()
+
+			token.complete(ReasonCode(pubrec.ReasonCode), string(pubrec.ReasonString), nil)
+			c.signal(packets.PUBREC, pubrec, nil)
+			break
+		}
+
+		// Send PUBREL control packet
+		pubrel := &packets.Pubrel{
+			Puback: packets.Puback{
+				PacketIdentifier: pubrec.PacketIdentifier,
+			},
 		}
 
 		if c.storage != nil {
 			// Discard original publish from persistent storage
-			if err = c.storage.Drop(pubrec.PacketIdentifier.Value()); err != nil {
+			if err = c.dropStored(pubrec.PacketIdentifier.Value()); err != nil {
+				c.mutex.Unlock()
 				return err
 			}
 
-			// Store the incoming PUBREC to persistent storage
-			if err = c.storage.Store(pubrec.PacketIdentifier.Value(), pubrec); err != nil {
+			// Store the PUBREL control packet in its place so that it is resent if the session is resumed before
+			// PUBCOMP is received
+			if err = c.storage.Store(pubrec.PacketIdentifier.Value(), pubrel); err != nil {
+				c.mutex.Unlock()
 				return err
 			}
 		}
 
-		// Send PUBREL control packet
-		pubrel := &packets.Pubrel{
-			Puback: packets.Puback{
-				PacketIdentifier: pubrec.PacketIdentifier,
-			},
-		}
-
-		if err = c.send(pubrel); err != nil {
+		if err = c.writeControl(ctx, pubrel); err != nil {
+			c.mutex.Unlock()
 			return err
 		}
 
@@ -1005,18 +1200,15 @@ func (c *Client) Poll(ctx context.Context) (err error) {
 	case packets.PUBREL:
 		pubrel := &packets.Pubrel{}
 		pubrel.Header = header
-		if _, err = pubrel.ReadFrom(c.conn); err != nil {
+		if err = c.receive(header, pubrel.DecodeFrom); err != nil {
 			return err
 		}
 
-		// Perform persistence operations as required by the QoS level of the related PUBLISH.
+		// Release the quota of the QoS 2 publish. No other publish is handled before PUBCOMP is sent as the caller holds
+		// connMutex. The state of inbound publishes is never kept in the storage since the packet identifiers of
+		// inbound and outbound publishes are independent of each other.
 		c.mutex.Lock()
-		if c.storage != nil {
-			// Discard original PUBREC control packet from persistent storage
-			if err = c.storage.Drop(pubrel.PacketIdentifier.Value()); err != nil {
-				return err
-			}
-		}
+		found := c.inbound.release(pubrel.PacketIdentifier.Value())
 		c.mutex.Unlock()
 
 		// Send PUBCOMP control packet
@@ -1026,176 +1218,153 @@ func (c *Client) Poll(ctx context.Context) (err error) {
 			},
 		}
 
-		if err = c.send(pubcomp); err != nil {
-			return err
+		if !found {
+			// SPEC: 0x92 Packet Identifier not found - The Packet Identifier is not known. This is not an error during
+			//       recovery, but at other times indicates a mismatch between the Session State on the Client and
+			//       Server.
+			pubcomp.ReasonCode = 0x92
 		}
 
-		// Increment receive quota counter
-		if c.receiveQuota < c.clientReceiveMaximum {
-			c.receiveQuota++
+		if err = c.writeControl(ctx, pubcomp); err != nil {
+			return err
 		}
 
 		c.signal(packets.PUBREL, pubrel, nil)
 	case packets.PUBCOMP:
 		pubcomp := &packets.Pubcomp{}
 		pubcomp.Header = header
-		if _, err = pubcomp.ReadFrom(c.conn); err != nil {
+		if err = c.receive(header, pubcomp.DecodeFrom); err != nil {
 			return err
 		}
 
-		// Perform rate limiting related operations
-		c.mutex.Lock()
-		if c.sendQuota < c.serverReceiveMaximum {
-			// Increment the sent publish counter
-			c.sendQuota++
+		// Allow a blocked call to Publish to continue
+		// SPEC: The send quota is incremented by 1: Each time a PUBACK or PUBCOMP packet is received, regardless of
+		//       whether the PUBACK or PUBCOMP carried an error code.
+		c.sendQuota.release(1)
 
-			// Potentially allow a blocked call to Publish to continue.
-			// NOTE: This is the reason why calls to Publish and Poll should not occur within the same goroutine.
-			select {
-			case <-c.pendingSendSemaphore: // Unblock a pending call to Publish
-			default: // No call to Publish is pending
-			}
-		}
+		c.mutex.Lock()
 
-		if c.storage != nil {
-			// Discard original PUBREC control packet from persistent storage
-			if err = c.storage.Drop(pubcomp.PacketIdentifier.Value()); err != nil {
-				return err
-			}
+		// Discard the PUBREL control packet from persistent storage
+		if err = c.dropStored(pubcomp.PacketIdentifier.Value()); err != nil {
+			c.mutex.Unlock()
+			return err
 		}
-
+		token := c.takeToken(pubcomp.PacketIdentifier.Value())
 		c.mutex.Unlock()
 
+		token.complete(ReasonCode(pubcomp.ReasonCode), string(pubcomp.ReasonString), nil)
 		c.signal(packets.PUBCOMP, pubcomp, nil)
 	case packets.SUBACK:
 		suback := &packets.Suback{Header: header}
-		if _, err = suback.ReadFrom(c.conn); err != nil {
+		if err = c.receive(header, suback.DecodeFrom); err != nil {
 			return
 		}
 
-		// Respond to the call to client.Subscribe
-		if respChan, ok := c.responseChan[int(suback.PacketIdentifier)]; ok {
+		// Respond to the call to client.Subscribe. The response channels are guarded by the mutex.
+		c.mutex.RLock()
+		respChan, ok := c.responseChan[int(suback.PacketIdentifier)]
+		c.mutex.RUnlock()
+		if ok {
 			respChan <- suback
 		}
 
 		c.signal(packets.SUBACK, suback, nil)
 	case packets.UNSUBACK:
 		unsuback := &packets.Unsuback{Header: header}
-		if _, err = unsuback.ReadFrom(c.conn); err != nil {
+		if err = c.receive(header, unsuback.DecodeFrom); err != nil {
 			return
 		}
 
-		// Respond to the call to client.Unsubscribe
-		if respChan, ok := c.responseChan[int(unsuback.PacketIdentifier)]; ok {
+		// Respond to the call to client.Unsubscribe. The response channels are guarded by the mutex.
+		c.mutex.RLock()
+		respChan, ok := c.responseChan[int(unsuback.PacketIdentifier)]
+		c.mutex.RUnlock()
+		if ok {
 			respChan <- unsuback
 		}
 
 		c.signal(packets.UNSUBACK, unsuback, nil)
 	case packets.DISCONNECT:
 		disconnect := &packets.Disconnect{Header: header}
-		if _, err = disconnect.ReadFrom(c.conn); err != nil {
+		if err = c.receive(header, disconnect.DecodeFrom); err != nil {
 			return
 		}
 		// Close the connection
+		c.isConnected = false
 		if err = c.conn.Close(); err != nil {
 			return
 		}
+
+		// Follow any server redirection upon reconnecting
+		c.redirect(ReasonCode(disconnect.ReasonCode), string(disconnect.ServerReference))
+
 		c.signal(packets.DISCONNECT, disconnect, nil)
 	case packets.AUTH:
 		auth := &packets.Auth{Header: header}
-		if _, err = auth.ReadFrom(c.conn); err != nil {
+		if err = c.receive(header, auth.DecodeFrom); err != nil {
 			return
 		}
 		c.signal(packets.AUTH, auth, nil)
 	case packets.PINGRESP:
 		// Extend the ping response deadline
 		c.pingRespDeadline = time.Now().Add(c.keepAliveInterval * 2)
+		c.pingSent.Store(0)
 	default:
 		return ErrUnexpectedPacketTypeReceived
 	}
 
-	// TODO: Process control packet
-
 	return nil
 }
 
-// matchTopic returns true if the input topic string matches the topic filter string. Otherwise, it returns false.
-func (c *Client) matchTopic(topic, filter string) bool {
-	// TODO: Support matching for shared topics
-	var filterPos int
-	var topicPos int
-	for filterPos < len(filter) {
-		if filter[filterPos] == '#' {
-			// Encountered multi-level wildcard.
-
-			// Quick path
-			if len(filter) == 1 {
-				return true
-			}
-
-			// Look around the wildcard
-			if (filterPos != 0 && filter[filterPos-1] != '/') || filterPos != len(filter)-1 {
-				// Invalid use of # wildcard. Do attempt to match the filter any further
-				return false
-			}
-
-			// Stop and return true
-			return true
-		} else if filter[filterPos] == '+' {
-			// Encountered single-level wildcard
-
-			// Look around the wildcard
-			if (filterPos != 0 && filter[filterPos-1] != '/') || (filterPos != len(filter)-1 && filter[filterPos+1] != '/') {
-				// Invalid use of + wildcard. Do attempt to match the filter any further
-				return false
-			}
-
-			// Fast-forward the topic position to the beginning of the next level
-			for topicPos < len(topic) && topic[topicPos] != '/' {
-				topicPos++
-			}
-
-			if topicPos == len(topic) {
-				// No levels left. Return true.
-				return true
-			}
-
-			// Advance the filter pos and continue at the beginning of the loop
-			filterPos++
-			continue
-		} else if filterPos >= len(topic) {
-			// The length of the filter exceeded the length of the topic. No way these can match.
-			return false
-		} else if filter[filterPos] != topic[topicPos] {
-			return false
-		}
-
-		filterPos++
-		topicPos++
+// dropStored discards the outbound publish or PUBREL control packet stored with the packet identifier. A missing entry
+// is not an error since the server may acknowledge a publish that was sent before the storage was set or that was
+// already dropped. The caller must hold the mutex.
+func (c *Client) dropStored(identifier uint16) error {
+	if c.storage == nil {
+		return nil
 	}
 
-	// Check if there is more characters in the topic that went unprocessed
-	if len(filter) != len(topic) && topicPos < len(topic) {
-		// Topic couldn't have matched the filter
-		return false
+	if err := c.storage.Drop(identifier); err != nil && err != storage.ErrNoEntry {
+		return err
 	}
-
-	return true
+	return nil
 }
 
-func (c *Client) send(w io.WriterTo) (err error) {
-	// Allocate a new buffer
-	buf := bytes.NewBuffer(make([]byte, 0, 128))
+// encoder is implemented by all control packets that can be sent by the client.
+type encoder interface {
+	AppendTo(dst []byte) ([]byte, error)
+}
 
-	// Write to the buffer
-	if _, err = w.WriteTo(buf); err != nil {
+// send encodes the control packet into the client's write buffer and writes it to the connection with a single call.
+// The caller must hold connMutex.
+func (c *Client) send(p encoder) (err error) {
+	// Encode into the reusable write buffer
+	if c.writeBuf, err = p.AppendTo(c.writeBuf[:0]); err != nil {
 		return err
 	}
 
 	// Finally, write to the open connection
-	if _, err = c.conn.Write(buf.Bytes()); err != nil {
+	if _, err = c.conn.Write(c.writeBuf); err != nil {
 		return err
 	}
 
+	// Record the time so that the run loop only sends PINGREQ when the connection has been idle
+	c.lastSent.Store(time.Now().UnixNano())
 	return nil
 }
+
+// receive reads the remainder of the control packet described by header into the client's read buffer and decodes it
+// using decodeFn. The caller must hold connMutex.
+func (c *Client) receive(header packets.FixedHeader, decodeFn func(src []byte) (int, error)) (err error) {
+	if cap(c.readBuf) < int(header.Remaining) {
+		c.readBuf = make([]byte, header.Remaining)
+	}
+	c.readBuf = c.readBuf[:header.Remaining]
+
+	if _, err = io.ReadFull(c.conn, c.readBuf); err != nil {
+		return err
+	}
+
+	_, err = decodeFn(c.readBuf)
+	return
+}
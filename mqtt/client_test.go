@@ -25,211 +25,151 @@
 package mqtt
 
 import (
+	"context"
+	"errors"
 	"net"
-	"sync"
 	"testing"
 	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
 )
 
-func TestClient_matchTopic(t *testing.T) {
-	type fields struct {
-		conn                  net.Conn
-		mutex                 sync.Mutex
-		isConnected           bool
-		keepAliveInterval     time.Duration
-		pingRespDeadline      time.Time
-		sessionExpiryInterval uint32
-		eventChans            map[int]chan<- *Event
-		topicChans            map[string]chan<- *Event
-		responseChan          map[int]chan any
-		evChanIdCounter       int
-		eventMutex            sync.Mutex
-		packetIdCounter       int
+// discardConn is a net.Conn that discards everything written to it.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestClient_PublishAllocs(t *testing.T) {
+	c := NewClient(discardConn{})
+	c.isConnected = true
+
+	pub := &packets.Publish{
+		QoS:     packets.QoS0,
+		Topic:   "test/topic",
+		Payload: []byte("hello"),
 	}
-	type args struct {
-		topic  string
-		filter string
+
+	ctx := context.Background()
+
+	// Warm up the write buffer
+	if err := c.Publish(ctx, pub); err != nil {
+		t.Fatal(err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		c.Publish(ctx, pub)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Publish() allocated %v times per run, want 0", allocs)
 	}
-	tests := []struct {
-		name string
-		//fields fields
-		args args
-		want bool
-	}{
-		{
-			name: "singleLevel0",
-			args: args{
-				topic:  "test",
-				filter: "test",
-			},
-			want: true,
-		},
-		{
-			name: "singleLevel1",
-			args: args{
-				topic:  "teststuff",
-				filter: "test",
-			},
-			want: false,
-		},
-		{
-			name: "singleLevel2",
-			args: args{
-				topic:  "test",
-				filter: "testextra",
-			},
-			want: false,
-		},
-		{
-			name: "singleLevel3",
-			args: args{
-				topic:  "test",
-				filter: "#",
-			},
-			want: true,
-		},
-		{
-			name: "singleLevel4",
-			args: args{
-				topic:  "test",
-				filter: "+",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel0",
-			args: args{
-				topic:  "test/extra",
-				filter: "test/extra",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel1",
-			args: args{
-				topic:  "test/extra",
-				filter: "test/#",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel2",
-			args: args{
-				topic:  "test/extra/stuff",
-				filter: "#",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel3",
-			args: args{
-				topic:  "test/extra",
-				filter: "test#",
-			},
-			want: false,
-		},
-		{
-			name: "multiLevel4",
-			args: args{
-				topic:  "test/extra/stuff",
-				filter: "test/#/stuff",
-			},
-			want: false,
-		},
-		{
-			name: "multiLevel5",
-			args: args{
-				topic:  "test/extra/stuff",
-				filter: "+/extra/stuff",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel6",
-			args: args{
-				topic:  "test/extra/stuff",
-				filter: "test/+/stuff",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel7",
-			args: args{
-				topic:  "test/extra/stuff",
-				filter: "test/extra/+",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel8",
-			args: args{
-				topic:  "test/extra/stuff",
-				filter: "test/extra+",
-			},
-			want: false,
-		},
-		{
-			name: "multiLevel9",
-			args: args{
-				topic:  "test/extra/stuff",
-				filter: "+/#",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel10",
-			args: args{
-				topic:  "test/extra/stuff",
-				filter: "+#",
-			},
-			want: false,
-		},
-		{
-			name: "multiLevel11",
-			args: args{
-				topic:  "test/extra/stuff/that/comes/after",
-				filter: "+/extra/#",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel12",
-			args: args{
-				topic:  "test/extra/stuff/that/comes/after",
-				filter: "+/extra/stuff/+/comes/after",
-			},
-			want: true,
-		},
-		{
-			name: "multiLevel13",
-			args: args{
-				topic:  "test/extra/stuff/that/comes/after",
-				filter: "#/extra/stuff/dontmatter/+/after",
-			},
-			want: false,
-		},
+}
+
+func BenchmarkClient_Publish(b *testing.B) {
+	c := NewClient(discardConn{})
+	c.isConnected = true
+
+	pub := &packets.Publish{
+		QoS:     packets.QoS0,
+		Topic:   "test/topic",
+		Payload: make([]byte, 64),
+	}
+
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Publish(ctx, pub)
+	}
+}
+
+func TestClient_SharedSubscription(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+	poll(t, c)
+
+	channel := c.CreateEventChannel(10)
+	topic := Topic{}
+	topic.SetFilter("$share/group/sensors/+")
+	topic.SetEventChannel(channel)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.Subscribe(context.Background(), []Topic{topic})
+	}()
+
+	s.suback()
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			/*c := &Client{
-				conn:                  tt.fields.conn,
-				mutex:                 tt.fields.mutex,
-				isConnected:           tt.fields.isConnected,
-				keepAliveInterval:     tt.fields.keepAliveInterval,
-				pingRespDeadline:      tt.fields.pingRespDeadline,
-				sessionExpiryInterval: tt.fields.sessionExpiryInterval,
-				eventChans:            tt.fields.eventChans,
-				topicChans:            tt.fields.topicChans,
-				responseChan:          tt.fields.responseChan,
-				evChanIdCounter:       tt.fields.evChanIdCounter,
-				eventMutex:            tt.fields.eventMutex,
-				packetIdCounter:       tt.fields.packetIdCounter,
-			}*/
-
-			c := &Client{}
-			if got := c.matchTopic(tt.args.topic, tt.args.filter); got != tt.want {
-				t.Errorf("matchTopic() = %v, want %v", got, tt.want)
+
+	// Messages are routed to the shared subscription by its topic filter
+	s.send(&packets.Publish{Topic: "sensors/a", Payload: []byte("shared")})
+
+	for {
+		select {
+		case e := <-channel.C:
+			if e.PacketType != packets.PUBLISH {
+				continue
 			}
-		})
+			if pub := e.Data.(*packets.Publish); pub.Topic != "sensors/a" {
+				t.Errorf("received publish on %s, want sensors/a", pub.Topic)
+			}
+			return
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for the shared subscription to receive the publish")
+		}
+	}
+}
+
+func TestClient_SharedSubscriptionUnavailable(t *testing.T) {
+	c, s := newTestClient(t)
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{Version: packets.MQTT5, ClientId: "test"})
+		errChan <- err
+	}()
+
+	// Accept the CONNECT control packet with Shared Subscription Available set to 0
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x05, 0x00, 0x00, 0x02, 0x2A, 0x00})
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	topic := Topic{}
+	topic.SetFilter("$share/group/sensors/+")
+	if err := c.Subscribe(context.Background(), []Topic{topic}); err != ReasonCode(0x9E) {
+		t.Errorf("Subscribe() = %v, want %v", err, ReasonCode(0x9E))
+	}
+}
+
+func TestClient_StrictValidation(t *testing.T) {
+	// The strict client rejects the reserved connect acknowledge flag while the other client is unaffected
+	for _, strict := range []bool{true, false} {
+		c, s := newTestClient(t)
+		c.SetStrictValidation(strict)
+
+		errChan := make(chan error, 1)
+		go func() {
+			_, err := c.Connect(context.Background(), &packets.Connect{Version: packets.MQTT5, KeepAlive: 60})
+			errChan <- err
+		}()
+
+		s.expect(packets.CONNECT)
+		s.write([]byte{0x20, 0x03, 0x02, 0x00, 0x00})
+
+		err := <-errChan
+		if strict && !errors.Is(err, packets.ErrControlPacketIsMalformed) {
+			t.Errorf("Connect() with strict validation = %v, want %v", err, packets.ErrControlPacketIsMalformed)
+		} else if !strict && err != nil {
+			t.Errorf("Connect() without strict validation = %v, want nil", err)
+		}
 	}
 }
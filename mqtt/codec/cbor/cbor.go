@@ -0,0 +1,707 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package cbor registers a Concise Binary Object Representation codec with the codec package when it is imported. The
+// codec does not depend on encoding/json, making it better suited than JSON for constrained targets.
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/codec"
+)
+
+var ErrMalformed = errors.New("malformed CBOR data item")
+
+// maxCBORDepth limits the nesting of arrays, maps and tags so that a malicious payload cannot exhaust the stack.
+const maxCBORDepth = 10000
+
+// Marshaler is implemented by types that encode themselves as a single CBOR data item.
+type Marshaler interface {
+	MarshalCBOR() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that decode themselves from a single CBOR data item.
+type Unmarshaler interface {
+	UnmarshalCBOR(data []byte) error
+}
+
+// Codec encodes payloads as Concise Binary Object Representation (RFC 8949). It supports booleans, numbers, strings,
+// byte slices, slices, arrays, maps, pointers and structs. Struct fields are encoded as map entries keyed by the "cbor"
+// struct tag or the field name, and the tag accepts the "omitempty" option. Map keys are sorted so that the encoding is
+// deterministic. Indefinite-length items are not supported.
+type Codec struct{}
+
+func init() {
+	codec.Register(Codec{})
+}
+
+func (Codec) ContentType() string {
+	return codec.ContentTypeCBOR
+}
+
+func (Codec) Marshal(v any) ([]byte, error) {
+	return appendCBOR(nil, reflect.ValueOf(v))
+}
+
+func (Codec) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return codec.ErrUnsupportedType
+	}
+
+	n, err := decodeCBOR(data, rv.Elem(), 0)
+	if err != nil {
+		return err
+	}
+
+	if n != len(data) {
+		return ErrMalformed
+	}
+	return nil
+}
+
+/* CBOR major types */
+const (
+	cborUint   = 0 << 5
+	cborInt    = 1 << 5
+	cborBytes  = 2 << 5
+	cborString = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+)
+
+var (
+	cborMarshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	cborUnmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	bytesType           = reflect.TypeOf([]byte(nil))
+)
+
+// appendHead appends the initial byte and argument of a data item.
+func appendHead(dst []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(dst, major|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(dst, major|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, major|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, major|26), uint32(arg))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, major|27), arg)
+}
+
+func appendCBOR(dst []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(dst, cborSimple|22), nil
+	}
+
+	if v.Type().Implements(cborMarshalerType) {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			return append(dst, cborSimple|22), nil
+		}
+
+		b, err := v.Interface().(Marshaler).MarshalCBOR()
+		if err != nil {
+			return dst, err
+		}
+		return append(dst, b...), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(dst, cborSimple|22), nil
+		}
+		return appendCBOR(dst, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(dst, cborSimple|21), nil
+		}
+		return append(dst, cborSimple|20), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); i < 0 {
+			return appendHead(dst, cborInt, uint64(-(i + 1))), nil
+		} else {
+			return appendHead(dst, cborUint, uint64(i)), nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendHead(dst, cborUint, v.Uint()), nil
+	case reflect.Float32:
+		return binary.BigEndian.AppendUint32(append(dst, cborSimple|26), math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(dst, cborSimple|27), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return append(appendHead(dst, cborString, uint64(v.Len())), v.String()...), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(dst, cborSimple|22), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(appendHead(dst, cborBytes, uint64(v.Len())), v.Bytes()...), nil
+		}
+		fallthrough
+	case reflect.Array:
+		var err error
+		dst = appendHead(dst, cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if dst, err = appendCBOR(dst, v.Index(i)); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(dst, cborSimple|22), nil
+		}
+		return appendCBORMap(dst, v)
+	case reflect.Struct:
+		return appendCBORStruct(dst, v)
+	}
+
+	return dst, codec.ErrUnsupportedType
+}
+
+// appendCBORMap appends the map v with its entries sorted by the encoded form of their keys.
+func appendCBORMap(dst []byte, v reflect.Value) ([]byte, error) {
+	type entry struct {
+		key   []byte
+		value reflect.Value
+	}
+
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := appendCBOR(nil, iter.Key())
+		if err != nil {
+			return dst, err
+		}
+		entries = append(entries, entry{key: key, value: iter.Value()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	var err error
+	dst = appendHead(dst, cborMap, uint64(len(entries)))
+	for _, e := range entries {
+		dst = append(dst, e.key...)
+		if dst, err = appendCBOR(dst, e.value); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// cborField describes an exported struct field.
+type cborField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+func cborFields(t reflect.Type) (fields []cborField) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		field := cborField{name: f.Name, index: i}
+		if tag, ok := f.Tag.Lookup("cbor"); ok {
+			if tag == "-" {
+				continue
+			}
+
+			name, options, _ := strings.Cut(tag, ",")
+			if len(name) > 0 {
+				field.name = name
+			}
+			field.omitEmpty = options == "omitempty"
+		}
+		fields = append(fields, field)
+	}
+	return
+}
+
+func appendCBORStruct(dst []byte, v reflect.Value) ([]byte, error) {
+	fields := cborFields(v.Type())
+
+	// Drop empty fields before writing the map header
+	present := fields[:0]
+	for _, f := range fields {
+		if f.omitEmpty && v.Field(f.index).IsZero() {
+			continue
+		}
+		present = append(present, f)
+	}
+
+	var err error
+	dst = appendHead(dst, cborMap, uint64(len(present)))
+	for _, f := range present {
+		dst = append(appendHead(dst, cborString, uint64(len(f.name))), f.name...)
+		if dst, err = appendCBOR(dst, v.Field(f.index)); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// decodeHead decodes the initial byte and argument of the data item at the beginning of src.
+func decodeHead(src []byte) (major byte, info byte, arg uint64, n int, err error) {
+	if len(src) == 0 {
+		return 0, 0, 0, 0, ErrMalformed
+	}
+
+	major = src[0] & 0xE0
+	info = src[0] & 0x1F
+	n = 1
+
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(src) >= 2:
+		arg = uint64(src[1])
+		n = 2
+	case info == 25 && len(src) >= 3:
+		arg = uint64(binary.BigEndian.Uint16(src[1:]))
+		n = 3
+	case info == 26 && len(src) >= 5:
+		arg = uint64(binary.BigEndian.Uint32(src[1:]))
+		n = 5
+	case info == 27 && len(src) >= 9:
+		arg = binary.BigEndian.Uint64(src[1:])
+		n = 9
+	default:
+		// Reserved values, indefinite lengths and truncated arguments
+		return 0, 0, 0, 0, ErrMalformed
+	}
+	return
+}
+
+// skipCBOR returns the length of the data item at the beginning of src. depth is the nesting level of the data item.
+func skipCBOR(src []byte, depth int) (n int, err error) {
+	if depth > maxCBORDepth {
+		return 0, ErrMalformed
+	}
+
+	major, _, arg, n, err := decodeHead(src)
+	if err != nil {
+		return 0, err
+	}
+
+	switch major {
+	case cborBytes, cborString:
+		if arg > uint64(len(src)-n) {
+			return 0, ErrMalformed
+		}
+		return n + int(arg), nil
+	case cborArray, cborMap:
+		count := arg
+		if major == cborMap {
+			count *= 2
+		}
+
+		for ; count > 0; count-- {
+			var size int
+			if size, err = skipCBOR(src[n:], depth+1); err != nil {
+				return 0, err
+			}
+			n += size
+		}
+		return n, nil
+	case cborTag:
+		var size int
+		if size, err = skipCBOR(src[n:], depth+1); err != nil {
+			return 0, err
+		}
+		return n + size, nil
+	}
+	return n, nil
+}
+
+// decodeCBOR decodes the data item at the beginning of src into v and returns the number of bytes consumed. depth is the
+// nesting level of the data item.
+func decodeCBOR(src []byte, v reflect.Value, depth int) (n int, err error) {
+	if depth > maxCBORDepth {
+		return 0, ErrMalformed
+	}
+
+	if reflect.PtrTo(v.Type()).Implements(cborUnmarshalerType) && v.CanAddr() {
+		if n, err = skipCBOR(src, depth); err != nil {
+			return 0, err
+		}
+		return n, v.Addr().Interface().(Unmarshaler).UnmarshalCBOR(src[:n])
+	}
+
+	major, info, arg, n, err := decodeHead(src)
+	if err != nil {
+		return 0, err
+	}
+
+	// Skip over tags and decode the tagged item
+	if major == cborTag {
+		var count int
+		if count, err = decodeCBOR(src[n:], v, depth+1); err != nil {
+			return 0, err
+		}
+		return n + count, nil
+	}
+
+	// Null and undefined set the value to its zero value
+	if major == cborSimple && (info == 22 || info == 23) {
+		v.Set(reflect.Zero(v.Type()))
+		return n, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeCBOR(src, v.Elem(), depth)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return 0, codec.ErrUnsupportedType
+		}
+
+		var value any
+		if value, n, err = decodeCBORAny(src, depth); err != nil {
+			return 0, err
+		}
+
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+		return n, nil
+	}
+
+	switch major {
+	case cborUint, cborInt:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if arg > math.MaxInt64 {
+				return 0, codec.ErrUnsupportedType
+			}
+
+			i := int64(arg)
+			if major == cborInt {
+				i = -1 - i
+			}
+
+			if v.OverflowInt(i) {
+				return 0, codec.ErrUnsupportedType
+			}
+			v.SetInt(i)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if major == cborInt || v.OverflowUint(arg) {
+				return 0, codec.ErrUnsupportedType
+			}
+			v.SetUint(arg)
+		case reflect.Float32, reflect.Float64:
+			f := float64(arg)
+			if major == cborInt {
+				f = -1 - f
+			}
+			v.SetFloat(f)
+		default:
+			return 0, codec.ErrUnsupportedType
+		}
+		return n, nil
+	case cborBytes, cborString:
+		if arg > uint64(len(src)-n) {
+			return 0, ErrMalformed
+		}
+
+		data := src[n : n+int(arg)]
+		n += int(arg)
+
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(data))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte(nil), data...))
+		default:
+			return 0, codec.ErrUnsupportedType
+		}
+		return n, nil
+	case cborArray:
+		switch v.Kind() {
+		case reflect.Slice:
+			if arg > uint64(len(src)) {
+				// Each element is at least one byte long
+				return 0, ErrMalformed
+			}
+			v.Set(reflect.MakeSlice(v.Type(), int(arg), int(arg)))
+		case reflect.Array:
+			if arg != uint64(v.Len()) {
+				return 0, codec.ErrUnsupportedType
+			}
+		default:
+			return 0, codec.ErrUnsupportedType
+		}
+
+		for i := 0; i < int(arg); i++ {
+			var count int
+			if count, err = decodeCBOR(src[n:], v.Index(i), depth+1); err != nil {
+				return 0, err
+			}
+			n += count
+		}
+		return n, nil
+	case cborMap:
+		switch v.Kind() {
+		case reflect.Map:
+			return decodeCBORMap(src, n, arg, v, depth)
+		case reflect.Struct:
+			return decodeCBORStruct(src, n, arg, v, depth)
+		}
+		return 0, codec.ErrUnsupportedType
+	case cborSimple:
+		switch {
+		case info == 20 || info == 21:
+			if v.Kind() != reflect.Bool {
+				return 0, codec.ErrUnsupportedType
+			}
+			v.SetBool(info == 21)
+		case info >= 25 && info <= 27:
+			if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+				return 0, codec.ErrUnsupportedType
+			}
+			v.SetFloat(cborFloat(info, arg))
+		default:
+			return 0, codec.ErrUnsupportedType
+		}
+		return n, nil
+	}
+
+	return 0, ErrMalformed
+}
+
+func decodeCBORMap(src []byte, n int, count uint64, v reflect.Value, depth int) (int, error) {
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+
+	keyType := v.Type().Key()
+	valueType := v.Type().Elem()
+	for ; count > 0; count-- {
+		key := reflect.New(keyType).Elem()
+		size, err := decodeCBOR(src[n:], key, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		n += size
+
+		value := reflect.New(valueType).Elem()
+		if size, err = decodeCBOR(src[n:], value, depth+1); err != nil {
+			return 0, err
+		}
+		n += size
+
+		v.SetMapIndex(key, value)
+	}
+	return n, nil
+}
+
+func decodeCBORStruct(src []byte, n int, count uint64, v reflect.Value, depth int) (int, error) {
+	fields := cborFields(v.Type())
+	for ; count > 0; count-- {
+		var name string
+		size, err := decodeCBOR(src[n:], reflect.ValueOf(&name).Elem(), depth+1)
+		if err != nil {
+			return 0, err
+		}
+		n += size
+
+		// Find the matching field, preferring an exact match
+		index := -1
+		for _, f := range fields {
+			if f.name == name {
+				index = f.index
+				break
+			}
+			if index < 0 && strings.EqualFold(f.name, name) {
+				index = f.index
+			}
+		}
+
+		if index < 0 {
+			// Ignore unknown fields
+			size, err = skipCBOR(src[n:], depth+1)
+		} else {
+			size, err = decodeCBOR(src[n:], v.Field(index), depth+1)
+		}
+
+		if err != nil {
+			return 0, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+// decodeCBORAny decodes the data item at the beginning of src into a generic value. Unsigned and negative integers
+// decode as uint64 and int64, maps with only string keys decode as map[string]any and all other maps as map[any]any.
+func decodeCBORAny(src []byte, depth int) (value any, n int, err error) {
+	if depth > maxCBORDepth {
+		return nil, 0, ErrMalformed
+	}
+
+	major, info, arg, n, err := decodeHead(src)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case cborUint:
+		return arg, n, nil
+	case cborInt:
+		if arg > math.MaxInt64 {
+			return nil, 0, codec.ErrUnsupportedType
+		}
+		return -1 - int64(arg), n, nil
+	case cborBytes, cborString:
+		if arg > uint64(len(src)-n) {
+			return nil, 0, ErrMalformed
+		}
+
+		data := src[n : n+int(arg)]
+		if major == cborString {
+			return string(data), n + int(arg), nil
+		}
+		return append([]byte(nil), data...), n + int(arg), nil
+	case cborArray:
+		if arg > uint64(len(src)) {
+			return nil, 0, ErrMalformed
+		}
+
+		values := make([]any, arg)
+		for i := range values {
+			var size int
+			if values[i], size, err = decodeCBORAny(src[n:], depth+1); err != nil {
+				return nil, 0, err
+			}
+			n += size
+		}
+		return values, n, nil
+	case cborMap:
+		if arg > uint64(len(src)) {
+			return nil, 0, ErrMalformed
+		}
+
+		keys := make([]any, arg)
+		values := make([]any, arg)
+		stringKeys := true
+		for i := range keys {
+			var size int
+			if keys[i], size, err = decodeCBORAny(src[n:], depth+1); err != nil {
+				return nil, 0, err
+			}
+			n += size
+
+			if values[i], size, err = decodeCBORAny(src[n:], depth+1); err != nil {
+				return nil, 0, err
+			}
+			n += size
+
+			if _, ok := keys[i].(string); !ok {
+				stringKeys = false
+			}
+		}
+
+		if stringKeys {
+			m := make(map[string]any, len(keys))
+			for i := range keys {
+				m[keys[i].(string)] = values[i]
+			}
+			return m, n, nil
+		}
+
+		m := make(map[any]any, len(keys))
+		for i := range keys {
+			if !reflect.TypeOf(keys[i]).Comparable() {
+				return nil, 0, codec.ErrUnsupportedType
+			}
+			m[keys[i]] = values[i]
+		}
+		return m, n, nil
+	case cborTag:
+		var size int
+		if value, size, err = decodeCBORAny(src[n:], depth+1); err != nil {
+			return nil, 0, err
+		}
+		return value, n + size, nil
+	}
+
+	switch {
+	case info == 20 || info == 21:
+		return info == 21, n, nil
+	case info == 22 || info == 23:
+		return nil, n, nil
+	case info >= 25 && info <= 27:
+		return cborFloat(info, arg), n, nil
+	}
+	return nil, 0, codec.ErrUnsupportedType
+}
+
+// cborFloat converts the argument of a half, single or double precision float to a float64.
+func cborFloat(info byte, arg uint64) float64 {
+	switch info {
+	case 25:
+		// Half precision
+		sign := 1.0
+		if arg&0x8000 != 0 {
+			sign = -1
+		}
+
+		exp := int(arg>>10) & 0x1F
+		mant := float64(arg & 0x3FF)
+		switch exp {
+		case 0:
+			return sign * math.Ldexp(mant, -24)
+		case 0x1F:
+			if mant == 0 {
+				return math.Inf(int(sign))
+			}
+			return math.NaN()
+		}
+		return sign * math.Ldexp(mant+1024, exp-25)
+	case 26:
+		return float64(math.Float32frombits(uint32(arg)))
+	}
+	return math.Float64frombits(arg)
+}
@@ -0,0 +1,176 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/codec"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+type reading struct {
+	Sensor string  `cbor:"sensor"`
+	Value  float64 `cbor:"value"`
+	Tags   []string
+	Unit   string `cbor:",omitempty"`
+	Ignore int    `cbor:"-"`
+}
+
+func TestEncodeDecode(t *testing.T) {
+	in := reading{Sensor: "temp", Value: 21.5, Tags: []string{"a", "b"}}
+
+	var p packets.Publish
+	if err := codec.Encode(&p, codec.ContentTypeCBOR, in); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p.ContentType) != codec.ContentTypeCBOR {
+		t.Errorf("ContentType = %q", p.ContentType)
+	}
+	if p.PayloadFormatIndicator != 0 {
+		t.Errorf("PayloadFormatIndicator = %d, want 0", p.PayloadFormatIndicator)
+	}
+
+	var out reading
+	if err := codec.Decode(&p, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Decode() = %+v, want %+v", out, in)
+	}
+}
+
+func TestCBOR_Vectors(t *testing.T) {
+	// Test vectors from RFC 8949 Appendix A
+	tests := []struct {
+		value any
+		hex   string
+	}{
+		{uint(0), "00"},
+		{uint(23), "17"},
+		{uint(24), "1818"},
+		{uint(1000), "1903e8"},
+		{uint64(1000000000000), "1b000000e8d4a51000"},
+		{int(-1), "20"},
+		{int(-1000), "3903e7"},
+		{float64(1.1), "fb3ff199999999999a"},
+		{false, "f4"},
+		{true, "f5"},
+		{nil, "f6"},
+		{"", "60"},
+		{"IETF", "6449455446"},
+		{"ü", "62c3bc"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{[]int{1, 2, 3}, "83010203"},
+		{map[string]int{"b": 2, "a": 1}, "a2616101616202"},
+	}
+
+	for _, test := range tests {
+		b, err := Codec{}.Marshal(test.value)
+		if err != nil {
+			t.Fatalf("Marshal(%v): %v", test.value, err)
+		}
+		if got := hex.EncodeToString(b); got != test.hex {
+			t.Errorf("Marshal(%v) = %s, want %s", test.value, got, test.hex)
+		}
+	}
+}
+
+func TestCBOR_Unmarshal(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want any
+	}{
+		{"1a000f4240", uint64(1000000)},
+		{"3863", int64(-100)},
+		{"f93c00", 1.0},
+		{"f97c00", math.Inf(1)},
+		{"fa47c35000", 100000.0},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+		{"8301820203820405", []any{uint64(1), []any{uint64(2), uint64(3)}, []any{uint64(4), uint64(5)}}},
+		{"a201020304", map[any]any{uint64(1): uint64(2), uint64(3): uint64(4)}},
+		{"a26161016162820203", map[string]any{"a": uint64(1), "b": []any{uint64(2), uint64(3)}}},
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.hex)
+
+		var got any
+		if err := (Codec{}).Unmarshal(data, &got); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", test.hex, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", test.hex, got, test.want)
+		}
+	}
+
+	// Truncated and indefinite-length items are malformed
+	for _, s := range []string{"19", "62c3", "8301", "5f42010243030405ff"} {
+		data, _ := hex.DecodeString(s)
+
+		var got any
+		if err := (Codec{}).Unmarshal(data, &got); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Unmarshal(%s) = %v, want %v", s, err, ErrMalformed)
+		}
+	}
+}
+
+func TestCBOR_NestingLimit(t *testing.T) {
+	nested := func(head byte, depth int) []byte {
+		return append(bytes.Repeat([]byte{head}, depth), 0x00)
+	}
+
+	// Items nested up to the limit decode
+	var value int
+	if err := (Codec{}).Unmarshal(nested(0xC6, maxCBORDepth), &value); err != nil {
+		t.Errorf("Unmarshal() at the nesting limit = %v", err)
+	}
+
+	// Deeper items are rejected by the typed decoder
+	if err := (Codec{}).Unmarshal(nested(0xC6, maxCBORDepth+1), &value); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Unmarshal(int) = %v, want %v", err, ErrMalformed)
+	}
+
+	// the generic decoder
+	for _, data := range [][]byte{nested(0xC6, maxCBORDepth+1), nested(0x81, maxCBORDepth+1)} {
+		var got any
+		if err := (Codec{}).Unmarshal(data, &got); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Unmarshal(any) = %v, want %v", err, ErrMalformed)
+		}
+	}
+
+	// and when skipping unknown struct fields
+	var got struct{ A int }
+	data := append([]byte{0xA1, 0x61, 'b'}, nested(0x81, maxCBORDepth+1)...)
+	if err := (Codec{}).Unmarshal(data, &got); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Unmarshal(struct) = %v, want %v", err, ErrMalformed)
+	}
+}
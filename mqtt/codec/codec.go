@@ -0,0 +1,137 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package codec provides a registry of payload codecs keyed on the content type of a PUBLISH message. No codec is
+// registered by default. Each codec lives in its own subpackage and registers itself when that package is imported, so
+// that only the codecs in use are linked into the program:
+//
+//	import _ "github.com/waj334/tinygo-mqtt/mqtt/codec/cbor"
+package codec
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeCBOR     = "application/cbor"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeRaw      = "application/octet-stream"
+)
+
+var (
+	ErrUnknownContentType = errors.New("no codec is registered for the content type")
+	ErrUnsupportedType    = errors.New("the codec does not support the value type")
+)
+
+// Codec marshals and unmarshals payloads of a single content type.
+type Codec interface {
+	// ContentType returns the MIME type of the payloads produced by the codec.
+	ContentType() string
+
+	// Marshal returns the encoded form of v.
+	Marshal(v any) ([]byte, error)
+
+	// Unmarshal decodes data into the value pointed to by v.
+	Unmarshal(data []byte, v any) error
+}
+
+// UTF8Codec is implemented by codecs whose output is always UTF-8 Encoded Character Data. Messages encoded with such a
+// codec have their payload format indicator set to 1.
+type UTF8Codec interface {
+	Codec
+	UTF8() bool
+}
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]Codec{}
+)
+
+// Register adds c to the registry, replacing any codec previously registered for the same content type.
+func Register(c Codec) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[mediaType(c.ContentType())] = c
+}
+
+// Lookup returns the codec registered for contentType. Parameters such as "; charset=utf-8" are ignored.
+func Lookup(contentType string) (c Codec, ok bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	c, ok = registry[mediaType(contentType)]
+	return
+}
+
+// Encode marshals v using the codec registered for contentType and stores the result as the payload of p. The content
+// type and payload format indicator of p are set accordingly.
+func Encode(p *packets.Publish, contentType string, v any) (err error) {
+	c, ok := Lookup(contentType)
+	if !ok {
+		return ErrUnknownContentType
+	}
+
+	var payload []byte
+	if payload, err = c.Marshal(v); err != nil {
+		return err
+	}
+
+	p.Payload = payload
+	p.ContentType = primitives.PrimitiveString(contentType)
+	p.PayloadFormatIndicator = 0
+	if utf8, ok := c.(UTF8Codec); ok && utf8.UTF8() {
+		p.PayloadFormatIndicator = 1
+	}
+
+	return nil
+}
+
+// Decode unmarshals the payload of p into v using the codec registered for the content type of p. JSON is assumed if
+// the message does not specify a content type, which requires the JSON codec to be registered.
+func Decode(p *packets.Publish, v any) error {
+	contentType := string(p.ContentType)
+	if len(contentType) == 0 {
+		contentType = ContentTypeJSON
+	}
+
+	c, ok := Lookup(contentType)
+	if !ok {
+		return ErrUnknownContentType
+	}
+
+	return c.Unmarshal(p.Payload, v)
+}
+
+// mediaType returns the lower-case media type of contentType without any parameters.
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
@@ -0,0 +1,111 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package codec
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+const contentTypeText = "text/plain"
+
+// text encodes strings as themselves and is registered by the tests in place of a real codec.
+type text struct{}
+
+func (text) ContentType() string {
+	return contentTypeText
+}
+
+func (text) Marshal(v any) ([]byte, error) {
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+func (text) Unmarshal(data []byte, v any) error {
+	if s, ok := v.(*string); ok {
+		*s = string(data)
+		return nil
+	}
+	return ErrUnsupportedType
+}
+
+func (text) UTF8() bool {
+	return true
+}
+
+func init() {
+	Register(text{})
+}
+
+func TestLookup(t *testing.T) {
+	for _, contentType := range []string{"text/plain", "Text/Plain", "text/plain; charset=utf-8"} {
+		if c, ok := Lookup(contentType); !ok || c.ContentType() != contentTypeText {
+			t.Errorf("Lookup(%q) = %v, %v", contentType, c, ok)
+		}
+	}
+
+	// Codecs are only registered when their package is imported
+	for _, contentType := range []string{"application/unknown", ContentTypeJSON, ContentTypeCBOR} {
+		if _, ok := Lookup(contentType); ok {
+			t.Errorf("Lookup(%q) found a codec for an unregistered content type", contentType)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	var p packets.Publish
+	if err := Encode(&p, contentTypeText, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p.ContentType) != contentTypeText {
+		t.Errorf("ContentType = %q", p.ContentType)
+	}
+	if p.PayloadFormatIndicator != 1 {
+		t.Errorf("PayloadFormatIndicator = %d, want 1", p.PayloadFormatIndicator)
+	}
+
+	var out string
+	if err := Decode(&p, &out); err != nil || out != "hello" {
+		t.Errorf("Decode() = %q, %v", out, err)
+	}
+
+	if err := Encode(&p, contentTypeText, 1); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Encode() = %v, want %v", err, ErrUnsupportedType)
+	}
+	if err := Encode(&p, ContentTypeJSON, "hello"); !errors.Is(err, ErrUnknownContentType) {
+		t.Errorf("Encode() = %v, want %v", err, ErrUnknownContentType)
+	}
+
+	// Messages without a content type are assumed to be JSON
+	p = packets.Publish{Payload: []byte(`"hello"`)}
+	if err := Decode(&p, &out); !errors.Is(err, ErrUnknownContentType) {
+		t.Errorf("Decode() = %v, want %v", err, ErrUnknownContentType)
+	}
+}
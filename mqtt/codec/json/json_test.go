@@ -0,0 +1,66 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package json
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/codec"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+type reading struct {
+	Sensor string  `json:"sensor"`
+	Value  float64 `json:"value"`
+}
+
+func TestEncodeDecode(t *testing.T) {
+	in := reading{Sensor: "temp", Value: 21.5}
+
+	var p packets.Publish
+	if err := codec.Encode(&p, codec.ContentTypeJSON, in); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p.ContentType) != codec.ContentTypeJSON {
+		t.Errorf("ContentType = %q", p.ContentType)
+	}
+	if p.PayloadFormatIndicator != 1 {
+		t.Errorf("PayloadFormatIndicator = %d, want 1", p.PayloadFormatIndicator)
+	}
+
+	var out reading
+	if err := codec.Decode(&p, &out); err != nil || !reflect.DeepEqual(in, out) {
+		t.Errorf("Decode() = %+v, %v, want %+v", out, err, in)
+	}
+
+	// Messages without a content type are assumed to be JSON
+	p = packets.Publish{Payload: []byte(`{"sensor":"x"}`)}
+	out = reading{}
+	if err := codec.Decode(&p, &out); err != nil || out.Sensor != "x" {
+		t.Errorf("Decode() = %+v, %v", out, err)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package protobuf registers a protocol buffers codec with the codec package when it is imported.
+package protobuf
+
+import "github.com/waj334/tinygo-mqtt/mqtt/codec"
+
+// Message is implemented by generated protocol buffer messages that can marshal themselves, such as those produced by
+// gogo/protobuf or csproto. The codec relies on this interface so that no protobuf runtime is linked in.
+type Message interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// Codec encodes payloads using the methods of Message.
+type Codec struct{}
+
+func init() {
+	codec.Register(Codec{})
+}
+
+func (Codec) ContentType() string {
+	return codec.ContentTypeProtobuf
+}
+
+func (Codec) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(Message); ok {
+		return m.Marshal()
+	}
+	return nil, codec.ErrUnsupportedType
+}
+
+func (Codec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(Message); ok {
+		return m.Unmarshal(data)
+	}
+	return codec.ErrUnsupportedType
+}
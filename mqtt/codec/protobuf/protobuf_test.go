@@ -0,0 +1,62 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protobuf
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/codec"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+type fakeMessage struct {
+	data []byte
+}
+
+func (m *fakeMessage) Marshal() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *fakeMessage) Unmarshal(data []byte) error {
+	m.data = append(m.data[:0], data...)
+	return nil
+}
+
+func TestEncodeDecode(t *testing.T) {
+	// Protobuf messages marshal themselves
+	var p packets.Publish
+	if err := codec.Encode(&p, codec.ContentTypeProtobuf, &fakeMessage{data: []byte{0x08, 0x01}}); err != nil {
+		t.Fatal(err)
+	}
+	var msg fakeMessage
+	if err := codec.Decode(&p, &msg); err != nil || !bytes.Equal(msg.data, []byte{0x08, 0x01}) {
+		t.Errorf("Decode() = %v, %v", msg.data, err)
+	}
+	if err := codec.Encode(&p, codec.ContentTypeProtobuf, "message"); !errors.Is(err, codec.ErrUnsupportedType) {
+		t.Errorf("Encode() = %v, want %v", err, codec.ErrUnsupportedType)
+	}
+}
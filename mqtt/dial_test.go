@@ -0,0 +1,174 @@
+//go:build !tinygo
+
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// acceptConnect accepts a connection on l, reads the CONNECT control packet and responds with a successful CONNACK. The
+// body of the CONNECT control packet is sent on the returned channel.
+func acceptConnect(t *testing.T, l net.Listener) <-chan []byte {
+	bodyChan := make(chan []byte, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			close(bodyChan)
+			return
+		}
+		t.Cleanup(func() {
+			conn.Close()
+		})
+
+		s := &fakeServer{t: t, conn: conn}
+		header, body := s.read()
+		if header.GetType() != packets.CONNECT {
+			t.Errorf("received %v, want CONNECT", header.GetType())
+		}
+
+		s.write([]byte{0x20, 0x03, 0x00, 0x00, 0x00})
+		bodyChan <- body
+	}()
+
+	return bodyChan
+}
+
+func TestDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	bodyChan := acceptConnect(t, l)
+	client, err := Dial(ctx, "mqtt://user:secret@"+l.Addr().String()+"?client_id=sensor-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := <-bodyChan
+	for _, s := range []string{"user", "secret", "sensor-1"} {
+		if !bytes.Contains(body, []byte(s)) {
+			t.Errorf("CONNECT control packet does not contain %q", s)
+		}
+	}
+
+	if !client.IsConnected() {
+		t.Error("client is not connected")
+	}
+
+	// Reconnecting opens a new connection and repeats the CONNECT control packet
+	bodyChan = acceptConnect(t, l)
+	if err = client.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(<-bodyChan, body) {
+		t.Error("Reconnect() sent a different CONNECT control packet")
+	}
+}
+
+func TestDial_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("unix sockets are not supported:", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	acceptConnect(t, l)
+	if _, err = Dial(ctx, "unix://"+path, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDial_CloseOnError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	closedChan := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			closedChan <- err
+			return
+		}
+		defer conn.Close()
+
+		// Respond to CONNECT with a packet other than CONNACK
+		s := &fakeServer{t: t, conn: conn}
+		s.read()
+		s.write([]byte{0xD0, 0x00})
+
+		// The client must close the connection instead of leaving it open
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		_, err = conn.Read(make([]byte, 1))
+		closedChan <- err
+	}()
+
+	if _, err = Dial(ctx, "mqtt://"+l.Addr().String(), nil); !errors.Is(err, ErrUnexpectedPacketTypeReceived) {
+		t.Fatalf("Dial() = %v, want %v", err, ErrUnexpectedPacketTypeReceived)
+	}
+
+	if err = <-closedChan; !errors.Is(err, io.EOF) {
+		t.Errorf("server read = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestDial_UnsupportedScheme(t *testing.T) {
+	if _, err := Dial(context.Background(), "http://localhost", nil); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Errorf("Dial() = %v, want %v", err, ErrUnsupportedScheme)
+	}
+
+	client := NewClient(nil)
+	if err := client.Reconnect(context.Background()); !errors.Is(err, ErrNoDialer) {
+		t.Errorf("Reconnect() = %v, want %v", err, ErrNoDialer)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer opens a new network connection to a server. A client created with a dialer can open its own connections and
+// reconnect after the connection is lost.
+type Dialer interface {
+	Dial(ctx context.Context) (net.Conn, error)
+}
+
+// DialerFunc adapts an ordinary function to the Dialer interface. It is useful for targets such as TinyGo where
+// connections are acquired through a netdev driver.
+type DialerFunc func(ctx context.Context) (net.Conn, error)
+
+func (f DialerFunc) Dial(ctx context.Context) (net.Conn, error) {
+	return f(ctx)
+}
+
+// NewClientWithDialer creates a client that uses dialer to open its connection. The connection is opened by the first
+// call to Connect.
+func NewClientWithDialer(dialer Dialer) *Client {
+	c := NewClient(nil)
+	c.dialer = dialer
+	return c
+}
+
+// dial opens a new connection with the client's dialer, replacing the current one. The caller must hold the client's
+// mutex.
+func (c *Client) dial(ctx context.Context) (err error) {
+	if c.dialer == nil {
+		return ErrNoDialer
+	}
+
+	var conn net.Conn
+	if conn, err = c.dialer.Dial(ctx); err != nil {
+		return err
+	}
+
+	c.connMutex.Lock()
+	if c.conn != nil {
+		// The previous connection is no longer usable
+		c.conn.Close()
+	}
+	c.conn = conn
+	c.connMutex.Unlock()
+
+	return nil
+}
+
+// Reconnect opens a new connection with the client's dialer and sends the CONNECT control packet that was last passed
+// to Connect. Server redirections received in the CONNACK control packet are followed. ErrNoDialer is returned if the
+// client was created without a dialer.
+func (c *Client) Reconnect(ctx context.Context) (err error) {
+	for redirects := 0; ; redirects++ {
+		c.mutex.Lock()
+		if c.dialer == nil || c.connectPacket == nil {
+			c.mutex.Unlock()
+			return ErrNoDialer
+		}
+
+		c.isConnected = false
+		err = c.dial(ctx)
+		packet := c.connectPacket
+		_, follow := c.dialer.(redirector)
+		c.mutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		// Connect again if the server redirected the client to another server
+		if _, err = c.Connect(ctx, packet); !follow || !errIsRedirection(err) || redirects == maxRedirects {
+			return err
+		}
+	}
+}
@@ -24,91 +24,40 @@
 
 package mqtt
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
 
 var (
 	ErrUnexpectedPacketTypeReceived = errors.New("unexpected packet type received")
 	ErrClientNotConnected           = errors.New("the client is not connected")
 	ErrInvalidArgument              = errors.New("invalid argument")
+	ErrNoDialer                     = errors.New("the client has no dialer to open a new connection with")
+	ErrUnsupportedScheme            = errors.New("unsupported url scheme")
+	ErrClientStopped                = errors.New("the client run loop has stopped")
+	ErrClientRunning                = errors.New("the client run loop is already running")
+	ErrOfflineQueueFull             = errors.New("the offline queue is full")
+	ErrSessionLost                  = errors.New("the server did not keep the session")
+	ErrMessageExpired               = errors.New("the message expired before it was delivered")
 )
 
-type ReasonCode byte
+// OpError is returned when a client operation stops because its context is done. Op names the operation and Err is
+// the error of the context.
+type OpError struct {
+	Op  string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
 
-func (r ReasonCode) Error() string {
-	switch r {
-	case 0x00:
-		return "success"
-	case 0x80:
-		return "unspecified error"
-	case 0x81:
-		return "malformed packet"
-	case 0x82:
-		return "protocol error"
-	case 0x83:
-		return "implementation specific error"
-	case 0x84:
-		return "unsupported protocol version"
-	case 0x85:
-		return "client identifier not valid"
-	case 0x86:
-		return "bad user name or password"
-	case 0x87:
-		return "not authorized"
-	case 0x88:
-		return "server not available"
-	case 0x89:
-		return "server busy"
-	case 0x8A:
-		return "banned"
-	case 0x8B:
-		return "server shutting down"
-	case 0x8C:
-		return "bad authentication method"
-	case 0x8D:
-		return "keep Alive timeout"
-	case 0x8E:
-		return "session taken over"
-	case 0x8F:
-		return "topic Filter invalid"
-	case 0x90:
-		return "topic name invalid"
-	case 0x91:
-		return "packet Identifier in use"
-	case 0x92:
-		return "packet Identifier not found"
-	case 0x93:
-		return "receive Maximum exceeded"
-	case 0x94:
-		return "topic Alias invalid"
-	case 0x95:
-		return "packet too large"
-	case 0x96:
-		return "message rate too high"
-	case 0x97:
-		return "quota exceeded"
-	case 0x98:
-		return "administrative action"
-	case 0x99:
-		return "retain not supported"
-	case 0x9A:
-		return "retain not supported"
-	case 0x9B:
-		return "qos not supported"
-	case 0x9C:
-		return "use another server"
-	case 0x9D:
-		return "server moved"
-	case 0x9E:
-		return "shared Subscriptions not supported"
-	case 0x9F:
-		return "connection rate exceeded"
-	case 0xA0:
-		return "maximum connect time"
-	case 0xA1:
-		return "subscription identifiers not supported"
-	case 0xA2:
-		return "wildcard subscriptions not supported"
-	default:
-		return "unknown error"
-	}
+func (e *OpError) Unwrap() error {
+	return e.Err
 }
+
+// ReasonCode is the reason code carried by acknowledgement and DISCONNECT control packets. Reason codes of 0x80 or
+// greater indicate failure.
+type ReasonCode = packets.ReasonCode
@@ -26,6 +26,17 @@ package mqtt
 
 import "github.com/waj334/tinygo-mqtt/mqtt/packets"
 
+// Client events that are not triggered by a control packet use packet types beyond the range of control packet types.
+const (
+	// EventBrokerChanged is signalled when the client connects to a different broker than before. Data is the address
+	// of the broker as a string.
+	EventBrokerChanged packets.PacketType = iota + 0x10
+
+	// EventMessageExpired is signalled when an outgoing publish is discarded because its message expiry interval
+	// elapsed before it could be sent. Data is the *packets.Publish that expired.
+	EventMessageExpired
+)
+
 // Event struct containing the control packet that triggered the event
 type Event struct {
 	// PacketType is the type of control packet that triggered the event.
@@ -44,4 +55,7 @@ type EventChannel struct {
 	id      int
 	channel chan *Event
 	done    chan struct{}
+
+	// routed is set for channels created by CreateSubscriptionChannel, which never receive general events
+	routed bool
 }
@@ -0,0 +1,129 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage"
+)
+
+// StoredPublish is a publish held in storage along with the time it was stored. The time is used to reduce the message
+// expiry interval of the publish when it is sent later.
+type StoredPublish struct {
+	Publish *packets.Publish
+	Stored  time.Time
+}
+
+// expired returns true if the message expiry interval of the publish has elapsed since it was stored.
+func (s *StoredPublish) expired(now time.Time) bool {
+	interval := time.Duration(s.Publish.MessageExpiryInterval) * time.Second
+	return interval > 0 && !now.Before(s.Stored.Add(interval))
+}
+
+// remaining returns a copy of the publish with its message expiry interval reduced by the time it has been stored.
+func (s *StoredPublish) remaining(now time.Time) *packets.Publish {
+	pub := *s.Publish
+	if pub.MessageExpiryInterval > 0 {
+		// SPEC: The PUBLISH packet sent to a Client by the Server MUST contain a Message Expiry Interval set to the
+		//       received value minus the time that the Application Message has been waiting in the Server
+		//       [MQTT-3.3.2-6].
+		elapsed := primitives.PrimitiveUint32(now.Sub(s.Stored) / time.Second)
+		if elapsed >= pub.MessageExpiryInterval {
+			elapsed = pub.MessageExpiryInterval - 1
+		}
+		pub.MessageExpiryInterval -= elapsed
+	}
+	return &pub
+}
+
+// ExpiredMessages returns the number of outgoing publishes that were discarded because their message expiry interval
+// elapsed before they could be sent.
+func (c *Client) ExpiredMessages() uint64 {
+	return c.expiredMessages.Load()
+}
+
+// messageExpired counts a publish discarded due to its message expiry interval and signals EventMessageExpired.
+func (c *Client) messageExpired(pub *packets.Publish) {
+	c.expiredMessages.Add(1)
+	c.signal(EventMessageExpired, pub, nil)
+}
+
+// redeliver resends the publishes persisted in storage with the DUP flag set after reconnecting to a session that
+// the server kept, along with the PUBREL control packets of QoS 2 publishes that await PUBCOMP. Publishes whose message
+// expiry interval has elapsed are discarded instead. Nothing is resent unless the storage implementation is a
+// storage.Ranger. The caller must hold the mutex and connMutex.
+func (c *Client) redeliver() (err error) {
+	ranger, ok := c.storage.(storage.Ranger)
+	if !ok {
+		// Nothing can be resent without enumerating the stored control packets
+		return nil
+	}
+
+	now := time.Now()
+	var expired []*packets.Publish
+	err = ranger.Range(func(identifier uint16, packet any) bool {
+		// SPEC: When a Client reconnects with Clean Start set to 0 and a session is present, both the Client and Server
+		//       MUST resend any unacknowledged PUBLISH packets (where QoS > 0) and PUBREL packets using their original
+		//       Packet Identifiers [MQTT-4.4.0-1].
+		if pubrel, ok := packet.(*packets.Pubrel); ok {
+			// The QoS 2 publish awaits PUBCOMP and still counts against the send quota
+			if err = c.send(pubrel); err != nil {
+				return false
+			}
+			c.sendQuota.consume(1)
+			return true
+		}
+
+		stored, ok := packet.(*StoredPublish)
+		if !ok {
+			return true
+		}
+
+		if stored.expired(now) {
+			c.storage.Drop(identifier)
+			expired = append(expired, stored.Publish)
+			return true
+		}
+
+		pub := stored.remaining(now)
+		pub.Duplicate = true
+		if err = c.send(pub); err != nil {
+			return false
+		}
+
+		c.sendQuota.consume(1)
+		return true
+	})
+
+	for _, pub := range expired {
+		c.takeToken(uint16(pub.PacketIdentifier)).complete(0, "", ErrMessageExpired)
+		c.messageExpired(pub)
+	}
+
+	return err
+}
@@ -0,0 +1,185 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage/memory"
+)
+
+func TestStoredPublish_Remaining(t *testing.T) {
+	now := time.Now()
+	stored := &StoredPublish{
+		Publish: &packets.Publish{Topic: "test/topic", MessageExpiryInterval: 10},
+		Stored:  now.Add(-time.Second * 3),
+	}
+
+	if stored.expired(now) {
+		t.Fatal("expired() = true, want false")
+	}
+	if pub := stored.remaining(now); pub.MessageExpiryInterval != 7 {
+		t.Errorf("MessageExpiryInterval = %d, want 7", pub.MessageExpiryInterval)
+	}
+	if stored.Publish.MessageExpiryInterval != 10 {
+		t.Error("remaining() modified the stored publish")
+	}
+	if !stored.expired(now.Add(time.Second * 7)) {
+		t.Error("expired() = false after the expiry interval elapsed")
+	}
+}
+
+func TestClient_Redeliver(t *testing.T) {
+	c, s := newTestClient(t)
+
+	store := memory.NewStorage()
+	c.SetStorage(store)
+	events := c.CreateEventChannel(10)
+
+	// One publish expired while the client was disconnected and one is still valid
+	store.Store(1, &StoredPublish{
+		Publish: &packets.Publish{QoS: packets.QoS1, PacketIdentifier: 1, Topic: "expired", MessageExpiryInterval: 1},
+		Stored:  time.Now().Add(-time.Second * 2),
+	})
+	store.Store(2, &StoredPublish{
+		Publish: &packets.Publish{QoS: packets.QoS1, PacketIdentifier: 2, Topic: "valid", MessageExpiryInterval: 60},
+		Stored:  time.Now().Add(-time.Second * 10),
+	})
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{
+			Version:   packets.MQTT5,
+			ClientId:  "test",
+			KeepAlive: 60,
+		})
+		errChan <- err
+	}()
+
+	// Accept the CONNECT control packet with the session present flag set
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x03, 0x01, 0x00, 0x00})
+
+	header, body := s.expect(packets.PUBLISH)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	pub := packets.Publish{Header: header}
+	if _, err := pub.DecodeFrom(body); err != nil {
+		t.Fatal(err)
+	}
+
+	if pub.Topic != "valid" || pub.PacketIdentifier != 2 || !pub.Duplicate {
+		t.Errorf("redelivered %s with identifier %d and DUP %v, want valid with identifier 2 and DUP true",
+			pub.Topic, pub.PacketIdentifier, pub.Duplicate)
+	}
+	if pub.MessageExpiryInterval > 50 {
+		t.Errorf("MessageExpiryInterval = %d, want at most 50", pub.MessageExpiryInterval)
+	}
+
+	if n := c.ExpiredMessages(); n != 1 {
+		t.Errorf("ExpiredMessages() = %d, want 1", n)
+	}
+	if _, err := store.Get(1); err == nil {
+		t.Error("expired publish was not dropped from storage")
+	}
+
+	for {
+		select {
+		case e := <-events.C:
+			if e.PacketType != EventMessageExpired {
+				continue
+			}
+			if expired := e.Data.(*packets.Publish); expired.Topic != "expired" {
+				t.Errorf("EventMessageExpired for %s, want expired", expired.Topic)
+			}
+			return
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for EventMessageExpired")
+		}
+	}
+}
+
+func TestClient_RedeliverPubrel(t *testing.T) {
+	c, s := newTestClient(t)
+
+	// A QoS 2 publish was received by the server but PUBCOMP never arrived
+	store := memory.NewStorage()
+	c.SetStorage(store)
+	store.Store(3, &packets.Pubrel{Puback: packets.Puback{PacketIdentifier: 3}})
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{
+			Version:   packets.MQTT5,
+			ClientId:  "test",
+			KeepAlive: 60,
+		})
+		errChan <- err
+	}()
+
+	// Accept the CONNECT control packet with the session present flag set
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x03, 0x01, 0x00, 0x00})
+
+	_, body := s.expect(packets.PUBREL)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.BigEndian.Uint16(body); id != 3 {
+		t.Errorf("PUBREL identifier = %d, want 3", id)
+	}
+
+	// The resent PUBREL counts against the send quota until PUBCOMP is received
+	if got := c.sendQuota.available(); got != defaultReceiveMaximum-1 {
+		t.Errorf("available() = %d, want %d", got, defaultReceiveMaximum-1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := startRun(t, ctx, c)
+
+	s.send(&packets.Pubcomp{Puback: packets.Puback{PacketIdentifier: 3}})
+	for deadline := time.Now().Add(time.Second * 5); ; {
+		if _, err := store.Get(3); err != nil && c.sendQuota.available() == defaultReceiveMaximum {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for PUBCOMP to drop the PUBREL and release the send quota")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := waitRun(t, runErr); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
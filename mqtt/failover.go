@@ -0,0 +1,241 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// Failover is a Dialer that connects to one of an ordered list of brokers. Dial starts with the broker that was last
+// connected to and moves on to the next broker in the list whenever a connection cannot be established or the broker
+// rejects the connection because it cannot serve the client. Server redirection received in CONNACK and DISCONNECT
+// control packets is honored by the client through Redirect.
+type Failover struct {
+	// DialFn opens a connection to the broker at address.
+	DialFn func(ctx context.Context, address string) (net.Conn, error)
+
+	mutex    sync.Mutex
+	brokers  []string
+	active   int
+	current  string
+	redirect string
+
+	// redirected is set while the current connection is to the target of a temporary redirection rather than to a
+	// broker in the list
+	redirected bool
+}
+
+// NewFailover returns a Failover that dials the brokers in the order given using dialFn.
+func NewFailover(dialFn func(ctx context.Context, address string) (net.Conn, error), brokers ...string) *Failover {
+	return &Failover{
+		DialFn:  dialFn,
+		brokers: append([]string(nil), brokers...),
+	}
+}
+
+// Dial connects to the pending temporary redirection if there is one and otherwise tries each broker in turn starting
+// with the active one. The error of the last attempt is returned if no broker could be connected to. The mutex is not
+// held while dialing so that Active, Brokers and Redirect do not block on the network.
+func (f *Failover) Dial(ctx context.Context) (conn net.Conn, err error) {
+	f.mutex.Lock()
+	// A temporary redirection is only used once
+	redirect := f.redirect
+	f.redirect = ""
+	brokers := append([]string(nil), f.brokers...)
+	active := f.active
+	f.mutex.Unlock()
+
+	if len(redirect) > 0 {
+		if conn, err = f.DialFn(ctx, redirect); err == nil {
+			f.mutex.Lock()
+			f.current = redirect
+			f.redirected = true
+			f.mutex.Unlock()
+			return conn, nil
+		}
+	}
+
+	if len(brokers) == 0 && err == nil {
+		return nil, ErrInvalidArgument
+	}
+
+	for i := range brokers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		index := (active + i) % len(brokers)
+		if conn, err = f.DialFn(ctx, brokers[index]); err == nil {
+			f.mutex.Lock()
+			if index < len(f.brokers) {
+				f.active = index
+			}
+			f.current = brokers[index]
+			f.redirected = false
+			f.mutex.Unlock()
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Active returns the address of the broker that was last connected to.
+func (f *Failover) Active() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.current
+}
+
+// Brokers returns a copy of the ordered broker list.
+func (f *Failover) Brokers() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.brokers...)
+}
+
+// Redirect records a server redirection. A permanent redirection replaces the active broker in the list while a
+// temporary redirection is only used by the next call to Dial. A permanent redirection received while connected to the
+// target of a temporary redirection is treated as temporary since the active broker in the list did not move. The
+// server reference may contain several references separated by spaces, in which case only the first is used.
+func (f *Failover) Redirect(reference string, permanent bool) {
+	fields := strings.Fields(reference)
+	if len(fields) == 0 {
+		return
+	}
+	reference = fields[0]
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !permanent || f.redirected {
+		f.redirect = reference
+		return
+	}
+
+	if len(f.brokers) == 0 {
+		f.brokers = append(f.brokers, reference)
+		f.active = 0
+		return
+	}
+
+	// The server moved so the old address does not need to be tried again
+	f.brokers[f.active] = reference
+	f.redirect = ""
+}
+
+// Reject records that the broker last connected to rejected the connection with the reason code of its CONNACK. The
+// next call to Dial starts with the next broker in the list if the reason code indicates that the broker cannot serve
+// the client at the moment. Nothing changes if the connection was to the target of a temporary redirection.
+func (f *Failover) Reject(code ReasonCode) {
+	if !isUnavailable(code) {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.redirected && len(f.brokers) > 0 {
+		f.active = (f.active + 1) % len(f.brokers)
+	}
+}
+
+// redirector is implemented by dialers that support server redirection.
+type redirector interface {
+	Redirect(reference string, permanent bool)
+}
+
+// rejecter is implemented by dialers that act on the server rejecting a connection.
+type rejecter interface {
+	Reject(code ReasonCode)
+}
+
+// activeBroker is implemented by dialers that can report which broker they connected to.
+type activeBroker interface {
+	Active() string
+}
+
+// isRedirection returns true if code is either of the server redirection reason codes.
+func isRedirection(code ReasonCode) bool {
+	// SPEC: 0x9C Use another server. The Client should temporarily use another server.
+	// SPEC: 0x9D Server moved. The Client should permanently use another server.
+	return code == 0x9C || code == 0x9D
+}
+
+// isUnavailable returns true if code indicates that the server cannot accept the connection at the moment, as opposed to
+// rejecting the client itself.
+func isUnavailable(code ReasonCode) bool {
+	switch code {
+	case 0x88, // Server unavailable
+		0x89, // Server busy
+		0x97, // Quota exceeded
+		0x9F: // Connection rate exceeded
+		return true
+	}
+	return false
+}
+
+// redirect passes a server redirection on to the dialer of the client. It returns true if the dialer will act on it.
+func (c *Client) redirect(code ReasonCode, reference string) bool {
+	if !isRedirection(code) || len(reference) == 0 {
+		return false
+	}
+
+	// SPEC: The Server uses a Reason Code of 0x9C (Use another server) or 0x9D (Server moved) to indicate that the
+	//       Client should use another Server, and the Server Reference is included to identify it.
+	if r, ok := c.dialer.(redirector); ok {
+		r.Redirect(reference, code == 0x9D)
+		return true
+	}
+	return false
+}
+
+// signalBrokerChange signals EventBrokerChanged if the dialer connected to a different broker than before.
+func (c *Client) signalBrokerChange() {
+	a, ok := c.dialer.(activeBroker)
+	if !ok {
+		return
+	}
+
+	if broker := a.Active(); broker != c.broker {
+		c.broker = broker
+		c.signal(EventBrokerChanged, broker, nil)
+	}
+}
+
+// maxRedirects is the number of server redirections Reconnect follows before giving up.
+const maxRedirects = 3
+
+// errIsRedirection returns true if err is a server redirection reason code.
+func errIsRedirection(err error) bool {
+	var code packets.ReasonCode
+	return errors.As(err, &code) && isRedirection(code)
+}
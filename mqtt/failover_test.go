@@ -0,0 +1,345 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// testBrokers creates a Failover whose brokers are served by fn. Brokers without a handler refuse connections.
+func testBrokers(t *testing.T, handlers map[string]func(s *fakeServer), brokers ...string) *Failover {
+	return NewFailover(func(ctx context.Context, address string) (net.Conn, error) {
+		handler, ok := handlers[address]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() {
+			clientConn.Close()
+			serverConn.Close()
+		})
+
+		go handler(&fakeServer{t: t, conn: serverConn})
+		return clientConn, nil
+	}, brokers...)
+}
+
+// accept accepts the CONNECT control packet with a successful CONNACK.
+func accept(s *fakeServer) {
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x03, 0x00, 0x00, 0x00})
+}
+
+// redirectTo rejects the CONNECT control packet with the reason code and server reference.
+func redirectTo(code byte, reference string) func(s *fakeServer) {
+	return func(s *fakeServer) {
+		s.expect(packets.CONNECT)
+
+		raw := []byte{0x20, byte(6 + len(reference)), 0x00, code, byte(3 + len(reference)), 0x1C, 0x00, byte(len(reference))}
+		s.write(append(raw, reference...))
+	}
+}
+
+// brokerEvents returns the addresses signalled by EventBrokerChanged events pending on the channel.
+func brokerEvents(events EventChannel) (brokers []string) {
+	for {
+		select {
+		case e := <-events.C:
+			if e.PacketType == EventBrokerChanged {
+				brokers = append(brokers, e.Data.(string))
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestFailover_Rotation(t *testing.T) {
+	handlers := map[string]func(s *fakeServer){
+		"b:1883": accept,
+	}
+
+	failover := testBrokers(t, handlers, "a:1883", "b:1883", "c:1883")
+	c := NewClientWithDialer(failover)
+	events := c.CreateEventChannel(10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// The first broker is down so the client connects to the second
+	if _, err := c.Connect(ctx, &packets.Connect{Version: packets.MQTT5, KeepAlive: 60}); err != nil {
+		t.Fatal(err)
+	}
+
+	if failover.Active() != "b:1883" {
+		t.Errorf("Active() = %q, want b:1883", failover.Active())
+	}
+
+	// The second broker goes down and the client moves on to the third
+	delete(handlers, "b:1883")
+	handlers["c:1883"] = accept
+	if err := c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := brokerEvents(events), []string{"b:1883", "c:1883"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("broker events = %v, want %v", got, want)
+	}
+
+	// No broker can be reached
+	delete(handlers, "c:1883")
+	if err := c.Reconnect(ctx); err == nil {
+		t.Error("Reconnect() succeeded with no reachable brokers")
+	}
+}
+
+func TestFailover_Redirection(t *testing.T) {
+	handlers := map[string]func(s *fakeServer){
+		"a:1883":    redirectTo(0x9C, "temp:1883"),
+		"temp:1883": accept,
+	}
+
+	failover := testBrokers(t, handlers, "a:1883")
+	c := NewClientWithDialer(failover)
+	events := c.CreateEventChannel(10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// Connect reports the redirection and Reconnect follows it
+	_, err := c.Connect(ctx, &packets.Connect{Version: packets.MQTT5, KeepAlive: 60})
+	if !errors.Is(err, ReasonCode(0x9C)) {
+		t.Fatalf("Connect() = %v, want %v", err, ReasonCode(0x9C))
+	}
+
+	if err = c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if failover.Active() != "temp:1883" {
+		t.Errorf("Active() = %q, want temp:1883", failover.Active())
+	}
+
+	// A temporary redirection does not change the broker list
+	if brokers := failover.Brokers(); !reflect.DeepEqual(brokers, []string{"a:1883"}) {
+		t.Errorf("Brokers() = %v", brokers)
+	}
+
+	// The server moved permanently
+	handlers["a:1883"] = redirectTo(0x9D, "new:1883")
+	handlers["new:1883"] = accept
+	if err = c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if brokers := failover.Brokers(); !reflect.DeepEqual(brokers, []string{"new:1883"}) {
+		t.Errorf("Brokers() = %v, want [new:1883]", brokers)
+	}
+
+	if got, want := brokerEvents(events), []string{"temp:1883", "new:1883"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("broker events = %v, want %v", got, want)
+	}
+}
+
+func TestFailover_DisconnectRedirection(t *testing.T) {
+	handlers := map[string]func(s *fakeServer){
+		"a:1883": func(s *fakeServer) {
+			accept(s)
+
+			// The server is shutting down and refers the client to another server
+			reference := "b:1883"
+			raw := []byte{0xE0, byte(5 + len(reference)), 0x9D, byte(3 + len(reference)), 0x1C, 0x00, byte(len(reference))}
+			s.write(append(raw, reference...))
+		},
+		"b:1883": accept,
+	}
+
+	failover := testBrokers(t, handlers, "a:1883")
+	c := NewClientWithDialer(failover)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.Connect(ctx, &packets.Connect{Version: packets.MQTT5, KeepAlive: 60}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.IsConnected() {
+		t.Error("client is still connected after DISCONNECT")
+	}
+
+	if err := c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if failover.Active() != "b:1883" {
+		t.Errorf("Active() = %q, want b:1883", failover.Active())
+	}
+}
+
+// reject rejects the CONNECT control packet with the reason code.
+func reject(code byte) func(s *fakeServer) {
+	return func(s *fakeServer) {
+		s.expect(packets.CONNECT)
+		s.write([]byte{0x20, 0x03, 0x00, code, 0x00})
+	}
+}
+
+func TestFailover_Rejection(t *testing.T) {
+	handlers := map[string]func(s *fakeServer){
+		"a:1883": reject(0x89),
+		"b:1883": accept,
+	}
+
+	failover := testBrokers(t, handlers, "a:1883", "b:1883")
+	c := NewClientWithDialer(failover)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// The first broker is busy so the next attempt goes to the second
+	_, err := c.Connect(ctx, &packets.Connect{Version: packets.MQTT5, KeepAlive: 60})
+	if !errors.Is(err, ReasonCode(0x89)) {
+		t.Fatalf("Connect() = %v, want %v", err, ReasonCode(0x89))
+	}
+
+	if err = c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if failover.Active() != "b:1883" {
+		t.Errorf("Active() = %q, want b:1883", failover.Active())
+	}
+
+	// Rejections of the client itself are not a reason to move on to another broker
+	handlers["b:1883"] = reject(0x86)
+	if err = c.Reconnect(ctx); !errors.Is(err, ReasonCode(0x86)) {
+		t.Fatalf("Reconnect() = %v, want %v", err, ReasonCode(0x86))
+	}
+
+	handlers["b:1883"] = accept
+	if err = c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if failover.Active() != "b:1883" {
+		t.Errorf("Active() = %q, want b:1883", failover.Active())
+	}
+}
+
+func TestFailover_PermanentRedirectionFromTemporaryServer(t *testing.T) {
+	handlers := map[string]func(s *fakeServer){
+		"a:1883": redirectTo(0x9C, "temp:1883"),
+		"temp:1883": func(s *fakeServer) {
+			accept(s)
+
+			// The temporary server moved permanently
+			reference := "new:1883"
+			raw := []byte{0xE0, byte(5 + len(reference)), 0x9D, byte(3 + len(reference)), 0x1C, 0x00, byte(len(reference))}
+			s.write(append(raw, reference...))
+		},
+		"new:1883": accept,
+	}
+
+	failover := testBrokers(t, handlers, "a:1883")
+	c := NewClientWithDialer(failover)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.Connect(ctx, &packets.Connect{Version: packets.MQTT5, KeepAlive: 60}); !errors.Is(err, ReasonCode(0x9C)) {
+		t.Fatalf("Connect() = %v, want %v", err, ReasonCode(0x9C))
+	}
+
+	if err := c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if failover.Active() != "new:1883" {
+		t.Errorf("Active() = %q, want new:1883", failover.Active())
+	}
+
+	// The broker in the list did not move
+	if brokers := failover.Brokers(); !reflect.DeepEqual(brokers, []string{"a:1883"}) {
+		t.Errorf("Brokers() = %v, want [a:1883]", brokers)
+	}
+}
+
+func TestFailover_DialWithoutLock(t *testing.T) {
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	failover := NewFailover(func(ctx context.Context, address string) (net.Conn, error) {
+		close(dialing)
+		<-release
+		return nil, errors.New("connection refused")
+	}, "a:1883")
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := failover.Dial(context.Background())
+		errChan <- err
+	}()
+	<-dialing
+
+	// The other methods do not wait for the dial to complete
+	done := make(chan struct{})
+	go func() {
+		failover.Active()
+		failover.Brokers()
+		failover.Redirect("b:1883", false)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Failover blocked while dialing")
+	}
+
+	close(release)
+	if err := <-errChan; err == nil {
+		t.Error("Dial() succeeded with no reachable brokers")
+	}
+}
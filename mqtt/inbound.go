@@ -0,0 +1,125 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// defaultReceiveMaximum is the Receive Maximum in effect when the CONNECT or CONNACK control packet does not specify one.
+// SPEC: If the Receive Maximum value is absent then its value defaults to 65,535.
+const defaultReceiveMaximum = 65535
+
+// inboundState is the state of a QoS 1 or QoS 2 publish received from the server that has not been fully acknowledged.
+type inboundState byte
+
+const (
+	// inboundReceived is a publish that has been received but not acknowledged yet.
+	inboundReceived inboundState = iota + 1
+
+	// inboundReleasing is a QoS 2 publish for which PUBREC has been sent and that awaits PUBREL.
+	inboundReleasing
+)
+
+// inboundFlow enforces the Receive Maximum that the client sent to the server. It tracks the packet identifiers of QoS 1
+// and QoS 2 publishes received from the server until the client has sent the PUBACK or PUBCOMP control packet that
+// completes them. inboundFlow is guarded by the client's mutex.
+// SPEC: [4.9 Flow Control]
+type inboundFlow struct {
+	maximum  uint16
+	inflight map[uint16]inboundState
+}
+
+// reset sets the Receive Maximum for a new network connection. QoS 2 publishes awaiting PUBREL are kept if the server
+// resumed the session since the server sends PUBREL for them again. Every other publish is forgotten.
+func (f *inboundFlow) reset(maximum uint16, sessionPresent bool) {
+	if maximum == 0 {
+		maximum = defaultReceiveMaximum
+	}
+	f.maximum = maximum
+
+	if f.inflight == nil {
+		f.inflight = make(map[uint16]inboundState)
+	}
+
+	for identifier, state := range f.inflight {
+		if !sessionPresent || state != inboundReleasing {
+			delete(f.inflight, identifier)
+		}
+	}
+}
+
+// receive records a publish received from the server. duplicate is true if the publish is a retransmission of a QoS 2
+// publish that was already received and must not be delivered again. ReasonCode 0x93 (Receive Maximum exceeded) is
+// returned if the server has more publishes in flight than the Receive Maximum allows.
+func (f *inboundFlow) receive(identifier uint16, qos packets.QoS) (duplicate bool, err error) {
+	if qos == packets.QoS0 {
+		return false, nil
+	}
+
+	if state, ok := f.inflight[identifier]; ok {
+		// SPEC: Until it has received the corresponding PUBREL packet, the receiver MUST acknowledge any subsequent
+		//       PUBLISH packet with the same Packet Identifier by sending a PUBREC. It MUST NOT cause duplicate
+		//       messages to be delivered to any onward recipients in this case [MQTT-4.3.3-10].
+		return qos == packets.QoS2 && state == inboundReleasing, nil
+	}
+
+	// SPEC: The Server MUST NOT send more than Receive Maximum QoS 1 and QoS 2 PUBLISH packets for which it has not
+	//       received PUBACK, PUBCOMP, or PUBREC with a Reason Code of 128 or greater from the Client [MQTT-3.3.4-9].
+	//       If it receives more than Receive Maximum QoS 1 and QoS 2 PUBLISH packets where it has not sent a PUBACK
+	//       or PUBCOMP in response, the Client uses DISCONNECT with Reason Code 0x93 (Receive Maximum exceeded).
+	if len(f.inflight) >= int(f.maximum) {
+		return false, ReasonCode(0x93)
+	}
+
+	f.inflight[identifier] = inboundReceived
+	return false, nil
+}
+
+// acknowledged records that PUBACK or PUBREC was sent with the specified reason code. The quota of a QoS 1 publish is
+// released along with that of a QoS 2 publish that was rejected with PUBREC. Accepted QoS 2 publishes remain in flight
+// until PUBCOMP is sent.
+func (f *inboundFlow) acknowledged(identifier uint16, qos packets.QoS, code ReasonCode) {
+	if qos == packets.QoS2 && code < 0x80 {
+		f.inflight[identifier] = inboundReleasing
+		return
+	}
+	delete(f.inflight, identifier)
+}
+
+// release records that PUBCOMP is sent in response to PUBREL and releases the quota of the QoS 2 publish. ok is false
+// if no QoS 2 publish with the identifier is awaiting PUBREL.
+func (f *inboundFlow) release(identifier uint16) (ok bool) {
+	if f.inflight[identifier] != inboundReleasing {
+		return false
+	}
+	delete(f.inflight, identifier)
+	return true
+}
+
+// quota returns the number of QoS 1 and QoS 2 publishes the server may still send.
+func (f *inboundFlow) quota() int {
+	return int(f.maximum) - len(f.inflight)
+}
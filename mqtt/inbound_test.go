@@ -0,0 +1,326 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage/memory"
+)
+
+func TestInboundFlow(t *testing.T) {
+	f := inboundFlow{}
+	f.reset(2, false)
+
+	receive := func(identifier uint16, qos packets.QoS, wantDuplicate bool, wantErr error) {
+		t.Helper()
+		if duplicate, err := f.receive(identifier, qos); duplicate != wantDuplicate || err != wantErr {
+			t.Errorf("receive(%d, %v) = %v, %v, want %v, %v", identifier, qos, duplicate, err, wantDuplicate, wantErr)
+		}
+	}
+	quota := func(want int) {
+		t.Helper()
+		if got := f.quota(); got != want {
+			t.Errorf("quota() = %d, want %d", got, want)
+		}
+	}
+
+	// QoS 0 publishes never consume quota
+	receive(1, packets.QoS1, false, nil)
+	receive(2, packets.QoS2, false, nil)
+	receive(3, packets.QoS0, false, nil)
+	quota(0)
+
+	// The server exceeded the Receive Maximum
+	receive(4, packets.QoS1, false, ReasonCode(0x93))
+
+	// PUBACK releases the quota of a QoS 1 publish while PUBREC does not for a QoS 2 publish
+	f.acknowledged(1, packets.QoS1, 0x00)
+	f.acknowledged(2, packets.QoS2, 0x00)
+	quota(1)
+
+	// A retransmission of the QoS 2 publish consumes no quota and is not delivered again
+	receive(2, packets.QoS2, true, nil)
+	quota(1)
+
+	// PUBCOMP releases the quota of the QoS 2 publish
+	if !f.release(2) {
+		t.Error("release(2) = false, want true")
+	}
+	if f.release(2) {
+		t.Error("release(2) = true after the publish was released")
+	}
+	quota(2)
+
+	// PUBREC with a failure reason code releases the quota immediately
+	receive(5, packets.QoS2, false, nil)
+	f.acknowledged(5, packets.QoS2, 0x80)
+	quota(2)
+	if f.release(5) {
+		t.Error("release(5) = true for a rejected publish")
+	}
+
+	// Only QoS 2 publishes awaiting PUBREL are kept when the session is resumed
+	receive(6, packets.QoS2, false, nil)
+	f.acknowledged(6, packets.QoS2, 0x00)
+	receive(7, packets.QoS1, false, nil)
+	f.reset(0, true)
+	quota(defaultReceiveMaximum - 1)
+	if !f.release(6) {
+		t.Error("release(6) = false after the session was resumed")
+	}
+
+	receive(8, packets.QoS2, false, nil)
+	f.acknowledged(8, packets.QoS2, 0x00)
+	f.reset(1, false)
+	quota(1)
+}
+
+// connectReceiveMaximum connects the client with the specified Receive Maximum.
+func connectReceiveMaximum(t *testing.T, c *Client, s *fakeServer, receiveMaximum uint16) {
+	t.Helper()
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{
+			Version:        packets.MQTT5,
+			ClientId:       "test",
+			KeepAlive:      60,
+			ReceiveMaximum: primitives.PrimitiveUint16(receiveMaximum),
+		})
+		errChan <- err
+	}()
+
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x03, 0x00, 0x00, 0x00})
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_ReceiveMaximumQoS2(t *testing.T) {
+	c, s := newTestClient(t)
+	connectReceiveMaximum(t, c, s, 1)
+
+	channel := c.CreateEventChannel(10)
+	poll(t, c)
+
+	pub := &packets.Publish{QoS: packets.QoS2, PacketIdentifier: 1, Topic: "test/topic", Payload: []byte("once")}
+	s.send(pub)
+	s.expect(packets.PUBREC)
+
+	// The retransmission is acknowledged again without exceeding the Receive Maximum
+	pub.Duplicate = true
+	s.send(pub)
+	s.expect(packets.PUBREC)
+
+	// PUBCOMP releases the quota so that the next publish is accepted
+	s.send(&packets.Pubrel{Puback: packets.Puback{PacketIdentifier: 1}})
+	if _, body := s.expect(packets.PUBCOMP); len(body) > 2 && body[2] != 0x00 {
+		t.Errorf("PUBCOMP reason code = %#x, want 0x00", body[2])
+	}
+
+	s.send(&packets.Publish{QoS: packets.QoS1, PacketIdentifier: 2, Topic: "test/topic"})
+	s.expect(packets.PUBACK)
+
+	// PUBREL for a packet identifier that is not in flight
+	s.send(&packets.Pubrel{Puback: packets.Puback{PacketIdentifier: 9}})
+	if _, body := s.expect(packets.PUBCOMP); len(body) < 3 || body[2] != 0x92 {
+		t.Errorf("PUBCOMP body = %x, want reason code 0x92", body)
+	}
+
+	// The QoS 2 publish was delivered exactly once
+	var delivered int
+	for {
+		select {
+		case e := <-channel.C:
+			if e.PacketType == packets.PUBLISH && e.Data.(*packets.Publish).PacketIdentifier == 1 {
+				delivered++
+			}
+			continue
+		case <-time.After(time.Millisecond * 50):
+		}
+		break
+	}
+	if delivered != 1 {
+		t.Errorf("QoS 2 publish delivered %d times, want 1", delivered)
+	}
+}
+
+func TestClient_ReceiveMaximumExceeded(t *testing.T) {
+	c, s := newTestClient(t)
+	connectReceiveMaximum(t, c, s, 1)
+
+	errChan := startRun(t, context.Background(), c)
+
+	s.send(&packets.Publish{QoS: packets.QoS2, PacketIdentifier: 1, Topic: "test/topic"})
+	s.expect(packets.PUBREC)
+
+	// The second publish is in excess of the Receive Maximum as PUBCOMP has not been sent for the first
+	s.send(&packets.Publish{QoS: packets.QoS1, PacketIdentifier: 2, Topic: "test/topic"})
+	if _, body := s.expect(packets.DISCONNECT); len(body) < 1 || body[0] != 0x93 {
+		t.Errorf("DISCONNECT body = %x, want reason code 0x93", body)
+	}
+
+	if err := waitRun(t, errChan); !errors.Is(err, ReasonCode(0x93)) {
+		t.Errorf("Run() = %v, want %v", err, ReasonCode(0x93))
+	}
+	if c.IsConnected() {
+		t.Error("client is still connected after exceeding the Receive Maximum")
+	}
+}
+
+func TestClient_InvalidPayloadFormat(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+
+	channel := c.CreateEventChannel(10)
+	errChan := startRun(t, context.Background(), c)
+
+	// invalid encodes a publish whose payload is not UTF-8 despite the payload format indicator
+	invalid := func(qos packets.QoS, identifier uint16) []byte {
+		pub := &packets.Publish{
+			QoS:                    qos,
+			PacketIdentifier:       primitives.PrimitiveUint16(identifier),
+			Topic:                  "test/topic",
+			PayloadFormatIndicator: 1,
+			Payload:                []byte("ab"),
+		}
+		raw := encode(t, pub)
+		copy(raw[len(raw)-2:], []byte{0xC0, 0xAF})
+		return raw
+	}
+
+	// Such publishes are rejected
+	s.write(invalid(packets.QoS1, 1))
+	if _, body := s.expect(packets.PUBACK); len(body) < 3 || body[2] != 0x99 {
+		t.Errorf("PUBACK body = %x, want reason code 0x99", body)
+	}
+
+	s.write(invalid(packets.QoS2, 2))
+	if _, body := s.expect(packets.PUBREC); len(body) < 3 || body[2] != 0x99 {
+		t.Errorf("PUBREC body = %x, want reason code 0x99", body)
+	}
+
+	// The session is kept and later publishes are delivered
+	s.send(&packets.Publish{QoS: packets.QoS1, PacketIdentifier: 3, Topic: "test/topic", PayloadFormatIndicator: 1, Payload: []byte("valid")})
+	if _, body := s.expect(packets.PUBACK); len(body) > 2 && body[2] != 0x00 {
+		t.Errorf("PUBACK reason code = %#x, want 0x00", body[2])
+	}
+
+	for {
+		select {
+		case e := <-channel.C:
+			if e.PacketType != packets.PUBLISH {
+				continue
+			}
+			if pub := e.Data.(*packets.Publish); pub.PacketIdentifier != 3 {
+				t.Errorf("publish %d with an invalid payload was delivered", pub.PacketIdentifier)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for the valid publish")
+		}
+		break
+	}
+
+	if !c.IsConnected() {
+		t.Error("client disconnected after rejecting the payload")
+	}
+
+	disconnectErr := make(chan error, 1)
+	go func() {
+		disconnectErr <- c.Disconnect(context.Background(), false)
+	}()
+	s.expect(packets.DISCONNECT)
+	if err := <-disconnectErr; err != nil {
+		t.Fatal(err)
+	}
+	if err := waitRun(t, errChan); err != nil {
+		t.Errorf("Run() = %v, want nil", err)
+	}
+}
+
+func TestClient_InboundIdentifiersSeparateFromStorage(t *testing.T) {
+	c, s := newTestClient(t)
+	store := memory.NewStorage()
+	c.SetStorage(store)
+	s.connect(c)
+	c.SetRngFn(func() uint32 { return 7 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := startRun(t, ctx, c)
+
+	// Store an outbound QoS 1 publish with the packet identifier 7
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.Publish(ctx, &packets.Publish{QoS: packets.QoS1, Topic: "test/topic"})
+	}()
+	s.expect(packets.PUBLISH)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	// Inbound publishes use packet identifiers of their own, including the one of the outbound publish
+	s.send(&packets.Publish{QoS: packets.QoS1, PacketIdentifier: 3, Topic: "test/topic"})
+	s.expect(packets.PUBACK)
+	s.send(&packets.Publish{QoS: packets.QoS2, PacketIdentifier: 7, Topic: "test/topic"})
+	s.expect(packets.PUBREC)
+	s.send(&packets.Pubrel{Puback: packets.Puback{PacketIdentifier: 7}})
+	if _, body := s.expect(packets.PUBCOMP); len(body) > 2 && body[2] != 0 {
+		t.Errorf("PUBCOMP reason code = %#x, want 0", body[2])
+	}
+
+	if _, err := store.Get(3); err != storage.ErrNoEntry {
+		t.Errorf("Get(3) = %v, want %v", err, storage.ErrNoEntry)
+	}
+	if _, err := store.Get(7); err != nil {
+		t.Errorf("Get(7) = %v, want the outbound publish", err)
+	}
+
+	// Acknowledging the outbound publish drops it and an unknown identifier is not an error
+	s.send(&packets.Puback{PacketIdentifier: 7})
+	s.send(&packets.Puback{PacketIdentifier: 9})
+	s.send(&packets.Pubcomp{Puback: packets.Puback{PacketIdentifier: 9}})
+
+	// Wait for the acknowledgements to be handled
+	s.send(&packets.Publish{QoS: packets.QoS1, PacketIdentifier: 4, Topic: "test/topic"})
+	s.expect(packets.PUBACK)
+
+	if _, err := store.Get(7); err != storage.ErrNoEntry {
+		t.Errorf("Get(7) = %v, want %v", err, storage.ErrNoEntry)
+	}
+
+	cancel()
+	if err := waitRun(t, runErr); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
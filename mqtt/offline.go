@@ -0,0 +1,306 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage/memory"
+)
+
+// DropPolicy decides which message is discarded when a publish is queued while the offline queue is full.
+type DropPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room for the new one.
+	DropOldest DropPolicy = iota
+
+	// DropNewest discards the new message. Publish returns ErrOfflineQueueFull.
+	DropNewest
+)
+
+// OfflineQueue is a bounded queue that holds publishes while the client is disconnected. Queued publishes are sent in
+// order once the client is connected again. Publishes whose message expiry interval elapses while queued are
+// discarded and reported with EventMessageExpired.
+type OfflineQueue struct {
+	mutex    sync.Mutex
+	capacity int
+	policy   DropPolicy
+	storage  storage.Storage
+
+	// ids holds the storage identifiers of the queued messages in order
+	ids    []uint16
+	nextId uint16
+
+	// flushing is true while queued publishes are being sent. New publishes are queued behind them in the meantime.
+	flushing bool
+
+	// expiredFn is called with every publish that is discarded because its message expiry interval elapsed
+	expiredFn func(pub *packets.Publish)
+}
+
+// NewOfflineQueue creates an offline queue that holds at most capacity publishes in memory.
+func NewOfflineQueue(capacity int, policy DropPolicy) *OfflineQueue {
+	queue, _ := NewOfflineQueueWithStorage(capacity, policy, memory.NewStorage())
+	return queue
+}
+
+// NewOfflineQueueWithStorage creates an offline queue that holds at most capacity publishes in store. Messages already
+// present in store are queued again if store is a storage.Ranger so that a persistent storage implementation can carry
+// the queue across restarts. store must not be shared with the client's storage as the packet identifiers of both
+// would collide.
+func NewOfflineQueueWithStorage(capacity int, policy DropPolicy, store storage.Storage) (queue *OfflineQueue, err error) {
+	if capacity <= 0 || capacity > 0xFFFF || store == nil {
+		return nil, ErrInvalidArgument
+	}
+
+	queue = &OfflineQueue{
+		capacity: capacity,
+		policy:   policy,
+		storage:  store,
+	}
+
+	ranger, ok := store.(storage.Ranger)
+	if !ok {
+		return queue, nil
+	}
+
+	// Recover messages queued by a previous instance
+	if err = ranger.Range(func(identifier uint16, packet any) bool {
+		if _, ok := packet.(*StoredPublish); ok {
+			queue.ids = append(queue.ids, identifier)
+			queue.nextId = identifier + 1
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+// Len returns the number of queued publishes.
+func (q *OfflineQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.ids)
+}
+
+// push queues a copy of pub unless the client is connected and no flush is in progress, in which case queued is false
+// and pub must be sent directly. Publishes made during a flush are queued behind the ones being sent.
+func (q *OfflineQueue) push(pub *packets.Publish, connected bool) (queued bool, err error) {
+	var expired []*packets.Publish
+	q.mutex.Lock()
+	defer func() {
+		q.mutex.Unlock()
+		q.expire(expired)
+	}()
+
+	// The flush ends under the mutex so that a publish is never left behind in the queue
+	if connected && !q.flushing {
+		return false, nil
+	}
+
+	now := time.Now()
+	if len(q.ids) >= q.capacity {
+		expired = q.dropExpired(now)
+	}
+
+	if len(q.ids) >= q.capacity {
+		if q.policy == DropNewest {
+			return false, ErrOfflineQueueFull
+		}
+
+		// Discard the oldest message
+		q.storage.Drop(q.ids[0])
+		q.ids = q.ids[1:]
+	}
+
+	// The caller may reuse pub and its payload once Publish returns
+	message := &StoredPublish{
+		Publish: new(packets.Publish),
+		Stored:  now,
+	}
+	*message.Publish = *pub
+	message.Publish.Payload = append([]byte(nil), pub.Payload...)
+
+	// Find an identifier that is not in use. One is always free as the capacity is limited to 65535.
+	for {
+		if err = q.storage.Store(q.nextId, message); err != storage.ErrDuplicateEntry {
+			break
+		}
+		q.nextId++
+	}
+	if err != nil {
+		return false, err
+	}
+
+	q.ids = append(q.ids, q.nextId)
+	q.nextId++
+
+	return true, nil
+}
+
+// dropExpired discards all messages whose message expiry interval has elapsed and returns their publishes. The caller
+// must hold the mutex.
+func (q *OfflineQueue) dropExpired(now time.Time) (expired []*packets.Publish) {
+	ids := q.ids[:0]
+	for _, id := range q.ids {
+		message, err := q.message(id)
+		if err == nil && !message.expired(now) {
+			ids = append(ids, id)
+			continue
+		}
+
+		if err == nil {
+			expired = append(expired, message.Publish)
+		}
+		q.storage.Drop(id)
+	}
+	q.ids = ids
+
+	return expired
+}
+
+// expire reports publishes discarded due to their message expiry interval.
+func (q *OfflineQueue) expire(expired []*packets.Publish) {
+	if q.expiredFn == nil {
+		return
+	}
+
+	for _, pub := range expired {
+		q.expiredFn(pub)
+	}
+}
+
+// message returns the queued message with the specified identifier. The caller must hold the mutex.
+func (q *OfflineQueue) message(id uint16) (message *StoredPublish, err error) {
+	var packet any
+	if packet, err = q.storage.Get(id); err != nil {
+		return nil, err
+	}
+
+	var ok bool
+	if message, ok = packet.(*StoredPublish); !ok {
+		return nil, ErrUnexpectedPacketTypeReceived
+	}
+	return message, nil
+}
+
+// next returns the oldest message that has not expired along with its identifier. Expired messages are discarded. ok
+// is false and the flush ends if the queue is empty.
+func (q *OfflineQueue) next(now time.Time) (id uint16, message *StoredPublish, ok bool) {
+	var expired []*packets.Publish
+	q.mutex.Lock()
+	defer func() {
+		q.mutex.Unlock()
+		q.expire(expired)
+	}()
+
+	for len(q.ids) > 0 {
+		id = q.ids[0]
+
+		var err error
+		if message, err = q.message(id); err == nil {
+			if !message.expired(now) {
+				return id, message, true
+			}
+			expired = append(expired, message.Publish)
+		}
+
+		q.storage.Drop(id)
+		q.ids = q.ids[1:]
+	}
+
+	q.flushing = false
+	return 0, nil, false
+}
+
+// remove discards the message with the specified identifier once it has been sent.
+func (q *OfflineQueue) remove(id uint16) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.ids) > 0 && q.ids[0] == id {
+		q.storage.Drop(id)
+		q.ids = q.ids[1:]
+	}
+}
+
+// SetOfflineQueue sets the queue that holds publishes while the client is disconnected. Publish queues messages
+// instead of returning ErrClientNotConnected while a queue is set. No offline queue is set by default.
+func (c *Client) SetOfflineQueue(queue *OfflineQueue) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if queue != nil {
+		queue.expiredFn = c.messageExpired
+	}
+	c.offline = queue
+}
+
+// FlushOfflineQueue sends the publishes held by the offline queue in the order they were queued. Publishes made while
+// the flush is in progress are queued behind them. Run flushes the offline queue automatically when it starts. A
+// publish that fails to send remains queued for the next flush.
+func (c *Client) FlushOfflineQueue(ctx context.Context) (err error) {
+	c.mutex.RLock()
+	queue := c.offline
+	c.mutex.RUnlock()
+
+	if queue == nil {
+		return nil
+	}
+
+	queue.mutex.Lock()
+	if queue.flushing {
+		// Another flush is already sending the queued publishes
+		queue.mutex.Unlock()
+		return nil
+	}
+	queue.flushing = true
+	queue.mutex.Unlock()
+
+	for {
+		now := time.Now()
+		id, message, ok := queue.next(now)
+		if !ok {
+			return nil
+		}
+
+		// Send a copy so that the queued message is left untouched if the publish fails
+		if err = c.publish(ctx, message.remaining(now), nil); err != nil {
+			queue.mutex.Lock()
+			queue.flushing = false
+			queue.mutex.Unlock()
+			return err
+		}
+		queue.remove(id)
+	}
+}
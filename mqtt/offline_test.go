@@ -0,0 +1,227 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage/memory"
+)
+
+func TestClient_OfflineQueueFlush(t *testing.T) {
+	c, s := newTestClient(t)
+	c.SetOfflineQueue(NewOfflineQueue(10, DropOldest))
+
+	// Publish while disconnected
+	payload := []byte("0")
+	for i := 0; i < 3; i++ {
+		payload[0] = byte('0' + i)
+		if err := c.Publish(context.Background(), &packets.Publish{Topic: "test/topic", Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := c.offline.Len(); n != 3 {
+		t.Fatalf("Len() = %d, want 3", n)
+	}
+
+	s.connect(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errChan := startRun(t, ctx, c)
+
+	// The queued publishes are sent in order once the run loop starts
+	for i := 0; i < 3; i++ {
+		header, body := s.expect(packets.PUBLISH)
+		pub := packets.Publish{Header: header}
+		if _, err := pub.DecodeFrom(body); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := string(rune('0' + i)); string(pub.Payload) != want {
+			t.Errorf("publish %d payload = %q, want %q", i, pub.Payload, want)
+		}
+	}
+
+	// Sent publishes are removed from the queue
+	for deadline := time.Now().Add(time.Second * 5); c.offline.Len() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Len() after flush = %d, want 0", c.offline.Len())
+		}
+	}
+
+	cancel()
+	waitRun(t, errChan)
+}
+
+func TestOfflineQueue_DropPolicy(t *testing.T) {
+	for _, policy := range []DropPolicy{DropOldest, DropNewest} {
+		queue := NewOfflineQueue(2, policy)
+
+		var errs []error
+		for _, payload := range []string{"a", "b", "c"} {
+			_, err := queue.push(&packets.Publish{Topic: "test/topic", Payload: []byte(payload)}, false)
+			errs = append(errs, err)
+		}
+
+		want := "ab"
+		if policy == DropOldest {
+			want = "bc"
+			if errs[2] != nil {
+				t.Errorf("push() with DropOldest = %v, want nil", errs[2])
+			}
+		} else if !errors.Is(errs[2], ErrOfflineQueueFull) {
+			t.Errorf("push() with DropNewest = %v, want %v", errs[2], ErrOfflineQueueFull)
+		}
+
+		var got string
+		for _, id := range queue.ids {
+			message, err := queue.message(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got += string(message.Publish.Payload)
+		}
+
+		if got != want {
+			t.Errorf("policy %d queued %q, want %q", policy, got, want)
+		}
+	}
+}
+
+func TestOfflineQueue_Expiry(t *testing.T) {
+	queue := NewOfflineQueue(2, DropNewest)
+
+	for _, interval := range []uint32{1, 0} {
+		pub := &packets.Publish{Topic: "test/topic", MessageExpiryInterval: primitives.PrimitiveUint32(interval)}
+		if _, err := queue.push(pub, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Expired messages are discarded to make room for new ones
+	later := time.Now().Add(time.Second * 2)
+	queue.mutex.Lock()
+	queue.dropExpired(later)
+	queue.mutex.Unlock()
+
+	if n := queue.Len(); n != 1 {
+		t.Fatalf("Len() = %d, want 1", n)
+	}
+
+	if _, message, ok := queue.next(later); !ok || message.Publish.MessageExpiryInterval != 0 {
+		t.Errorf("next() = %v, %v, want the message without expiry", message, ok)
+	}
+}
+
+func TestOfflineQueue_Recover(t *testing.T) {
+	store := memory.NewStorage()
+
+	queue, err := NewOfflineQueueWithStorage(4, DropOldest, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"a", "b"} {
+		if _, err = queue.push(&packets.Publish{Topic: "test/topic", Payload: []byte(payload)}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new queue using the same storage picks up where the previous one left off
+	if queue, err = NewOfflineQueueWithStorage(4, DropOldest, store); err != nil {
+		t.Fatal(err)
+	}
+	if n := queue.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+	if _, err = queue.push(&packets.Publish{Topic: "test/topic", Payload: []byte("c")}, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := queue.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+}
+
+func TestOfflineQueue_PushWhileConnected(t *testing.T) {
+	queue := NewOfflineQueue(4, DropOldest)
+	pub := &packets.Publish{Topic: "test/topic", Payload: []byte("a")}
+
+	// Publishes are sent directly while connected unless a flush is in progress
+	if queued, err := queue.push(pub, true); queued || err != nil {
+		t.Errorf("push() while connected = %v, %v, want false, nil", queued, err)
+	}
+
+	queue.mutex.Lock()
+	queue.flushing = true
+	queue.mutex.Unlock()
+	if queued, err := queue.push(pub, true); !queued || err != nil {
+		t.Errorf("push() during a flush = %v, %v, want true, nil", queued, err)
+	}
+
+	// The flush ends once the queue is drained and later publishes are sent directly again
+	if _, _, ok := queue.next(time.Now()); !ok {
+		t.Fatal("next() found no queued message")
+	}
+	queue.remove(queue.ids[0])
+	if _, _, ok := queue.next(time.Now()); ok {
+		t.Fatal("next() found a message in the drained queue")
+	}
+	if queued, err := queue.push(pub, true); queued || err != nil {
+		t.Errorf("push() after the flush = %v, %v, want false, nil", queued, err)
+	}
+}
+
+// basicStorage hides the Range method of the storage implementation it wraps.
+type basicStorage struct {
+	storage.Storage
+}
+
+func TestOfflineQueue_StorageWithoutRange(t *testing.T) {
+	store := memory.NewStorage()
+	store.Store(1, &StoredPublish{Publish: &packets.Publish{Topic: "test/topic"}, Stored: time.Now()})
+
+	// Messages cannot be recovered without enumerating the storage, but the queue still works
+	queue, err := NewOfflineQueueWithStorage(4, DropOldest, basicStorage{store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := queue.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+
+	if _, err = queue.push(&packets.Publish{Topic: "test/topic"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := queue.Len(); n != 1 {
+		t.Errorf("Len() = %d, want 1", n)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outbound control packet priorities. Queued control packets of a lower priority value are written first while the
+// order of control packets of the same priority is preserved.
+const (
+	// priorityControl is used for acknowledgements and PINGREQ.
+	priorityControl = iota
+
+	// priorityRequest is used for SUBSCRIBE and UNSUBSCRIBE.
+	priorityRequest
+
+	// priorityBulk is used for PUBLISH and DISCONNECT. DISCONNECT shares the priority of PUBLISH so that messages
+	// queued before it are still sent.
+	priorityBulk
+
+	priorityCount
+)
+
+// maxCoalesce is the number of bytes after which the writer stops coalescing queued control packets into a single
+// write.
+const maxCoalesce = 16 * 1024
+
+/* Outbound entry states */
+const (
+	entryPending int32 = iota
+	entryAbandoned
+	entryDone
+)
+
+// outboundEntry is an encoded control packet waiting to be written. Entries are pooled so that queueing control
+// packets does not allocate.
+type outboundEntry struct {
+	buf   []byte
+	state atomic.Int32
+
+	// detached is true if no sender waits for the result of the write. The writer releases detached entries.
+	detached bool
+	done     chan error
+}
+
+var entryPool = sync.Pool{
+	New: func() any {
+		return &outboundEntry{done: make(chan error, 1)}
+	},
+}
+
+func releaseEntry(e *outboundEntry) {
+	entryPool.Put(e)
+}
+
+// outboundQueue is drained by a single writer goroutine while the run loop is active.
+type outboundQueue struct {
+	mutex  sync.Mutex
+	queues [priorityCount][]*outboundEntry
+	closed bool
+	err    error
+
+	signal chan struct{}
+	stop   chan struct{}
+
+	// batch and buf are only used by the writer
+	batch []*outboundEntry
+	buf   []byte
+}
+
+func newOutboundQueue() *outboundQueue {
+	return &outboundQueue{
+		signal: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+}
+
+// push encodes p and appends it to the queue of the specified priority.
+func (q *outboundQueue) push(p encoder, priority int, detached bool) (e *outboundEntry, err error) {
+	e = entryPool.Get().(*outboundEntry)
+	if e.buf, err = p.AppendTo(e.buf[:0]); err != nil {
+		releaseEntry(e)
+		return nil, err
+	}
+	e.detached = detached
+	e.state.Store(entryPending)
+
+	q.mutex.Lock()
+	if q.closed {
+		err = q.err
+		q.mutex.Unlock()
+		releaseEntry(e)
+		return nil, err
+	}
+	q.queues[priority] = append(q.queues[priority], e)
+	q.mutex.Unlock()
+
+	// Wake up the writer
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+
+	return e, nil
+}
+
+// send queues p and waits until it has been written or ctx is done. A control packet that has not been written by the
+// time ctx is done is dropped from the queue.
+func (q *outboundQueue) send(ctx context.Context, p encoder, priority int) (err error) {
+	var e *outboundEntry
+	if e, err = q.push(p, priority, false); err != nil {
+		return err
+	}
+
+	select {
+	case err = <-e.done:
+	case <-ctx.Done():
+		if e.state.CompareAndSwap(entryPending, entryAbandoned) {
+			// The writer releases the entry
+			return ctx.Err()
+		}
+
+		// The control packet was written in the meantime
+		err = <-e.done
+	}
+
+	releaseEntry(e)
+	return err
+}
+
+// take removes queued control packets in order of priority and coalesces them into buf until maxCoalesce is reached.
+// Control packets whose sender stopped waiting are dropped.
+func (q *outboundQueue) take() []*outboundEntry {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.batch = q.batch[:0]
+	q.buf = q.buf[:0]
+
+	for priority := range q.queues {
+		queue := q.queues[priority]
+
+		n := 0
+		for ; n < len(queue) && (len(q.buf) == 0 || len(q.buf)+len(queue[n].buf) <= maxCoalesce); n++ {
+			e := queue[n]
+			if !e.detached && e.state.Load() == entryAbandoned {
+				releaseEntry(e)
+				continue
+			}
+
+			q.buf = append(q.buf, e.buf...)
+			q.batch = append(q.batch, e)
+		}
+
+		// Shift the remaining entries to the front of the queue
+		remaining := copy(queue, queue[n:])
+		for i := remaining; i < len(queue); i++ {
+			queue[i] = nil
+		}
+		q.queues[priority] = queue[:remaining]
+
+		if remaining > 0 {
+			// The batch is full
+			break
+		}
+	}
+
+	return q.batch
+}
+
+// complete reports the result of writing e to its sender.
+func (q *outboundQueue) complete(e *outboundEntry, err error) {
+	if !e.detached && e.state.CompareAndSwap(entryPending, entryDone) {
+		e.done <- err
+		return
+	}
+
+	// Nobody is waiting for the result
+	releaseEntry(e)
+}
+
+// run writes queued control packets to conn until the queue is closed or a write fails.
+func (q *outboundQueue) run(conn net.Conn, lastSent *atomic.Int64) error {
+	// Deadlines are handled per operation by the senders
+	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+		q.close(err)
+		return err
+	}
+
+	for {
+		select {
+		case <-q.stop:
+			return nil
+		case <-q.signal:
+		}
+
+		for batch := q.take(); len(batch) > 0; batch = q.take() {
+			_, err := conn.Write(q.buf)
+			for _, e := range batch {
+				q.complete(e, err)
+			}
+
+			if err != nil {
+				q.close(err)
+				return err
+			}
+			lastSent.Store(time.Now().UnixNano())
+		}
+	}
+}
+
+// close stops the writer and fails all queued control packets with err.
+func (q *outboundQueue) close(err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.err = err
+	close(q.stop)
+
+	for priority, queue := range q.queues {
+		for _, e := range queue {
+			q.complete(e, err)
+		}
+		q.queues[priority] = nil
+	}
+}
+
+// write sends the control packet. While the run loop is active, the control packet is queued for the writer goroutine
+// and write returns once it has been written or ctx is done. Otherwise, it is written directly using the deadline of ctx
+// as the write deadline.
+func (c *Client) write(ctx context.Context, p encoder, priority int) (err error) {
+	if q := c.outbound.Load(); q != nil {
+		return q.send(ctx, p, priority)
+	}
+
+	var deadline time.Time
+	var ok bool
+	if deadline, ok = ctx.Deadline(); !ok {
+		deadline = time.Time{}
+	}
+
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
+	// Set I/O deadline
+	if err = c.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+
+	// Stop writing once ctx is done
+	defer interruptOnDone(ctx, c.conn, true)()
+
+	return c.send(p)
+}
+
+// writeControl sends an acknowledgement without waiting for it to be written while the run loop is active. Otherwise,
+// it is written directly and the caller must hold connMutex.
+func (c *Client) writeControl(ctx context.Context, p encoder) (err error) {
+	if q := c.outbound.Load(); q != nil {
+		_, err = q.push(p, priorityControl, true)
+		return err
+	}
+
+	var deadline time.Time
+	var ok bool
+	if deadline, ok = ctx.Deadline(); !ok {
+		deadline = time.Time{}
+	}
+
+	// Set I/O deadline
+	if err = c.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+
+	// Stop writing once ctx is done
+	defer interruptOnDone(ctx, c.conn, true)()
+
+	return c.send(p)
+}
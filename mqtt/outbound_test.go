@@ -0,0 +1,234 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// recordingConn records every call to Write.
+type recordingConn struct {
+	net.Conn
+	mutex  sync.Mutex
+	writes [][]byte
+	signal chan struct{}
+}
+
+func newRecordingConn() *recordingConn {
+	return &recordingConn{signal: make(chan struct{}, 16)}
+}
+
+func (r *recordingConn) Write(b []byte) (int, error) {
+	r.mutex.Lock()
+	r.writes = append(r.writes, append([]byte{}, b...))
+	r.mutex.Unlock()
+	r.signal <- struct{}{}
+	return len(b), nil
+}
+
+func (r *recordingConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (r *recordingConn) wait(t *testing.T) [][]byte {
+	select {
+	case <-r.signal:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for a write")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.writes
+}
+
+func encode(t *testing.T, p encoder) []byte {
+	buf, err := p.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestOutboundQueue_PriorityAndCoalescing(t *testing.T) {
+	q := newOutboundQueue()
+
+	publish := &packets.Publish{Topic: "test/topic", Payload: []byte("bulk")}
+	unsubscribe := &packets.Unsubscribe{PacketIdentifier: 2, Topics: []packets.Topic{{}}}
+	unsubscribe.Topics[0].SetFilter("test/topic")
+	puback := &packets.Puback{PacketIdentifier: 1}
+
+	// Queue the control packets in reverse order of priority before the writer starts
+	for _, item := range []struct {
+		p        encoder
+		priority int
+	}{{publish, priorityBulk}, {unsubscribe, priorityRequest}, {puback, priorityControl}} {
+		if _, err := q.push(item.p, item.priority, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := newRecordingConn()
+	var lastSent atomic.Int64
+	go q.run(conn, &lastSent)
+	defer q.close(ErrClientStopped)
+
+	writes := conn.wait(t)
+	if len(writes) != 1 {
+		t.Fatalf("queued control packets were written with %d writes, want 1", len(writes))
+	}
+
+	var want []byte
+	want = append(want, encode(t, puback)...)
+	want = append(want, encode(t, unsubscribe)...)
+	want = append(want, encode(t, publish)...)
+	if !bytes.Equal(writes[0], want) {
+		t.Errorf("Write() = %x, want %x", writes[0], want)
+	}
+
+	if lastSent.Load() == 0 {
+		t.Error("writer did not record the time of the write")
+	}
+}
+
+func TestOutboundQueue_CoalesceLimit(t *testing.T) {
+	q := newOutboundQueue()
+
+	publish := &packets.Publish{Topic: "test/topic", Payload: make([]byte, maxCoalesce/2)}
+	for i := 0; i < 3; i++ {
+		if _, err := q.push(publish, priorityBulk, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := q.take()
+	if len(batch) != 1 {
+		t.Fatalf("take() returned %d control packets, want 1", len(batch))
+	}
+	if len(q.buf) > maxCoalesce {
+		t.Errorf("take() coalesced %d bytes, want at most %d", len(q.buf), maxCoalesce)
+	}
+}
+
+func TestOutboundQueue_Cancel(t *testing.T) {
+	q := newOutboundQueue()
+
+	// The writer is not running yet so the control packet stays queued until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := q.send(ctx, &packets.Publish{Topic: "dropped"}, priorityBulk); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("send() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	conn := newRecordingConn()
+	var lastSent atomic.Int64
+	go q.run(conn, &lastSent)
+	defer q.close(ErrClientStopped)
+
+	// Only the control packet sent after the cancelled one may be written
+	pingreq := &packets.Pingreq{}
+	if err := q.send(context.Background(), pingreq, priorityControl); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := conn.wait(t)
+	if len(writes) != 1 || !bytes.Equal(writes[0], encode(t, pingreq)) {
+		t.Errorf("writes = %x, want only PINGREQ", writes)
+	}
+}
+
+func TestOutboundQueue_Close(t *testing.T) {
+	q := newOutboundQueue()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- q.send(context.Background(), &packets.Pingreq{}, priorityControl)
+	}()
+
+	// Wait for the control packet to be queued
+	for {
+		q.mutex.Lock()
+		queued := len(q.queues[priorityControl])
+		q.mutex.Unlock()
+
+		if queued > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	q.close(ErrClientStopped)
+	if err := <-errChan; !errors.Is(err, ErrClientStopped) {
+		t.Errorf("send() = %v, want %v", err, ErrClientStopped)
+	}
+
+	if _, err := q.push(&packets.Pingreq{}, priorityControl, true); !errors.Is(err, ErrClientStopped) {
+		t.Errorf("push() after close = %v, want %v", err, ErrClientStopped)
+	}
+}
+
+func TestClient_RunConcurrentSubscribe(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := startRun(t, ctx, c)
+
+	// Pending subscriptions are registered while the run loop delivers acknowledgements
+	const subscribers = 2
+	errChan := make(chan error, subscribers)
+	for i := 0; i < subscribers; i++ {
+		go func(filter string) {
+			topic := Topic{}
+			topic.SetFilter(filter)
+			errChan <- c.Subscribe(ctx, []Topic{topic})
+		}(fmt.Sprintf("test/topic/%d", i))
+	}
+
+	for i := 0; i < subscribers; i++ {
+		s.suback()
+	}
+	for i := 0; i < subscribers; i++ {
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+	if err := waitRun(t, runErr); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
@@ -35,159 +35,151 @@ type Auth struct {
 
 	/* Properties */
 	AuthenticationMethod primitives.PrimitiveString
-	AuthenticationData   primitives.PrimitiveString
+	AuthenticationData   primitives.PrimitiveBinary
 	ReasonString         primitives.PrimitiveString
-	UserProperties       primitives.PrimitiveStringMap
+	UserProperties       primitives.PrimitiveStringPairs
 }
 
 func (a *Auth) ReadFrom(r io.Reader) (n int64, err error) {
-	var count int64
+	return readFrom(r, a.Header.Remaining, a.DecodeFrom)
+}
 
-	// Read the reason code
-	if _, err = a.AuthenticateReasonCode.ReadFrom(r); err != nil {
+// DecodeFrom decodes the variable header of the AUTH control packet from src. The fixed header must already be set.
+func (a *Auth) DecodeFrom(src []byte) (n int, err error) {
+	var count int
+	if src, err = body(a.Header, src); err != nil {
+		return 0, err
+	}
+
+	// SPEC: The Reason Code and Property Length can be omitted if the Reason Code is 0x00 (Success) and there are no
+	//       Properties. In this case the AUTH has a Remaining Length of 0.
+	if len(src) == 0 {
 		return
 	}
-	n++
 
-	if n >= int64(a.Header.Remaining) {
+	// Read the reason code
+	if n, err = a.AuthenticateReasonCode.DecodeFrom(src); err != nil {
+		return 0, fieldError(AUTH, "Reason Code", err)
+	}
+
+	if n >= len(src) {
 		return
 	}
 
 	// Read the properties
 	var propertiesLen primitives.VariableByteInt
-	if count, err = propertiesLen.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = propertiesLen.DecodeFrom(src[n:]); err != nil {
+		return 0, fieldError(AUTH, "Property Length", err)
 	}
 	n += count
 
-	if n >= int64(a.Header.Remaining) {
-		return
+	end := n + int(propertiesLen)
+	if end > len(src) {
+		return 0, fieldError(AUTH, "Property Length", ErrControlPacketIsMalformed)
 	}
 
-	remaining := int64(propertiesLen)
-	for remaining > 0 {
+	seen := propertySet{strict: a.Header.Strict}
+	for n < end {
 		// Read the identifier byte
-		var identifier byte
-		if identifier, err = primitives.ReadByte(r); err != nil {
+		identifier := src[n]
+		n++
+
+		if err = seen.add(AUTH, identifier); err != nil {
 			return 0, err
 		}
-		n++
-		remaining--
 
 		switch identifier {
 		case 0x15: // Authentication Method
-			if count, err = a.AuthenticationMethod.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = a.AuthenticationMethod.DecodeFrom(src[n:end])
 		case 0x16: // Authentication Data
-			if count, err = a.AuthenticationData.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = a.AuthenticationData.DecodeFrom(src[n:end])
 		case 0x1F: // Reason String
-			if count, err = a.ReasonString.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = a.ReasonString.DecodeFrom(src[n:end])
 		case 0x26: // User Property
-			if a.UserProperties == nil {
-				a.UserProperties = make(primitives.PrimitiveStringMap)
-			}
-			var k, v primitives.PrimitiveString
-			if count, err = k.ReadFrom(r); err != nil {
-				return 0, err
-			}
-
-			var count2 int64
-			if count2, err = v.ReadFrom(r); err != nil {
-				return 0, err
-			}
-			count += count2
-			a.UserProperties[k] = v
+			count, err = a.UserProperties.DecodeFrom(src[n:end])
+		default:
+			// Skip over properties that are not allowed for this packet type
+			count, err = skipProperty(identifier, src[n:end])
+		}
+
+		if err != nil {
+			return 0, propertyError(AUTH, identifier, err)
 		}
 		n += count
-		remaining -= count
+	}
+
+	if err = checkRemaining(AUTH, a.Header.Strict, n, src); err != nil {
+		return 0, err
 	}
 
 	return
 }
 
 func (a *Auth) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, a.AppendTo)
+}
+
+// AppendTo appends the encoded AUTH control packet to dst and returns the extended slice.
+func (a *Auth) AppendTo(dst []byte) ([]byte, error) {
 	variableHeaderLen := primitives.VariableByteInt(0)
 	propertiesLen := primitives.VariableByteInt(0)
 
-	// Calculate remaining length
-	// SPEC: The Reason Code and Property Length can be omitted if the Reason Code is 0x00 (Success) and there are no
-	//       Properties. In this case the AUTH has a Remaining Length of 0.
-	if a.AuthenticateReasonCode != 0 {
-		variableHeaderLen++
+	if err := validateStringProperty(AUTH, 0x15, a.AuthenticationMethod); err != nil {
+		return dst, err
 	}
 
-	if len(a.AuthenticationMethod) > 0 {
-		l := primitives.VariableByteInt(len(a.AuthenticationMethod))
-		propertiesLen += 3 + l
+	if err := validateStringProperty(AUTH, 0x1F, a.ReasonString); err != nil {
+		return dst, err
 	}
 
-	if len(a.AuthenticationData) > 0 {
-		l := primitives.VariableByteInt(len(a.AuthenticationData))
-		propertiesLen += 3 + l
+	if err := validateUserProperties(AUTH, a.UserProperties); err != nil {
+		return dst, err
 	}
 
-	if len(a.ReasonString) > 0 {
-		l := primitives.VariableByteInt(len(a.ReasonString))
-		propertiesLen += 3 + l
+	// Calculate remaining length
+	if len(a.AuthenticationMethod) > 0 {
+		propertiesLen += a.AuthenticationMethod.Length(true)
+		propertiesLen += a.AuthenticationData.Length(true)
 	}
 
-	for k, v := range a.UserProperties {
-		propertiesLen += 1 + k.Length(false) + v.Length(false)
+	if len(a.ReasonString) > 0 {
+		propertiesLen += a.ReasonString.Length(true)
 	}
 
-	variableHeaderLen += propertiesLen
+	propertiesLen += a.UserProperties.Length(true)
+
+	// SPEC: The Reason Code and Property Length can be omitted if the Reason Code is 0x00 (Success) and there are no
+	//       Properties. In this case the AUTH has a Remaining Length of 0.
+	omit := a.AuthenticateReasonCode == 0 && propertiesLen == 0
+	if !omit {
+		variableHeaderLen += a.AuthenticateReasonCode.Length(false) + propertiesLen.Length(false) + propertiesLen
+	}
 
 	a.Header.SetType(AUTH)
 	a.Header.Remaining = variableHeaderLen
+	dst = a.Header.AppendTo(dst)
 
-	var count int64
-	if n, err = a.Header.WriteTo(w); err != nil {
-		return 0, err
+	if omit {
+		return dst, nil
 	}
 
+	dst = a.AuthenticateReasonCode.AppendTo(dst)
+
 	/* Properties begin */
-	if len(a.AuthenticationMethod) > 0 {
-		if count, err = a.AuthenticationMethod.WriteToAsProperty(0x15, w); err != nil {
-			return 0, err
-		}
-		n += count
+	dst = propertiesLen.AppendTo(dst)
 
-		if count, err = a.AuthenticationData.WriteToAsProperty(0x16, w); err != nil {
-			return 0, err
-		}
-		n += count
+	if len(a.AuthenticationMethod) > 0 {
+		dst = a.AuthenticationMethod.AppendToAsProperty(0x15, dst)
+		dst = a.AuthenticationData.AppendToAsProperty(0x16, dst)
 	}
 
 	if len(a.ReasonString) > 0 {
-		if count, err = a.ReasonString.WriteToAsProperty(0x1F, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = a.ReasonString.AppendToAsProperty(0x1F, dst)
 	}
 
 	// Write user properties
-	for k, v := range a.UserProperties {
-		if err = primitives.WriteByte(0x26, w); err != nil {
-			return 0, err
-		}
-		n++
-
-		if count, err = k.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-
-		if count, err = v.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-	}
+	dst = a.UserProperties.AppendToAsProperty(0x26, dst)
 	/* Properties end */
 
-	return
+	return dst, nil
 }
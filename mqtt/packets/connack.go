@@ -45,7 +45,7 @@ type Connack struct {
 	ClientId                primitives.PrimitiveString
 	TopicAliasMaximum       primitives.PrimitiveUint16
 	ReasonString            primitives.PrimitiveString
-	UserProperties          primitives.PrimitiveStringMap
+	UserProperties          primitives.PrimitiveStringPairs
 	WildcardSubscriptions   primitives.PrimitiveByte
 	SubscriptionIdentifiers primitives.PrimitiveByte
 	SharedSubscriptions     primitives.PrimitiveByte
@@ -53,31 +53,55 @@ type Connack struct {
 	ResponseInformation     primitives.PrimitiveString
 	ServerReference         primitives.PrimitiveString
 	AuthenticationMethod    primitives.PrimitiveString
-	AuthenticationData      primitives.PrimitiveString
+	AuthenticationData      primitives.PrimitiveBinary
 }
 
 func (c *Connack) ReadFrom(r io.Reader) (n int64, err error) {
-	var count int64
+	return readFrom(r, c.Header.Remaining, c.DecodeFrom)
+}
+
+// DecodeFrom decodes the variable header and properties of the CONNACK control packet from src. The fixed header must
+// already be set.
+func (c *Connack) DecodeFrom(src []byte) (n int, err error) {
+	var count int
+	if src, err = body(c.Header, src); err != nil {
+		return 0, err
+	}
 
 	/* Variable header begin */
 	// Connect acknowledgement flags
-	if count, err = c.Flags.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = c.Flags.DecodeFrom(src); err != nil {
+		return 0, fieldError(CONNACK, "Connect Acknowledge Flags", err)
 	}
 	n += count
 
+	// SPEC: Bits 7-1 are reserved and MUST be set to 0 [MQTT-3.2.2-1].
+	if c.Header.Strict && c.Flags&0xFE != 0 {
+		return 0, fieldError(CONNACK, "Connect Acknowledge Flags", ErrControlPacketIsMalformed)
+	}
+
 	c.SessionPresent = (c.Flags & 0x01) != 0
 
-	if n >= int64(c.Header.Remaining) {
+	// Features that the server does not declare are available
+	// SPEC: If not present, then Retained Messages are supported.
+	// SPEC: If not present, then Wildcard Subscriptions are supported.
+	// SPEC: If not present, then Subscription Identifiers are supported.
+	// SPEC: If not present, then Shared Subscriptions are supported.
+	c.RetainAvailable = 1
+	c.WildcardSubscriptions = 1
+	c.SubscriptionIdentifiers = 1
+	c.SharedSubscriptions = 1
+
+	if n >= len(src) {
 		return
 	}
 
-	if count, err = c.ReasonCode.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = c.ReasonCode.DecodeFrom(src[n:]); err != nil {
+		return 0, fieldError(CONNACK, "Reason Code", err)
 	}
 	n += count
 
-	if n >= int64(c.Header.Remaining) {
+	if n >= len(src) {
 		return
 	}
 
@@ -85,112 +109,76 @@ func (c *Connack) ReadFrom(r io.Reader) (n int64, err error) {
 
 	/* Properties begin */
 	var propertiesLen primitives.VariableByteInt
-	if count, err = propertiesLen.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = propertiesLen.DecodeFrom(src[n:]); err != nil {
+		return 0, fieldError(CONNACK, "Property Length", err)
 	}
 	n += count
 
-	if n >= int64(c.Header.Remaining) {
-		return
+	end := n + int(propertiesLen)
+	if end > len(src) {
+		return 0, fieldError(CONNACK, "Property Length", ErrControlPacketIsMalformed)
 	}
 
-	remaining := int64(propertiesLen)
-
-	for remaining > 0 {
+	seen := propertySet{strict: c.Header.Strict}
+	for n < end {
 		// Read the identifier byte
-		var identifier byte
-		if identifier, err = primitives.ReadByte(r); err != nil {
+		identifier := src[n]
+		n++
+
+		if err = seen.add(CONNACK, identifier); err != nil {
 			return 0, err
 		}
-		n++
-		remaining--
 
 		switch identifier {
 		case 0x11: // Session Expiry Interval
-			if count, err = c.SessionExpiryInterval.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.SessionExpiryInterval.DecodeFrom(src[n:end])
 		case 0x21: // Receive Maximum
-			if count, err = c.ReceiveMaximum.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.ReceiveMaximum.DecodeFrom(src[n:end])
 		case 0x24: // Maximum QoS
-			if count, err = c.MaximumQoS.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.MaximumQoS.DecodeFrom(src[n:end])
 		case 0x25: // Retain Available
-			if count, err = c.RetainAvailable.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.RetainAvailable.DecodeFrom(src[n:end])
 		case 0x27: // Maximum Packet Size
-			if count, err = c.MaximumPacketSize.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.MaximumPacketSize.DecodeFrom(src[n:end])
 		case 0x12: // Assigned Client Identifier
-			if count, err = c.ClientId.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.ClientId.DecodeFrom(src[n:end])
 		case 0x22: // Topic Alias Maximum
-			if count, err = c.TopicAliasMaximum.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.TopicAliasMaximum.DecodeFrom(src[n:end])
 		case 0x1F: // Reason String
-			if count, err = c.ReasonString.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.ReasonString.DecodeFrom(src[n:end])
 		case 0x26: // User Property
-			if c.UserProperties == nil {
-				c.UserProperties = make(primitives.PrimitiveStringMap)
-			}
-			var k, v primitives.PrimitiveString
-			if count, err = k.ReadFrom(r); err != nil {
-				return 0, err
-			}
-
-			var count2 int64
-			if count2, err = v.ReadFrom(r); err != nil {
-				return 0, err
-			}
-			count += count2
-			c.UserProperties[k] = v
+			count, err = c.UserProperties.DecodeFrom(src[n:end])
 		case 0x28: // Wildcard Subscription Available
-			if count, err = c.WildcardSubscriptions.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.WildcardSubscriptions.DecodeFrom(src[n:end])
 		case 0x29: // Subscription Identifiers Available
-			if count, err = c.SubscriptionIdentifiers.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.SubscriptionIdentifiers.DecodeFrom(src[n:end])
 		case 0x2A: // Shared Subscription Available
-			if count, err = c.SharedSubscriptions.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.SharedSubscriptions.DecodeFrom(src[n:end])
 		case 0x13: // Server Keep Alive
-			if count, err = c.ServerKeepAlive.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.ServerKeepAlive.DecodeFrom(src[n:end])
 		case 0x1A: // Response Information
-			if count, err = c.ResponseInformation.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.ResponseInformation.DecodeFrom(src[n:end])
 		case 0x1C: // Server Reference
-			if count, err = c.ServerReference.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.ServerReference.DecodeFrom(src[n:end])
 		case 0x15: // Authentication Method
-			if count, err = c.AuthenticationMethod.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.AuthenticationMethod.DecodeFrom(src[n:end])
 		case 0x16: // Authentication Data
-			if count, err = c.AuthenticationData.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = c.AuthenticationData.DecodeFrom(src[n:end])
+		default:
+			// Skip over properties that are not allowed for this packet type
+			count, err = skipProperty(identifier, src[n:end])
+		}
+
+		if err != nil {
+			return 0, propertyError(CONNACK, identifier, err)
 		}
 		n += count
-		remaining -= count
 	}
-
-	n += int64(c.Header.Remaining)
 	/* Properties end */
+
+	if err = checkRemaining(CONNACK, c.Header.Strict, n, src); err != nil {
+		return 0, err
+	}
+
 	return
 }
@@ -38,7 +38,16 @@ const (
 	MQTT31  ProtocolVersion = 3
 )
 
+// protocolName returns the protocol name sent in the variable header of the CONNECT control packet.
+func (v ProtocolVersion) protocolName() primitives.PrimitiveString {
+	if v == MQTT31 {
+		return "MQIsdp"
+	}
+	return "MQTT"
+}
+
 type Connect struct {
+	Header       FixedHeader
 	Version      ProtocolVersion
 	CleanSession bool
 	KeepAlive    primitives.PrimitiveUint16
@@ -46,18 +55,9 @@ type Connect struct {
 	Username     primitives.PrimitiveString
 	Password     primitives.PrimitiveString
 
-	WillRetain bool
-	WillQos    QoS
-	Will       primitives.PrimitiveString
-	WillTopic  primitives.PrimitiveString
-
-	/* Will properties */
-	WillDelayInterval         primitives.PrimitiveUint32
-	WillMessageExpiryInterval primitives.PrimitiveUint32
-	WillContentType           primitives.PrimitiveString
-	WillResponseTopic         primitives.PrimitiveString
-	WillCorrelationData       primitives.PrimitiveString
-	WillUserProperties        primitives.PrimitiveStringMap
+	// Will is the Will Message published by the server if the network connection is closed unexpectedly. No Will
+	// Message is sent if Will is nil.
+	Will *Will
 
 	/* Variable header properties */
 	RequestResponseInformation primitives.PrimitiveByte
@@ -66,18 +66,55 @@ type Connect struct {
 	TopicAliasMaximum          primitives.PrimitiveUint16
 	SessionExpiryInterval      primitives.PrimitiveUint32
 	MaximumPacketSize          primitives.PrimitiveUint32
-	UserProperties             primitives.PrimitiveStringMap
+	UserProperties             primitives.PrimitiveStringPairs
 	AuthenticationMethod       primitives.PrimitiveString
-	AuthenticationData         primitives.PrimitiveString
+	AuthenticationData         primitives.PrimitiveBinary
+}
+
+// SetWill sets the Will Message that is published to topic if the network connection is closed unexpectedly. The Will
+// Message is returned so that its QoS, retain flag and properties can be set.
+func (c *Connect) SetWill(topic string, payload []byte) *Will {
+	c.Will = NewWill(topic, payload)
+	return c.Will
 }
 
 func (c *Connect) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, c.AppendTo)
+}
+
+// AppendTo appends the encoded CONNECT control packet to dst and returns the extended slice.
+func (c *Connect) AppendTo(dst []byte) ([]byte, error) {
 	var flags primitives.PrimitiveByte
-	variableHeaderLen := primitives.VariableByteInt(11)
+	protocolName := c.Version.protocolName()
+	variableHeaderLen := protocolName.Length(false) + 4 // Protocol Version, Connect Flags and Keep Alive
 	propertiesLen := primitives.VariableByteInt(0)
 	willPropertiesLen := primitives.VariableByteInt(0)
 	payloadLen := c.ClientId.Length(false)
 
+	// Properties were introduced by MQTT 5
+	properties := c.Version >= MQTT5
+
+	if err := c.ClientId.Validate(); err != nil {
+		return dst, fieldError(CONNECT, "Client Identifier", err)
+	}
+
+	if err := c.Username.Validate(); err != nil {
+		return dst, fieldError(CONNECT, "User Name", err)
+	}
+
+	// The password is Binary Data and is only limited in length
+	if len(c.Password) > 65535 {
+		return dst, fieldError(CONNECT, "Password", primitives.ErrStringTooLong)
+	}
+
+	if err := validateUserProperties(CONNECT, c.UserProperties); err != nil {
+		return dst, err
+	}
+
+	if err := validateStringProperty(CONNECT, 0x15, c.AuthenticationMethod); err != nil {
+		return dst, err
+	}
+
 	// Calculate length of properties and payload
 	if c.SessionExpiryInterval > 0 {
 		propertiesLen += c.SessionExpiryInterval.Length(true)
@@ -103,16 +140,16 @@ func (c *Connect) WriteTo(w io.Writer) (n int64, err error) {
 		propertiesLen += c.RequestProblemInformation.Length(true)
 	}
 
-	for k, v := range c.UserProperties {
-		propertiesLen += 1 + k.Length(false) + v.Length(false)
-	}
+	propertiesLen += c.UserProperties.Length(true)
 
 	if len(c.AuthenticationMethod) > 0 {
 		propertiesLen += c.AuthenticationMethod.Length(true)
 		propertiesLen += c.AuthenticationData.Length(true)
 	}
 
-	variableHeaderLen += propertiesLen
+	if properties {
+		variableHeaderLen += propertiesLen.Length(false) + propertiesLen
+	}
 
 	// Set flags bits
 	if c.CleanSession {
@@ -132,272 +169,321 @@ func (c *Connect) WriteTo(w io.Writer) (n int64, err error) {
 		payloadLen += c.Password.Length(false)
 	}
 
-	if len(c.Will) > 0 {
+	if c.Will != nil {
+		if err := c.Will.validate(); err != nil {
+			return dst, err
+		}
+
 		// Set bit 2
 		flags |= 1 << 2
 
-		if c.WillRetain {
+		if c.Will.Retain {
 			// Set bit 5
 			flags |= 1 << 5
 		}
 
 		// Will QoS is bits 4 and 3
-		flags |= primitives.PrimitiveByte(c.WillQos) << 3
+		flags |= primitives.PrimitiveByte(c.Will.QoS) << 3
+
+		// The will properties, will topic and will payload are actually a part of the payload
+		if properties {
+			willPropertiesLen = c.Will.propertiesLength()
+			payloadLen += willPropertiesLen.Length(false) + willPropertiesLen
+		}
+		payloadLen += c.Will.Topic.Length(false)
+		payloadLen += c.Will.Payload.Length(false)
+	}
+
+	/* Fixed header begin */
+	c.Header = FixedHeader{
+		Remaining: variableHeaderLen + payloadLen,
+	}
+	c.Header.SetType(CONNECT)
+	dst = c.Header.AppendTo(dst)
+	/* Fixed header end */
 
-		// The will and will topic are actually a part of the payload
-		payloadLen += 1 + c.Will.Length(false) // Includes byte for payload property indicator
-		payloadLen += c.WillTopic.Length(false)
+	/* Variable header begin */
+	dst = protocolName.AppendTo(dst)
 
-		if c.WillDelayInterval > 0 {
-			willPropertiesLen += c.WillDelayInterval.Length(true)
+	version := primitives.PrimitiveByte(c.Version)
+	dst = version.AppendTo(dst)
+	dst = flags.AppendTo(dst)
+	dst = c.KeepAlive.AppendTo(dst)
+
+	if properties {
+		dst = propertiesLen.AppendTo(dst)
+
+		if c.SessionExpiryInterval > 0 {
+			dst = c.SessionExpiryInterval.AppendToAsProperty(0x11, dst)
 		}
 
-		if c.WillMessageExpiryInterval > 0 {
-			willPropertiesLen += c.WillMessageExpiryInterval.Length(true)
+		if c.ReceiveMaximum > 0 {
+			dst = c.ReceiveMaximum.AppendToAsProperty(0x21, dst)
 		}
 
-		if len(c.WillContentType) > 0 {
-			willPropertiesLen += c.WillContentType.Length(true)
+		if c.MaximumPacketSize > 0 {
+			dst = c.MaximumPacketSize.AppendToAsProperty(0x27, dst)
 		}
 
-		if len(c.WillResponseTopic) > 0 {
-			willPropertiesLen += c.WillResponseTopic.Length(true)
+		if c.TopicAliasMaximum > 0 {
+			dst = c.TopicAliasMaximum.AppendToAsProperty(0x22, dst)
 		}
 
-		if len(c.WillCorrelationData) > 0 {
-			willPropertiesLen += c.WillCorrelationData.Length(true)
+		if c.RequestResponseInformation > 0 {
+			dst = c.RequestResponseInformation.AppendToAsProperty(0x19, dst)
 		}
 
-		for k, v := range c.WillUserProperties {
-			willPropertiesLen += 1 + k.Length(false) + v.Length(false)
+		if c.RequestProblemInformation > 0 {
+			dst = c.RequestProblemInformation.AppendToAsProperty(0x17, dst)
 		}
-	}
 
-	payloadLen += willPropertiesLen
+		dst = c.UserProperties.AppendToAsProperty(0x26, dst)
 
-	/* Fixed header begin */
-	fh := FixedHeader{
-		Remaining: variableHeaderLen + payloadLen,
+		if len(c.AuthenticationMethod) > 0 {
+			dst = c.AuthenticationMethod.AppendToAsProperty(0x15, dst)
+			dst = c.AuthenticationData.AppendToAsProperty(0x16, dst)
+		}
 	}
-	fh.SetType(CONNECT)
+	/* Variable header end */
 
-	var count int64
-	if n, err = fh.WriteTo(w); err != nil {
-		return 0, err
-	}
+	/* Payload start */
+	dst = c.ClientId.AppendTo(dst)
 
-	/* Fixed header end */
+	// SPEC: If the Will Flag is set to 1, the Will Properties is the next field in the Payload.
+	//       [3.1.3.2 Will Properties]
+	if c.Will != nil {
+		if properties {
+			dst = c.Will.appendProperties(willPropertiesLen, dst)
+		}
 
-	/* Variable header begin */
-	protocolName := primitives.PrimitiveString("MQTT")
-	if count, err = protocolName.WriteTo(w); err != nil {
-		return 0, err
+		// Will topic
+		dst = c.Will.Topic.AppendTo(dst)
+
+		// Will payload
+		dst = c.Will.Payload.AppendTo(dst)
 	}
-	n += count
 
-	version := primitives.PrimitiveByte(c.Version)
-	if count, err = version.WriteTo(w); err != nil {
-		return 0, err
+	// User name
+	if len(c.Username) > 0 {
+		dst = c.Username.AppendTo(dst)
 	}
-	n += count
 
-	if count, err = flags.WriteTo(w); err != nil {
-		return 0, err
+	// Password
+	if len(c.Password) > 0 {
+		dst = c.Password.AppendTo(dst)
 	}
-	n += count
+	/* Payload end */
 
-	if count, err = c.KeepAlive.WriteTo(w); err != nil {
-		return 0, err
+	return dst, nil
+}
+
+func (c *Connect) ReadFrom(r io.Reader) (n int64, err error) {
+	// Read the header from the reader if it has not been initialized
+	if c.Header.GetType() == 0 {
+		if n, err = c.Header.ReadFrom(r); err != nil {
+			return
+		}
 	}
-	n += count
 
-	if count, err = propertiesLen.WriteTo(w); err != nil {
+	var count int64
+	if count, err = readFrom(r, c.Header.Remaining, c.DecodeFrom); err != nil {
 		return 0, err
 	}
 	n += count
 
-	if c.SessionExpiryInterval > 0 {
-		if count, err = c.SessionExpiryInterval.WriteToAsProperty(0x11, w); err != nil {
+	return
+}
+
+// DecodeFrom decodes the CONNECT control packet from src. The fixed header is decoded from src first if it has not been
+// set.
+func (c *Connect) DecodeFrom(src []byte) (n int, err error) {
+	var count, i int
+
+	// Decode the header if it has not been initialized
+	if c.Header.GetType() == 0 {
+		if n, err = c.Header.DecodeFrom(src); err != nil {
 			return 0, err
 		}
-		n += count
 	}
 
-	if c.ReceiveMaximum > 0 {
-		if count, err = c.ReceiveMaximum.WriteToAsProperty(0x21, w); err != nil {
-			return 0, err
-		}
-		n += count
+	if src, err = body(c.Header, src[n:]); err != nil {
+		return 0, err
 	}
 
-	if c.MaximumPacketSize > 0 {
-		if count, err = c.MaximumPacketSize.WriteToAsProperty(0x27, w); err != nil {
-			return 0, err
-		}
-		n += count
+	/* Variable header begin */
+	var protocolName primitives.PrimitiveString
+	if count, err = protocolName.DecodeFrom(src); err != nil {
+		return 0, fieldError(CONNECT, "Protocol Name", err)
 	}
+	i += count
 
-	if c.TopicAliasMaximum > 0 {
-		if count, err = c.TopicAliasMaximum.WriteToAsProperty(0x12, w); err != nil {
-			return 0, err
-		}
-		n += count
+	var version primitives.PrimitiveByte
+	if count, err = version.DecodeFrom(src[i:]); err != nil {
+		return 0, fieldError(CONNECT, "Protocol Version", err)
+	}
+	i += count
+	c.Version = ProtocolVersion(version)
+
+	// SPEC: If the Protocol Version is not 5 and the Server does not want to accept the CONNECT packet, the Server MAY
+	//       send a CONNACK packet with Reason Code 0x84 (Unsupported Protocol Version) and then MUST close the Network
+	//       Connection [MQTT-3.1.2-2].
+	if c.Version < MQTT31 || c.Version > MQTT5 {
+		return 0, fieldError(CONNECT, "Protocol Version", ReasonCode(0x84))
 	}
 
-	if c.RequestResponseInformation > 0 {
-		if count, err = c.RequestResponseInformation.WriteToAsProperty(0x19, w); err != nil {
-			return 0, err
-		}
-		n += count
+	// SPEC: The protocol name is a UTF-8 Encoded String that represents the protocol name "MQTT".
+	if protocolName != c.Version.protocolName() {
+		return 0, fieldError(CONNECT, "Protocol Name", ErrControlPacketIsMalformed)
 	}
 
-	if c.RequestProblemInformation > 0 {
-		if count, err = c.RequestProblemInformation.WriteToAsProperty(0x19, w); err != nil {
-			return 0, err
-		}
-		n += count
+	var flags primitives.PrimitiveByte
+	if count, err = flags.DecodeFrom(src[i:]); err != nil {
+		return 0, fieldError(CONNECT, "Connect Flags", err)
 	}
+	i += count
 
-	for k, v := range c.UserProperties {
-		if err = primitives.WriteByte(0x26, w); err != nil {
-			return 0, err
-		}
-		n++
+	// SPEC: The Server MUST validate that the reserved flag in the CONNECT packet is set to 0 [MQTT-3.1.2-3].
+	if flags&0x01 != 0 {
+		return 0, fieldError(CONNECT, "Connect Flags", ErrControlPacketIsMalformed)
+	}
 
-		if count, err = k.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
+	c.CleanSession = flags&(1<<1) != 0
+	willFlag := flags&(1<<2) != 0
+	willQoS := QoS(flags>>3) & 0x03
+	willRetain := flags&(1<<5) != 0
 
-		if count, err = v.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
+	// SPEC: If the Will Flag is set to 0, then the Will QoS MUST be set to 0 (0x00) [MQTT-3.1.2-11].
+	// SPEC: If the Will Flag is set to 0, then Will Retain MUST be set to 0 [MQTT-3.1.2-13].
+	if !willFlag && (willQoS != QoS0 || willRetain) {
+		return 0, fieldError(CONNECT, "Connect Flags", ErrControlPacketIsMalformed)
 	}
 
-	if len(c.AuthenticationMethod) > 0 {
-		if count, err = c.AuthenticationMethod.WriteToAsProperty(0x15, w); err != nil {
-			return 0, err
-		}
-		n += count
-
-		if count, err = c.AuthenticationData.WriteToAsProperty(0x16, w); err != nil {
-			return 0, err
-		}
-		n += count
+	// SPEC: If the Will Flag is set to 1, the value of Will QoS can be 0 (0x00), 1 (0x01), or 2 (0x02). It MUST NOT be 3
+	//       (0x03) [MQTT-3.1.2-12].
+	if willQoS > QoS2 {
+		return 0, fieldError(CONNECT, "Will QoS", ErrControlPacketIsMalformed)
 	}
-	/* Variable header end */
 
-	/* Payload start */
-	if count, err = c.ClientId.WriteTo(w); err != nil {
-		return 0, err
+	if count, err = c.KeepAlive.DecodeFrom(src[i:]); err != nil {
+		return 0, fieldError(CONNECT, "Keep Alive", err)
 	}
-	n += count
+	i += count
+	/* Variable header end */
 
-	// SPEC: If the Will Flag is set to 1, the Will Properties is the next field in the Payload.
-	//       [3.1.3.2 Will Properties]
-	if len(c.Will) > 0 {
-		/* Will properties begin */
-		if count, err = willPropertiesLen.WriteTo(w); err != nil {
-			return 0, err
+	/* Properties begin */
+	if c.Version >= MQTT5 {
+		var propertiesLen primitives.VariableByteInt
+		if count, err = propertiesLen.DecodeFrom(src[i:]); err != nil {
+			return 0, fieldError(CONNECT, "Property Length", err)
 		}
-		n += count
+		i += count
 
-		// Will delay interval
-		if c.WillDelayInterval > 0 {
-			if count, err = c.WillDelayInterval.WriteToAsProperty(0x18, w); err != nil {
-				return 0, err
-			}
-			n += count
+		end := i + int(propertiesLen)
+		if end > len(src) {
+			return 0, fieldError(CONNECT, "Property Length", ErrControlPacketIsMalformed)
 		}
 
-		// Will payload format indicator - 0x00 = Bytes
-		willPayloadFormat := primitives.PrimitiveByte(0)
-		if count, err = willPayloadFormat.WriteToAsProperty(0x01, w); err != nil {
-			return 0, err
-		}
-		n += count
+		seen := propertySet{strict: c.Header.Strict}
+		for i < end {
+			// Read the identifier byte
+			identifier := src[i]
+			i++
 
-		// Will message expiry interval
-		if c.WillMessageExpiryInterval > 0 {
-			if count, err = c.WillMessageExpiryInterval.WriteToAsProperty(0x12, w); err != nil {
+			if err = seen.add(CONNECT, identifier); err != nil {
 				return 0, err
 			}
-			n += count
-		}
 
-		// Will content type
-		if len(c.WillContentType) > 0 {
-			if count, err = c.WillContentType.WriteToAsProperty(0x03, w); err != nil {
-				return 0, err
+			switch identifier {
+			case 0x11: // Session Expiry Interval
+				count, err = c.SessionExpiryInterval.DecodeFrom(src[i:end])
+			case 0x21: // Receive Maximum
+				count, err = c.ReceiveMaximum.DecodeFrom(src[i:end])
+			case 0x27: // Maximum Packet Size
+				count, err = c.MaximumPacketSize.DecodeFrom(src[i:end])
+			case 0x22: // Topic Alias Maximum
+				count, err = c.TopicAliasMaximum.DecodeFrom(src[i:end])
+			case 0x19: // Request Response Information
+				count, err = c.RequestResponseInformation.DecodeFrom(src[i:end])
+			case 0x17: // Request Problem Information
+				count, err = c.RequestProblemInformation.DecodeFrom(src[i:end])
+			case 0x26: // User Property
+				count, err = c.UserProperties.DecodeFrom(src[i:end])
+			case 0x15: // Authentication Method
+				count, err = c.AuthenticationMethod.DecodeFrom(src[i:end])
+			case 0x16: // Authentication Data
+				count, err = c.AuthenticationData.DecodeFrom(src[i:end])
+			default:
+				// Skip over properties that are not allowed for this packet type
+				count, err = skipProperty(identifier, src[i:end])
 			}
-			n += count
-		}
 
-		// Will response topic
-		if len(c.WillResponseTopic) > 0 {
-			if count, err = c.WillResponseTopic.WriteToAsProperty(0x8, w); err != nil {
-				return 0, err
+			if err != nil {
+				return 0, propertyError(CONNECT, identifier, err)
 			}
-			n += count
+			i += count
 		}
+	}
+	/* Properties end */
 
-		// Will correlation data
-		if len(c.WillCorrelationData) > 0 {
-			if count, err = c.WillCorrelationData.WriteToAsProperty(0x9, w); err != nil {
-				return 0, err
-			}
-			n += count
-		}
+	/* Payload begin */
+	if count, err = c.ClientId.DecodeFrom(src[i:]); err != nil {
+		return 0, fieldError(CONNECT, "Client Identifier", err)
+	}
+	i += count
 
-		// Will user properties
-		for k, v := range c.WillUserProperties {
-			if err = primitives.WriteByte(0x26, w); err != nil {
-				return 0, err
-			}
-			n++
+	c.Will = nil
+	if willFlag {
+		c.Will = &Will{
+			QoS:    willQoS,
+			Retain: willRetain,
+		}
 
-			if count, err = k.WriteTo(w); err != nil {
+		if c.Version >= MQTT5 {
+			if count, err = c.Will.decodeProperties(src[i:], c.Header.Strict); err != nil {
 				return 0, err
 			}
-			n += count
+			i += count
+		}
 
-			if count, err = v.WriteTo(w); err != nil {
-				return 0, err
-			}
-			n += count
+		if count, err = c.Will.Topic.DecodeFrom(src[i:]); err != nil {
+			return 0, fieldError(CONNECT, "Will Topic", err)
 		}
-		/* Will properties end */
+		i += count
 
-		// Will topic
-		if count, err = c.WillTopic.WriteTo(w); err != nil {
-			return 0, err
+		if count, err = c.Will.Payload.DecodeFrom(src[i:]); err != nil {
+			return 0, fieldError(CONNECT, "Will Payload", err)
 		}
-		n += count
+		i += count
 
-		// Will payload
-		if count, err = c.Will.WriteTo(w); err != nil {
+		if err = c.Will.validatePayload(); err != nil {
 			return 0, err
 		}
-		n += count
 	}
 
-	// User name
-	if len(c.Username) > 0 {
-		if count, err = c.Username.WriteTo(w); err != nil {
-			return 0, err
+	c.Username = ""
+	if flags&(1<<7) != 0 {
+		if count, err = c.Username.DecodeFrom(src[i:]); err != nil {
+			return 0, fieldError(CONNECT, "User Name", err)
 		}
-		n += count
+		i += count
 	}
 
-	// Password
-	if len(c.Password) > 0 {
-		if count, err = c.Password.WriteTo(w); err != nil {
-			return 0, err
+	// The password is Binary Data and is not required to be UTF-8
+	c.Password = ""
+	if flags&(1<<6) != 0 {
+		var password primitives.PrimitiveBinary
+		if count, err = password.DecodeFrom(src[i:]); err != nil {
+			return 0, fieldError(CONNECT, "Password", err)
 		}
-		n += count
+		i += count
+		c.Password = primitives.PrimitiveString(password)
 	}
 	/* Payload end */
 
+	if err = checkRemaining(CONNECT, c.Header.Strict, i, src); err != nil {
+		return 0, err
+	}
+	n += len(src)
+
 	return
 }
@@ -0,0 +1,312 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022-2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+// connectFixtures are CONNECT control packets alongside their encoding as laid out by the specification.
+// SPEC: [3.1 CONNECT – Connection Request]
+var connectFixtures = []struct {
+	name    string
+	connect func() *Connect
+	raw     []byte
+}{
+	{
+		name: "mqtt311Minimal",
+		connect: func() *Connect {
+			return &Connect{Version: MQTT311, CleanSession: true, KeepAlive: 60, ClientId: "test"}
+		},
+		raw: []byte{
+			0x10, 0x10, // Fixed header
+			0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol Name
+			0x04,       // Protocol Version
+			0x02,       // Connect Flags: Clean Session
+			0x00, 0x3C, // Keep Alive
+			0x00, 0x04, 't', 'e', 's', 't', // Client Identifier
+		},
+	},
+	{
+		// The variable header is the non-normative example of the specification
+		// SPEC: [3.1.2.12 Variable Header non-normative example]
+		name: "specExample",
+		connect: func() *Connect {
+			c := &Connect{
+				Version:               MQTT5,
+				CleanSession:          true,
+				KeepAlive:             10,
+				SessionExpiryInterval: 10,
+				ClientId:              "client",
+				Username:              "user",
+				Password:              "pass",
+			}
+			c.SetWill("status/client", []byte("offline")).
+				SetQoS(QoS1).
+				SetDelayInterval(time.Second * 30).
+				SetMessageExpiryInterval(time.Minute)
+			return c
+		},
+		raw: []byte{
+			0x10, 0x47, // Fixed header
+			0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol Name
+			0x05,       // Protocol Version
+			0xCE,       // Connect Flags: User Name, Password, Will QoS 1, Will Flag, Clean Start
+			0x00, 0x0A, // Keep Alive
+			0x05,                         // Property Length
+			0x11, 0x00, 0x00, 0x00, 0x0A, // Session Expiry Interval
+			0x00, 0x06, 'c', 'l', 'i', 'e', 'n', 't', // Client Identifier
+			0x0A,                         // Will Property Length
+			0x18, 0x00, 0x00, 0x00, 0x1E, // Will Delay Interval
+			0x02, 0x00, 0x00, 0x00, 0x3C, // Message Expiry Interval
+			0x00, 0x0D, 's', 't', 'a', 't', 'u', 's', '/', 'c', 'l', 'i', 'e', 'n', 't', // Will Topic
+			0x00, 0x07, 'o', 'f', 'f', 'l', 'i', 'n', 'e', // Will Payload
+			0x00, 0x04, 'u', 's', 'e', 'r', // User Name
+			0x00, 0x04, 'p', 'a', 's', 's', // Password
+		},
+	},
+	{
+		name: "allProperties",
+		connect: func() *Connect {
+			c := &Connect{
+				Version:                    MQTT5,
+				SessionExpiryInterval:      120,
+				ReceiveMaximum:             20,
+				MaximumPacketSize:          4096,
+				TopicAliasMaximum:          10,
+				RequestResponseInformation: 1,
+				RequestProblemInformation:  1,
+				AuthenticationMethod:       "SCR",
+				AuthenticationData:         []byte{0x01, 0x02},
+			}
+			c.UserProperties.Add("k", "v")
+			return c
+		},
+		raw: []byte{
+			0x10, 0x33, // Fixed header
+			0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol Name
+			0x05,       // Protocol Version
+			0x00,       // Connect Flags
+			0x00, 0x00, // Keep Alive
+			0x26,                         // Property Length
+			0x11, 0x00, 0x00, 0x00, 0x78, // Session Expiry Interval
+			0x21, 0x00, 0x14, // Receive Maximum
+			0x27, 0x00, 0x00, 0x10, 0x00, // Maximum Packet Size
+			0x22, 0x00, 0x0A, // Topic Alias Maximum
+			0x19, 0x01, // Request Response Information
+			0x17, 0x01, // Request Problem Information
+			0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v', // User Property
+			0x15, 0x00, 0x03, 'S', 'C', 'R', // Authentication Method
+			0x16, 0x00, 0x02, 0x01, 0x02, // Authentication Data
+			0x00, 0x00, // Client Identifier
+		},
+	},
+	{
+		name: "allWillProperties",
+		connect: func() *Connect {
+			c := &Connect{Version: MQTT5, ClientId: "c"}
+			c.SetWill("a/b", []byte("hi")).
+				SetQoS(QoS2).
+				SetRetain(true).
+				SetDelayInterval(time.Second*5).
+				SetPayloadFormatIndicator(true).
+				SetMessageExpiryInterval(time.Minute*5).
+				SetContentType("text/plain").
+				SetResponseTopic("reply").
+				SetCorrelationData([]byte{0xCA, 0xFE}).
+				AddUserProperty("a", "b")
+			return c
+		},
+		raw: []byte{
+			0x10, 0x45, // Fixed header
+			0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol Name
+			0x05,       // Protocol Version
+			0x34,       // Connect Flags: Will Retain, Will QoS 2, Will Flag
+			0x00, 0x00, // Keep Alive
+			0x00,            // Property Length
+			0x00, 0x01, 'c', // Client Identifier
+			0x2D,                         // Will Property Length
+			0x18, 0x00, 0x00, 0x00, 0x05, // Will Delay Interval
+			0x01, 0x01, // Payload Format Indicator
+			0x02, 0x00, 0x00, 0x01, 0x2C, // Message Expiry Interval
+			0x03, 0x00, 0x0A, 't', 'e', 'x', 't', '/', 'p', 'l', 'a', 'i', 'n', // Content Type
+			0x08, 0x00, 0x05, 'r', 'e', 'p', 'l', 'y', // Response Topic
+			0x09, 0x00, 0x02, 0xCA, 0xFE, // Correlation Data
+			0x26, 0x00, 0x01, 'a', 0x00, 0x01, 'b', // User Property
+			0x00, 0x03, 'a', '/', 'b', // Will Topic
+			0x00, 0x02, 'h', 'i', // Will Payload
+		},
+	},
+	{
+		name: "mqtt311Will",
+		connect: func() *Connect {
+			c := &Connect{Version: MQTT311, ClientId: "c"}
+
+			// Will properties are not encoded before MQTT 5
+			c.SetWill("t", nil).SetRetain(true).SetDelayInterval(time.Second)
+			return c
+		},
+		raw: []byte{
+			0x10, 0x12, // Fixed header
+			0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol Name
+			0x04,       // Protocol Version
+			0x24,       // Connect Flags: Will Retain, Will Flag
+			0x00, 0x00, // Keep Alive
+			0x00, 0x01, 'c', // Client Identifier
+			0x00, 0x01, 't', // Will Topic
+			0x00, 0x00, // Will Payload
+		},
+	},
+}
+
+func TestConnect_Golden(t *testing.T) {
+	for _, tt := range connectFixtures {
+		t.Run(tt.name, func(t *testing.T) {
+			connect := tt.connect()
+
+			buf, err := connect.AppendTo(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, tt.raw) {
+				t.Fatalf("AppendTo() = % x, want % x", buf, tt.raw)
+			}
+
+			var w bytes.Buffer
+			if _, err = connect.WriteTo(&w); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(w.Bytes(), tt.raw) {
+				t.Fatalf("WriteTo() = % x, want % x", w.Bytes(), tt.raw)
+			}
+
+			// Decode the packet using both the slice and reader paths
+			decoded := Connect{}
+			n, err := decoded.DecodeFrom(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.raw) {
+				t.Errorf("DecodeFrom() consumed %d bytes, want %d", n, len(tt.raw))
+			}
+
+			read := Connect{}
+			if _, err = read.ReadFrom(bytes.NewReader(tt.raw)); err != nil {
+				t.Fatal(err)
+			}
+
+			// Properties that are not encoded before MQTT 5 are not decoded either
+			if connect.Version < MQTT5 && connect.Will != nil {
+				connect.Will = &Will{Topic: connect.Will.Topic, Payload: connect.Will.Payload, QoS: connect.Will.QoS,
+					Retain: connect.Will.Retain}
+			}
+
+			for _, got := range []Connect{decoded, read} {
+				if !reflect.DeepEqual(&got, connect) {
+					t.Errorf("decoded %+v with will %+v, want %+v with will %+v", got, got.Will, *connect, connect.Will)
+				}
+			}
+		})
+	}
+}
+
+func TestConnect_WillValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		will      *Will
+		wantField string
+		wantErr   error
+	}{
+		{
+			name:      "emptyTopic",
+			will:      NewWill("", []byte("offline")),
+			wantField: "Will Topic",
+			wantErr:   ReasonCode(0x90),
+		},
+		{
+			name:      "wildcardTopic",
+			will:      NewWill("status/#", []byte("offline")),
+			wantField: "Will Topic",
+			wantErr:   ReasonCode(0x90),
+		},
+		{
+			name:      "qos3",
+			will:      NewWill("status", nil).SetQoS(3),
+			wantField: "Will QoS",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name:      "invalidUTF8",
+			will:      NewWill("status", []byte{0xFF}).SetPayloadFormatIndicator(true),
+			wantField: "Will Payload",
+			wantErr:   ReasonCode(0x99),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connect := Connect{Version: MQTT5, Will: tt.will}
+
+			_, err := connect.AppendTo(nil)
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) {
+				t.Fatalf("AppendTo() error = %v, want *FieldError", err)
+			}
+
+			if fieldErr.Field != tt.wantField || fieldErr.Err != tt.wantErr {
+				t.Errorf("AppendTo() error = %v, want %s: %v", err, tt.wantField, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnect_DecodeFromTruncated(t *testing.T) {
+	raw := connectFixtures[1].raw
+	for i := 0; i < len(raw); i++ {
+		decoded := Connect{}
+		if _, err := decoded.DecodeFrom(raw[:i]); err == nil {
+			t.Errorf("DecodeFrom() with %d of %d bytes succeeded", i, len(raw))
+		}
+	}
+}
+
+func TestConnect_BinaryPassword(t *testing.T) {
+	// The password is Binary Data and is not required to be UTF-8
+	connect := Connect{Version: MQTT5, Password: primitives.PrimitiveString([]byte{0xFF, 0xFE})}
+	buf, err := connect.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := Connect{}
+	if _, err = decoded.DecodeFrom(buf); err != nil || decoded.Password != connect.Password {
+		t.Errorf("DecodeFrom() = %q, %v, want %q", decoded.Password, err, connect.Password)
+	}
+}
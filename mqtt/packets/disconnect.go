@@ -36,152 +36,155 @@ type Disconnect struct {
 	/* Properties */
 	SessionExpiryInterval primitives.PrimitiveUint32
 	ReasonString          primitives.PrimitiveString
-	UserProperties        primitives.PrimitiveStringMap
+	UserProperties        primitives.PrimitiveStringPairs
 	ServerReference       primitives.PrimitiveString
 }
 
 func (d *Disconnect) ReadFrom(r io.Reader) (n int64, err error) {
-	var count int64
+	return readFrom(r, d.Header.Remaining, d.DecodeFrom)
+}
 
-	/* Variable header begin */
-	if count, err = d.ReasonCode.ReadFrom(r); err != nil {
+// DecodeFrom decodes the variable header of the DISCONNECT control packet from src. The fixed header must already be
+// set.
+func (d *Disconnect) DecodeFrom(src []byte) (n int, err error) {
+	var count int
+	if src, err = body(d.Header, src); err != nil {
 		return 0, err
 	}
+
+	// SPEC: If the Remaining Length is less than 1 the value of 0x00 (Normal disconnection) is used.
+	if len(src) == 0 {
+		return
+	}
+
+	/* Variable header begin */
+	if count, err = d.ReasonCode.DecodeFrom(src); err != nil {
+		return 0, fieldError(DISCONNECT, "Reason Code", err)
+	}
 	n += count
 
-	if n >= int64(d.Header.Remaining) {
+	if n >= len(src) {
 		return
 	}
 
 	/* Properties begin */
 	var propertiesLen primitives.VariableByteInt
-	if count, err = propertiesLen.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = propertiesLen.DecodeFrom(src[n:]); err != nil {
+		return 0, fieldError(DISCONNECT, "Property Length", err)
 	}
 	n += count
 
-	remaining := int64(propertiesLen)
-	for remaining > 0 {
+	end := n + int(propertiesLen)
+	if end > len(src) {
+		return 0, fieldError(DISCONNECT, "Property Length", ErrControlPacketIsMalformed)
+	}
+
+	seen := propertySet{strict: d.Header.Strict}
+	for n < end {
 		// Read the identifier byte
-		var identifier byte
-		if identifier, err = primitives.ReadByte(r); err != nil {
+		identifier := src[n]
+		n++
+
+		if err = seen.add(DISCONNECT, identifier); err != nil {
 			return 0, err
 		}
-		n++
-		remaining--
 
 		switch identifier {
 		case 0x11: // Session expiry interval
-			if count, err = d.SessionExpiryInterval.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = d.SessionExpiryInterval.DecodeFrom(src[n:end])
 		case 0x1F: // Reason String
-			if count, err = d.ReasonString.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = d.ReasonString.DecodeFrom(src[n:end])
 		case 0x26: // User Property
-			if d.UserProperties == nil {
-				d.UserProperties = make(primitives.PrimitiveStringMap)
-			}
-			var k, v primitives.PrimitiveString
-			if count, err = k.ReadFrom(r); err != nil {
-				return 0, err
-			}
-
-			var count2 int64
-			if count2, err = v.ReadFrom(r); err != nil {
-				return 0, err
-			}
-			count += count2
-			d.UserProperties[k] = v
+			count, err = d.UserProperties.DecodeFrom(src[n:end])
 		case 0x1C: // Server Reference
-			if count, err = d.ServerReference.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = d.ServerReference.DecodeFrom(src[n:end])
+		default:
+			// Skip over properties that are not allowed for this packet type
+			count, err = skipProperty(identifier, src[n:end])
+		}
+
+		if err != nil {
+			return 0, propertyError(DISCONNECT, identifier, err)
 		}
 		n += count
-		remaining -= count
 	}
 	/* Properties end */
 	/* Variable header end */
 
+	if err = checkRemaining(DISCONNECT, d.Header.Strict, n, src); err != nil {
+		return 0, err
+	}
+
 	return
 }
 
 func (d *Disconnect) WriteTo(w io.Writer) (n int64, err error) {
-	variableHeaderLen := primitives.VariableByteInt(2) // Account for reason code and properties length var
+	return writeTo(w, d.AppendTo)
+}
+
+// AppendTo appends the encoded DISCONNECT control packet to dst and returns the extended slice.
+func (d *Disconnect) AppendTo(dst []byte) ([]byte, error) {
+	variableHeaderLen := primitives.VariableByteInt(1) // Account for reason code
 	propertiesLen := primitives.VariableByteInt(0)
 
+	if err := validateStringProperty(DISCONNECT, 0x1F, d.ReasonString); err != nil {
+		return dst, err
+	}
+
+	if err := validateUserProperties(DISCONNECT, d.UserProperties); err != nil {
+		return dst, err
+	}
+
+	if err := validateStringProperty(DISCONNECT, 0x1C, d.ServerReference); err != nil {
+		return dst, err
+	}
+
 	// Calculate properties length
 	if d.SessionExpiryInterval > 0 {
 		propertiesLen += d.SessionExpiryInterval.Length(true)
 	}
 
-	for k, v := range d.UserProperties {
-		propertiesLen += 1 + k.Length(false) + v.Length(false)
+	if len(d.ReasonString) > 0 {
+		propertiesLen += d.ReasonString.Length(true)
 	}
 
+	propertiesLen += d.UserProperties.Length(true)
+
 	if len(d.ServerReference) > 0 {
 		propertiesLen += d.ServerReference.Length(true)
 	}
 
-	variableHeaderLen += propertiesLen
+	variableHeaderLen += propertiesLen.Length(false) + propertiesLen
 
 	// Write fixed header
 	d.Header.SetType(DISCONNECT)
 	d.Header.Remaining = variableHeaderLen
-
-	var count int64
-	if n, err = d.Header.WriteTo(w); err != nil {
-		return 0, err
-	}
+	dst = d.Header.AppendTo(dst)
 
 	// Write reason code
-	if count, err = d.ReasonCode.WriteTo(w); err != nil {
-		return 0, err
-	}
-	n += count
+	dst = d.ReasonCode.AppendTo(dst)
 
 	/* Properties begin */
-	if count, err = propertiesLen.WriteTo(w); err != nil {
-		return 0, err
-	}
-	n += count
+	dst = propertiesLen.AppendTo(dst)
 
 	// Session expiry interval
 	if d.SessionExpiryInterval > 0 {
-		if count, err = d.SessionExpiryInterval.WriteToAsProperty(0x11, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = d.SessionExpiryInterval.AppendToAsProperty(0x11, dst)
 	}
 
 	// Reason string
 	if len(d.ReasonString) > 0 {
-		if count, err = d.ReasonString.WriteToAsProperty(0x1F, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = d.ReasonString.AppendToAsProperty(0x1F, dst)
 	}
 
 	// User properties
-	for k, v := range d.UserProperties {
-		if err = primitives.WriteByte(0x26, w); err != nil {
-			return 0, err
-		}
-		n++
-
-		if count, err = k.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
+	dst = d.UserProperties.AppendToAsProperty(0x26, dst)
 
-		if count, err = v.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
+	// Server reference
+	if len(d.ServerReference) > 0 {
+		dst = d.ServerReference.AppendToAsProperty(0x1C, dst)
 	}
 	/* Properties end */
 
-	return
+	return dst, nil
 }
@@ -24,8 +24,55 @@
 
 package packets
 
-import "errors"
+import (
+	"errors"
+	"io"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
 
 var (
 	ErrControlPacketIsMalformed = errors.New("the control packet is malformed")
+	ErrProtocolError            = errors.New("the control packet violates the protocol")
 )
+
+// FieldError is returned when a field of a control packet fails validation. It identifies the type of the control
+// packet and the offending field. Err is either ErrControlPacketIsMalformed, ErrProtocolError or a ReasonCode.
+type FieldError struct {
+	PacketType PacketType
+	Field      string
+	Err        error
+}
+
+func (e *FieldError) Error() string {
+	return e.PacketType.String() + " " + e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// fieldError returns a FieldError for the specified field. Truncated fields are reported as malformed since they end
+// before the remaining length of the control packet does, and so are strings that are not valid UTF-8 Encoded Strings.
+func fieldError(packetType PacketType, field string, err error) error {
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, primitives.ErrMalformedVariableByteInt),
+		errors.Is(err, primitives.ErrStringTooLong),
+		errors.Is(err, primitives.ErrInvalidUTF8),
+		errors.Is(err, primitives.ErrNullCharacter),
+		errors.Is(err, primitives.ErrDisallowedCodePoint):
+		err = ErrControlPacketIsMalformed
+	}
+
+	return &FieldError{
+		PacketType: packetType,
+		Field:      field,
+		Err:        err,
+	}
+}
@@ -93,9 +93,40 @@ const (
 	AUTH
 )
 
+var packetTypeNames = [...]string{
+	CONNECT:     "CONNECT",
+	CONNACK:     "CONNACK",
+	PUBLISH:     "PUBLISH",
+	PUBACK:      "PUBACK",
+	PUBREC:      "PUBREC",
+	PUBREL:      "PUBREL",
+	PUBCOMP:     "PUBCOMP",
+	SUBSCRIBE:   "SUBSCRIBE",
+	SUBACK:      "SUBACK",
+	UNSUBSCRIBE: "UNSUBSCRIBE",
+	UNSUBACK:    "UNSUBACK",
+	PINGREQ:     "PINGREQ",
+	PINGRESP:    "PINGRESP",
+	DISCONNECT:  "DISCONNECT",
+	AUTH:        "AUTH",
+}
+
+func (p PacketType) String() string {
+	if int(p) < len(packetTypeNames) && packetTypeNames[p] != "" {
+		return packetTypeNames[p]
+	}
+	return "RESERVED"
+}
+
 type FixedHeader struct {
 	Header    primitives.PrimitiveByte
 	Remaining primitives.VariableByteInt
+
+	// Strict enables strict validation when the control packet described by the header is decoded. Decoders then also
+	// reject properties that are not allowed for the control packet type, duplicate properties, reserved fixed header
+	// flags that are not set to their specified values and remaining lengths that do not match the decoded fields.
+	// Strict is not a part of the encoded fixed header.
+	Strict bool
 }
 
 func (f *FixedHeader) SetType(packetType PacketType) {
@@ -132,6 +163,26 @@ func (f *FixedHeader) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+func (f *FixedHeader) AppendTo(dst []byte) []byte {
+	dst = f.Header.AppendTo(dst)
+	return f.Remaining.AppendTo(dst)
+}
+
+// DecodeFrom decodes the fixed header from the beginning of src and returns the number of bytes consumed.
+func (f *FixedHeader) DecodeFrom(src []byte) (n int, err error) {
+	if n, err = f.Header.DecodeFrom(src); err != nil {
+		return 0, err
+	}
+
+	var count int
+	if count, err = f.Remaining.DecodeFrom(src[n:]); err != nil {
+		return 0, err
+	}
+	n += count
+
+	return
+}
+
 func (f *FixedHeader) ReadFrom(r io.Reader) (n int64, err error) {
 	// Read byte 1
 	if n, err = f.Header.ReadFrom(r); err != nil {
@@ -146,3 +197,72 @@ func (f *FixedHeader) ReadFrom(r io.Reader) (n int64, err error) {
 
 	return
 }
+
+// writeTo encodes a control packet using its append function and writes the result to w with a single call to Write.
+func writeTo(w io.Writer, appendFn func(dst []byte) ([]byte, error)) (n int64, err error) {
+	var buf []byte
+	if buf, err = appendFn(nil); err != nil {
+		return 0, err
+	}
+
+	count, err := w.Write(buf)
+	return int64(count), err
+}
+
+// readFrom reads the remaining length of a control packet from r and decodes it using its decode function.
+func readFrom(r io.Reader, remaining primitives.VariableByteInt, decodeFn func(src []byte) (int, error)) (n int64, err error) {
+	buf := make([]byte, remaining)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+
+	if _, err = decodeFn(buf); err != nil {
+		return 0, err
+	}
+
+	return int64(remaining), nil
+}
+
+// body validates the fixed header and returns the portion of src that belongs to the control packet it describes.
+func body(header FixedHeader, src []byte) ([]byte, error) {
+	if err := validateFlags(header); err != nil {
+		return nil, err
+	}
+
+	if len(src) < int(header.Remaining) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return src[:header.Remaining], nil
+}
+
+// validateFlags validates the flags of the fixed header for its packet type.
+func validateFlags(header FixedHeader) error {
+	packetType := header.GetType()
+	flags := header.GetFlags()
+
+	if packetType == PUBLISH {
+		// SPEC: A PUBLISH Packet MUST NOT have both QoS bits set to 1 [MQTT-3.3.1-4].
+		if (flags>>1)&0x03 == 0x03 {
+			return fieldError(packetType, "QoS", ErrControlPacketIsMalformed)
+		}
+
+		// SPEC: The DUP flag MUST be set to 0 for all QoS 0 messages [MQTT-3.3.1-2].
+		if header.Strict && (flags>>1)&0x03 == 0 && flags&0x08 != 0 {
+			return fieldError(packetType, "DUP", ErrControlPacketIsMalformed)
+		}
+		return nil
+	}
+
+	// SPEC: Where a flag bit is marked as "Reserved", it is reserved for future use and MUST be set to the value listed.
+	//       If invalid flags are received it is a Malformed Packet.
+	var reserved primitives.PrimitiveByte
+	switch packetType {
+	case PUBREL, SUBSCRIBE, UNSUBSCRIBE:
+		reserved = 0x02
+	}
+
+	if header.Strict && flags != reserved {
+		return fieldError(packetType, "Fixed Header Flags", ErrControlPacketIsMalformed)
+	}
+	return nil
+}
@@ -22,6 +22,20 @@
  * SOFTWARE.
  */
 
-package primitives
+package packets
 
-type PrimitiveStringMap map[PrimitiveString]PrimitiveString
+import "io"
+
+// Pingreq is the PINGREQ control packet. It consists of only the fixed header.
+type Pingreq struct{}
+
+func (p *Pingreq) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, p.AppendTo)
+}
+
+// AppendTo appends the encoded PINGREQ control packet to dst and returns the extended slice.
+func (p *Pingreq) AppendTo(dst []byte) ([]byte, error) {
+	header := FixedHeader{}
+	header.SetType(PINGREQ)
+	return header.AppendTo(dst), nil
+}
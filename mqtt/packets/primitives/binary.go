@@ -0,0 +1,118 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022-2023 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package primitives
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// PrimitiveBinary is Binary Data represented by a Two Byte Integer length followed by that number of bytes. Unlike
+// PrimitiveString, the data is not required to be UTF-8.
+type PrimitiveBinary []byte
+
+func (p *PrimitiveBinary) WriteTo(w io.Writer) (n int64, err error) {
+	// Write the length of the data
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(len(*p)))
+	if _, err = w.Write(buf[:]); err != nil {
+		return 0, err
+	}
+	n += 2
+
+	// Write the data
+	var count int
+	if count, err = w.Write(*p); err != nil {
+		return 0, err
+	}
+	n += int64(count)
+
+	return
+}
+
+func (p *PrimitiveBinary) WriteToAsProperty(identifier byte, w io.Writer) (n int64, err error) {
+	if err = WriteByte(identifier, w); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if count, err = p.WriteTo(w); err != nil {
+		return 0, err
+	}
+
+	return 1 + count, nil
+}
+
+func (p *PrimitiveBinary) AppendTo(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(*p)))
+	return append(dst, *p...)
+}
+
+func (p *PrimitiveBinary) AppendToAsProperty(identifier byte, dst []byte) []byte {
+	return p.AppendTo(append(dst, identifier))
+}
+
+func (p *PrimitiveBinary) ReadFrom(r io.Reader) (n int64, err error) {
+	// Read the 16-bit length
+	var length uint16
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, err
+	}
+	n += 2
+
+	// Read the data. A single call to Read may return fewer bytes than requested.
+	buf := make([]byte, length)
+	var count int
+	if count, err = io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	n += int64(count)
+
+	*p = buf
+	return
+}
+
+func (p *PrimitiveBinary) DecodeFrom(src []byte) (n int, err error) {
+	if len(src) < 2 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	length := int(binary.BigEndian.Uint16(src))
+	if len(src) < 2+length {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	// NOTE: The data is copied so that src can be reused by the caller.
+	*p = append(PrimitiveBinary(nil), src[2:2+length]...)
+	return 2 + length, nil
+}
+
+func (p *PrimitiveBinary) Length(property bool) (result VariableByteInt) {
+	result = 2 + VariableByteInt(len(*p))
+	if property {
+		result++
+	}
+	return
+}
@@ -53,6 +53,14 @@ func (p *PrimitiveByte) WriteToAsProperty(identifier byte, w io.Writer) (n int64
 	return
 }
 
+func (p *PrimitiveByte) AppendTo(dst []byte) []byte {
+	return append(dst, byte(*p))
+}
+
+func (p *PrimitiveByte) AppendToAsProperty(identifier byte, dst []byte) []byte {
+	return append(dst, identifier, byte(*p))
+}
+
 func (p *PrimitiveByte) ReadFrom(r io.Reader) (n int64, err error) {
 	var b byte
 	if b, err = ReadByte(r); err != nil {
@@ -65,6 +73,15 @@ func (p *PrimitiveByte) ReadFrom(r io.Reader) (n int64, err error) {
 	return
 }
 
+func (p *PrimitiveByte) DecodeFrom(src []byte) (n int, err error) {
+	if len(src) < 1 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	*p = PrimitiveByte(src[0])
+	return 1, nil
+}
+
 func (p *PrimitiveByte) Length(property bool) (result VariableByteInt) {
 	result = 1
 	if property {
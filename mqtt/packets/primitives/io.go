@@ -34,6 +34,16 @@ type Primitive interface {
 	WriteToAsProperty(identifier byte, w io.Writer) (n int64, err error)
 	ReadFrom(r io.Reader) (n int64, err error)
 	Length(property bool) VariableByteInt
+
+	// AppendTo appends the encoded primitive to dst and returns the extended slice.
+	AppendTo(dst []byte) []byte
+
+	// AppendToAsProperty appends the property identifier followed by the encoded primitive to dst and returns the
+	// extended slice.
+	AppendToAsProperty(identifier byte, dst []byte) []byte
+
+	// DecodeFrom decodes the primitive from the beginning of src and returns the number of bytes consumed.
+	DecodeFrom(src []byte) (n int, err error)
 }
 
 //go:inline
@@ -44,6 +54,6 @@ func WriteByte(b byte, w io.Writer) error {
 
 //go:inline
 func ReadByte(r io.Reader) (b byte, err error) {
-	_, err = r.Read(unsafe.Slice(&b, 1))
+	_, err = io.ReadFull(r, unsafe.Slice(&b, 1))
 	return
 }
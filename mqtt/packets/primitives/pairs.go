@@ -0,0 +1,182 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package primitives
+
+import "io"
+
+// PrimitiveStringPair is a UTF-8 String Pair.
+type PrimitiveStringPair struct {
+	Key   PrimitiveString
+	Value PrimitiveString
+}
+
+// PrimitiveStringPairs is an ordered list of UTF-8 String Pairs used for user properties. The same key may appear more
+// than once and the order of the pairs is preserved when encoding and decoding.
+type PrimitiveStringPairs []PrimitiveStringPair
+
+// Get returns the value of the first pair with the given key.
+func (p PrimitiveStringPairs) Get(key string) (value string, ok bool) {
+	for _, pair := range p {
+		if string(pair.Key) == key {
+			return string(pair.Value), true
+		}
+	}
+	return "", false
+}
+
+// GetAll returns the values of every pair with the given key in the order they appear.
+func (p PrimitiveStringPairs) GetAll(key string) (values []string) {
+	for _, pair := range p {
+		if string(pair.Key) == key {
+			values = append(values, string(pair.Value))
+		}
+	}
+	return
+}
+
+// Add appends a pair to the end of the list.
+func (p *PrimitiveStringPairs) Add(key, value string) {
+	*p = append(*p, PrimitiveStringPair{Key: PrimitiveString(key), Value: PrimitiveString(value)})
+}
+
+// Set replaces the value of the first pair with the given key and removes any other pairs with the same key. The pair
+// is appended if the key is not present.
+func (p *PrimitiveStringPairs) Set(key, value string) {
+	found := false
+	result := (*p)[:0]
+	for _, pair := range *p {
+		if string(pair.Key) == key {
+			if found {
+				continue
+			}
+			pair.Value = PrimitiveString(value)
+			found = true
+		}
+		result = append(result, pair)
+	}
+
+	if !found {
+		result = append(result, PrimitiveStringPair{Key: PrimitiveString(key), Value: PrimitiveString(value)})
+	}
+	*p = result
+}
+
+// WriteTo writes each pair without a property identifier.
+func (p *PrimitiveStringPairs) WriteTo(w io.Writer) (n int64, err error) {
+	for i := range *p {
+		var count int64
+		if count, err = (*p)[i].Key.WriteTo(w); err != nil {
+			return 0, err
+		}
+		n += count
+
+		if count, err = (*p)[i].Value.WriteTo(w); err != nil {
+			return 0, err
+		}
+		n += count
+	}
+	return
+}
+
+// WriteToAsProperty writes each pair preceded by the property identifier.
+func (p *PrimitiveStringPairs) WriteToAsProperty(identifier byte, w io.Writer) (n int64, err error) {
+	for i := range *p {
+		if err = WriteByte(identifier, w); err != nil {
+			return 0, err
+		}
+		n++
+
+		pair := PrimitiveStringPairs{(*p)[i]}
+		var count int64
+		if count, err = pair.WriteTo(w); err != nil {
+			return 0, err
+		}
+		n += count
+	}
+	return
+}
+
+func (p *PrimitiveStringPairs) AppendTo(dst []byte) []byte {
+	for i := range *p {
+		dst = (*p)[i].Key.AppendTo(dst)
+		dst = (*p)[i].Value.AppendTo(dst)
+	}
+	return dst
+}
+
+func (p *PrimitiveStringPairs) AppendToAsProperty(identifier byte, dst []byte) []byte {
+	for i := range *p {
+		dst = append(dst, identifier)
+		dst = (*p)[i].Key.AppendTo(dst)
+		dst = (*p)[i].Value.AppendTo(dst)
+	}
+	return dst
+}
+
+// ReadFrom reads a single pair and appends it to the list.
+func (p *PrimitiveStringPairs) ReadFrom(r io.Reader) (n int64, err error) {
+	var pair PrimitiveStringPair
+	if n, err = pair.Key.ReadFrom(r); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if count, err = pair.Value.ReadFrom(r); err != nil {
+		return 0, err
+	}
+	n += count
+
+	*p = append(*p, pair)
+	return
+}
+
+// DecodeFrom decodes a single pair from src and appends it to the list.
+func (p *PrimitiveStringPairs) DecodeFrom(src []byte) (n int, err error) {
+	var pair PrimitiveStringPair
+	if n, err = pair.Key.DecodeFrom(src); err != nil {
+		return 0, err
+	}
+
+	var count int
+	if count, err = pair.Value.DecodeFrom(src[n:]); err != nil {
+		return 0, err
+	}
+	n += count
+
+	*p = append(*p, pair)
+	return
+}
+
+// Length returns the encoded length of every pair. Each pair includes a property identifier byte when property is
+// true.
+func (p *PrimitiveStringPairs) Length(property bool) (result VariableByteInt) {
+	for i := range *p {
+		result += (*p)[i].Key.Length(false) + (*p)[i].Value.Length(false)
+		if property {
+			result++
+		}
+	}
+	return
+}
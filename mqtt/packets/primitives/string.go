@@ -33,14 +33,16 @@ type PrimitiveString string
 
 func (p *PrimitiveString) WriteTo(w io.Writer) (n int64, err error) {
 	// Write the length of the string
-	if err = binary.Write(w, binary.BigEndian, uint16(len(*p))); err != nil {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(len(*p)))
+	if _, err = w.Write(buf[:]); err != nil {
 		return 0, err
 	}
 	n += 2
 
 	// Write the string
 	var count int
-	if count, err = w.Write([]byte(*p)); err != nil {
+	if count, err = io.WriteString(w, string(*p)); err != nil {
 		return 0, err
 	}
 	n += int64(count)
@@ -61,6 +63,15 @@ func (p *PrimitiveString) WriteToAsProperty(identifier byte, w io.Writer) (n int
 	return
 }
 
+func (p *PrimitiveString) AppendTo(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(*p)))
+	return append(dst, *p...)
+}
+
+func (p *PrimitiveString) AppendToAsProperty(identifier byte, dst []byte) []byte {
+	return p.AppendTo(append(dst, identifier))
+}
+
 func (p *PrimitiveString) ReadFrom(r io.Reader) (n int64, err error) {
 	// Read the 16-bit length
 	var length uint16
@@ -72,18 +83,42 @@ func (p *PrimitiveString) ReadFrom(r io.Reader) (n int64, err error) {
 	// Allocate memory for the string
 	buf := make([]byte, length)
 
-	// Read the string
+	// Read the string. A single call to Read may return fewer bytes than requested.
 	var count int
-	if count, err = r.Read(buf); err != nil {
+	if count, err = io.ReadFull(r, buf); err != nil {
 		return 0, err
-	} else {
-		n += int64(count)
 	}
+	n += int64(count)
 
-	*p = PrimitiveString(buf)
+	s := PrimitiveString(buf)
+	if err = s.Validate(); err != nil {
+		return 0, err
+	}
+
+	*p = s
 	return
 }
 
+func (p *PrimitiveString) DecodeFrom(src []byte) (n int, err error) {
+	if len(src) < 2 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	length := int(binary.BigEndian.Uint16(src))
+	if len(src) < 2+length {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	// NOTE: The conversion copies the bytes so that src can be reused by the caller.
+	s := PrimitiveString(src[2 : 2+length])
+	if err = s.Validate(); err != nil {
+		return 0, err
+	}
+
+	*p = s
+	return 2 + length, nil
+}
+
 func (p *PrimitiveString) Length(property bool) (result VariableByteInt) {
 	result = 2 + VariableByteInt(len(*p))
 	if property {
@@ -32,7 +32,8 @@ import (
 type PrimitiveUint16 uint16
 
 func (p *PrimitiveUint16) WriteTo(w io.Writer) (n int64, err error) {
-	if err = binary.Write(w, binary.BigEndian, uint16(*p)); err != nil {
+	var buf [2]byte
+	if _, err = w.Write(p.AppendTo(buf[:0])); err != nil {
 		return 0, err
 	}
 	return 2, nil
@@ -50,6 +51,14 @@ func (p *PrimitiveUint16) WriteToAsProperty(identifier byte, w io.Writer) (n int
 	return 3, nil
 }
 
+func (p *PrimitiveUint16) AppendTo(dst []byte) []byte {
+	return binary.BigEndian.AppendUint16(dst, uint16(*p))
+}
+
+func (p *PrimitiveUint16) AppendToAsProperty(identifier byte, dst []byte) []byte {
+	return p.AppendTo(append(dst, identifier))
+}
+
 func (p *PrimitiveUint16) ReadFrom(r io.Reader) (n int64, err error) {
 	if err = binary.Read(r, binary.BigEndian, (*uint16)(p)); err != nil {
 		return 0, err
@@ -57,6 +66,15 @@ func (p *PrimitiveUint16) ReadFrom(r io.Reader) (n int64, err error) {
 	return 2, nil
 }
 
+func (p *PrimitiveUint16) DecodeFrom(src []byte) (n int, err error) {
+	if len(src) < 2 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	*p = PrimitiveUint16(binary.BigEndian.Uint16(src))
+	return 2, nil
+}
+
 func (p *PrimitiveUint16) Length(property bool) (result VariableByteInt) {
 	result = 2
 	if property {
@@ -32,7 +32,8 @@ import (
 type PrimitiveUint32 uint32
 
 func (p *PrimitiveUint32) WriteTo(w io.Writer) (n int64, err error) {
-	if err = binary.Write(w, binary.BigEndian, uint32(*p)); err != nil {
+	var buf [4]byte
+	if _, err = w.Write(p.AppendTo(buf[:0])); err != nil {
 		return 0, err
 	}
 	return 4, nil
@@ -50,6 +51,14 @@ func (p *PrimitiveUint32) WriteToAsProperty(identifier byte, w io.Writer) (n int
 	return 5, nil
 }
 
+func (p *PrimitiveUint32) AppendTo(dst []byte) []byte {
+	return binary.BigEndian.AppendUint32(dst, uint32(*p))
+}
+
+func (p *PrimitiveUint32) AppendToAsProperty(identifier byte, dst []byte) []byte {
+	return p.AppendTo(append(dst, identifier))
+}
+
 func (p *PrimitiveUint32) ReadFrom(r io.Reader) (n int64, err error) {
 	if err = binary.Read(r, binary.BigEndian, (*uint32)(p)); err != nil {
 		return 0, err
@@ -57,6 +66,15 @@ func (p *PrimitiveUint32) ReadFrom(r io.Reader) (n int64, err error) {
 	return 4, nil
 }
 
+func (p *PrimitiveUint32) DecodeFrom(src []byte) (n int, err error) {
+	if len(src) < 4 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	*p = PrimitiveUint32(binary.BigEndian.Uint32(src))
+	return 4, nil
+}
+
 func (p *PrimitiveUint32) Length(property bool) (result VariableByteInt) {
 	result = 4
 	if property {
@@ -0,0 +1,101 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022-2023 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package primitives
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+var (
+	ErrStringTooLong       = errors.New("string exceeds the maximum length of 65535 bytes")
+	ErrInvalidUTF8         = errors.New("string is not well-formed UTF-8")
+	ErrNullCharacter       = errors.New("string contains the null character U+0000")
+	ErrDisallowedCodePoint = errors.New("string contains a disallowed code point")
+)
+
+// ValidateUTF8 returns ErrInvalidUTF8 if b is not well-formed UTF-8. It is used to validate UTF-8 Encoded Character
+// Data such as payloads with a payload format indicator of 1.
+func ValidateUTF8(b []byte) error {
+	if !utf8.Valid(b) {
+		return ErrInvalidUTF8
+	}
+	return nil
+}
+
+// ValidateString validates that s can be encoded as a UTF-8 Encoded String.
+func ValidateString(s string) error {
+	if len(s) > 65535 {
+		return ErrStringTooLong
+	}
+
+	// SPEC: A UTF-8 Encoded String MUST NOT include an encoding of the null character U+0000 [MQTT-1.5.4-2].
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 {
+			return ErrNullCharacter
+		}
+	}
+
+	// SPEC: The character data in a UTF-8 Encoded String MUST be well-formed UTF-8 as defined by the Unicode
+	//       specification and restated in RFC 3629. In particular, the character data MUST NOT include encodings of
+	//       code points between U+D800 and U+DFFF [MQTT-1.5.4-1].
+	// NOTE: utf8.ValidString rejects surrogate halves.
+	if !utf8.ValidString(s) {
+		return ErrInvalidUTF8
+	}
+
+	return nil
+}
+
+// ValidateStringStrict validates s like ValidateString and additionally rejects the code points that a UTF-8 Encoded
+// String should not include.
+func ValidateStringStrict(s string) error {
+	if err := ValidateString(s); err != nil {
+		return err
+	}
+
+	// SPEC: The data SHOULD NOT include encodings of the Unicode code points listed below. If a receiver (Server or
+	//       Client) receives a Control Packet containing any of them it MAY treat it as a Malformed Packet:
+	//       - U+0001..U+001F control characters
+	//       - U+007F..U+009F control characters
+	//       - Code points defined in the Unicode specification to be non-characters (for example U+0FFFF)
+	for _, r := range s {
+		if r <= 0x1F || (r >= 0x7F && r <= 0x9F) || isNonCharacter(r) {
+			return ErrDisallowedCodePoint
+		}
+	}
+
+	return nil
+}
+
+// isNonCharacter returns true if r is a Unicode non-character.
+func isNonCharacter(r rune) bool {
+	return (r >= 0xFDD0 && r <= 0xFDEF) || r&0xFFFE == 0xFFFE
+}
+
+// Validate validates that the string can be encoded as a UTF-8 Encoded String.
+func (p *PrimitiveString) Validate() error {
+	return ValidateString(string(*p))
+}
@@ -31,6 +31,8 @@ import (
 
 type VariableByteInt uint32
 
+var ErrMalformedVariableByteInt = errors.New("malformed variable byte integer")
+
 func (v *VariableByteInt) Length(property bool) (result VariableByteInt) {
 	if *v < 128 {
 		result = 1
@@ -53,7 +55,26 @@ func (v *VariableByteInt) Length(property bool) (result VariableByteInt) {
 }
 
 func (v *VariableByteInt) WriteTo(w io.Writer) (int64, error) {
-	result := make([]byte, 0, 4)
+	var buf [5]byte
+	count, err := w.Write(v.AppendTo(buf[:0]))
+
+	return int64(count), err
+}
+
+func (v *VariableByteInt) WriteToAsProperty(identifier byte, w io.Writer) (n int64, err error) {
+	if _, err = w.Write([]byte{identifier}); err != nil {
+		return 0, err
+	}
+
+	if n, err = v.WriteTo(w); err != nil {
+		return 0, err
+	}
+	n++
+
+	return
+}
+
+func (v *VariableByteInt) AppendTo(dst []byte) []byte {
 	tmp := uint32(*v)
 
 	for {
@@ -62,27 +83,47 @@ func (v *VariableByteInt) WriteTo(w io.Writer) (int64, error) {
 		if tmp > 0 {
 			b = b | 0x80
 		}
-		result = append(result, b)
+		dst = append(dst, b)
 		if tmp <= 0 {
 			break
 		}
 	}
 
-	count, err := w.Write(result)
+	return dst
+}
 
-	return int64(count), err
+func (v *VariableByteInt) AppendToAsProperty(identifier byte, dst []byte) []byte {
+	return v.AppendTo(append(dst, identifier))
 }
 
-func (v *VariableByteInt) WriteToAsProperty(identifier byte, w io.Writer) (n int64, err error) {
-	if _, err = w.Write([]byte{identifier}); err != nil {
-		return 0, err
-	}
+func (v *VariableByteInt) DecodeFrom(src []byte) (n int, err error) {
+	var mul uint32
+	var val uint32
 
-	if n, err = v.WriteTo(w); err != nil {
-		return 0, err
+	for {
+		// SPEC: The Variable Byte Integer is encoded using an encoding scheme which uses a single byte for values up
+		//       to 127. [...] This allows the encoding of numbers up to 268,435,455 (256 MB).
+		if n == 4 {
+			return 0, ErrMalformedVariableByteInt
+		}
+
+		if n >= len(src) {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		b := src[n]
+		n++
+
+		val |= uint32(b&127) << mul
+
+		if b&128 == 0 {
+			break
+		}
+
+		mul += 7
 	}
-	n++
 
+	*v = VariableByteInt(val)
 	return
 }
 
@@ -91,18 +132,20 @@ func (v *VariableByteInt) ReadFrom(r io.Reader) (n int64, err error) {
 	var val uint32
 
 	for {
-		var b [1]byte
-		if _, err = r.Read(b[:]); err != nil {
+		// SPEC: The maximum number of bytes in the Variable Byte Integer field is four.
+		if n == 4 {
+			return 0, ErrMalformedVariableByteInt
+		}
+
+		var b byte
+		if b, err = ReadByte(r); err != nil {
 			return 0, err
 		}
 		n++
 
-		val |= uint32(b[0]&127) << mul
-		if val > 268_435_455 {
-			return 0, errors.New("malformed variable byte integer")
-		}
+		val |= uint32(b&127) << mul
 
-		if b[0]&128 == 0 {
+		if b&128 == 0 {
 			break
 		}
 
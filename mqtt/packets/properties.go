@@ -0,0 +1,212 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package packets
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+type propertyKind byte
+
+const (
+	propertyByte propertyKind = iota + 1
+	propertyUint16
+	propertyUint32
+	propertyVarInt
+	propertyString
+	propertyBinary
+	propertyStringPair
+)
+
+// willProperties is used in place of a packet type for properties that are allowed in the will properties of CONNECT.
+const willProperties PacketType = 0
+
+type property struct {
+	name    string
+	kind    propertyKind
+	allowed uint32
+}
+
+func allowedIn(packetTypes ...PacketType) (mask uint32) {
+	for _, packetType := range packetTypes {
+		mask |= 1 << packetType
+	}
+	return
+}
+
+// properties describes every property defined by MQTT 5 indexed by its identifier.
+// SPEC: [2.2.2.2 Property]
+var properties = [...]property{
+	0x01: {"Payload Format Indicator", propertyByte, allowedIn(PUBLISH, willProperties)},
+	0x02: {"Message Expiry Interval", propertyUint32, allowedIn(PUBLISH, willProperties)},
+	0x03: {"Content Type", propertyString, allowedIn(PUBLISH, willProperties)},
+	0x08: {"Response Topic", propertyString, allowedIn(PUBLISH, willProperties)},
+	0x09: {"Correlation Data", propertyBinary, allowedIn(PUBLISH, willProperties)},
+	0x0B: {"Subscription Identifier", propertyVarInt, allowedIn(PUBLISH, SUBSCRIBE)},
+	0x11: {"Session Expiry Interval", propertyUint32, allowedIn(CONNECT, CONNACK, DISCONNECT)},
+	0x12: {"Assigned Client Identifier", propertyString, allowedIn(CONNACK)},
+	0x13: {"Server Keep Alive", propertyUint16, allowedIn(CONNACK)},
+	0x15: {"Authentication Method", propertyString, allowedIn(CONNECT, CONNACK, AUTH)},
+	0x16: {"Authentication Data", propertyBinary, allowedIn(CONNECT, CONNACK, AUTH)},
+	0x17: {"Request Problem Information", propertyByte, allowedIn(CONNECT)},
+	0x18: {"Will Delay Interval", propertyUint32, allowedIn(willProperties)},
+	0x19: {"Request Response Information", propertyByte, allowedIn(CONNECT)},
+	0x1A: {"Response Information", propertyString, allowedIn(CONNACK)},
+	0x1C: {"Server Reference", propertyString, allowedIn(CONNACK, DISCONNECT)},
+	0x1F: {"Reason String", propertyString, allowedIn(CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK,
+		DISCONNECT, AUTH)},
+	0x21: {"Receive Maximum", propertyUint16, allowedIn(CONNECT, CONNACK)},
+	0x22: {"Topic Alias Maximum", propertyUint16, allowedIn(CONNECT, CONNACK)},
+	0x23: {"Topic Alias", propertyUint16, allowedIn(PUBLISH)},
+	0x24: {"Maximum QoS", propertyByte, allowedIn(CONNACK)},
+	0x25: {"Retain Available", propertyByte, allowedIn(CONNACK)},
+	0x26: {"User Property", propertyStringPair, allowedIn(CONNECT, CONNACK, PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP,
+		SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK, DISCONNECT, AUTH, willProperties)},
+	0x27: {"Maximum Packet Size", propertyUint32, allowedIn(CONNECT, CONNACK)},
+	0x28: {"Wildcard Subscription Available", propertyByte, allowedIn(CONNACK)},
+	0x29: {"Subscription Identifier Available", propertyByte, allowedIn(CONNACK)},
+	0x2A: {"Shared Subscription Available", propertyByte, allowedIn(CONNACK)},
+}
+
+// propertySet records the properties decoded from a single property list so that duplicates can be detected when strict
+// validation is enabled.
+type propertySet struct {
+	seen   uint64
+	strict bool
+}
+
+// add validates that the property identifier may appear in the property list of the specified packet type and records
+// it. Unknown identifiers are always rejected since the length of their value cannot be determined.
+func (s *propertySet) add(packetType PacketType, identifier byte) error {
+	// Errors in the will properties are reported against the CONNECT control packet they are part of
+	reported := packetType
+	if packetType == willProperties {
+		reported = CONNECT
+	}
+
+	if int(identifier) >= len(properties) || properties[identifier].kind == 0 {
+		return fieldError(reported, "Property Identifier", ErrControlPacketIsMalformed)
+	}
+
+	if !s.strict {
+		return nil
+	}
+
+	p := properties[identifier]
+
+	// SPEC: A Control Packet which contains an Identifier which is not valid for its packet type [...] is a Malformed
+	//       Packet.
+	if p.allowed&(1<<packetType) == 0 {
+		return fieldError(reported, p.name, ErrControlPacketIsMalformed)
+	}
+
+	// SPEC: It is a Protocol Error to include [the property] more than once. User properties are allowed to appear
+	//       multiple times and so is the subscription identifier in a PUBLISH packet.
+	repeatable := identifier == 0x26 || (identifier == 0x0B && packetType == PUBLISH)
+	if s.seen&(1<<identifier) != 0 && !repeatable {
+		return fieldError(reported, p.name, ErrProtocolError)
+	}
+	s.seen |= 1 << identifier
+
+	return nil
+}
+
+// skipProperty returns the length of the value of a known property that is not decoded for the packet type.
+func skipProperty(identifier byte, src []byte) (n int, err error) {
+	switch properties[identifier].kind {
+	case propertyByte:
+		n = 1
+	case propertyUint16:
+		n = 2
+	case propertyUint32:
+		n = 4
+	case propertyVarInt:
+		var v primitives.VariableByteInt
+		return v.DecodeFrom(src)
+	case propertyString, propertyBinary:
+		if len(src) < 2 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n = 2 + int(binary.BigEndian.Uint16(src))
+	case propertyStringPair:
+		if n, err = skipProperty(0x03, src); err != nil {
+			return 0, err
+		}
+
+		var count int
+		if count, err = skipProperty(0x03, src[n:]); err != nil {
+			return 0, err
+		}
+		n += count
+	}
+
+	if n > len(src) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// propertyError returns a FieldError naming the property that failed to decode.
+func propertyError(packetType PacketType, identifier byte, err error) error {
+	name := "Property Identifier"
+	if int(identifier) < len(properties) && properties[identifier].kind != 0 {
+		name = properties[identifier].name
+	}
+	return fieldError(packetType, name, err)
+}
+
+// validateStringProperty validates that a string property can be encoded as a UTF-8 Encoded String.
+func validateStringProperty(packetType PacketType, identifier byte, s primitives.PrimitiveString) error {
+	if err := s.Validate(); err != nil {
+		return propertyError(packetType, identifier, err)
+	}
+	return nil
+}
+
+// validateUserProperties validates that every user property can be encoded as a UTF-8 String Pair.
+func validateUserProperties(packetType PacketType, pairs primitives.PrimitiveStringPairs) error {
+	for i := range pairs {
+		if err := validateStringProperty(packetType, 0x26, pairs[i].Key); err != nil {
+			return err
+		}
+
+		if err := validateStringProperty(packetType, 0x26, pairs[i].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRemaining validates that the decoded fields account for the entire remaining length of the control packet when
+// strict validation is enabled.
+func checkRemaining(packetType PacketType, strict bool, n int, src []byte) error {
+	if strict && n != len(src) {
+		return fieldError(packetType, "Remaining Length", ErrControlPacketIsMalformed)
+	}
+	return nil
+}
@@ -37,7 +37,7 @@ type Puback struct {
 
 	/* Properties */
 	ReasonString   primitives.PrimitiveString
-	UserProperties primitives.PrimitiveStringMap
+	UserProperties primitives.PrimitiveStringPairs
 }
 
 // Note: The following control packets have the same structure as PUBACK:
@@ -47,9 +47,13 @@ type Pubrec struct {
 }
 
 func (p *Pubrec) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, p.AppendTo)
+}
+
+func (p *Pubrec) AppendTo(dst []byte) ([]byte, error) {
 	// Override the packet type in the fixed header
 	p.Header.SetType(PUBREC)
-	return p.Puback.WriteTo(w)
+	return p.Puback.AppendTo(dst)
 }
 
 type Pubrel struct {
@@ -57,12 +61,16 @@ type Pubrel struct {
 }
 
 func (p *Pubrel) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, p.AppendTo)
+}
+
+func (p *Pubrel) AppendTo(dst []byte) ([]byte, error) {
 	// Override the packet type in the fixed header
 	p.Header.SetType(PUBREL)
 
 	// Pubrel has a reserved bit set to 1 in the fixed header
 	p.Header.SetFlags(0x02)
-	return p.Puback.WriteTo(w)
+	return p.Puback.AppendTo(dst)
 }
 
 type Pubcomp struct {
@@ -70,81 +78,115 @@ type Pubcomp struct {
 }
 
 func (p *Pubcomp) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, p.AppendTo)
+}
+
+func (p *Pubcomp) AppendTo(dst []byte) ([]byte, error) {
 	// Override the packet type in the fixed header
 	p.Header.SetType(PUBCOMP)
-	return p.Puback.WriteTo(w)
+	return p.Puback.AppendTo(dst)
 }
 
 ////////////////
 
 func (p *Puback) ReadFrom(r io.Reader) (n int64, err error) {
-	var count int64
+	return readFrom(r, p.Header.Remaining, p.DecodeFrom)
+}
 
-	if n, err = p.PacketIdentifier.ReadFrom(r); err != nil {
+// DecodeFrom decodes the variable header and properties of the PUBACK, PUBREC, PUBREL or PUBCOMP control packet from
+// src. The fixed header must already be set.
+func (p *Puback) DecodeFrom(src []byte) (n int, err error) {
+	var count int
+	packetType := p.Header.GetType()
+	if src, err = body(p.Header, src); err != nil {
 		return 0, err
 	}
 
-	if n >= int64(p.Header.Remaining) {
+	if n, err = p.PacketIdentifier.DecodeFrom(src); err != nil {
+		return 0, fieldError(packetType, "Packet Identifier", err)
+	}
+
+	if n >= len(src) {
 		return
 	}
 
-	if count, err = p.ReasonCode.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = p.ReasonCode.DecodeFrom(src[n:]); err != nil {
+		return 0, fieldError(packetType, "Reason Code", err)
 	}
 	n += count
 
-	if n >= int64(p.Header.Remaining) {
+	if n >= len(src) {
 		return
 	}
 
 	var propertiesLen primitives.VariableByteInt
-	if count, err = propertiesLen.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = propertiesLen.DecodeFrom(src[n:]); err != nil {
+		return 0, fieldError(packetType, "Property Length", err)
 	}
 	n += count
 
-	remaining := int64(propertiesLen)
-	for remaining > 0 {
+	end := n + int(propertiesLen)
+	if end > len(src) {
+		return 0, fieldError(packetType, "Property Length", ErrControlPacketIsMalformed)
+	}
+
+	seen := propertySet{strict: p.Header.Strict}
+	for n < end {
 		// Read the identifier byte
-		var identifier byte
-		if identifier, err = primitives.ReadByte(r); err != nil {
+		identifier := src[n]
+		n++
+
+		if err = seen.add(packetType, identifier); err != nil {
 			return 0, err
 		}
-		n++
-		remaining--
 
 		switch identifier {
 		case 0x1F: // Reason String
-			if count, err = p.ReasonString.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = p.ReasonString.DecodeFrom(src[n:end])
 		case 0x26: // User Property
-			if p.UserProperties == nil {
-				p.UserProperties = make(primitives.PrimitiveStringMap)
-			}
-			var k, v primitives.PrimitiveString
-			if count, err = k.ReadFrom(r); err != nil {
-				return 0, err
-			}
-
-			var count2 int64
-			if count2, err = v.ReadFrom(r); err != nil {
-				return 0, err
-			}
-			count += count2
-			p.UserProperties[k] = v
+			count, err = p.UserProperties.DecodeFrom(src[n:end])
+		default:
+			// Skip over properties that are not allowed for this packet type
+			count, err = skipProperty(identifier, src[n:end])
+		}
+
+		if err != nil {
+			return 0, propertyError(packetType, identifier, err)
 		}
 		n += count
-		remaining -= count
+	}
+
+	if err = checkRemaining(packetType, p.Header.Strict, n, src); err != nil {
+		return 0, err
 	}
 
 	return
 }
 
 func (p *Puback) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, p.AppendTo)
+}
+
+// AppendTo appends the encoded control packet to dst and returns the extended slice.
+func (p *Puback) AppendTo(dst []byte) ([]byte, error) {
 	variableHeaderLen := primitives.VariableByteInt(0)
 	propertiesLen := primitives.VariableByteInt(0)
 
+	// Default the packet type to PUBACK if one is not set. Possible prior values could only be PUBREL, PUBREC or
+	// PUBCOMP.
+	if p.Header.GetType() == 0 {
+		p.Header.SetType(PUBACK)
+	}
+	packetType := p.Header.GetType()
+
+	if err := validateStringProperty(packetType, 0x1F, p.ReasonString); err != nil {
+		return dst, err
+	}
+
+	if err := validateUserProperties(packetType, p.UserProperties); err != nil {
+		return dst, err
+	}
+
 	// Calculate length of variable header
 	variableHeaderLen += p.PacketIdentifier.Length(false)
 
@@ -152,9 +194,7 @@ func (p *Puback) WriteTo(w io.Writer) (n int64, err error) {
 		propertiesLen += p.ReasonString.Length(true)
 	}
 
-	for k, v := range p.UserProperties {
-		propertiesLen += 1 + k.Length(false) + v.Length(false)
-	}
+	propertiesLen += p.UserProperties.Length(true)
 
 	// SPEC: Byte 3 in the Variable Header is the PUBACK Reason Code. If the Remaining Length is 2, then there is no
 	//       Reason Code and the value of 0x00 (Success) is used.
@@ -166,66 +206,30 @@ func (p *Puback) WriteTo(w io.Writer) (n int64, err error) {
 
 	variableHeaderLen += propertiesLen.Length(false) + propertiesLen
 
-	// Default the packet type to PUBACK if one is not set. Possible prior values could only be PUBREL, PUBREC or
-	// PUBCOMP.
-	if p.Header.GetType() == 0 {
-		p.Header.SetType(PUBACK)
-	}
 	p.Header.Remaining = variableHeaderLen
 
 	// Write the control packet
-	var count int64
-	if n, err = p.Header.WriteTo(w); err != nil {
-		return 0, err
-	}
-
-	if count, err = p.PacketIdentifier.WriteTo(w); err != nil {
-		return 0, err
-	}
-	n += count
+	dst = p.Header.AppendTo(dst)
+	dst = p.PacketIdentifier.AppendTo(dst)
 
 	// SPEC: Byte 3 in the Variable Header is the PUBACK Reason Code. If the Remaining Length is 2, then there is no
 	//       Reason Code and the value of 0x00 (Success) is used.
 	// SPEC: The Reason Code and Property Length can be omitted if the Reason Code is 0x00 (Success) and there are no
 	//       Properties. In this case the PUBACK has a Remaining Length of 2.
 	if p.ReasonCode != 0 || propertiesLen != 0 {
-		if count, err = p.ReasonCode.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = p.ReasonCode.AppendTo(dst)
 	}
 
 	/* Properties begin */
-	if count, err = propertiesLen.WriteTo(w); err != nil {
-		return 0, err
-	}
-	n += count
+	dst = propertiesLen.AppendTo(dst)
 
 	if len(p.ReasonString) > 0 {
-		if count, err = p.ReasonString.WriteToAsProperty(0x1F, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = p.ReasonString.AppendToAsProperty(0x1F, dst)
 	}
 
 	// Write user properties
-	for k, v := range p.UserProperties {
-		if err = primitives.WriteByte(0x26, w); err != nil {
-			return 0, err
-		}
-		n++
-
-		if count, err = k.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-
-		if count, err = v.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-	}
+	dst = p.UserProperties.AppendToAsProperty(0x26, dst)
 	/* Properties end */
 
-	return
+	return dst, nil
 }
@@ -44,11 +44,12 @@ type Publish struct {
 	offset  int
 
 	/* Properties */
+	PayloadFormatIndicator primitives.PrimitiveByte
 	MessageExpiryInterval  primitives.PrimitiveUint32
 	TopicAlias             primitives.PrimitiveUint16
 	ResponseTopic          primitives.PrimitiveString
-	CorrelationData        primitives.PrimitiveString
-	UserProperties         primitives.PrimitiveStringMap
+	CorrelationData        primitives.PrimitiveBinary
+	UserProperties         primitives.PrimitiveStringPairs
 	SubscriptionIdentifier primitives.VariableByteInt
 	ContentType            primitives.PrimitiveString
 
@@ -87,15 +88,37 @@ func (p *Publish) Reset() {
 }
 
 func (p *Publish) ReadFrom(r io.Reader) (n int64, err error) {
-	var count, offset int64
-
 	// Read the header from the reader if it has not been initialized
 	if p.Header.GetType() == 0 {
-		if count, err = p.Header.ReadFrom(r); err != nil {
+		if n, err = p.Header.ReadFrom(r); err != nil {
 			return
 		}
-		n += count
-		offset = 2
+	}
+
+	var count int64
+	if count, err = readFrom(r, p.Header.Remaining, p.DecodeFrom); err != nil {
+		return 0, err
+	}
+	n += count
+
+	return
+}
+
+// DecodeFrom decodes the PUBLISH control packet from src. The fixed header is decoded from src first if it has not been
+// set. The payload is copied so that src can be reused by the caller. The payload is not validated against the payload
+// format indicator so that the receiver can acknowledge an invalid payload with Reason Code 0x99 using ValidatePayload.
+func (p *Publish) DecodeFrom(src []byte) (n int, err error) {
+	var count, i int
+
+	// Decode the header if it has not been initialized
+	if p.Header.GetType() == 0 {
+		if n, err = p.Header.DecodeFrom(src); err != nil {
+			return 0, err
+		}
+	}
+
+	if src, err = body(p.Header, src[n:]); err != nil {
+		return 0, err
 	}
 
 	// Parse flags
@@ -104,100 +127,95 @@ func (p *Publish) ReadFrom(r io.Reader) (n int64, err error) {
 	p.Duplicate = ((p.Header.GetFlags() >> 3) & 0x01) != 0
 
 	// Read variable header
-	if count, err = p.Topic.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = p.Topic.DecodeFrom(src); err != nil {
+		return 0, fieldError(PUBLISH, "Topic Name", err)
+	}
+	i += count
+
+	// SPEC: The Topic Name in the PUBLISH packet MUST NOT contain wildcard characters [MQTT-3.3.2-2].
+	if len(p.Topic) > 0 {
+		if err = ValidateTopicName(string(p.Topic)); err != nil {
+			return 0, fieldError(PUBLISH, "Topic Name", err)
+		}
+
+		if p.Header.Strict {
+			if err = primitives.ValidateStringStrict(string(p.Topic)); err != nil {
+				return 0, fieldError(PUBLISH, "Topic Name", err)
+			}
+		}
 	}
-	n += count
 
 	if p.QoS > QoS0 {
-		if count, err = p.PacketIdentifier.ReadFrom(r); err != nil {
-			return 0, err
+		if count, err = p.PacketIdentifier.DecodeFrom(src[i:]); err != nil {
+			return 0, fieldError(PUBLISH, "Packet Identifier", err)
 		}
-		n += count
+		i += count
 	}
 
 	/* Properties start */
 	var propertiesLen primitives.VariableByteInt
-	if count, err = propertiesLen.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = propertiesLen.DecodeFrom(src[i:]); err != nil {
+		return 0, fieldError(PUBLISH, "Property Length", err)
 	}
-	n += count
+	i += count
 
-	if n >= int64(p.Header.Remaining) {
-		return
+	end := i + int(propertiesLen)
+	if end > len(src) {
+		return 0, fieldError(PUBLISH, "Property Length", ErrControlPacketIsMalformed)
 	}
 
-	remaining := int64(propertiesLen)
-	for remaining > 0 {
+	seen := propertySet{strict: p.Header.Strict}
+	for i < end {
 		// Read the identifier byte
-		var identifier byte
-		if identifier, err = primitives.ReadByte(r); err != nil {
+		identifier := src[i]
+		i++
+
+		if err = seen.add(PUBLISH, identifier); err != nil {
 			return 0, err
 		}
-		n++
-		remaining--
 
 		switch identifier {
+		case 0x01: // Payload format indicator
+			count, err = p.PayloadFormatIndicator.DecodeFrom(src[i:end])
 		case 0x02: // Message expiry interval
-			if count, err = p.MessageExpiryInterval.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = p.MessageExpiryInterval.DecodeFrom(src[i:end])
 		case 0x23: // Topic alias
-			if count, err = p.TopicAlias.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = p.TopicAlias.DecodeFrom(src[i:end])
 		case 0x08: // Response topic
-			if count, err = p.ResponseTopic.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = p.ResponseTopic.DecodeFrom(src[i:end])
 		case 0x09: // Correlation data
-			if count, err = p.CorrelationData.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = p.CorrelationData.DecodeFrom(src[i:end])
 		case 0x26: // User Property
-			if p.UserProperties == nil {
-				p.UserProperties = make(primitives.PrimitiveStringMap)
-			}
-			var k, v primitives.PrimitiveString
-			if count, err = k.ReadFrom(r); err != nil {
-				return 0, err
-			}
-
-			var count2 int64
-			if count2, err = v.ReadFrom(r); err != nil {
-				return 0, err
-			}
-			count += count2
-			p.UserProperties[k] = v
+			count, err = p.UserProperties.DecodeFrom(src[i:end])
 		case 0x0B: // Subscription identifier
-			if count, err = p.SubscriptionIdentifier.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = p.SubscriptionIdentifier.DecodeFrom(src[i:end])
 		case 0x03: // Content type
-			if count, err = p.ContentType.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = p.ContentType.DecodeFrom(src[i:end])
+		default:
+			// Skip over properties that are not allowed for this packet type
+			count, err = skipProperty(identifier, src[i:end])
 		}
-		n += count
-		remaining -= count
-	}
-	/* Properties end */
 
-	// Read the payload
-	payloadLen := int64(p.Header.Remaining) - n + offset
-	if payloadLen > 0 {
-		p.Payload = make([]byte, payloadLen)
-		if count, err := r.Read(p.Payload); err != nil {
-			return 0, err
-		} else {
-			n += int64(count)
+		if err != nil {
+			return 0, propertyError(PUBLISH, identifier, err)
 		}
+		i += count
 	}
+	/* Properties end */
+
+	// The remainder of the control packet is the payload
+	p.Payload = append(p.Payload[:0], src[i:]...)
+	n += len(src)
 
 	return
 }
 
 func (p *Publish) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, p.AppendTo)
+}
+
+// AppendTo appends the encoded PUBLISH control packet to dst and returns the extended slice.
+func (p *Publish) AppendTo(dst []byte) ([]byte, error) {
 	var flags primitives.PrimitiveByte
 	variableHeaderLen := primitives.VariableByteInt(0)
 	propertiesLen := primitives.VariableByteInt(0)
@@ -209,7 +227,29 @@ func (p *Publish) WriteTo(w io.Writer) (n int64, err error) {
 	// SPEC: If a Topic Alias mapping has been set at the receiver, a sender can send a PUBLISH packet that contains
 	//       that Topic Alias and a zero length Topic Name.
 	if len(p.Topic) == 0 && p.TopicAlias == 0 {
-		return 0, ErrControlPacketIsMalformed
+		return dst, ErrControlPacketIsMalformed
+	}
+
+	if len(p.Topic) > 0 {
+		if err := ValidateTopicName(string(p.Topic)); err != nil {
+			return dst, fieldError(PUBLISH, "Topic Name", err)
+		}
+	}
+
+	if err := p.ValidatePayload(); err != nil {
+		return dst, err
+	}
+
+	if err := validateStringProperty(PUBLISH, 0x08, p.ResponseTopic); err != nil {
+		return dst, err
+	}
+
+	if err := validateUserProperties(PUBLISH, p.UserProperties); err != nil {
+		return dst, err
+	}
+
+	if err := validateStringProperty(PUBLISH, 0x03, p.ContentType); err != nil {
+		return dst, err
 	}
 
 	// Calculate length of properties and payload
@@ -219,6 +259,10 @@ func (p *Publish) WriteTo(w io.Writer) (n int64, err error) {
 		variableHeaderLen += p.PacketIdentifier.Length(false)
 	}
 
+	if p.PayloadFormatIndicator > 0 {
+		propertiesLen += p.PayloadFormatIndicator.Length(true)
+	}
+
 	if p.MessageExpiryInterval > 0 {
 		propertiesLen += p.MessageExpiryInterval.Length(true)
 	}
@@ -235,9 +279,7 @@ func (p *Publish) WriteTo(w io.Writer) (n int64, err error) {
 		propertiesLen += p.CorrelationData.Length(true)
 	}
 
-	for k, v := range p.UserProperties {
-		propertiesLen += 1 + k.Length(false) + v.Length(false)
-	}
+	propertiesLen += p.UserProperties.Length(true)
 
 	if p.SubscriptionIdentifier > 0 {
 		propertiesLen += p.SubscriptionIdentifier.Length(true)
@@ -264,99 +306,65 @@ func (p *Publish) WriteTo(w io.Writer) (n int64, err error) {
 	p.Header.SetFlags(flags)
 	p.Header.Remaining = variableHeaderLen + payloadLen
 
-	var count int64
-
 	// Write fixed header
-	if n, err = p.Header.WriteTo(w); err != nil {
-		return 0, err
-	}
-
-	if count, err = p.Topic.WriteTo(w); err != nil {
-		return 0, err
-	}
-	n += count
+	dst = p.Header.AppendTo(dst)
+	dst = p.Topic.AppendTo(dst)
 
 	if p.QoS > QoS0 {
-		if count, err = p.PacketIdentifier.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = p.PacketIdentifier.AppendTo(dst)
 	}
 
 	/* Properties start */
-	if count, err = propertiesLen.WriteTo(w); err != nil {
-		return 0, err
+	dst = propertiesLen.AppendTo(dst)
+
+	if p.PayloadFormatIndicator > 0 {
+		dst = p.PayloadFormatIndicator.AppendToAsProperty(0x01, dst)
 	}
-	n += count
 
 	if p.MessageExpiryInterval > 0 {
-		if count, err = p.MessageExpiryInterval.WriteToAsProperty(0x02, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = p.MessageExpiryInterval.AppendToAsProperty(0x02, dst)
 	}
 
 	if p.TopicAlias > 0 {
-		if count, err = p.TopicAlias.WriteToAsProperty(0x23, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = p.TopicAlias.AppendToAsProperty(0x23, dst)
 	}
 
 	if len(p.ResponseTopic) > 0 {
-		if count, err = p.ResponseTopic.WriteToAsProperty(0x08, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = p.ResponseTopic.AppendToAsProperty(0x08, dst)
 	}
 
 	if len(p.CorrelationData) > 0 {
-		if count, err = p.CorrelationData.WriteToAsProperty(0x09, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = p.CorrelationData.AppendToAsProperty(0x09, dst)
 	}
 
-	for k, v := range p.UserProperties {
-		if err = primitives.WriteByte(0x26, w); err != nil {
-			return 0, err
-		}
-		n++
-
-		if count, err = k.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-
-		if count, err = v.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-	}
+	dst = p.UserProperties.AppendToAsProperty(0x26, dst)
 
 	if p.SubscriptionIdentifier > 0 {
-		if count, err = p.SubscriptionIdentifier.WriteToAsProperty(0x0B, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = p.SubscriptionIdentifier.AppendToAsProperty(0x0B, dst)
 	}
 
 	if len(p.ContentType) > 0 {
-		if count, err = p.ContentType.WriteToAsProperty(0x03, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = p.ContentType.AppendToAsProperty(0x03, dst)
 	}
 	/* Properties end */
 
 	//Finally, write the payload
-	if len(p.Payload) > 0 {
-		if count, err := w.Write(p.Payload); err != nil {
-			return 0, err
-		} else {
-			n += int64(count)
+	dst = append(dst, p.Payload...)
+
+	return dst, nil
+}
+
+// ValidatePayload validates that the payload is UTF-8 Encoded Character Data if the payload format indicator says so.
+// ReasonCode 0x99 (Payload format invalid) is returned otherwise.
+func (p *Publish) ValidatePayload() error {
+	// SPEC: 1 (0x01) Byte Indicates that the Payload is UTF-8 Encoded Character Data. The UTF-8 data in the Payload
+	//       MUST be well-formed UTF-8 as defined by the Unicode specification and restated in RFC 3629 [MQTT-3.3.2-4].
+	// SPEC: A receiver (Client or Server) MAY validate that the Payload is of the format indicated, and if it is not
+	//       send a PUBACK, PUBREC, or DISCONNECT with Reason Code of 0x99 (Payload format invalid).
+	if p.PayloadFormatIndicator == 1 {
+		if err := primitives.ValidateUTF8(p.Payload); err != nil {
+			return fieldError(PUBLISH, "Payload", ReasonCode(0x99))
 		}
 	}
-
-	return
+	return nil
 }
@@ -0,0 +1,287 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022-2023 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+func TestPublish_AppendTo(t *testing.T) {
+	pub := Publish{
+		QoS:                   QoS1,
+		Topic:                 "test/topic",
+		PacketIdentifier:      1234,
+		MessageExpiryInterval: 60,
+		ContentType:           "text/plain",
+		CorrelationData:       []byte{0x00, 0xFF, 0xC0}, // Not valid UTF-8
+		Payload:               []byte("hello"),
+	}
+
+	buf, err := pub.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The append and writer paths must produce identical output
+	var w bytes.Buffer
+	if _, err = pub.WriteTo(&w); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, w.Bytes()) {
+		t.Fatalf("AppendTo() = %x, WriteTo() = %x", buf, w.Bytes())
+	}
+
+	// Decode the packet using both the slice and reader paths
+	decoded := Publish{}
+	n, err := decoded.DecodeFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(buf) {
+		t.Errorf("DecodeFrom() consumed %d bytes, want %d", n, len(buf))
+	}
+
+	read := Publish{}
+	if _, err = read.ReadFrom(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, got := range []Publish{decoded, read} {
+		if got.Topic != pub.Topic || got.QoS != pub.QoS || got.PacketIdentifier != pub.PacketIdentifier ||
+			got.MessageExpiryInterval != pub.MessageExpiryInterval || got.ContentType != pub.ContentType ||
+			!bytes.Equal(got.CorrelationData, pub.CorrelationData) || !bytes.Equal(got.Payload, pub.Payload) {
+			t.Errorf("decoded publish %+v does not match %+v", got, pub)
+		}
+	}
+}
+
+func TestPublish_UserProperties(t *testing.T) {
+	pub := Publish{
+		Topic:   "test/topic",
+		Payload: []byte("hello"),
+	}
+	pub.UserProperties.Add("trace", "b")
+	pub.UserProperties.Add("span", "1")
+	pub.UserProperties.Add("trace", "a")
+
+	buf, err := pub.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encoding must be deterministic
+	for i := 0; i < 10; i++ {
+		again, err := pub.AppendTo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, again) {
+			t.Fatalf("AppendTo() = %x, want %x", again, buf)
+		}
+	}
+
+	decoded := Publish{}
+	if _, err = decoded.DecodeFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.UserProperties) != len(pub.UserProperties) {
+		t.Fatalf("decoded %d user properties, want %d", len(decoded.UserProperties), len(pub.UserProperties))
+	}
+	for i := range pub.UserProperties {
+		if decoded.UserProperties[i] != pub.UserProperties[i] {
+			t.Errorf("user property %d = %v, want %v", i, decoded.UserProperties[i], pub.UserProperties[i])
+		}
+	}
+
+	if values := decoded.UserProperties.GetAll("trace"); len(values) != 2 || values[0] != "b" || values[1] != "a" {
+		t.Errorf("GetAll(trace) = %v, want [b a]", values)
+	}
+
+	decoded.UserProperties.Set("trace", "c")
+	if value, ok := decoded.UserProperties.Get("trace"); !ok || value != "c" {
+		t.Errorf("Get(trace) = %q, %v, want c, true", value, ok)
+	}
+	if values := decoded.UserProperties.GetAll("trace"); len(values) != 1 {
+		t.Errorf("GetAll(trace) after Set = %v, want [c]", values)
+	}
+	if decoded.UserProperties[1].Key != "span" {
+		t.Errorf("Set() did not preserve order: %v", decoded.UserProperties)
+	}
+}
+
+func TestPublish_DecodeFromTruncated(t *testing.T) {
+	pub := Publish{
+		Topic:   "test/topic",
+		Payload: []byte("hello"),
+	}
+
+	buf, err := pub.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(buf); i++ {
+		decoded := Publish{}
+		if _, err = decoded.DecodeFrom(buf[:i]); err == nil {
+			t.Errorf("DecodeFrom() with %d of %d bytes succeeded", i, len(buf))
+		}
+	}
+}
+
+func TestPublish_AppendToAllocs(t *testing.T) {
+	pub := Publish{
+		QoS:     QoS0,
+		Topic:   "test/topic",
+		Payload: []byte("hello"),
+	}
+
+	buf := make([]byte, 0, 128)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = pub.AppendTo(buf[:0])
+	})
+
+	if allocs != 0 {
+		t.Errorf("AppendTo() allocated %v times per run, want 0", allocs)
+	}
+}
+
+func TestPrimitives_AppendToAllocs(t *testing.T) {
+	str := primitives.PrimitiveString("test/topic")
+	varint := primitives.VariableByteInt(268_435_455)
+	u16 := primitives.PrimitiveUint16(1234)
+	u32 := primitives.PrimitiveUint32(123456)
+
+	buf := make([]byte, 0, 128)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = str.AppendTo(buf[:0])
+		buf = varint.AppendTo(buf)
+		buf = u16.AppendToAsProperty(0x21, buf)
+		buf = u32.AppendToAsProperty(0x11, buf)
+	})
+
+	if allocs != 0 {
+		t.Errorf("AppendTo() allocated %v times per run, want 0", allocs)
+	}
+}
+
+func BenchmarkPublish_AppendTo(b *testing.B) {
+	pub := Publish{
+		QoS:     QoS0,
+		Topic:   "test/topic",
+		Payload: make([]byte, 64),
+	}
+
+	buf := make([]byte, 0, 128)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, _ = pub.AppendTo(buf[:0])
+	}
+}
+
+func BenchmarkPublish_WriteTo(b *testing.B) {
+	pub := Publish{
+		QoS:     QoS0,
+		Topic:   "test/topic",
+		Payload: make([]byte, 64),
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pub.WriteTo(io.Discard)
+	}
+}
+
+func BenchmarkPublish_DecodeFrom(b *testing.B) {
+	pub := Publish{
+		QoS:     QoS0,
+		Topic:   "test/topic",
+		Payload: make([]byte, 64),
+	}
+
+	buf, _ := pub.AppendTo(nil)
+	decoded := Publish{}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		decoded.Header = FixedHeader{}
+		decoded.DecodeFrom(buf)
+	}
+}
+
+func TestPublish_PayloadFormatIndicator(t *testing.T) {
+	pub := Publish{
+		Topic:                  "test/topic",
+		PayloadFormatIndicator: 1,
+		Payload:                []byte("héllo"),
+	}
+
+	buf, err := pub.AppendTo(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := Publish{}
+	if _, err = decoded.DecodeFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.PayloadFormatIndicator != 1 {
+		t.Errorf("PayloadFormatIndicator = %d, want 1", decoded.PayloadFormatIndicator)
+	}
+
+	// Payloads that are not UTF-8 are rejected when encoding and left to the receiver when decoding
+	pub.Payload = []byte{0xC0, 0xAF}
+	if _, err = pub.AppendTo(nil); !errors.Is(err, ReasonCode(0x99)) {
+		t.Errorf("AppendTo() = %v, want %v", err, ReasonCode(0x99))
+	}
+	if !strings.Contains(err.Error(), "payload format invalid") {
+		t.Errorf("AppendTo() error = %q, want it to mention the invalid payload format", err)
+	}
+
+	pub.PayloadFormatIndicator = 0
+	if buf, err = pub.AppendTo(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set the payload format indicator in the encoded packet by hand: header(2) + topic(12) + properties length(1)
+	raw := append([]byte{}, buf[:14]...)
+	raw = append(raw, 0x02, 0x01, 0x01)
+	raw = append(raw, pub.Payload...)
+	raw[1] += 2
+
+	decoded = Publish{}
+	if _, err = decoded.DecodeFrom(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err = decoded.ValidatePayload(); !errors.Is(err, ReasonCode(0x99)) {
+		t.Errorf("ValidatePayload() = %v, want %v", err, ReasonCode(0x99))
+	}
+}
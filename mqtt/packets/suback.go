@@ -36,90 +36,82 @@ type Suback struct {
 
 	/* Properties */
 	ReasonString   primitives.PrimitiveString
-	UserProperties primitives.PrimitiveStringMap
+	UserProperties primitives.PrimitiveStringPairs
 
 	/* Payload */
 	ReasonCodes []byte
 }
 
 func (s *Suback) ReadFrom(r io.Reader) (n int64, err error) {
-	var count int64
+	return readFrom(r, s.Header.Remaining, s.DecodeFrom)
+}
 
-	/* Variable header begin */
-	if n, err = s.PacketIdentifier.ReadFrom(r); err != nil {
+// DecodeFrom decodes the variable header, properties and payload of the SUBACK control packet from src. The fixed header
+// must already be set.
+func (s *Suback) DecodeFrom(src []byte) (n int, err error) {
+	var count int
+	if src, err = body(s.Header, src); err != nil {
 		return 0, err
 	}
 
-	if n >= int64(s.Header.Remaining) {
+	/* Variable header begin */
+	if n, err = s.PacketIdentifier.DecodeFrom(src); err != nil {
+		return 0, fieldError(SUBACK, "Packet Identifier", err)
+	}
+
+	if n >= len(src) {
 		return
 	}
 	/* Variable header end */
 
 	/* Properties header start */
 	var propertiesLen primitives.VariableByteInt
-	if count, err = propertiesLen.ReadFrom(r); err != nil {
-		return 0, err
+	if count, err = propertiesLen.DecodeFrom(src[n:]); err != nil {
+		return 0, fieldError(SUBACK, "Property Length", err)
 	}
 	n += count
 
-	if n >= int64(s.Header.Remaining) {
-		return
+	end := n + int(propertiesLen)
+	if end > len(src) {
+		return 0, fieldError(SUBACK, "Property Length", ErrControlPacketIsMalformed)
 	}
 
-	remaining := int64(propertiesLen)
-	for remaining > 0 {
+	seen := propertySet{strict: s.Header.Strict}
+	for n < end {
 		// Read the identifier byte
-		var identifier byte
-		if identifier, err = primitives.ReadByte(r); err != nil {
+		identifier := src[n]
+		n++
+
+		if err = seen.add(SUBACK, identifier); err != nil {
 			return 0, err
 		}
-		n++
-		remaining--
 
 		switch identifier {
 		case 0x1F: // Reason String
-			if count, err = s.ReasonString.ReadFrom(r); err != nil {
-				return 0, err
-			}
+			count, err = s.ReasonString.DecodeFrom(src[n:end])
 		case 0x26: // User Property
-			if s.UserProperties == nil {
-				s.UserProperties = make(primitives.PrimitiveStringMap)
-			}
-			var k, v primitives.PrimitiveString
-			if count, err = k.ReadFrom(r); err != nil {
-				return 0, err
-			}
-
-			var count2 int64
-			if count2, err = v.ReadFrom(r); err != nil {
-				return 0, err
-			}
-			count += count2
-			s.UserProperties[k] = v
+			count, err = s.UserProperties.DecodeFrom(src[n:end])
+		default:
+			// Skip over properties that are not allowed for this packet type
+			count, err = skipProperty(identifier, src[n:end])
+		}
+
+		if err != nil {
+			return 0, propertyError(SUBACK, identifier, err)
 		}
 		n += count
-		remaining -= count
 	}
 
 	// Fail if this is the end of the control packet
-	if n >= int64(s.Header.Remaining) {
-		return 0, ErrControlPacketIsMalformed
+	if n >= len(src) {
+		return 0, fieldError(SUBACK, "Reason Codes", ErrControlPacketIsMalformed)
 	}
 	/* Properties header end */
 
 	/* Payload begin */
-	{
-		var count int
-
-		// Allocate memory for storing the reason codes
-		s.ReasonCodes = make([]byte, int64(s.Header.Remaining)-n)
-
-		// Read the reason codes
-		if count, err = io.ReadFull(r, s.ReasonCodes); err != nil {
-			return 0, err
-		}
-		n += int64(count)
-	}
+	// Copy the reason codes so that src can be reused by the caller
+	s.ReasonCodes = append(s.ReasonCodes[:0], src[n:]...)
+	n = len(src)
 	/* Payload end */
 
 	return
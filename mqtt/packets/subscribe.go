@@ -35,13 +35,18 @@ type Subscribe struct {
 
 	/* Properties */
 	SubscriptionIdentifier primitives.VariableByteInt
-	UserProperties         primitives.PrimitiveStringMap
+	UserProperties         primitives.PrimitiveStringPairs
 
 	/* Payload */
 	Topics []Topic
 }
 
 func (s *Subscribe) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, s.AppendTo)
+}
+
+// AppendTo appends the encoded SUBSCRIBE control packet to dst and returns the extended slice.
+func (s *Subscribe) AppendTo(dst []byte) ([]byte, error) {
 	variableHeaderLen := primitives.VariableByteInt(0)
 	propertiesLen := primitives.VariableByteInt(0)
 	payloadLen := primitives.VariableByteInt(0)
@@ -49,7 +54,11 @@ func (s *Subscribe) WriteTo(w io.Writer) (n int64, err error) {
 	// Fail early if no topics were specified
 	// SPEC: The Payload MUST contain at least one Topic filter and Subscription options pair [MQTT-3.8.3-2]
 	if len(s.Topics) == 0 {
-		return 0, ErrControlPacketIsMalformed
+		return dst, ErrControlPacketIsMalformed
+	}
+
+	if err := validateUserProperties(SUBSCRIBE, s.UserProperties); err != nil {
+		return dst, err
 	}
 
 	// Calculate length of properties
@@ -57,14 +66,14 @@ func (s *Subscribe) WriteTo(w io.Writer) (n int64, err error) {
 		propertiesLen += s.SubscriptionIdentifier.Length(true)
 	}
 
-	for k, v := range s.UserProperties {
-		//[IDENTIFIER = 1] + [STRING LENGTHS = 2+2] + [LEN(KEY STRING) = N] + [LEN(VALUE STRING) = N]
-		// NOTE: User properties does not implement Primitive yet
-		propertiesLen += 1 + k.Length(false) + v.Length(false)
-	}
+	propertiesLen += s.UserProperties.Length(true)
 
 	// Calculate length of payload
 	for _, topic := range s.Topics {
+		if err := ValidateTopicFilter(topic.Filter()); err != nil {
+			return dst, fieldError(SUBSCRIBE, "Topic Filter", err)
+		}
+
 		payloadLen += topic.filter.Length(false) + topic.options.Length(false)
 	}
 
@@ -81,63 +90,28 @@ func (s *Subscribe) WriteTo(w io.Writer) (n int64, err error) {
 	//       respectively. The Server MUST treat any other value as malformed and close the Network Connection
 	//       [MQTT-3.8.1-1].
 	fh.SetFlags(0x02)
-
-	var count int64
-	if n, err = fh.WriteTo(w); err != nil {
-		return 0, err
-	}
+	dst = fh.AppendTo(dst)
 
 	// Write packet identifier
-	if count, err = s.PacketIdentifier.WriteTo(w); err != nil {
-		return 0, err
-	}
-	n += count
+	dst = s.PacketIdentifier.AppendTo(dst)
 
 	/* Properties begin */
-	if count, err = propertiesLen.WriteTo(w); err != nil {
-		return 0, err
-	}
-	n += count
+	dst = propertiesLen.AppendTo(dst)
 
 	// Write subscription identifier
 	if s.SubscriptionIdentifier > 0 {
-		if count, err = s.SubscriptionIdentifier.WriteToAsProperty(0x0B, w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = s.SubscriptionIdentifier.AppendToAsProperty(0x0B, dst)
 	}
 
 	// Write user properties
-	for k, v := range s.UserProperties {
-		if err = primitives.WriteByte(0x26, w); err != nil {
-			return 0, err
-		}
-		n++
-
-		if count, err = k.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-
-		if count, err = v.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-	}
+	dst = s.UserProperties.AppendToAsProperty(0x26, dst)
 	/* Properties end */
 	/* Payload begin */
 	for _, topic := range s.Topics {
-		if count, err = topic.filter.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-
-		if count, err = topic.options.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = topic.filter.AppendTo(dst)
+		dst = topic.options.AppendTo(dst)
 	}
 	/* Payload end */
 
-	return
+	return dst, nil
 }
@@ -24,7 +24,135 @@
 
 package packets
 
-import "github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+import (
+	"strings"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+// sharePrefix is the first topic level of a shared subscription.
+const sharePrefix = "$share/"
+
+// SharedSubscription is a topic filter of the form $share/{ShareName}/{filter}. The server delivers each message
+// matching Filter to only one of the sessions subscribed with the same ShareName.
+type SharedSubscription struct {
+	ShareName string
+	Filter    string
+}
+
+// String returns the topic filter of the shared subscription as sent in the SUBSCRIBE control packet.
+func (s SharedSubscription) String() string {
+	return sharePrefix + s.ShareName + "/" + s.Filter
+}
+
+// IsSharedSubscription returns true if filter starts with the $share topic level.
+func IsSharedSubscription(filter string) bool {
+	return strings.HasPrefix(filter, sharePrefix)
+}
+
+// ParseSharedSubscription splits a shared subscription into its share name and topic filter. ok is false if filter is
+// not a shared subscription. ReasonCode 0x8F (Topic Filter invalid) is returned if the share name or the topic filter
+// is invalid.
+func ParseSharedSubscription(filter string) (shared SharedSubscription, ok bool, err error) {
+	if !IsSharedSubscription(filter) {
+		return shared, false, nil
+	}
+
+	rest := filter[len(sharePrefix):]
+	separator := strings.IndexByte(rest, '/')
+	if separator < 0 {
+		return shared, true, ReasonCode(0x8F)
+	}
+	shared.ShareName = rest[:separator]
+	shared.Filter = rest[separator+1:]
+
+	// SPEC: A Shared Subscription's Topic Filter MUST start with $share/ and MUST contain a ShareName that is at least
+	//       one character long [MQTT-4.8.2-1].
+	// SPEC: The ShareName MUST NOT contain the characters "/", "+" or "#", but MUST be followed by a "/" character.
+	//       This "/" character MUST be followed by a Topic Filter [MQTT-4.8.2-2].
+	if len(shared.ShareName) == 0 || strings.ContainsAny(shared.ShareName, "+#") || len(shared.Filter) == 0 {
+		return shared, true, ReasonCode(0x8F)
+	}
+
+	return shared, true, nil
+}
+
+// ValidateTopicName returns ReasonCode 0x90 (Topic Name invalid) if name cannot be used as the topic name of a PUBLISH
+// control packet.
+func ValidateTopicName(name string) error {
+	// SPEC: All Topic Names and Topic Filters MUST be at least one character long [MQTT-4.7.3-1].
+	if len(name) == 0 {
+		return ReasonCode(0x90)
+	}
+
+	// SPEC: Topic Names and Topic Filters MUST NOT include the null character (Unicode U+0000) [MQTT-4.7.3-2].
+	// SPEC: Topic Names and Topic Filters are UTF-8 Encoded Strings; they MUST NOT encode to more than 65,535 bytes
+	//       [MQTT-4.7.3-3].
+	if err := primitives.ValidateString(name); err != nil {
+		return ReasonCode(0x90)
+	}
+
+	// SPEC: The wildcard characters can be used in Topic Filters, but MUST NOT be used within a Topic Name
+	//       [MQTT-4.7.0-1].
+	for i := 0; i < len(name); i++ {
+		if name[i] == '+' || name[i] == '#' {
+			return ReasonCode(0x90)
+		}
+	}
+
+	return nil
+}
+
+// ValidateTopicFilter returns ReasonCode 0x8F (Topic Filter invalid) if filter cannot be used as the topic filter of a
+// SUBSCRIBE or UNSUBSCRIBE control packet.
+func ValidateTopicFilter(filter string) error {
+	// SPEC: All Topic Names and Topic Filters MUST be at least one character long [MQTT-4.7.3-1].
+	if len(filter) == 0 {
+		return ReasonCode(0x8F)
+	}
+
+	if err := primitives.ValidateString(filter); err != nil {
+		return ReasonCode(0x8F)
+	}
+
+	// Validate the share name and the topic filter of a shared subscription separately
+	if shared, ok, err := ParseSharedSubscription(filter); ok {
+		if err != nil {
+			return err
+		}
+		filter = shared.Filter
+	}
+
+	levelStart := 0
+	for i := 0; i <= len(filter); i++ {
+		if i < len(filter) && filter[i] != '/' {
+			continue
+		}
+
+		level := filter[levelStart:i]
+		for j := 0; j < len(level); j++ {
+			switch level[j] {
+			case '#':
+				// SPEC: The multi-level wildcard character MUST be specified either on its own or following a topic
+				//       level separator. In either case it MUST be the last character specified in the Topic Filter
+				//       [MQTT-4.7.1-1].
+				if len(level) != 1 || i != len(filter) {
+					return ReasonCode(0x8F)
+				}
+			case '+':
+				// SPEC: The single-level wildcard can be used at any level in the Topic Filter, including first and
+				//       last levels. Where it is used, it MUST occupy an entire level of the filter [MQTT-4.7.1-2].
+				if len(level) != 1 {
+					return ReasonCode(0x8F)
+				}
+			}
+		}
+
+		levelStart = i + 1
+	}
+
+	return nil
+}
 
 type Topic struct {
 	filter  primitives.PrimitiveString
@@ -39,17 +167,28 @@ func (t *Topic) SetQoS(qos QoS) *Topic {
 	return t
 }
 
+// QoS returns the maximum QoS requested for the subscription.
+func (t *Topic) QoS() QoS {
+	return QoS(t.options & 0x03)
+}
+
 func (t *Topic) Filter() string {
 	return string(t.filter)
 }
 
+// Shared returns the share name and topic filter if the topic filter is a shared subscription.
+func (t *Topic) Shared() (shared SharedSubscription, ok bool) {
+	shared, ok, err := ParseSharedSubscription(t.Filter())
+	return shared, ok && err == nil
+}
+
 func (t *Topic) SetFilter(filter string) *Topic {
-	if len(t.filter) >= 6 && t.filter[:6] == "$share" {
+	t.filter = primitives.PrimitiveString(filter)
+	if IsSharedSubscription(filter) {
 		// Unset no local option
 		// SPEC: It is a Protocol Error to set the No Local bit to 1 on a Shared Subscription [MQTT-3.8.3-4]
 		t.SetNoLocal(false)
 	}
-	t.filter = primitives.PrimitiveString(filter)
 	return t
 }
 
@@ -59,7 +198,7 @@ func (t *Topic) SetNoLocal(on bool) *Topic {
 
 	// Leave bit unset if this is a shared subscription
 	// SPEC: It is a Protocol Error to set the No Local bit to 1 on a Shared Subscription [MQTT-3.8.3-4]
-	if on && t.filter[:6] != "$share" {
+	if on && !IsSharedSubscription(t.Filter()) {
 		t.options |= primitives.PrimitiveByte(1 << 2)
 	}
 	return t
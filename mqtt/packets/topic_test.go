@@ -0,0 +1,181 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package packets
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+func TestValidateTopicName(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		want  error
+	}{
+		{name: "simple", topic: "sensors/a"},
+		{name: "leadingSlash", topic: "/test/ping"},
+		{name: "emptyLevels", topic: "a//b/"},
+		{name: "system", topic: "$SYS/broker/uptime"},
+		{name: "unicode", topic: "capteurs/température"},
+		{name: "empty", topic: "", want: ReasonCode(0x90)},
+		{name: "singleLevelWildcard", topic: "sensors/+", want: ReasonCode(0x90)},
+		{name: "multiLevelWildcard", topic: "sensors/#", want: ReasonCode(0x90)},
+		{name: "embeddedWildcard", topic: "sensors/a+b", want: ReasonCode(0x90)},
+		{name: "nullCharacter", topic: "sensors/\x00", want: ReasonCode(0x90)},
+		{name: "invalidUTF8", topic: "sensors/\xff", want: ReasonCode(0x90)},
+		{name: "surrogate", topic: "sensors/\xed\xa0\x80", want: ReasonCode(0x90)},
+		{name: "tooLong", topic: strings.Repeat("a", 65536), want: ReasonCode(0x90)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateTopicName(tt.topic); err != tt.want {
+				t.Errorf("ValidateTopicName() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		want   error
+	}{
+		{name: "simple", filter: "sensors/a"},
+		{name: "multiLevel", filter: "#"},
+		{name: "multiLevelLast", filter: "sensors/#"},
+		{name: "singleLevel", filter: "+"},
+		{name: "singleLevelFirst", filter: "+/a"},
+		{name: "singleLevelMiddle", filter: "sensors/+/temperature"},
+		{name: "singleLevelLast", filter: "sensors/+"},
+		{name: "combined", filter: "+/+/#"},
+		{name: "emptyLevels", filter: "/+//#"},
+		{name: "empty", filter: "", want: ReasonCode(0x8F)},
+		{name: "multiLevelNotLast", filter: "sensors/#/a", want: ReasonCode(0x8F)},
+		{name: "multiLevelNotAlone", filter: "sensors#", want: ReasonCode(0x8F)},
+		{name: "multiLevelSuffix", filter: "sensors/#a", want: ReasonCode(0x8F)},
+		{name: "singleLevelNotAlone", filter: "sensors/a+", want: ReasonCode(0x8F)},
+		{name: "singleLevelPrefix", filter: "+a/b", want: ReasonCode(0x8F)},
+		{name: "nullCharacter", filter: "a/\x00", want: ReasonCode(0x8F)},
+		{name: "invalidUTF8", filter: "a/\xc3", want: ReasonCode(0x8F)},
+		{name: "shared", filter: "$share/group/sensors/+"},
+		{name: "sharedMultiLevel", filter: "$share/group/#"},
+		{name: "sharedEmptyShareName", filter: "$share//sensors", want: ReasonCode(0x8F)},
+		{name: "sharedNoFilter", filter: "$share/group", want: ReasonCode(0x8F)},
+		{name: "sharedEmptyFilter", filter: "$share/group/", want: ReasonCode(0x8F)},
+		{name: "sharedWildcardShareName", filter: "$share/gr+oup/sensors", want: ReasonCode(0x8F)},
+		{name: "sharedInvalidFilter", filter: "$share/group/sensors/#/a", want: ReasonCode(0x8F)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateTopicFilter(tt.filter); err != tt.want {
+				t.Errorf("ValidateTopicFilter() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateStringStrict(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want error
+	}{
+		{name: "valid", s: "hello, wörld"},
+		{name: "controlCharacter", s: "a\nb", want: primitives.ErrDisallowedCodePoint},
+		{name: "c1ControlCharacter", s: "a\u0085b", want: primitives.ErrDisallowedCodePoint},
+		{name: "nonCharacter", s: "a￿b", want: primitives.ErrDisallowedCodePoint},
+		{name: "nullCharacter", s: "a\x00b", want: primitives.ErrNullCharacter},
+		{name: "invalidUTF8", s: "a\x80b", want: primitives.ErrInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := primitives.ValidateStringStrict(tt.s); err != tt.want {
+				t.Errorf("ValidateStringStrict() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicValidation_EncodeDecode(t *testing.T) {
+	pub := Publish{Topic: "sensors/+", Payload: []byte("x")}
+	if _, err := pub.AppendTo(nil); !errors.Is(err, ReasonCode(0x90)) {
+		t.Errorf("Publish.AppendTo() error = %v, want %v", err, ReasonCode(0x90))
+	}
+
+	subscribe := Subscribe{PacketIdentifier: 1}
+	topic := Topic{}
+	topic.SetFilter("sensors/#/a")
+	subscribe.Topics = append(subscribe.Topics, topic)
+	if _, err := subscribe.AppendTo(nil); !errors.Is(err, ReasonCode(0x8F)) {
+		t.Errorf("Subscribe.AppendTo() error = %v, want %v", err, ReasonCode(0x8F))
+	}
+
+	// PUBLISH with a wildcard in the topic name
+	if err := decodeRaw([]byte{0x30, 0x04, 0x00, 0x01, '#', 0x00}, false); !errors.Is(err, ReasonCode(0x90)) {
+		t.Errorf("DecodeFrom() error = %v, want %v", err, ReasonCode(0x90))
+	}
+
+	// PUBLISH with a topic name that is not well-formed UTF-8
+	if err := decodeRaw([]byte{0x30, 0x04, 0x00, 0x01, 0xFF, 0x00}, false); !errors.Is(err, ErrControlPacketIsMalformed) {
+		t.Errorf("DecodeFrom() error = %v, want %v", err, ErrControlPacketIsMalformed)
+	}
+}
+
+func TestParseSharedSubscription(t *testing.T) {
+	shared, ok, err := ParseSharedSubscription("$share/group/sensors/+")
+	if err != nil || !ok {
+		t.Fatalf("ParseSharedSubscription() = %v, %v", ok, err)
+	}
+	if shared.ShareName != "group" || shared.Filter != "sensors/+" {
+		t.Errorf("ParseSharedSubscription() = %+v, want group and sensors/+", shared)
+	}
+	if shared.String() != "$share/group/sensors/+" {
+		t.Errorf("String() = %q", shared.String())
+	}
+
+	if _, ok, _ = ParseSharedSubscription("sensors/+"); ok {
+		t.Error("ParseSharedSubscription() of an ordinary filter returned ok")
+	}
+
+	topic := Topic{}
+	topic.SetFilter("$share/group/sensors/+").SetNoLocal(true)
+	if topic.options&(1<<2) != 0 {
+		t.Error("SetNoLocal() set the No Local bit on a shared subscription")
+	}
+	if shared, ok = topic.Shared(); !ok || shared.Filter != "sensors/+" {
+		t.Errorf("Shared() = %+v, %v", shared, ok)
+	}
+
+	// SetNoLocal must not panic on short topic filters
+	topic.SetFilter("a").SetNoLocal(true)
+	if topic.options&(1<<2) == 0 {
+		t.Error("SetNoLocal() did not set the No Local bit")
+	}
+}
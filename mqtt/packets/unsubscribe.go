@@ -33,13 +33,18 @@ type Unsubscribe struct {
 	PacketIdentifier primitives.PrimitiveUint16
 
 	/* Properties */
-	UserProperties primitives.PrimitiveStringMap
+	UserProperties primitives.PrimitiveStringPairs
 
 	/* Payload */
 	Topics []Topic
 }
 
 func (u *Unsubscribe) WriteTo(w io.Writer) (n int64, err error) {
+	return writeTo(w, u.AppendTo)
+}
+
+// AppendTo appends the encoded UNSUBSCRIBE control packet to dst and returns the extended slice.
+func (u *Unsubscribe) AppendTo(dst []byte) ([]byte, error) {
 	variableHeaderLen := primitives.VariableByteInt(0)
 	propertiesLen := primitives.VariableByteInt(0)
 	payloadLen := primitives.VariableByteInt(0)
@@ -47,16 +52,22 @@ func (u *Unsubscribe) WriteTo(w io.Writer) (n int64, err error) {
 	// Fail early if no topics were specified
 	// SPEC: The Payload of an UNSUBSCRIBE packet MUST contain at least one Topic Filter [MQTT-3.10.3-2]
 	if len(u.Topics) == 0 {
-		return 0, ErrControlPacketIsMalformed
+		return dst, ErrControlPacketIsMalformed
 	}
 
-	// Calculate length of properties
-	for k, v := range u.UserProperties {
-		propertiesLen += 1 + k.Length(false) + v.Length(false)
+	if err := validateUserProperties(UNSUBSCRIBE, u.UserProperties); err != nil {
+		return dst, err
 	}
 
+	// Calculate length of properties
+	propertiesLen += u.UserProperties.Length(true)
+
 	// Calculate length of payload
 	for _, topic := range u.Topics {
+		if err := ValidateTopicFilter(topic.Filter()); err != nil {
+			return dst, fieldError(UNSUBSCRIBE, "Topic Filter", err)
+		}
+
 		payloadLen += topic.filter.Length(false)
 	}
 
@@ -73,51 +84,23 @@ func (u *Unsubscribe) WriteTo(w io.Writer) (n int64, err error) {
 	//       respectively. The Server MUST treat any other value as malformed and close the Network Connection
 	//       [MQTT-3.10.1-1].
 	fh.SetFlags(0x02)
-
-	var count int64
-	if n, err = fh.WriteTo(w); err != nil {
-		return 0, err
-	}
+	dst = fh.AppendTo(dst)
 
 	// Write packet identifier
-	if count, err = u.PacketIdentifier.WriteTo(w); err != nil {
-		return 0, err
-	}
-	n += count
+	dst = u.PacketIdentifier.AppendTo(dst)
 
 	/* Properties begin */
-	if count, err = propertiesLen.WriteTo(w); err != nil {
-		return 0, err
-	}
-	n += count
+	dst = propertiesLen.AppendTo(dst)
 
 	// Write user properties
-	for k, v := range u.UserProperties {
-		if err = primitives.WriteByte(0x26, w); err != nil {
-			return 0, err
-		}
-		n++
-
-		if count, err = k.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-
-		if count, err = v.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
-	}
+	dst = u.UserProperties.AppendToAsProperty(0x26, dst)
 	/* Properties end */
 
 	/* Payload begin */
 	for _, topic := range u.Topics {
-		if count, err = topic.filter.WriteTo(w); err != nil {
-			return 0, err
-		}
-		n += count
+		dst = topic.filter.AppendTo(dst)
 	}
 	/* Payload end */
 
-	return
+	return dst, nil
 }
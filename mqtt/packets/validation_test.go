@@ -0,0 +1,323 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+// decodeRaw decodes a control packet from its raw bytes including the fixed header.
+func decodeRaw(raw []byte, strict bool) error {
+	header := FixedHeader{Strict: strict}
+	n, err := header.DecodeFrom(raw)
+	if err != nil {
+		return err
+	}
+
+	var decodeFn func([]byte) (int, error)
+	switch header.GetType() {
+	case CONNECT:
+		decodeFn = (&Connect{Header: header}).DecodeFrom
+	case CONNACK:
+		decodeFn = (&Connack{Header: header}).DecodeFrom
+	case PUBLISH:
+		decodeFn = (&Publish{Header: header}).DecodeFrom
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		decodeFn = (&Puback{Header: header}).DecodeFrom
+	case SUBACK:
+		decodeFn = (&Suback{Header: header}).DecodeFrom
+	case UNSUBACK:
+		decodeFn = (&Unsuback{Header: header}).DecodeFrom
+	case DISCONNECT:
+		decodeFn = (&Disconnect{Header: header}).DecodeFrom
+	case AUTH:
+		decodeFn = (&Auth{Header: header}).DecodeFrom
+	}
+
+	_, err = decodeFn(raw[n:])
+	return err
+}
+
+func TestDecodeFrom_Validation(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       []byte
+		strict    bool
+		wantField string
+		wantErr   error
+	}{
+		{
+			name: "validPuback",
+			raw:  []byte{0x40, 0x02, 0x00, 0x01},
+		},
+		{
+			name:      "unknownProperty",
+			raw:       []byte{0x40, 0x05, 0x00, 0x01, 0x00, 0x01, 0x7F},
+			wantField: "Property Identifier",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name: "disallowedPropertySkipped",
+			raw:  []byte{0x30, 0x0B, 0x00, 0x01, 't', 0x05, 0x11, 0x00, 0x00, 0x00, 0x3C, 'h', 'i'},
+		},
+		{
+			name:      "disallowedPropertyStrict",
+			raw:       []byte{0x30, 0x0B, 0x00, 0x01, 't', 0x05, 0x11, 0x00, 0x00, 0x00, 0x3C, 'h', 'i'},
+			strict:    true,
+			wantField: "Session Expiry Interval",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name: "duplicatePropertyAccepted",
+			raw:  []byte{0x40, 0x0C, 0x00, 0x01, 0x80, 0x08, 0x1F, 0x00, 0x01, 'a', 0x1F, 0x00, 0x01, 'b'},
+		},
+		{
+			name:      "duplicatePropertyStrict",
+			raw:       []byte{0x40, 0x0C, 0x00, 0x01, 0x80, 0x08, 0x1F, 0x00, 0x01, 'a', 0x1F, 0x00, 0x01, 'b'},
+			strict:    true,
+			wantField: "Reason String",
+			wantErr:   ErrProtocolError,
+		},
+		{
+			name:   "repeatedUserPropertyStrict",
+			raw:    []byte{0x40, 0x10, 0x00, 0x01, 0x80, 0x0C, 0x26, 0x00, 0x01, 'k', 0x00, 0x00, 0x26, 0x00, 0x01, 'k', 0x00, 0x00},
+			strict: true,
+		},
+		{
+			name:      "reservedFlagsStrict",
+			raw:       []byte{0x91, 0x04, 0x00, 0x01, 0x00, 0x00},
+			strict:    true,
+			wantField: "Fixed Header Flags",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name:      "publishQoS3",
+			raw:       []byte{0x36, 0x06, 0x00, 0x01, 't', 0x00, 0x01, 0x00},
+			wantField: "QoS",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name:      "publishDupQoS0Strict",
+			raw:       []byte{0x38, 0x04, 0x00, 0x01, 't', 0x00},
+			strict:    true,
+			wantField: "DUP",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name:      "propertyExceedsRemainingLength",
+			raw:       []byte{0xE0, 0x03, 0x00, 0x05, 0x11},
+			wantField: "Property Length",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name:      "truncatedProperty",
+			raw:       []byte{0xE0, 0x05, 0x00, 0x03, 0x11, 0x00, 0x00},
+			wantField: "Session Expiry Interval",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name: "trailingBytesAccepted",
+			raw:  []byte{0xE0, 0x03, 0x00, 0x00, 0xFF},
+		},
+		{
+			name:      "trailingBytesStrict",
+			raw:       []byte{0xE0, 0x03, 0x00, 0x00, 0xFF},
+			strict:    true,
+			wantField: "Remaining Length",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name:      "connackReservedFlagsStrict",
+			raw:       []byte{0x20, 0x03, 0x02, 0x00, 0x00},
+			strict:    true,
+			wantField: "Connect Acknowledge Flags",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name:      "connectReservedFlag",
+			raw:       []byte{0x10, 0x0D, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00},
+			wantField: "Connect Flags",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name:      "connectWillQoSWithoutWill",
+			raw:       []byte{0x10, 0x0D, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00},
+			wantField: "Connect Flags",
+			wantErr:   ErrControlPacketIsMalformed,
+		},
+		{
+			name:      "connectUnsupportedVersion",
+			raw:       []byte{0x10, 0x0D, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			wantField: "Protocol Version",
+			wantErr:   ReasonCode(0x84),
+		},
+		{
+			name: "connectDuplicateWillPropertyStrict",
+			raw: []byte{0x10, 0x1D, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x0A, 0x18, 0x00, 0x00, 0x00, 0x01, 0x18, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01, 't', 0x00, 0x00},
+			strict:    true,
+			wantField: "Will Delay Interval",
+			wantErr:   ErrProtocolError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := decodeRaw(tt.raw, tt.strict)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("DecodeFrom() error = %v, want nil", err)
+				}
+				return
+			}
+
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) {
+				t.Fatalf("DecodeFrom() error = %v, want *FieldError", err)
+			}
+
+			if fieldErr.Field != tt.wantField {
+				t.Errorf("FieldError.Field = %q, want %q", fieldErr.Field, tt.wantField)
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("DecodeFrom() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrimitiveString_ReadFromShortReads(t *testing.T) {
+	var s primitives.PrimitiveString
+	r := iotest.OneByteReader(bytes.NewReader([]byte{0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}))
+
+	n, err := s.ReadFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 7 || s != "hello" {
+		t.Errorf("ReadFrom() = %d, %q, want 7, %q", n, s, "hello")
+	}
+}
+
+func TestAppendTo_StringValidation(t *testing.T) {
+	long := primitives.PrimitiveString(strings.Repeat("a", 65536))
+	null := primitives.PrimitiveString("a\x00b")
+
+	tests := []struct {
+		name       string
+		appendTo   func([]byte) ([]byte, error)
+		wantPacket PacketType
+		wantField  string
+	}{
+		{
+			name:       "connectClientIdTooLong",
+			appendTo:   (&Connect{Version: MQTT5, ClientId: long}).AppendTo,
+			wantPacket: CONNECT,
+			wantField:  "Client Identifier",
+		},
+		{
+			name: "connectUserPropertyNull",
+			appendTo: (&Connect{Version: MQTT5, UserProperties: primitives.PrimitiveStringPairs{
+				{Key: "key", Value: null},
+			}}).AppendTo,
+			wantPacket: CONNECT,
+			wantField:  "User Property",
+		},
+		{
+			name:       "willContentTypeNull",
+			appendTo:   (&Connect{Version: MQTT5, Will: &Will{Topic: "t", ContentType: null}}).AppendTo,
+			wantPacket: CONNECT,
+			wantField:  "Content Type",
+		},
+		{
+			name:       "publishContentTypeNull",
+			appendTo:   (&Publish{Topic: "t", ContentType: null}).AppendTo,
+			wantPacket: PUBLISH,
+			wantField:  "Content Type",
+		},
+		{
+			name:       "publishResponseTopicTooLong",
+			appendTo:   (&Publish{Topic: "t", ResponseTopic: long}).AppendTo,
+			wantPacket: PUBLISH,
+			wantField:  "Response Topic",
+		},
+		{
+			name:       "pubrecReasonStringNull",
+			appendTo:   (&Pubrec{Puback{ReasonString: null}}).AppendTo,
+			wantPacket: PUBREC,
+			wantField:  "Reason String",
+		},
+		{
+			name: "subscribeUserPropertyTooLong",
+			appendTo: (&Subscribe{Topics: []Topic{{filter: "t"}}, UserProperties: primitives.PrimitiveStringPairs{
+				{Key: long, Value: "value"},
+			}}).AppendTo,
+			wantPacket: SUBSCRIBE,
+			wantField:  "User Property",
+		},
+		{
+			name:       "disconnectServerReferenceNull",
+			appendTo:   (&Disconnect{ServerReference: null}).AppendTo,
+			wantPacket: DISCONNECT,
+			wantField:  "Server Reference",
+		},
+		{
+			name:       "authMethodNull",
+			appendTo:   (&Auth{AuthenticationMethod: null}).AppendTo,
+			wantPacket: AUTH,
+			wantField:  "Authentication Method",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, err := tt.appendTo(nil)
+
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) {
+				t.Fatalf("AppendTo() error = %v, want *FieldError", err)
+			}
+
+			if fieldErr.PacketType != tt.wantPacket || fieldErr.Field != tt.wantField {
+				t.Errorf("FieldError = %s %q, want %s %q", fieldErr.PacketType, fieldErr.Field, tt.wantPacket,
+					tt.wantField)
+			}
+
+			if !errors.Is(err, ErrControlPacketIsMalformed) {
+				t.Errorf("AppendTo() error = %v, want %v", err, ErrControlPacketIsMalformed)
+			}
+
+			if len(dst) != 0 {
+				t.Errorf("AppendTo() appended %d bytes, want 0", len(dst))
+			}
+		})
+	}
+}
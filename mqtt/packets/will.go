@@ -0,0 +1,264 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022-2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package packets
+
+import (
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+// Will is the Will Message that the server publishes on behalf of the client when the network connection is closed
+// without a DISCONNECT control packet with Reason Code 0x00 (Normal disconnection).
+// SPEC: [3.1.2.5 Will Flag] [3.1.3.2 Will Properties]
+type Will struct {
+	Topic   primitives.PrimitiveString
+	Payload primitives.PrimitiveBinary
+	QoS     QoS
+	Retain  bool
+
+	/* Will properties */
+	DelayInterval          primitives.PrimitiveUint32
+	PayloadFormatIndicator primitives.PrimitiveByte
+	MessageExpiryInterval  primitives.PrimitiveUint32
+	ContentType            primitives.PrimitiveString
+	ResponseTopic          primitives.PrimitiveString
+	CorrelationData        primitives.PrimitiveBinary
+	UserProperties         primitives.PrimitiveStringPairs
+}
+
+// NewWill creates a Will Message that is published to topic with QoS 0.
+func NewWill(topic string, payload []byte) *Will {
+	return &Will{
+		Topic:   primitives.PrimitiveString(topic),
+		Payload: payload,
+	}
+}
+
+func (w *Will) SetQoS(qos QoS) *Will {
+	w.QoS = qos
+	return w
+}
+
+func (w *Will) SetRetain(on bool) *Will {
+	w.Retain = on
+	return w
+}
+
+// SetDelayInterval sets the time the server waits after the network connection is closed before publishing the Will
+// Message. The interval is truncated to whole seconds.
+func (w *Will) SetDelayInterval(interval time.Duration) *Will {
+	w.DelayInterval = primitives.PrimitiveUint32(interval / time.Second)
+	return w
+}
+
+// SetMessageExpiryInterval sets the lifetime of the Will Message once it has been published. The interval is truncated
+// to whole seconds and zero means that the message does not expire.
+func (w *Will) SetMessageExpiryInterval(interval time.Duration) *Will {
+	w.MessageExpiryInterval = primitives.PrimitiveUint32(interval / time.Second)
+	return w
+}
+
+// SetPayloadFormatIndicator declares whether the payload is UTF-8 Encoded Character Data.
+func (w *Will) SetPayloadFormatIndicator(utf8 bool) *Will {
+	w.PayloadFormatIndicator = 0
+	if utf8 {
+		w.PayloadFormatIndicator = 1
+	}
+	return w
+}
+
+func (w *Will) SetContentType(contentType string) *Will {
+	w.ContentType = primitives.PrimitiveString(contentType)
+	return w
+}
+
+func (w *Will) SetResponseTopic(topic string) *Will {
+	w.ResponseTopic = primitives.PrimitiveString(topic)
+	return w
+}
+
+func (w *Will) SetCorrelationData(data []byte) *Will {
+	w.CorrelationData = data
+	return w
+}
+
+func (w *Will) AddUserProperty(key, value string) *Will {
+	w.UserProperties.Add(key, value)
+	return w
+}
+
+// validate validates the Will Message before it is encoded.
+func (w *Will) validate() error {
+	// SPEC: If the Will Flag is set to 1, the value of Will QoS can be 0 (0x00), 1 (0x01), or 2 (0x02). It MUST NOT be 3
+	//       (0x03) [MQTT-3.1.2-12].
+	if w.QoS > QoS2 {
+		return fieldError(CONNECT, "Will QoS", ErrControlPacketIsMalformed)
+	}
+
+	if err := ValidateTopicName(string(w.Topic)); err != nil {
+		return fieldError(CONNECT, "Will Topic", err)
+	}
+
+	if err := validateStringProperty(CONNECT, 0x03, w.ContentType); err != nil {
+		return err
+	}
+
+	if err := validateStringProperty(CONNECT, 0x08, w.ResponseTopic); err != nil {
+		return err
+	}
+
+	if err := validateUserProperties(CONNECT, w.UserProperties); err != nil {
+		return err
+	}
+
+	return w.validatePayload()
+}
+
+// validatePayload validates that the payload is UTF-8 Encoded Character Data if the payload format indicator says so.
+func (w *Will) validatePayload() error {
+	// SPEC: If the Payload Format Indicator is 1, the Will Message is UTF-8 Encoded Character Data.
+	if w.PayloadFormatIndicator == 1 {
+		if err := primitives.ValidateUTF8(w.Payload); err != nil {
+			return fieldError(CONNECT, "Will Payload", ReasonCode(0x99))
+		}
+	}
+	return nil
+}
+
+// propertiesLength returns the length of the will properties excluding the Property Length field.
+func (w *Will) propertiesLength() (n primitives.VariableByteInt) {
+	if w.DelayInterval > 0 {
+		n += w.DelayInterval.Length(true)
+	}
+
+	if w.PayloadFormatIndicator > 0 {
+		n += w.PayloadFormatIndicator.Length(true)
+	}
+
+	if w.MessageExpiryInterval > 0 {
+		n += w.MessageExpiryInterval.Length(true)
+	}
+
+	if len(w.ContentType) > 0 {
+		n += w.ContentType.Length(true)
+	}
+
+	if len(w.ResponseTopic) > 0 {
+		n += w.ResponseTopic.Length(true)
+	}
+
+	if len(w.CorrelationData) > 0 {
+		n += w.CorrelationData.Length(true)
+	}
+
+	n += w.UserProperties.Length(true)
+	return
+}
+
+// appendProperties appends the will properties including the Property Length field to dst.
+func (w *Will) appendProperties(propertiesLen primitives.VariableByteInt, dst []byte) []byte {
+	dst = propertiesLen.AppendTo(dst)
+
+	if w.DelayInterval > 0 {
+		dst = w.DelayInterval.AppendToAsProperty(0x18, dst)
+	}
+
+	if w.PayloadFormatIndicator > 0 {
+		dst = w.PayloadFormatIndicator.AppendToAsProperty(0x01, dst)
+	}
+
+	if w.MessageExpiryInterval > 0 {
+		dst = w.MessageExpiryInterval.AppendToAsProperty(0x02, dst)
+	}
+
+	if len(w.ContentType) > 0 {
+		dst = w.ContentType.AppendToAsProperty(0x03, dst)
+	}
+
+	if len(w.ResponseTopic) > 0 {
+		dst = w.ResponseTopic.AppendToAsProperty(0x08, dst)
+	}
+
+	if len(w.CorrelationData) > 0 {
+		dst = w.CorrelationData.AppendToAsProperty(0x09, dst)
+	}
+
+	return w.UserProperties.AppendToAsProperty(0x26, dst)
+}
+
+// decodeProperties decodes the will properties including the Property Length field from src. strict enables the strict
+// validation of the CONNECT control packet that the will properties are part of.
+func (w *Will) decodeProperties(src []byte, strict bool) (n int, err error) {
+	var count int
+	var propertiesLen primitives.VariableByteInt
+	if count, err = propertiesLen.DecodeFrom(src); err != nil {
+		return 0, fieldError(CONNECT, "Will Property Length", err)
+	}
+	n += count
+
+	end := n + int(propertiesLen)
+	if end > len(src) {
+		return 0, fieldError(CONNECT, "Will Property Length", ErrControlPacketIsMalformed)
+	}
+
+	seen := propertySet{strict: strict}
+	for n < end {
+		// Read the identifier byte
+		identifier := src[n]
+		n++
+
+		if err = seen.add(willProperties, identifier); err != nil {
+			return 0, err
+		}
+
+		switch identifier {
+		case 0x18: // Will Delay Interval
+			count, err = w.DelayInterval.DecodeFrom(src[n:end])
+		case 0x01: // Payload Format Indicator
+			count, err = w.PayloadFormatIndicator.DecodeFrom(src[n:end])
+		case 0x02: // Message Expiry Interval
+			count, err = w.MessageExpiryInterval.DecodeFrom(src[n:end])
+		case 0x03: // Content Type
+			count, err = w.ContentType.DecodeFrom(src[n:end])
+		case 0x08: // Response Topic
+			count, err = w.ResponseTopic.DecodeFrom(src[n:end])
+		case 0x09: // Correlation Data
+			count, err = w.CorrelationData.DecodeFrom(src[n:end])
+		case 0x26: // User Property
+			count, err = w.UserProperties.DecodeFrom(src[n:end])
+		default:
+			// Skip over properties that are not allowed in the will properties
+			count, err = skipProperty(identifier, src[n:end])
+		}
+
+		if err != nil {
+			return 0, propertyError(CONNECT, identifier, err)
+		}
+		n += count
+	}
+
+	return n, nil
+}
@@ -0,0 +1,159 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"sync"
+)
+
+// quotaWaiter is a caller blocked in acquire. ready is closed once its weight has been acquired.
+type quotaWaiter struct {
+	n     int
+	ready chan struct{}
+}
+
+// quotaSemaphore is a weighted semaphore that limits the number of QoS 1 and QoS 2 publishes sent to the server for
+// which no acknowledgement has been received yet. Blocked callers acquire the quota in the order in which they called
+// acquire so that a publish is never overtaken by later ones.
+// SPEC: [4.9 Flow Control]
+type quotaSemaphore struct {
+	mutex   sync.Mutex
+	maximum int
+	used    int
+	waiters []*quotaWaiter
+}
+
+// reset sets the maximum to the Receive Maximum of the server for a new network connection. No publish is in flight
+// afterwards and blocked callers are woken up as far as the new maximum allows.
+// SPEC: If the Receive Maximum value is absent, then its value defaults to 65,535.
+func (q *quotaSemaphore) reset(maximum uint16) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if maximum == 0 {
+		maximum = defaultReceiveMaximum
+	}
+	q.maximum = int(maximum)
+	q.used = 0
+	q.notify()
+}
+
+// acquire blocks until n publishes may be sent. It returns ctx.Err() once ctx is done and ErrClientStopped once
+// stopped is closed, in which case nothing is acquired. ErrInvalidArgument is returned if n exceeds the maximum.
+func (q *quotaSemaphore) acquire(ctx context.Context, n int, stopped <-chan struct{}) (err error) {
+	q.mutex.Lock()
+	if n > q.maximum {
+		q.mutex.Unlock()
+		return ErrInvalidArgument
+	}
+
+	// Only take the quota directly if nobody is waiting for it already
+	if len(q.waiters) == 0 && q.used+n <= q.maximum {
+		q.used += n
+		q.mutex.Unlock()
+		return nil
+	}
+
+	w := &quotaWaiter{n: n, ready: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	q.mutex.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-stopped:
+		err = ErrClientStopped
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	select {
+	case <-w.ready:
+		// The quota was acquired in the meantime. Hand it to the next caller.
+		q.used -= n
+	default:
+		for i, waiter := range q.waiters {
+			if waiter == w {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// Callers queued behind this one may fit now
+	q.notify()
+	return err
+}
+
+// consume takes n publishes from the quota without blocking. It is used for publishes that are resent when the session
+// is resumed.
+func (q *quotaSemaphore) consume(n int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.used += n; q.used > q.maximum {
+		q.used = q.maximum
+	}
+}
+
+// release returns n publishes to the quota once they have been acknowledged.
+func (q *quotaSemaphore) release(n int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Acknowledgements for publishes sent on an earlier connection do not count
+	if q.used -= n; q.used < 0 {
+		q.used = 0
+	}
+	q.notify()
+}
+
+// available returns the number of publishes that may be sent without blocking.
+func (q *quotaSemaphore) available() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.maximum - q.used
+}
+
+// notify wakes up blocked callers in order for as long as the quota suffices. The caller must hold the mutex.
+func (q *quotaSemaphore) notify() {
+	for len(q.waiters) > 0 {
+		w := q.waiters[0]
+		if q.used+w.n > q.maximum {
+			// Later callers must not overtake the first one
+			break
+		}
+
+		q.used += w.n
+		q.waiters[0] = nil
+		q.waiters = q.waiters[1:]
+		close(w.ready)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+// acquireAsync calls acquire on its own goroutine and sends the result on the returned channel.
+func acquireAsync(ctx context.Context, q *quotaSemaphore, n int) <-chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- q.acquire(ctx, n, nil)
+	}()
+	return errChan
+}
+
+// waitWaiters waits for the specified number of callers to be blocked in acquire.
+func waitWaiters(t *testing.T, q *quotaSemaphore, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		q.mutex.Lock()
+		waiting := len(q.waiters)
+		q.mutex.Unlock()
+
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers are waiting, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQuotaSemaphore(t *testing.T) {
+	q := quotaSemaphore{}
+	q.reset(0)
+	if got := q.available(); got != defaultReceiveMaximum {
+		t.Errorf("available() = %d, want %d", got, defaultReceiveMaximum)
+	}
+
+	q.reset(3)
+	ctx := context.Background()
+	if err := q.acquire(ctx, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.acquire(ctx, 4, nil); err != ErrInvalidArgument {
+		t.Errorf("acquire(4) = %v, want %v", err, ErrInvalidArgument)
+	}
+
+	// The heavier caller is queued first and the lighter one must not overtake it
+	first := acquireAsync(ctx, &q, 2)
+	waitWaiters(t, &q, 1)
+	second := acquireAsync(ctx, &q, 1)
+	waitWaiters(t, &q, 2)
+
+	q.release(1)
+	select {
+	case <-first:
+		t.Fatal("acquire(2) returned before enough quota was released")
+	case <-second:
+		t.Fatal("acquire(1) overtook a caller queued before it")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	// Releasing enough quota wakes both callers in order
+	q.release(1)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	q.release(1)
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if got := q.available(); got != 0 {
+		t.Errorf("available() = %d, want 0", got)
+	}
+
+	// A reconnect makes the full quota available again
+	q.reset(3)
+	if got := q.available(); got != 3 {
+		t.Errorf("available() = %d after reset, want 3", got)
+	}
+
+	// Acknowledgements that do not belong to a publish in flight are ignored
+	q.release(5)
+	if got := q.available(); got != 3 {
+		t.Errorf("available() = %d after releasing too much, want 3", got)
+	}
+}
+
+func TestQuotaSemaphore_Cancel(t *testing.T) {
+	q := quotaSemaphore{}
+	q.reset(2)
+	q.consume(2)
+
+	// The cancelled caller is at the front of the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := acquireAsync(ctx, &q, 2)
+	waitWaiters(t, &q, 1)
+	next := acquireAsync(context.Background(), &q, 1)
+	waitWaiters(t, &q, 2)
+
+	q.release(1)
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire() = %v, want %v", err, context.Canceled)
+	}
+
+	// The caller queued behind it proceeds once it is gone
+	select {
+	case err := <-next:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("caller queued behind a cancelled one is still blocked")
+	}
+
+	// Stopping the run loop fails blocked callers as well
+	stopped := make(chan struct{})
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- q.acquire(context.Background(), 1, stopped)
+	}()
+	waitWaiters(t, &q, 1)
+	close(stopped)
+	if err := <-errChan; err != ErrClientStopped {
+		t.Errorf("acquire() = %v, want %v", err, ErrClientStopped)
+	}
+	if got := q.available(); got != 0 {
+		t.Errorf("available() = %d, want 0", got)
+	}
+}
+
+func TestClient_SendQuota(t *testing.T) {
+	const receiveMaximum = 2
+	const publishes = 12
+
+	c, s := newTestClient(t)
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{Version: packets.MQTT5, ClientId: "test"})
+		errChan <- err
+	}()
+
+	// Accept the CONNECT control packet with a Receive Maximum of 2
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x06, 0x00, 0x00, 0x03, 0x21, 0x00, receiveMaximum})
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := startRun(t, ctx, c)
+
+	// Publish concurrently from several goroutines
+	var wg sync.WaitGroup
+	publishErr := make(chan error, publishes)
+	for i := 0; i < publishes; i++ {
+		qos := packets.QoS1
+		if i%2 == 0 {
+			qos = packets.QoS2
+		}
+
+		wg.Add(1)
+		go func(qos packets.QoS) {
+			defer wg.Done()
+			publishErr <- c.Publish(ctx, &packets.Publish{QoS: qos, Topic: "test/topic", Payload: []byte("quota")})
+		}(qos)
+	}
+
+	// The server delays acknowledging until the client stops sending at the Receive Maximum. Publishes stay in flight
+	// until PUBACK or PUBCOMP is sent.
+	inflight := make(map[uint16]packets.QoS)
+	pubrecSent := make(map[uint16]bool)
+	var received, completed int
+	for completed < publishes {
+		header, body := s.read()
+		switch header.GetType() {
+		case packets.PUBLISH:
+			pub := &packets.Publish{Header: header}
+			if _, err := pub.DecodeFrom(body); err != nil {
+				t.Fatal(err)
+			}
+			inflight[pub.PacketIdentifier.Value()] = pub.QoS
+			received++
+
+			if len(inflight) > receiveMaximum {
+				t.Fatalf("client sent a publish with %d publishes in flight", len(inflight)-1)
+			}
+		case packets.PUBREL:
+			pubrel := &packets.Pubrel{}
+			pubrel.Header = header
+			if _, err := pubrel.DecodeFrom(body); err != nil {
+				t.Fatal(err)
+			}
+			id := pubrel.PacketIdentifier.Value()
+			s.send(&packets.Pubcomp{Puback: packets.Puback{PacketIdentifier: pubrel.PacketIdentifier}})
+			delete(inflight, id)
+			delete(pubrecSent, id)
+			completed++
+			continue
+		default:
+			t.Fatalf("received %v", header.GetType())
+		}
+
+		if len(inflight) < receiveMaximum && received < publishes {
+			continue
+		}
+
+		// Nothing else may be sent until a publish is acknowledged
+		if len(pubrecSent) == 0 {
+			s.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 20))
+			if _, err := (&packets.FixedHeader{}).ReadFrom(s.conn); err == nil {
+				t.Fatalf("client sent a control packet with %d publishes in flight", len(inflight))
+			}
+		}
+
+		for id, qos := range inflight {
+			ack := packets.Puback{PacketIdentifier: primitives.PrimitiveUint16(id)}
+			switch {
+			case qos == packets.QoS1:
+				s.send(&ack)
+				delete(inflight, id)
+				completed++
+			case !pubrecSent[id]:
+				// The quota of a QoS 2 publish is only released by PUBCOMP
+				s.send(&packets.Pubrec{Puback: ack})
+				pubrecSent[id] = true
+			}
+		}
+	}
+
+	wg.Wait()
+	close(publishErr)
+	for err := range publishErr {
+		if err != nil {
+			t.Errorf("Publish() = %v", err)
+		}
+	}
+
+	cancel()
+	if err := waitRun(t, runErr); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
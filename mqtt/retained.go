@@ -0,0 +1,132 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"sync"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+// RetainedCache is a local last-value cache of retained messages keyed by topic name. It is populated from incoming
+// publishes that have the RETAIN flag set so that the latest state of a topic can be read without waiting for a new
+// message. A RetainedCache is safe for concurrent use.
+type RetainedCache struct {
+	mutex    sync.RWMutex
+	messages map[string]*packets.Publish
+}
+
+// NewRetainedCache creates an empty retained message cache.
+func NewRetainedCache() *RetainedCache {
+	return &RetainedCache{
+		messages: make(map[string]*packets.Publish),
+	}
+}
+
+// Get returns the last retained message received on topic.
+func (r *RetainedCache) Get(topic string) (pub *packets.Publish, ok bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	pub, ok = r.messages[topic]
+	return
+}
+
+// Len returns the number of cached retained messages.
+func (r *RetainedCache) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.messages)
+}
+
+// Range calls fn for each cached retained message until fn returns false.
+func (r *RetainedCache) Range(fn func(topic string, pub *packets.Publish) bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for topic, pub := range r.messages {
+		if !fn(topic, pub) {
+			return
+		}
+	}
+}
+
+// store caches pub as the retained message of its topic. A publish with an empty payload removes the retained message.
+func (r *RetainedCache) store(pub *packets.Publish) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// SPEC: A PUBLISH packet with a RETAIN flag set to 1 and a payload containing zero bytes will be processed as normal
+	//       by the Server and sent to Clients with a subscription matching the topic name. Additionally any existing
+	//       retained message with the same topic name MUST be removed and any future subscribers for the topic will
+	//       not receive a retained message [MQTT-3.3.1-6].
+	if len(pub.Payload) == 0 {
+		delete(r.messages, pub.Topic.String())
+		return
+	}
+	r.messages[pub.Topic.String()] = pub
+}
+
+// remove removes the retained message of topic.
+func (r *RetainedCache) remove(topic string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.messages, topic)
+}
+
+// SetRetainedCache sets the cache that incoming retained messages are stored in. No retained message cache is set by
+// default.
+func (c *Client) SetRetainedCache(cache *RetainedCache) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.retained = cache
+}
+
+// ClearRetained removes the retained message of topic at the server by publishing a retained message with an empty
+// payload. The message is also removed from the retained message cache. ReasonCode 0x9A (Retain not supported) is
+// returned if the server does not support retained messages.
+func (c *Client) ClearRetained(ctx context.Context, topic string) (err error) {
+	if err = c.Publish(ctx, &packets.Publish{
+		Retain: true,
+		QoS:    packets.QoS0,
+		Topic:  primitives.PrimitiveString(topic),
+	}); err != nil {
+		return err
+	}
+
+	c.mutex.RLock()
+	cache := c.retained
+	c.mutex.RUnlock()
+
+	if cache != nil {
+		cache.remove(topic)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// waitRetained waits until the retained message cache holds n messages.
+func waitRetained(t *testing.T, cache *RetainedCache, n int) {
+	for deadline := time.Now().Add(time.Second * 5); cache.Len() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Len() = %d, want %d", cache.Len(), n)
+		}
+	}
+}
+
+func TestClient_RetainedCache(t *testing.T) {
+	c, s := newTestClient(t)
+	cache := NewRetainedCache()
+	c.SetRetainedCache(cache)
+	s.connect(c)
+	poll(t, c)
+
+	// Only publishes with the RETAIN flag set are cached
+	s.send(&packets.Publish{Topic: "devices/a/state", Payload: []byte("live")})
+	s.send(&packets.Publish{Topic: "devices/a/state", Retain: true, Payload: []byte("on")})
+	s.send(&packets.Publish{Topic: "devices/b/state", Retain: true, Payload: []byte("off")})
+	waitRetained(t, cache, 2)
+
+	if pub, ok := cache.Get("devices/a/state"); !ok || string(pub.Payload) != "on" {
+		t.Errorf("Get(devices/a/state) = %v, %v, want on", pub, ok)
+	}
+
+	// A retained publish with an empty payload removes the retained message
+	s.send(&packets.Publish{Topic: "devices/b/state", Retain: true})
+	waitRetained(t, cache, 1)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.ClearRetained(context.Background(), "devices/a/state")
+	}()
+
+	header, body := s.expect(packets.PUBLISH)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	pub := packets.Publish{Header: header}
+	if _, err := pub.DecodeFrom(body); err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Retain || len(pub.Payload) != 0 || pub.Topic != "devices/a/state" {
+		t.Errorf("ClearRetained() sent %+v, want an empty retained publish on devices/a/state", pub)
+	}
+	if _, ok := cache.Get("devices/a/state"); ok {
+		t.Error("ClearRetained() did not remove the cached message")
+	}
+}
+
+func TestClient_RetainUnavailable(t *testing.T) {
+	c, s := newTestClient(t)
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{Version: packets.MQTT5, ClientId: "test"})
+		errChan <- err
+	}()
+
+	// Accept the CONNECT control packet with Retain Available set to 0
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x05, 0x00, 0x00, 0x02, 0x25, 0x00})
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.ClearRetained(context.Background(), "devices/a/state"); err != ReasonCode(0x9A) {
+		t.Errorf("ClearRetained() = %v, want %v", err, ReasonCode(0x9A))
+	}
+}
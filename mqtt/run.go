@@ -0,0 +1,208 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// Run reads and processes incoming control packets and keeps the connection alive until ctx is cancelled, the
+// connection is lost or the client disconnects. PINGREQ is only sent when no other control packet has been sent within
+// the keep alive interval, and the connection is closed if the server does not respond with PINGRESP in time. Run
+// replaces calling Poll and KeepAlive manually and must not be used together with them.
+//
+// While Run is active, outgoing control packets are written by a dedicated writer goroutine. Acknowledgements and
+// PINGREQ are written ahead of queued publishes, small control packets are coalesced into a single write and each
+// operation stops waiting for its control packet to be written once its context is done.
+//
+// When Run returns, the network connection is closed and pending calls to Subscribe, Unsubscribe and Publish fail
+// with ErrClientStopped. Run returns nil if the client or the server disconnected, ctx.Err() if ctx was cancelled,
+// ReasonCode 0x8D (Keep Alive timeout) if the server stopped responding and the reason code sent with DISCONNECT if the
+// client disconnected because the server violated the protocol, such as ReasonCode 0x93 (Receive Maximum exceeded).
+func (c *Client) Run(ctx context.Context) (err error) {
+	c.mutex.Lock()
+	if !c.isConnected {
+		c.mutex.Unlock()
+		return ErrClientNotConnected
+	}
+
+	if c.stopped != nil {
+		select {
+		case <-c.stopped:
+			// A previous run loop has exited
+		default:
+			c.mutex.Unlock()
+			return ErrClientRunning
+		}
+	}
+
+	conn := c.conn
+
+	// Clear any read deadline left behind by Connect or Poll as the reader loop below waits for control packets
+	// indefinitely
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+
+	stopped := make(chan struct{})
+	c.stopped = stopped
+
+	// Outgoing control packets are queued for the writer goroutine while the run loop is active
+	outbound := newOutboundQueue()
+	c.outbound.Store(outbound)
+	c.mutex.Unlock()
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The writer closes the connection if a write fails, which also ends the reader loop below
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		if err := outbound.run(conn, &c.lastSent); err != nil {
+			conn.Close()
+		}
+	}()
+
+	// Subscribe again if the server did not keep the session and send the publishes queued while the client was
+	// disconnected
+	go func() {
+		c.RestoreSubscriptions(runCtx)
+		c.FlushOfflineQueue(runCtx)
+	}()
+
+	// The keep alive timer closes the connection if the server stops responding, which also ends the reader loop below
+	keepAliveErrChan := make(chan error, 1)
+	go func() {
+		keepAliveErrChan <- c.keepAliveLoop(runCtx)
+		conn.Close()
+	}()
+
+	for {
+		// Wait for the next control packet without holding the connection mutex so that control packets can be sent in
+		// the meantime.
+		header := packets.FixedHeader{Strict: c.strictValidation.Load()}
+		if _, err = header.ReadFrom(conn); err == nil {
+			c.connMutex.Lock()
+			err = c.handle(runCtx, header)
+			c.connMutex.Unlock()
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	// Stop the keep alive timer and wait for it to exit
+	cancel()
+	keepAliveErr := <-keepAliveErrChan
+
+	// Stop the writer and fail any queued control packets
+	c.outbound.Store(nil)
+	outbound.close(ErrClientStopped)
+	<-writerDone
+
+	c.mutex.Lock()
+	switch {
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case errors.As(err, new(ReasonCode)):
+		// The client disconnected because the server violated the protocol
+	case !c.isConnected:
+		// The connection was closed by Disconnect or by the server
+		err = nil
+	case keepAliveErr != nil:
+		err = keepAliveErr
+	}
+
+	// Fail any pending operations
+	c.isConnected = false
+	close(stopped)
+	c.mutex.Unlock()
+
+	return err
+}
+
+// keepAliveLoop sends PINGREQ whenever no other control packet has been sent within the keep alive interval. It returns
+// ReasonCode 0x8D (Keep Alive timeout) if PINGRESP is not received within the keep alive interval of sending PINGREQ
+// and nil once ctx is done.
+func (c *Client) keepAliveLoop(ctx context.Context) error {
+	c.mutex.RLock()
+	interval := c.keepAliveInterval
+	c.mutex.RUnlock()
+
+	// SPEC: A Keep Alive value of 0 has the effect of turning off the Keep Alive mechanism.
+	if interval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	c.pingSent.Store(0)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		if sent := c.pingSent.Load(); sent != 0 {
+			// SPEC: If a Client does not receive a PINGRESP packet within a reasonable amount of time after it has sent
+			//       a PINGREQ, it SHOULD close the Network Connection to the Server.
+			deadline := time.Unix(0, sent).Add(interval)
+			if !now.Before(deadline) {
+				return ReasonCode(0x8D)
+			}
+			timer.Reset(deadline.Sub(now))
+			continue
+		}
+
+		// Wait until the connection has been idle for the full interval
+		if next := time.Unix(0, c.lastSent.Load()).Add(interval); now.Before(next) {
+			timer.Reset(next.Sub(now))
+			continue
+		}
+
+		// SPEC: If Keep Alive is non-zero and in the absence of sending any other MQTT Control Packets, the Client MUST
+		//       send a PINGREQ packet [MQTT-3.1.2-20].
+		c.pingSent.Store(now.UnixNano())
+
+		if err := c.write(ctx, &packets.Pingreq{}, priorityControl); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		timer.Reset(interval)
+	}
+}
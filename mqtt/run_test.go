@@ -0,0 +1,203 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// startRun starts the run loop of the client and waits for it to begin. The error returned by Run is sent on the
+// returned channel.
+func startRun(t *testing.T, ctx context.Context, c *Client) <-chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.Run(ctx)
+	}()
+
+	for {
+		c.mutex.RLock()
+		running := c.stopped != nil
+		c.mutex.RUnlock()
+
+		if running {
+			return errChan
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitRun waits for the run loop to return.
+func waitRun(t *testing.T, errChan <-chan error) error {
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for Run to return")
+	}
+	return nil
+}
+
+func TestClient_RunKeepAlive(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+	c.keepAliveInterval = time.Millisecond * 200
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errChan := startRun(t, ctx, c)
+
+	// Keep the connection busy for longer than the keep alive interval
+	go func() {
+		for i := 0; i < 8; i++ {
+			c.Publish(ctx, &packets.Publish{Topic: "test/topic", Payload: []byte("busy")})
+			time.Sleep(time.Millisecond * 50)
+		}
+	}()
+
+	for i := 0; i < 8; i++ {
+		if header, _ := s.read(); header.GetType() != packets.PUBLISH {
+			t.Fatalf("received %v while the connection was busy", header.GetType())
+		}
+	}
+	lastPublish := time.Now()
+
+	// PINGREQ is sent once the connection is idle
+	s.expect(packets.PINGREQ)
+	if elapsed := time.Since(lastPublish); elapsed < time.Millisecond*100 {
+		t.Errorf("PINGREQ sent %v after the last control packet", elapsed)
+	}
+	s.write([]byte{0xD0, 0x00})
+
+	// The next PINGREQ is sent after another interval
+	s.expect(packets.PINGREQ)
+	s.write([]byte{0xD0, 0x00})
+
+	cancel()
+	if err := waitRun(t, errChan); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+
+	if c.IsConnected() {
+		t.Error("client is still connected after Run returned")
+	}
+}
+
+func TestClient_RunPingTimeout(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+	c.keepAliveInterval = time.Millisecond * 100
+
+	errChan := startRun(t, context.Background(), c)
+
+	// Subscribe is pending when the run loop stops
+	subErr := make(chan error, 1)
+	go func() {
+		topic := Topic{}
+		topic.SetFilter("test/topic")
+		subErr <- c.Subscribe(context.Background(), []Topic{topic})
+	}()
+
+	s.expect(packets.SUBSCRIBE)
+
+	// Never respond to PINGREQ
+	s.expect(packets.PINGREQ)
+
+	if err := waitRun(t, errChan); !errors.Is(err, ReasonCode(0x8D)) {
+		t.Errorf("Run() = %v, want %v", err, ReasonCode(0x8D))
+	}
+
+	if err := <-subErr; !errors.Is(err, ErrClientStopped) {
+		t.Errorf("Subscribe() = %v, want %v", err, ErrClientStopped)
+	}
+}
+
+func TestClient_RunDisconnect(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+
+	errChan := startRun(t, context.Background(), c)
+
+	if err := startRun(t, context.Background(), c); !errors.Is(<-err, ErrClientRunning) {
+		t.Error("a second run loop was started")
+	}
+
+	disconnectErr := make(chan error, 1)
+	go func() {
+		disconnectErr <- c.Disconnect(context.Background(), false)
+	}()
+
+	s.expect(packets.DISCONNECT)
+	if err := <-disconnectErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := waitRun(t, errChan); err != nil {
+		t.Errorf("Run() = %v, want nil", err)
+	}
+}
+
+func TestClient_RunAfterConnectTimeout(t *testing.T) {
+	c, s := newTestClient(t)
+
+	// Connect with a deadline that passes while the run loop is active
+	connectCtx, connectCancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer connectCancel()
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(connectCtx, &packets.Connect{Version: packets.MQTT5, ClientId: "test"})
+		errChan <- err
+	}()
+
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x03, 0x00, 0x00, 0x00})
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := startRun(t, ctx, c)
+
+	select {
+	case err := <-runErr:
+		t.Fatalf("Run() = %v after the deadline of Connect passed", err)
+	case <-time.After(time.Millisecond * 400):
+	}
+
+	// The run loop still receives control packets
+	s.send(&packets.Publish{QoS: packets.QoS1, PacketIdentifier: 1, Topic: "test/topic"})
+	s.expect(packets.PUBACK)
+
+	cancel()
+	if err := waitRun(t, runErr); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
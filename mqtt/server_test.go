@@ -0,0 +1,164 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// fakeServer is the server end of an in-memory connection to a Client. Tests use it to read the control packets sent
+// by the client and to write raw responses back.
+type fakeServer struct {
+	t    testing.TB
+	conn net.Conn
+}
+
+// newTestClient returns a client connected to a fake server. Both ends are closed when the test completes.
+func newTestClient(t testing.TB) (*Client, *fakeServer) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	return NewClient(clientConn), &fakeServer{t: t, conn: serverConn}
+}
+
+// read reads the next control packet sent by the client and returns its fixed header and body.
+func (s *fakeServer) read() (header packets.FixedHeader, body []byte) {
+	s.t.Helper()
+
+	s.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := header.ReadFrom(s.conn); err != nil {
+		s.t.Fatalf("failed to read control packet header: %v", err)
+	}
+
+	body = make([]byte, header.Remaining)
+	if _, err := io.ReadFull(s.conn, body); err != nil {
+		s.t.Fatalf("failed to read control packet body: %v", err)
+	}
+	return
+}
+
+// expect reads the next control packet sent by the client and fails the test if it is not of the specified type.
+func (s *fakeServer) expect(packetType packets.PacketType) (header packets.FixedHeader, body []byte) {
+	s.t.Helper()
+
+	if header, body = s.read(); header.GetType() != packetType {
+		s.t.Fatalf("received %v, want %v", header.GetType(), packetType)
+	}
+	return
+}
+
+// write writes raw bytes to the client.
+func (s *fakeServer) write(raw []byte) {
+	s.t.Helper()
+
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if _, err := s.conn.Write(raw); err != nil {
+		s.t.Fatalf("failed to write to client: %v", err)
+	}
+}
+
+// send encodes a control packet and writes it to the client.
+func (s *fakeServer) send(p encoder) {
+	s.t.Helper()
+
+	raw, err := p.AppendTo(nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.write(raw)
+}
+
+// connect connects the client and accepts the CONNECT control packet with a successful CONNACK.
+func (s *fakeServer) connect(c *Client) {
+	s.t.Helper()
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{
+			Version:   packets.MQTT5,
+			ClientId:  "test",
+			KeepAlive: 60,
+		})
+		errChan <- err
+	}()
+
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x03, 0x00, 0x00, 0x00})
+
+	if err := <-errChan; err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// suback accepts the next SUBSCRIBE control packet and grants every requested subscription at QoS 0.
+func (s *fakeServer) suback() {
+	s.t.Helper()
+
+	_, body := s.expect(packets.SUBSCRIBE)
+
+	// Skip the packet identifier and properties to count the topic filters
+	i := 2 + 1 + int(body[2])
+	var filters int
+	for i < len(body) {
+		i += 2 + int(binary.BigEndian.Uint16(body[i:])) + 1
+		filters++
+	}
+
+	raw := []byte{0x90, byte(3 + filters), body[0], body[1], 0x00}
+	raw = append(raw, make([]byte, filters)...)
+	s.write(raw)
+}
+
+// poll calls Poll on the client until the test completes.
+func poll(t testing.TB, c *Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			pollCtx, pollCancel := context.WithTimeout(ctx, time.Millisecond*10)
+			err := c.Poll(pollCtx)
+			pollCancel()
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
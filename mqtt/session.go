@@ -0,0 +1,121 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+// Session describes the session established by Connect, including the parameters that the server provided in the
+// CONNACK control packet.
+type Session struct {
+	// ClientId is the client identifier of the session. It is the identifier assigned by the server if the CONNECT
+	// control packet did not specify one.
+	ClientId string
+
+	// Assigned is true if ClientId was assigned by the server.
+	Assigned bool
+
+	// Present is true if the server resumed an existing session.
+	Present bool
+
+	// SessionExpiryInterval is the number of seconds the server keeps the session after the network connection is
+	// closed.
+	SessionExpiryInterval uint32
+
+	// KeepAlive is the keep alive interval in use. It is the Server Keep Alive if the server sent one.
+	KeepAlive time.Duration
+
+	// ResponseInformation is the basis the server provided for creating response topics. It is only sent if the
+	// CONNECT control packet requested response information.
+	ResponseInformation string
+}
+
+// newSession creates the session established by sending packet and receiving connack.
+func newSession(packet *packets.Connect, connack *packets.Connack) *Session {
+	session := &Session{
+		ClientId:              string(packet.ClientId),
+		Present:               connack.SessionPresent,
+		SessionExpiryInterval: uint32(packet.SessionExpiryInterval),
+		KeepAlive:             time.Second * time.Duration(packet.KeepAlive),
+		ResponseInformation:   string(connack.ResponseInformation),
+	}
+
+	// SPEC: If the Client connects using a zero length Client Identifier, the Server MUST respond with a CONNACK
+	//       containing an Assigned Client Identifier [MQTT-3.2.2-16].
+	if len(connack.ClientId) > 0 {
+		session.ClientId = string(connack.ClientId)
+		session.Assigned = true
+	}
+
+	// SPEC: If the Session Expiry Interval is absent the value in the CONNECT Packet used. The server uses this
+	//       property to inform the Client that it is using a value other than that sent by the Client in the CONNACK.
+	if connack.SessionExpiryInterval > 0 {
+		session.SessionExpiryInterval = uint32(connack.SessionExpiryInterval)
+	}
+
+	// SPEC: If the Server returns a Server Keep Alive on the CONNACK packet, the Client MUST use that value instead of
+	//       the value it sent as the Keep Alive [MQTT-3.1.2-21].
+	if connack.ServerKeepAlive > 0 {
+		session.KeepAlive = time.Second * time.Duration(connack.ServerKeepAlive)
+	}
+
+	return session
+}
+
+// resume returns the CONNECT control packet to send in order to resume the current session. The client identifier
+// assigned by the server is used if packet does not specify one. packet itself is left untouched. The caller must hold
+// the client's mutex.
+func (c *Client) resume(packet *packets.Connect) *packets.Connect {
+	if len(packet.ClientId) > 0 || c.session == nil || !c.session.Assigned {
+		return packet
+	}
+
+	resumed := *packet
+	resumed.ClientId = primitives.PrimitiveString(c.session.ClientId)
+	return &resumed
+}
+
+// Session returns a copy of the session established by the last successful call to Connect or nil if the client has
+// not connected yet.
+func (c *Client) Session() *Session {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.session.copy()
+}
+
+// copy returns a copy of the session so that callers cannot modify the session used to reconnect.
+func (s *Session) copy() *Session {
+	if s == nil {
+		return nil
+	}
+
+	session := *s
+	return &session
+}
@@ -0,0 +1,137 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// expectConnect receives the CONNECT control packet and returns its client identifier.
+func (s *fakeServer) expectConnect() string {
+	s.t.Helper()
+
+	header, body := s.expect(packets.CONNECT)
+	connect := packets.Connect{Header: header}
+	if _, err := connect.DecodeFrom(body); err != nil {
+		s.t.Fatal(err)
+	}
+	return string(connect.ClientId)
+}
+
+func TestClient_AssignedClientId(t *testing.T) {
+	servers := make(chan *fakeServer, 3)
+	c := NewClientWithDialer(DialerFunc(func(ctx context.Context) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() {
+			clientConn.Close()
+			serverConn.Close()
+		})
+
+		servers <- &fakeServer{t: t, conn: serverConn}
+		return clientConn, nil
+	}))
+
+	type result struct {
+		session *Session
+		err     error
+	}
+	connected := make(chan result, 1)
+	go func() {
+		session, err := c.Connect(context.Background(), &packets.Connect{
+			Version:                    packets.MQTT5,
+			KeepAlive:                  60,
+			SessionExpiryInterval:      3600,
+			RequestResponseInformation: 1,
+		})
+		connected <- result{session, err}
+	}()
+
+	// The server assigns a client identifier and overrides the keep alive and session expiry intervals
+	s := <-servers
+	if id := s.expectConnect(); id != "" {
+		t.Errorf("CONNECT client identifier = %q, want empty", id)
+	}
+	s.write([]byte{0x20, 0x1C, 0x00, 0x00, 0x19,
+		0x12, 0x00, 0x06, 'a', 'u', 't', 'o', '-', '1', // Assigned Client Identifier
+		0x13, 0x00, 0x1E, // Server Keep Alive
+		0x11, 0x00, 0x00, 0x00, 0x3C, // Session Expiry Interval
+		0x1A, 0x00, 0x05, 'r', 'e', 's', 'p', '/', // Response Information
+	})
+
+	r := <-connected
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	want := Session{
+		ClientId:              "auto-1",
+		Assigned:              true,
+		SessionExpiryInterval: 60,
+		KeepAlive:             time.Second * 30,
+		ResponseInformation:   "resp/",
+	}
+	if *r.session != want {
+		t.Errorf("Connect() session = %+v, want %+v", *r.session, want)
+	}
+
+	if c.keepAliveInterval != time.Second*30 {
+		t.Errorf("keep alive interval = %v, want %v", c.keepAliveInterval, time.Second*30)
+	}
+
+	// The returned session cannot be used to change the session of the client
+	r.session.ClientId = "modified"
+
+	// Later connections resume the session using the assigned client identifier
+	for i := 0; i < 2; i++ {
+		go func() {
+			connected <- result{nil, c.Reconnect(context.Background())}
+		}()
+
+		s = <-servers
+		if id := s.expectConnect(); id != "auto-1" {
+			t.Errorf("CONNECT client identifier = %q, want auto-1", id)
+		}
+		s.write([]byte{0x20, 0x03, 0x01, 0x00, 0x00})
+
+		if r = <-connected; r.err != nil {
+			t.Fatal(r.err)
+		}
+	}
+
+	session := c.Session()
+	if session.ClientId != "auto-1" || !session.Assigned || !session.Present || session.SessionExpiryInterval != 3600 {
+		t.Errorf("Session() = %+v", *session)
+	}
+
+	// The CONNECT control packet passed to Connect is left untouched
+	if len(c.connectPacket.ClientId) != 0 {
+		t.Errorf("CONNECT control packet client identifier = %q, want empty", c.connectPacket.ClientId)
+	}
+}
@@ -102,3 +102,19 @@ func (s *Storage) Drop(identifier uint16) (err error) {
 	// No entry was found
 	return storage.ErrNoEntry
 }
+
+// Range calls fn for each control packet in the order they were stored until fn returns false.
+func (s *Storage) Range(fn func(identifier uint16, packet any) bool) (err error) {
+	// Iterate over a copy so that fn can modify the storage
+	s.mutex.Lock()
+	entries := append([]entry(nil), s.store...)
+	s.mutex.Unlock()
+
+	for _, e := range entries {
+		if !fn(e.id, e.packet) {
+			break
+		}
+	}
+
+	return
+}
@@ -41,3 +41,12 @@ type Storage interface {
 	// Drop removes the control packet with the specified identifier from persistent storage.
 	Drop(identifier uint16) (err error)
 }
+
+// Ranger is implemented by storage implementations that can enumerate the stored control packets. The client resends
+// unacknowledged control packets when a session is resumed and the offline queue recovers queued messages only if the
+// storage implementation is a Ranger.
+type Ranger interface {
+	// Range calls fn for each stored control packet in the order they were stored until fn returns false. fn may drop
+	// the control packet it is called with.
+	Range(fn func(identifier uint16, packet any) bool) (err error)
+}
@@ -0,0 +1,259 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"sort"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// maxSubscribeBatch is the maximum number of topic filters sent in a single SUBSCRIBE control packet when restoring
+// subscriptions.
+const maxSubscribeBatch = 32
+
+// subscription is a topic filter subscribed at the server along with its subscribers. Each call to Subscribe adds one
+// subscriber per topic filter. Subscribers without an event channel have a zero EventChannel. The subscription remains
+// at the server when all of its event channels are closed until Unsubscribe is called.
+type subscription struct {
+	// topic is the topic filter and the subscription options last sent to the server
+	topic       packets.Topic
+	subscribers []EventChannel
+}
+
+// needsSubscribe returns true if topic must be sent to the server because its topic filter is not subscribed yet or
+// because a higher maximum QoS is requested. The caller must hold the mutex.
+func (c *Client) needsSubscribe(topic packets.Topic) bool {
+	sub, ok := c.topicSubs[topic.Filter()]
+	return !ok || topic.QoS() > sub.topic.QoS()
+}
+
+// register records a topic filter accepted by the server. The caller must hold the mutex.
+func (c *Client) register(topic packets.Topic) {
+	sub, ok := c.topicSubs[topic.Filter()]
+	if !ok {
+		sub = &subscription{}
+		c.topicSubs[topic.Filter()] = sub
+	}
+
+	// SPEC: If a Server receives a SUBSCRIBE packet containing a Topic Filter that is identical to a Non‑shared
+	//       Subscription's Topic Filter for the current Session, then it MUST replace that existing Subscription
+	//       with a new Subscription [MQTT-3.8.4-3].
+	sub.topic = topic
+}
+
+// addSubscriber adds a subscriber to the subscription of its topic filter and binds its event channel. Nothing happens
+// if the topic filter was not accepted by the server. The caller must hold the mutex.
+func (c *Client) addSubscriber(topic Topic) {
+	filter := topic.Filter()
+	sub, ok := c.topicSubs[filter]
+	if !ok {
+		return
+	}
+	sub.subscribers = append(sub.subscribers, topic.channel)
+
+	if chanid := topic.channel.id; chanid != 0 {
+		// Map the event channel to the topic
+		c.subscriptions.Add(filter, topic.channel)
+
+		// Remove this channel from the general event channel map until its last binding is removed
+		c.eventMutex.Lock()
+		delete(c.eventChans, chanid)
+		c.eventMutex.Unlock()
+	}
+}
+
+// removeSubscriber removes a single subscriber with the specified event channel from the subscription of filter. It
+// returns false if there is no such subscriber. The caller must hold the mutex.
+func (c *Client) removeSubscriber(filter string, channel EventChannel) bool {
+	sub, ok := c.topicSubs[filter]
+	if !ok {
+		return false
+	}
+
+	index, count := -1, 0
+	for i, subscriber := range sub.subscribers {
+		if subscriber.id == channel.id {
+			index = i
+			count++
+		}
+	}
+	if index < 0 {
+		return false
+	}
+	sub.subscribers = append(sub.subscribers[:index], sub.subscribers[index+1:]...)
+
+	// Stop routing to the event channel once it has no subscription to this topic filter left
+	if count == 1 && channel.id != 0 {
+		c.subscriptions.Remove(filter, channel)
+		c.unbind(channel)
+	}
+	return true
+}
+
+// unbind registers the event channel for general events again once it is no longer bound to any topic filter so that
+// it keeps receiving events until it is closed. Channels created by CreateSubscriptionChannel are never registered. The
+// caller must hold the mutex.
+func (c *Client) unbind(channel EventChannel) {
+	if channel.id == 0 || channel.routed || c.isBound(channel) {
+		return
+	}
+
+	c.eventMutex.Lock()
+	c.eventChans[channel.id] = channel
+	c.eventMutex.Unlock()
+}
+
+// removeChannel removes every subscriber with the specified event channel. The caller must hold the mutex.
+func (c *Client) removeChannel(channel EventChannel) {
+	for filter, sub := range c.topicSubs {
+		remaining := sub.subscribers[:0]
+		for _, subscriber := range sub.subscribers {
+			if subscriber.id != channel.id {
+				remaining = append(remaining, subscriber)
+			}
+		}
+
+		if len(remaining) != len(sub.subscribers) {
+			sub.subscribers = remaining
+			c.subscriptions.Remove(filter, channel)
+		}
+	}
+}
+
+// isBound returns true if the event channel is bound to any topic filter. The caller must hold the mutex.
+func (c *Client) isBound(channel EventChannel) bool {
+	for _, sub := range c.topicSubs {
+		for _, subscriber := range sub.subscribers {
+			if subscriber.id == channel.id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UnsubscribeChannel removes the subscriber with the specified event channel from each of the topic filters. The
+// UNSUBSCRIBE control packet is only sent for the topic filters that have no subscribers left. A zero EventChannel
+// removes a subscriber that was added without an event channel. The event channel is not closed and receives general
+// events again once it is no longer bound to any topic filter, unless it was created by CreateSubscriptionChannel.
+func (c *Client) UnsubscribeChannel(ctx context.Context, channel EventChannel, topics []string) (err error) {
+	// Do nothing if topics list is empty
+	if len(topics) == 0 {
+		return ErrInvalidArgument
+	}
+
+	if !c.isConnected {
+		return ErrClientNotConnected
+	}
+
+	c.mutex.Lock()
+	var unused []string
+	for _, filter := range topics {
+		if c.removeSubscriber(filter, channel) && len(c.topicSubs[filter].subscribers) == 0 {
+			// Forget the subscription right away so that a concurrent call to Subscribe sends it again
+			delete(c.topicSubs, filter)
+			unused = append(unused, filter)
+		}
+	}
+	c.mutex.Unlock()
+
+	if len(unused) == 0 {
+		return nil
+	}
+	return c.unsubscribe(ctx, unused)
+}
+
+// RestoreSubscriptions sends the subscriptions made through Subscribe again if the server did not keep the session of
+// the client when it last connected. The topic filters are sent in batches. Subscriptions that the server rejects are
+// removed along with the bindings of their event channels, and the first failure reason code is returned as a
+// ReasonCode error. Run restores subscriptions automatically when it starts.
+func (c *Client) RestoreSubscriptions(ctx context.Context) (err error) {
+	c.mutex.Lock()
+	if !c.restoreSubscriptions {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.restoreSubscriptions = false
+
+	topics := make([]packets.Topic, 0, len(c.topicSubs))
+	for _, sub := range c.topicSubs {
+		topics = append(topics, sub.topic)
+	}
+	c.mutex.Unlock()
+
+	// Subscribe in a deterministic order
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Filter() < topics[j].Filter()
+	})
+
+	for len(topics) > 0 {
+		batch := topics
+		if len(batch) > maxSubscribeBatch {
+			batch = batch[:maxSubscribeBatch]
+		}
+		topics = topics[len(batch):]
+
+		suback, subscribeErr := c.subscribe(ctx, batch)
+		if subscribeErr != nil {
+			// Try again upon the next call
+			c.mutex.Lock()
+			c.restoreSubscriptions = true
+			c.mutex.Unlock()
+			return subscribeErr
+		}
+
+		c.mutex.Lock()
+		for i := range batch {
+			code := byte(0x80)
+			if i < len(suback.ReasonCodes) {
+				code = suback.ReasonCodes[i]
+			}
+
+			if code >= 0x80 {
+				if err == nil {
+					err = ReasonCode(code)
+				}
+
+				// The subscription no longer exists
+				filter := batch[i].Filter()
+				var subscribers []EventChannel
+				if sub, ok := c.topicSubs[filter]; ok {
+					subscribers = sub.subscribers
+				}
+				delete(c.topicSubs, filter)
+				c.subscriptions.RemoveAll(filter)
+
+				for _, channel := range subscribers {
+					c.unbind(channel)
+				}
+			}
+		}
+		c.mutex.Unlock()
+	}
+
+	return err
+}
@@ -0,0 +1,249 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// receivePublish waits for a PUBLISH event on channel and returns its topic. An empty string is returned if none
+// arrives within timeout.
+func receivePublish(channel EventChannel, timeout time.Duration) string {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case e := <-channel.C:
+			if e.PacketType == packets.PUBLISH {
+				return e.Data.(*packets.Publish).Topic.String()
+			}
+		case <-deadline:
+			return ""
+		}
+	}
+}
+
+func TestClient_SubscribeReferenceCounting(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+	poll(t, c)
+
+	channels := []EventChannel{c.CreateEventChannel(10), c.CreateEventChannel(10), c.CreateEventChannel(10)}
+	general := c.CreateEventChannel(10)
+	subscribe := func(channel EventChannel, qos packets.QoS) <-chan error {
+		topic := Topic{}
+		topic.SetFilter("sensors/+").SetQoS(qos)
+		topic.SetEventChannel(channel)
+
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- c.Subscribe(context.Background(), []Topic{topic})
+		}()
+		return errChan
+	}
+
+	// Only the first subscriber sends SUBSCRIBE
+	errChan := subscribe(channels[0], packets.QoS0)
+	s.suback()
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-subscribe(channels[1], packets.QoS0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A subscriber requesting a higher QoS upgrades the subscription
+	errChan = subscribe(channels[2], packets.QoS1)
+	_, body := s.expect(packets.SUBSCRIBE)
+	if qos := body[len(body)-1] & 0x03; qos != 1 {
+		t.Errorf("upgraded subscription requested QoS %d, want 1", qos)
+	}
+	s.write([]byte{0x90, 0x04, body[0], body[1], 0x00, 0x01})
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	s.send(&packets.Publish{Topic: "sensors/a"})
+	for i, channel := range channels {
+		if topic := receivePublish(channel, time.Second*5); topic != "sensors/a" {
+			t.Errorf("channel %d received %q, want sensors/a", i, topic)
+		}
+	}
+
+	// The publish has been handled once it reaches the general event channels
+	if topic := receivePublish(general, time.Second*5); topic != "sensors/a" {
+		t.Errorf("general channel received %q, want sensors/a", topic)
+	}
+
+	// Removing a subscriber does not send UNSUBSCRIBE while others remain
+	for _, channel := range channels[:2] {
+		if err := c.UnsubscribeChannel(context.Background(), channel, []string{"sensors/+"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.send(&packets.Publish{Topic: "sensors/b"})
+	if topic := receivePublish(channels[2], time.Second*5); topic != "sensors/b" {
+		t.Errorf("remaining channel received %q, want sensors/b", topic)
+	}
+
+	// The removed channel is no longer bound to a topic filter and receives general events again, so it sees the
+	// publish once through the fanout to every general event channel
+	if topic := receivePublish(channels[0], time.Second*5); topic != "sensors/b" {
+		t.Errorf("unbound channel received %q, want sensors/b", topic)
+	}
+	if topic := receivePublish(channels[0], time.Millisecond*50); topic != "" {
+		t.Errorf("unbound channel received %q twice", topic)
+	}
+
+	// The last subscriber to leave sends UNSUBSCRIBE
+	unsubscribed := make(chan error, 1)
+	go func() {
+		unsubscribed <- c.UnsubscribeChannel(context.Background(), channels[2], []string{"sensors/+"})
+	}()
+	_, body = s.expect(packets.UNSUBSCRIBE)
+	s.write([]byte{0xB0, 0x04, body[0], body[1], 0x00, 0x00})
+	if err := <-unsubscribed; err != nil {
+		t.Fatal(err)
+	}
+
+	c.mutex.RLock()
+	_, ok := c.topicSubs["sensors/+"]
+	c.mutex.RUnlock()
+	if ok {
+		t.Error("subscription is still recorded after the last subscriber left")
+	}
+}
+
+func TestClient_RestoreSubscriptions(t *testing.T) {
+	servers := make(chan *fakeServer, 2)
+	c := NewClientWithDialer(DialerFunc(func(ctx context.Context) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() {
+			clientConn.Close()
+			serverConn.Close()
+		})
+
+		servers <- &fakeServer{t: t, conn: serverConn}
+		return clientConn, nil
+	}))
+
+	connected := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{Version: packets.MQTT5, ClientId: "test"})
+		connected <- err
+	}()
+	s := <-servers
+	accept(s)
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := startRun(t, ctx, c)
+
+	// Subscribe to more topic filters than fit into a single batch
+	channel := c.CreateEventChannel(10)
+	var topics []Topic
+	for i := 0; i < 40; i++ {
+		topic := Topic{}
+		topic.SetFilter(fmt.Sprintf("sensors/%02d", i))
+		if i == 0 {
+			topic.SetEventChannel(channel)
+		}
+		topics = append(topics, topic)
+	}
+
+	subscribed := make(chan error, 1)
+	go func() {
+		subscribed <- c.Subscribe(context.Background(), topics)
+	}()
+	s.suback()
+	if err := <-subscribed; err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	waitRun(t, errChan)
+
+	// Reconnect to a server that did not keep the session
+	go func() {
+		connected <- c.Reconnect(context.Background())
+	}()
+	s = <-servers
+	accept(s)
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	errChan = startRun(t, ctx, c)
+
+	// The subscriptions are sent again in two batches. The server rejects the last topic filter.
+	for _, want := range []int{maxSubscribeBatch, 40 - maxSubscribeBatch} {
+		_, body := s.expect(packets.SUBSCRIBE)
+
+		i := 2 + 1 + int(body[2])
+		var filters int
+		for i < len(body) {
+			i += 2 + int(binary.BigEndian.Uint16(body[i:])) + 1
+			filters++
+		}
+		if filters != want {
+			t.Errorf("SUBSCRIBE contained %d topic filters, want %d", filters, want)
+		}
+
+		raw := []byte{0x90, byte(3 + filters), body[0], body[1], 0x00}
+		raw = append(raw, make([]byte, filters)...)
+		if want != maxSubscribeBatch {
+			raw[len(raw)-1] = 0x80
+		}
+		s.write(raw)
+	}
+
+	// Publishes are routed to the restored subscription
+	s.send(&packets.Publish{Topic: "sensors/00"})
+	if topic := receivePublish(channel, time.Second*5); topic != "sensors/00" {
+		t.Errorf("restored subscription received %q, want sensors/00", topic)
+	}
+
+	c.mutex.RLock()
+	_, rejected := c.topicSubs["sensors/39"]
+	count := len(c.topicSubs)
+	c.mutex.RUnlock()
+	if rejected || count != 39 {
+		t.Errorf("registry holds %d subscriptions, rejected subscription present %v, want 39 and false", count, rejected)
+	}
+
+	cancel()
+	waitRun(t, errChan)
+}
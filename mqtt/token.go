@@ -0,0 +1,150 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// DeliveryToken tracks the delivery of a publish sent by PublishWithToken. The token is done once the server
+// acknowledged a QoS 1 publish with PUBACK or completed a QoS 2 publish with PUBCOMP. QoS 0 publishes are done once
+// they have been written.
+type DeliveryToken struct {
+	done chan struct{}
+
+	reasonCode   ReasonCode
+	reasonString string
+	err          error
+}
+
+func newDeliveryToken() *DeliveryToken {
+	return &DeliveryToken{
+		done: make(chan struct{}),
+	}
+}
+
+// complete resolves the token. Acknowledgements carrying a Reason Code of 0x80 or greater fail the delivery. A nil
+// token is ignored.
+func (t *DeliveryToken) complete(code ReasonCode, reasonString string, err error) {
+	if t == nil {
+		return
+	}
+
+	t.reasonCode = code
+	t.reasonString = reasonString
+	t.err = err
+	if err == nil && code >= 0x80 {
+		t.err = code
+	}
+	close(t.done)
+}
+
+// Done returns a channel that is closed once the delivery has completed or failed.
+func (t *DeliveryToken) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait waits until the delivery has completed or failed and returns the same error as Err. If ctx is done first, the
+// publish remains in flight and the error of ctx is returned.
+func (t *DeliveryToken) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return opError("publish", ctx, ctx.Err())
+	}
+}
+
+// Err returns nil if the publish was delivered. It returns the Reason Code of the acknowledgement if the server
+// rejected the publish, ErrSessionLost if the server did not keep the session while the publish was in flight and
+// ErrMessageExpired if the publish expired before it could be resent. Err returns nil until the token is done.
+func (t *DeliveryToken) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// ReasonCode returns the Reason Code of the PUBACK or PUBCOMP control packet that completed the delivery, or of the
+// PUBREC control packet that rejected it. It returns 0 until the token is done.
+func (t *DeliveryToken) ReasonCode() ReasonCode {
+	select {
+	case <-t.done:
+		return t.reasonCode
+	default:
+		return 0
+	}
+}
+
+// ReasonString returns the Reason String of the acknowledgement that resolved the token if the server sent one.
+func (t *DeliveryToken) ReasonString() string {
+	select {
+	case <-t.done:
+		return t.reasonString
+	default:
+		return ""
+	}
+}
+
+// PublishWithToken sends the PUBLISH control packet to the server like Publish and returns a token that is done once
+// the server acknowledged the publish. Unlike Publish, it does not queue publishes in the offline queue and returns
+// ErrClientNotConnected while the client is disconnected.
+func (c *Client) PublishWithToken(ctx context.Context, pub *packets.Publish) (token *DeliveryToken, err error) {
+	token = newDeliveryToken()
+	if err = c.publish(ctx, pub, token); err != nil {
+		return nil, err
+	}
+
+	if pub.QoS == packets.QoS0 {
+		// There is no acknowledgement for QoS 0
+		token.complete(0, "", nil)
+	}
+	return token, nil
+}
+
+// takeToken removes the in-flight publish with the specified packet identifier so that the identifier can be reused
+// and returns its token. It returns nil if the publish was not sent by PublishWithToken. The caller must hold the
+// mutex.
+func (c *Client) takeToken(identifier uint16) (token *DeliveryToken) {
+	token = c.inflight[identifier]
+	delete(c.inflight, identifier)
+	return token
+}
+
+// failTokens fails the tokens of every in-flight publish and removes the publishes from storage since the server
+// discarded the session they were sent in. The caller must hold the mutex.
+func (c *Client) failTokens(err error) {
+	for identifier, token := range c.inflight {
+		delete(c.inflight, identifier)
+		if c.storage != nil {
+			c.storage.Drop(identifier)
+		}
+		token.complete(0, "", err)
+	}
+}
@@ -0,0 +1,331 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+	"github.com/waj334/tinygo-mqtt/mqtt/storage/memory"
+)
+
+// publishWithToken sends pub with PublishWithToken and returns the token along with the PUBLISH received by the
+// server.
+func publishWithToken(t *testing.T, c *Client, s *fakeServer, pub *packets.Publish) (*DeliveryToken, *packets.Publish) {
+	t.Helper()
+
+	type result struct {
+		token *DeliveryToken
+		err   error
+	}
+	published := make(chan result, 1)
+	go func() {
+		token, err := c.PublishWithToken(context.Background(), pub)
+		published <- result{token, err}
+	}()
+
+	header, body := s.expect(packets.PUBLISH)
+	received := &packets.Publish{Header: header}
+	if _, err := received.DecodeFrom(body); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-published
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return r.token, received
+}
+
+// waitToken waits for the token to be done.
+func waitToken(t *testing.T, token *DeliveryToken) error {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	err := token.Wait(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("timed out waiting for the delivery token")
+	}
+	return err
+}
+
+func TestClient_DeliveryTokenQoS1(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+	poll(t, c)
+
+	token, pub := publishWithToken(t, c, s, &packets.Publish{QoS: packets.QoS1, Topic: "test/topic"})
+
+	select {
+	case <-token.Done():
+		t.Fatal("token is done before PUBACK was received")
+	default:
+	}
+
+	// The publish was accepted but nobody is subscribed
+	puback := &packets.Puback{PacketIdentifier: pub.PacketIdentifier, ReasonCode: 0x10, ReasonString: "no subscribers"}
+	s.send(puback)
+
+	if err := waitToken(t, token); err != nil {
+		t.Errorf("Wait() = %v, want nil", err)
+	}
+	if token.ReasonCode() != 0x10 || token.ReasonString() != "no subscribers" {
+		t.Errorf("token reason = %v %q", token.ReasonCode(), token.ReasonString())
+	}
+
+	// Waiting for a token that is never done stops with the context
+	token, _ = publishWithToken(t, c, s, &packets.Publish{QoS: packets.QoS1, Topic: "test/topic"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	expectOpError(t, token.Wait(ctx), "publish", context.DeadlineExceeded)
+	if token.Err() != nil {
+		t.Errorf("Err() = %v before the token is done", token.Err())
+	}
+}
+
+func TestClient_DeliveryTokenQoS2(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+	poll(t, c)
+
+	token, pub := publishWithToken(t, c, s, &packets.Publish{QoS: packets.QoS2, Topic: "test/topic"})
+
+	s.send(&packets.Pubrec{Puback: packets.Puback{PacketIdentifier: pub.PacketIdentifier}})
+	s.expect(packets.PUBREL)
+
+	select {
+	case <-token.Done():
+		t.Fatal("token is done before PUBCOMP was received")
+	default:
+	}
+
+	s.send(&packets.Pubcomp{Puback: packets.Puback{PacketIdentifier: pub.PacketIdentifier}})
+	if err := waitToken(t, token); err != nil {
+		t.Errorf("Wait() = %v, want nil", err)
+	}
+
+	// A PUBREC with an error reason code ends the flow without PUBREL
+	token, pub = publishWithToken(t, c, s, &packets.Publish{QoS: packets.QoS2, Topic: "test/topic"})
+	s.send(&packets.Pubrec{Puback: packets.Puback{PacketIdentifier: pub.PacketIdentifier, ReasonCode: 0x87}})
+
+	if err := waitToken(t, token); err != ReasonCode(0x87) {
+		t.Errorf("Wait() = %v, want %v", err, ReasonCode(0x87))
+	}
+
+	// QoS 0 publishes are done once written
+	token, _ = publishWithToken(t, c, s, &packets.Publish{Topic: "test/topic"})
+	if err := waitToken(t, token); err != nil {
+		t.Errorf("Wait() = %v, want nil", err)
+	}
+}
+
+func TestClient_DeliveryTokenSessionLost(t *testing.T) {
+	servers := make(chan *fakeServer, 2)
+	c := NewClientWithDialer(DialerFunc(func(ctx context.Context) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() {
+			clientConn.Close()
+			serverConn.Close()
+		})
+
+		servers <- &fakeServer{t: t, conn: serverConn}
+		return clientConn, nil
+	}))
+
+	connected := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{Version: packets.MQTT5, ClientId: "test"})
+		connected <- err
+	}()
+	s := <-servers
+	accept(s)
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is lost before PUBACK arrives
+	token, _ := publishWithToken(t, c, s, &packets.Publish{QoS: packets.QoS1, Topic: "test/topic"})
+
+	go func() {
+		connected <- c.Reconnect(context.Background())
+	}()
+	accept(<-servers)
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := waitToken(t, token); err != ErrSessionLost {
+		t.Errorf("Wait() = %v, want %v", err, ErrSessionLost)
+	}
+}
+
+func TestClient_DeliveryTokenIdentifiers(t *testing.T) {
+	c, s := newTestClient(t)
+	c.SetStorage(memory.NewStorage())
+	s.connect(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := startRun(t, ctx, c)
+
+	// Every publish draws an identifier that is already in use first
+	ids := []uint32{5, 5, 6, 6, 7}
+	c.SetRngFn(func() uint32 {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	})
+
+	token, pub := publishWithToken(t, c, s, &packets.Publish{QoS: packets.QoS1, Topic: "test/topic"})
+	if pub.PacketIdentifier != 5 {
+		t.Fatalf("token publish identifier = %d, want 5", pub.PacketIdentifier)
+	}
+
+	// Plain publishes skip the identifiers of token publishes and of stored publishes
+	for _, want := range []primitives.PrimitiveUint16{6, 7} {
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- c.Publish(context.Background(), &packets.Publish{QoS: packets.QoS1, Topic: "test/topic"})
+		}()
+
+		header, body := s.expect(packets.PUBLISH)
+		received := &packets.Publish{Header: header}
+		if _, err := received.DecodeFrom(body); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+		if received.PacketIdentifier != want {
+			t.Errorf("publish identifier = %d, want %d", received.PacketIdentifier, want)
+		}
+	}
+
+	// The acknowledgements of the plain publishes leave the token alone
+	s.send(&packets.Puback{PacketIdentifier: 6})
+	s.send(&packets.Puback{PacketIdentifier: 7})
+	select {
+	case <-token.Done():
+		t.Fatal("token completed by the acknowledgement of another publish")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	s.send(&packets.Puback{PacketIdentifier: 5})
+	if err := waitToken(t, token); err != nil {
+		t.Errorf("Wait() = %v, want nil", err)
+	}
+
+	cancel()
+	if err := waitRun(t, runErr); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestClient_InflightIdentifiers(t *testing.T) {
+	c, s := newTestClient(t)
+	s.connect(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := startRun(t, ctx, c)
+
+	ids := []uint32{5, 5, 6, 5}
+	c.SetRngFn(func() uint32 {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	})
+
+	// publish sends a plain QoS 1 publish without storage and returns its packet identifier
+	publish := func() primitives.PrimitiveUint16 {
+		t.Helper()
+
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- c.Publish(context.Background(), &packets.Publish{QoS: packets.QoS1, Topic: "test/topic"})
+		}()
+
+		header, body := s.expect(packets.PUBLISH)
+		received := &packets.Publish{Header: header}
+		if _, err := received.DecodeFrom(body); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+		return received.PacketIdentifier
+	}
+
+	if id := publish(); id != 5 {
+		t.Fatalf("publish identifier = %d, want 5", id)
+	}
+
+	// The token publish skips the identifier of the unacknowledged plain publish
+	token, pub := publishWithToken(t, c, s, &packets.Publish{QoS: packets.QoS1, Topic: "test/topic"})
+	if pub.PacketIdentifier != 6 {
+		t.Fatalf("token publish identifier = %d, want 6", pub.PacketIdentifier)
+	}
+
+	s.send(&packets.Puback{PacketIdentifier: 5})
+	select {
+	case <-token.Done():
+		t.Fatal("token completed by the acknowledgement of another publish")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	// The identifier can be used again once the plain publish has been acknowledged
+	for {
+		c.mutex.RLock()
+		_, ok := c.inflight[5]
+		c.mutex.RUnlock()
+
+		if !ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if id := publish(); id != 5 {
+		t.Errorf("publish identifier = %d, want 5", id)
+	}
+
+	s.send(&packets.Puback{PacketIdentifier: 6})
+	if err := waitToken(t, token); err != nil {
+		t.Errorf("Wait() = %v, want nil", err)
+	}
+
+	cancel()
+	if err := waitRun(t, runErr); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+}
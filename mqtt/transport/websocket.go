@@ -0,0 +1,431 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package transport provides network transports that MQTT clients can be created with in addition to raw TCP.
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidScheme        = errors.New("websocket url scheme must be ws or wss")
+	ErrBadHandshake         = errors.New("websocket handshake failed")
+	ErrWebSocketProtocol    = errors.New("websocket protocol violation")
+	ErrUnsupportedFrameType = errors.New("websocket data frame is not binary")
+)
+
+// webSocketGUID is appended to the handshake key to compute the accept value.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// closeFrameTimeout bounds the time Close waits for the close frame to be written.
+const closeFrameTimeout = time.Second
+
+/* WebSocket opcodes */
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// WebSocketDialer connects to MQTT servers using MQTT over WebSockets.
+// SPEC: The Client MUST include "mqtt" in the list of WebSocket Sub Protocols it offers [MQTT-6.0.0-3].
+type WebSocketDialer struct {
+	// NetDialer is used to open the underlying TCP connection. The zero value is used if nil.
+	NetDialer *net.Dialer
+
+	// TLSConfig is used for wss URLs. A default configuration using the host of the URL as the server name is used if
+	// nil.
+	TLSConfig *tls.Config
+
+	// Header specifies additional HTTP headers sent with the handshake request, such as authentication tokens.
+	Header http.Header
+}
+
+// DialWebSocket connects to the WebSocket endpoint at rawURL using the default WebSocketDialer.
+func DialWebSocket(ctx context.Context, rawURL string) (net.Conn, error) {
+	var d WebSocketDialer
+	return d.DialContext(ctx, rawURL)
+}
+
+// DialContext opens a connection to the WebSocket endpoint at rawURL, which must use the ws or wss scheme, and performs
+// the opening handshake. The returned connection frames everything written to it as binary WebSocket messages. The
+// deadline of ctx, if any, applies to the handshake only.
+func (d *WebSocketDialer) DialContext(ctx context.Context, rawURL string) (conn net.Conn, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultPort string
+	switch u.Scheme {
+	case "ws":
+		defaultPort = "80"
+	case "wss":
+		defaultPort = "443"
+	default:
+		return nil, ErrInvalidScheme
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	netDialer := d.NetDialer
+	if netDialer == nil {
+		netDialer = &net.Dialer{}
+	}
+
+	if conn, err = netDialer.DialContext(ctx, "tcp", address); err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "wss" {
+		config := d.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		} else {
+			config = config.Clone()
+		}
+
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	var wsConn *webSocketConn
+	if wsConn, err = handshake(ctx, conn, u, d.Header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return wsConn, nil
+}
+
+// handshake performs the client side of the WebSocket opening handshake on conn.
+func handshake(ctx context.Context, conn net.Conn, u *url.URL, header http.Header) (*webSocketConn, error) {
+	// Apply the deadline of the context to the handshake only
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: "http", Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "mqtt")
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		!headerContainsToken(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, ErrBadHandshake
+	}
+
+	// SPEC: The Server MUST select "mqtt" as the WebSocket Sub Protocol it responds with [MQTT-6.0.0-4].
+	if resp.Header.Get("Sec-WebSocket-Protocol") != "mqtt" {
+		return nil, ErrBadHandshake
+	}
+
+	return &webSocketConn{
+		Conn: conn,
+		br:   br,
+	}, nil
+}
+
+// acceptKey returns the expected value of the Sec-WebSocket-Accept header for key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken returns true if the comma separated header contains token.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketConn adapts a WebSocket connection to net.Conn. Writes are sent as single binary frames and reads return
+// the payload of binary frames, so MQTT control packets may span any number of frames or fragments.
+type webSocketConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	readMutex sync.Mutex
+	remaining uint64
+	inMessage bool
+	closed    bool
+
+	writeMutex sync.Mutex
+	writeBuf   []byte
+	closeSent  bool
+}
+
+func (c *webSocketConn) Read(b []byte) (n int, err error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+
+		reply, payload, err := c.nextFrame()
+		if reply != 0 {
+			// Answer the control frame without holding the read lock since the write may block on a stalled link
+			c.readMutex.Unlock()
+			writeErr := c.writeFrame(reply, payload)
+			c.readMutex.Lock()
+
+			// The end of the stream is reported even if the echoed close frame could not be sent
+			if writeErr != nil && err == nil {
+				err = writeErr
+			}
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+
+	n, err = c.br.Read(b)
+	c.remaining -= uint64(n)
+	return
+}
+
+// nextFrame reads the next frame header. The payload of a data frame is left to be read. Control frames are read in
+// full and reply is set to the opcode of the frame that must be sent in response along with its payload. The caller
+// must hold the read lock.
+func (c *webSocketConn) nextFrame() (reply byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0F
+
+	// Extensions are not negotiated so the reserved bits must be clear. Frames from the server must not be masked.
+	if head[0]&0x70 != 0 || head[1]&0x80 != 0 {
+		return 0, nil, ErrWebSocketProtocol
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	switch opcode {
+	case opBinary, opContinuation:
+		// A continuation frame is only valid within a fragmented message and a new message cannot begin before the
+		// previous one ended.
+		if (opcode == opContinuation) != c.inMessage {
+			return 0, nil, ErrWebSocketProtocol
+		}
+		// SPEC: A single WebSocket data frame can contain multiple or partial MQTT Control Packets. The receiver MUST
+		//       NOT assume that MQTT Control Packets are aligned on WebSocket frame boundaries [MQTT-6.0.0-2].
+		c.inMessage = !fin
+		c.remaining = length
+		return 0, nil, nil
+	case opText:
+		// SPEC: MQTT Control Packets MUST be sent in WebSocket binary data frames. If any other type of data frame is
+		//       received the recipient MUST close the Network Connection [MQTT-6.0.0-1].
+		return 0, nil, ErrUnsupportedFrameType
+	case opClose, opPing, opPong:
+		// Control frames must not be fragmented and have a payload of at most 125 bytes
+		if !fin || length > 125 {
+			return 0, nil, ErrWebSocketProtocol
+		}
+
+		payload = make([]byte, length)
+		if _, err = io.ReadFull(c.br, payload); err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			return opPong, payload, nil
+		case opClose:
+			// Echo the status code back to the server and report the end of the stream
+			c.closed = true
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			return opClose, payload, io.EOF
+		}
+		return 0, nil, nil
+	}
+
+	return 0, nil, ErrWebSocketProtocol
+}
+
+func (c *webSocketConn) Write(b []byte) (n int, err error) {
+	if err = c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame writes a single masked frame to the connection.
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) (err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writeFrameLocked(opcode, payload)
+}
+
+// writeFrameLocked writes a single masked frame to the connection. The caller must hold the write lock.
+func (c *webSocketConn) writeFrameLocked(opcode byte, payload []byte) (err error) {
+	// No frames may be sent after the close frame
+	if c.closeSent {
+		return net.ErrClosed
+	}
+
+	buf := append(c.writeBuf[:0], 0x80|opcode)
+
+	// SPEC: A client MUST mask all frames that it sends to the server. [RFC 6455 5.1]
+	switch length := len(payload); {
+	case length < 126:
+		buf = append(buf, 0x80|byte(length))
+	case length <= 0xFFFF:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0x80|126), uint16(length))
+	default:
+		buf = binary.BigEndian.AppendUint64(append(buf, 0x80|127), uint64(length))
+	}
+
+	var mask [4]byte
+	if _, err = rand.Read(mask[:]); err != nil {
+		return err
+	}
+	buf = append(buf, mask[:]...)
+
+	start := len(buf)
+	buf = append(buf, payload...)
+	for i := range buf[start:] {
+		buf[start+i] ^= mask[i&3]
+	}
+	c.writeBuf = buf
+
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	_, err = c.Conn.Write(buf)
+	return
+}
+
+// Close sends a close frame with the normal closure status code and closes the underlying connection.
+func (c *webSocketConn) Close() error {
+	// The close frame is sent on a best effort basis. It is skipped if another write is in progress since that write
+	// may be blocked on a stalled link, which is when the connection is most likely to be closed, and closing the
+	// underlying connection is what unblocks it.
+	if c.writeMutex.TryLock() {
+		if !c.closeSent {
+			c.Conn.SetWriteDeadline(time.Now().Add(closeFrameTimeout))
+			c.writeFrameLocked(opClose, []byte{0x03, 0xE8})
+		}
+		c.writeMutex.Unlock()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,347 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serverFrame is a frame read by the test server.
+type serverFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// readServerFrame reads and unmasks a frame sent by the client.
+func readServerFrame(r io.Reader) (f serverFrame, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return f, err
+	}
+
+	if head[1]&0x80 == 0 {
+		return f, errors.New("client frame is not masked")
+	}
+
+	f.fin = head[0]&0x80 != 0
+	f.opcode = head[0] & 0x0F
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return f, err
+	}
+
+	f.payload = make([]byte, length)
+	if _, err = io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+
+	for i := range f.payload {
+		f.payload[i] ^= mask[i&3]
+	}
+	return
+}
+
+// serverFrameBytes returns an unmasked frame as sent by a server.
+func serverFrameBytes(fin bool, opcode byte, payload []byte) []byte {
+	b := []byte{opcode}
+	if fin {
+		b[0] |= 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		b = append(b, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		b = binary.BigEndian.AppendUint16(append(b, 126), uint16(len(payload)))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, 127), uint64(len(payload)))
+	}
+	return append(b, payload...)
+}
+
+// newWebSocketServer starts a server that completes the handshake with the given subprotocol and then runs fn on the
+// hijacked connection.
+func newWebSocketServer(t *testing.T, protocol string, fn func(conn net.Conn, rw *bufio.ReadWriter)) string {
+	done := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+
+		if r.Header.Get("Sec-WebSocket-Version") != "13" || !strings.Contains(r.Header.Get("Sec-WebSocket-Protocol"), "mqtt") {
+			t.Errorf("unexpected handshake request headers: %v", r.Header)
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + acceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+		if len(protocol) > 0 {
+			rw.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+		}
+		rw.WriteString("\r\n")
+		rw.Flush()
+
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		fn(conn, rw)
+	}))
+
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestWebSocket_Fragmentation(t *testing.T) {
+	ping := []byte("are you there?")
+	pongChan := make(chan serverFrame, 1)
+
+	url := newWebSocketServer(t, "mqtt", func(conn net.Conn, rw *bufio.ReadWriter) {
+		f, err := readServerFrame(rw)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !f.fin || f.opcode != opBinary {
+			t.Errorf("client sent frame with fin=%v opcode=%d", f.fin, f.opcode)
+		}
+
+		// Echo the payload back in three fragments with a ping between them
+		third := len(f.payload) / 3
+		rw.Write(serverFrameBytes(false, opBinary, f.payload[:third]))
+		rw.Write(serverFrameBytes(true, opPing, ping))
+		rw.Write(serverFrameBytes(false, opContinuation, f.payload[third:2*third]))
+		rw.Write(serverFrameBytes(true, opContinuation, f.payload[2*third:]))
+		rw.Flush()
+
+		if f, err = readServerFrame(rw); err != nil {
+			t.Error(err)
+			return
+		}
+		pongChan <- f
+	})
+
+	conn, err := DialWebSocket(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A PINGREQ followed by a PUBLISH larger than 125 bytes
+	packet := []byte{0xC0, 0x00, 0x30, 0xC8, 0x01, 0x00, 0x01, 't', 0x00}
+	packet = append(packet, bytes.Repeat([]byte{0xAB}, 197)...)
+
+	if _, err = conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(packet))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, packet) {
+		t.Errorf("Read() = %x, want %x", got, packet)
+	}
+
+	select {
+	case f := <-pongChan:
+		if f.opcode != opPong || !bytes.Equal(f.payload, ping) {
+			t.Errorf("client answered ping with opcode=%d payload=%q", f.opcode, f.payload)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for pong")
+	}
+}
+
+func TestWebSocket_Close(t *testing.T) {
+	closeChan := make(chan serverFrame, 1)
+
+	url := newWebSocketServer(t, "mqtt", func(conn net.Conn, rw *bufio.ReadWriter) {
+		rw.Write(serverFrameBytes(true, opClose, []byte{0x03, 0xE8}))
+		rw.Flush()
+
+		f, err := readServerFrame(rw)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		closeChan <- f
+	})
+
+	conn, err := DialWebSocket(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() = %v, want %v", err, io.EOF)
+	}
+
+	if f := <-closeChan; f.opcode != opClose || !bytes.Equal(f.payload, []byte{0x03, 0xE8}) {
+		t.Errorf("client answered close with opcode=%d payload=%x", f.opcode, f.payload)
+	}
+}
+
+func TestWebSocket_CloseStalledWrite(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	c := &webSocketConn{Conn: clientConn, br: bufio.NewReader(clientConn)}
+
+	// The server never reads, so the write blocks
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("stalled"))
+		writeErr <- err
+	}()
+
+	for c.writeMutex.TryLock() {
+		c.writeMutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Close() blocked on the stalled write")
+	}
+
+	if err := <-writeErr; err == nil {
+		t.Error("Write() = nil, want an error once the connection is closed")
+	}
+}
+
+func TestWebSocket_PingWithoutReadLock(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	c := &webSocketConn{Conn: clientConn, br: bufio.NewReader(clientConn)}
+	defer c.Close()
+	defer serverConn.Close()
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	serverConn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := serverConn.Write(serverFrameBytes(true, opPing, []byte("ping"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pong is blocked until the server reads it, which must not keep the read lock held
+	deadline := time.Now().Add(time.Second * 5)
+	for !c.readMutex.TryLock() {
+		if time.Now().After(deadline) {
+			t.Fatal("read lock held while the pong is written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.readMutex.Unlock()
+
+	f, err := readServerFrame(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.opcode != opPong || string(f.payload) != "ping" {
+		t.Errorf("client answered ping with opcode=%d payload=%q", f.opcode, f.payload)
+	}
+
+	if _, err = serverConn.Write(serverFrameBytes(true, opBinary, []byte{0x01})); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-readErr; err != nil {
+		t.Errorf("Read() = %v, want nil", err)
+	}
+}
+
+func TestWebSocket_TextFrame(t *testing.T) {
+	url := newWebSocketServer(t, "mqtt", func(conn net.Conn, rw *bufio.ReadWriter) {
+		rw.Write(serverFrameBytes(true, opText, []byte("hello")))
+		rw.Flush()
+	})
+
+	conn, err := DialWebSocket(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Read(make([]byte, 5)); !errors.Is(err, ErrUnsupportedFrameType) {
+		t.Errorf("Read() = %v, want %v", err, ErrUnsupportedFrameType)
+	}
+}
+
+func TestWebSocket_Handshake(t *testing.T) {
+	// The server must select the mqtt subprotocol
+	url := newWebSocketServer(t, "", func(conn net.Conn, rw *bufio.ReadWriter) {})
+	if _, err := DialWebSocket(context.Background(), url); !errors.Is(err, ErrBadHandshake) {
+		t.Errorf("DialWebSocket() = %v, want %v", err, ErrBadHandshake)
+	}
+
+	if _, err := DialWebSocket(context.Background(), "tcp://localhost:1883"); !errors.Is(err, ErrInvalidScheme) {
+		t.Errorf("DialWebSocket() = %v, want %v", err, ErrInvalidScheme)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package trie implements a subscription trie that matches topic names against topic filters level by level.
+package trie
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+// Trie maps topic filters to subscribers. A topic filter may have any number of subscribers and a subscriber may be
+// added with any number of topic filters. Shared subscriptions are matched by the topic filter following their share
+// name. A Trie is safe for concurrent use.
+type Trie[V comparable] struct {
+	mutex sync.RWMutex
+	root  node[V]
+	count int
+}
+
+type node[V comparable] struct {
+	children map[string]*node[V]
+
+	// plus is the child for the single-level wildcard
+	plus *node[V]
+
+	// subscribers are subscribed with a topic filter ending at this node. multi are subscribed with a topic filter
+	// ending with a multi-level wildcard following this node.
+	subscribers []entry[V]
+	multi       []entry[V]
+}
+
+type entry[V comparable] struct {
+	filter string
+	value  V
+}
+
+// New returns an empty trie.
+func New[V comparable]() *Trie[V] {
+	return &Trie[V]{}
+}
+
+// Len returns the number of subscriptions in the trie.
+func (t *Trie[V]) Len() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.count
+}
+
+// route returns the topic filter used for matching. Shared subscriptions are matched by the topic filter following the
+// share name.
+func route(filter string) (string, error) {
+	if err := packets.ValidateTopicFilter(filter); err != nil {
+		return "", err
+	}
+
+	if shared, ok, _ := packets.ParseSharedSubscription(filter); ok {
+		return shared.Filter, nil
+	}
+	return filter, nil
+}
+
+// Add subscribes value to filter. Adding the same subscription more than once has no effect. ReasonCode 0x8F (Topic
+// Filter invalid) is returned if filter is not a valid topic filter.
+func (t *Trie[V]) Add(filter string, value V) (err error) {
+	var path string
+	if path, err = route(filter); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := &t.root
+	for {
+		level, rest, more := strings.Cut(path, "/")
+		if level == "#" {
+			// The multi-level wildcard is always the last level
+			return t.add(&n.multi, filter, value)
+		}
+
+		n = n.child(level)
+		if !more {
+			return t.add(&n.subscribers, filter, value)
+		}
+		path = rest
+	}
+}
+
+// add appends the subscription to entries unless it is already present. The caller must hold the mutex.
+func (t *Trie[V]) add(entries *[]entry[V], filter string, value V) error {
+	for _, e := range *entries {
+		if e.filter == filter && e.value == value {
+			return nil
+		}
+	}
+
+	*entries = append(*entries, entry[V]{filter: filter, value: value})
+	t.count++
+	return nil
+}
+
+// child returns the child node for level, creating it if it does not exist.
+func (n *node[V]) child(level string) *node[V] {
+	if level == "+" {
+		if n.plus == nil {
+			n.plus = &node[V]{}
+		}
+		return n.plus
+	}
+
+	if n.children == nil {
+		n.children = make(map[string]*node[V])
+	}
+
+	child, ok := n.children[level]
+	if !ok {
+		child = &node[V]{}
+		n.children[level] = child
+	}
+	return child
+}
+
+// Remove unsubscribes value from filter and returns true if the subscription existed.
+func (t *Trie[V]) Remove(filter string, value V) bool {
+	return t.remove(filter, func(e entry[V]) bool {
+		return e.value == value
+	})
+}
+
+// RemoveAll removes every subscriber of filter and returns true if there was at least one.
+func (t *Trie[V]) RemoveAll(filter string) bool {
+	return t.remove(filter, func(entry[V]) bool {
+		return true
+	})
+}
+
+func (t *Trie[V]) remove(filter string, fn func(e entry[V]) bool) bool {
+	path, err := route(filter)
+	if err != nil {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Remember the nodes along the way so that empty nodes can be pruned afterwards
+	type step struct {
+		parent *node[V]
+		level  string
+	}
+	var steps []step
+
+	n := &t.root
+	var entries *[]entry[V]
+	for entries == nil {
+		level, rest, more := strings.Cut(path, "/")
+		if level == "#" {
+			entries = &n.multi
+			break
+		}
+
+		var child *node[V]
+		if level == "+" {
+			child = n.plus
+		} else {
+			child = n.children[level]
+		}
+		if child == nil {
+			return false
+		}
+
+		steps = append(steps, step{parent: n, level: level})
+		n = child
+		if !more {
+			entries = &n.subscribers
+		}
+		path = rest
+	}
+
+	removed := false
+	remaining := (*entries)[:0]
+	for _, e := range *entries {
+		if e.filter == filter && fn(e) {
+			removed = true
+			t.count--
+			continue
+		}
+		remaining = append(remaining, e)
+	}
+	*entries = remaining
+
+	// Prune nodes that no longer lead to any subscriber
+	for i := len(steps) - 1; i >= 0; i-- {
+		child := n
+		if len(child.children) > 0 || child.plus != nil || len(child.subscribers) > 0 || len(child.multi) > 0 {
+			break
+		}
+
+		n = steps[i].parent
+		if steps[i].level == "+" {
+			n.plus = nil
+		} else {
+			delete(n.children, steps[i].level)
+		}
+	}
+
+	return removed
+}
+
+// Match appends the subscribers of every topic filter matching topic to dst and returns the extended slice. A
+// subscriber is appended once for each of its matching topic filters.
+func (t *Trie[V]) Match(topic string, dst []V) []V {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	// SPEC: The Server MUST NOT match Topic Filters starting with a wildcard character (# or +) with Topic Names
+	//       beginning with a $ character [MQTT-4.7.2-1].
+	return t.root.match(topic, len(topic) > 0 && topic[0] == '$', dst)
+}
+
+func (n *node[V]) match(topic string, dollar bool, dst []V) []V {
+	if !dollar {
+		// A multi-level wildcard matches the remaining levels
+		dst = appendValues(dst, n.multi)
+	}
+
+	level, rest, more := strings.Cut(topic, "/")
+	if child := n.children[level]; child != nil {
+		dst = child.visit(rest, more, dst)
+	}
+	if n.plus != nil && !dollar {
+		dst = n.plus.visit(rest, more, dst)
+	}
+	return dst
+}
+
+// visit matches the remaining levels of the topic name against the node or appends its subscribers if there are none.
+func (n *node[V]) visit(rest string, more bool, dst []V) []V {
+	if more {
+		return n.match(rest, false, dst)
+	}
+
+	// SPEC: The multi-level wildcard represents the parent and any number of child levels.
+	dst = appendValues(dst, n.subscribers)
+	return appendValues(dst, n.multi)
+}
+
+func appendValues[V comparable](dst []V, entries []entry[V]) []V {
+	for _, e := range entries {
+		dst = append(dst, e.value)
+	}
+	return dst
+}
+
+// MatchFilter returns true if topic matches filter.
+func MatchFilter(topic, filter string) bool {
+	path, err := route(filter)
+	if err != nil {
+		return false
+	}
+
+	// SPEC: The Server MUST NOT match Topic Filters starting with a wildcard character (# or +) with Topic Names
+	//       beginning with a $ character [MQTT-4.7.2-1].
+	if len(topic) > 0 && topic[0] == '$' && len(path) > 0 && (path[0] == '+' || path[0] == '#') {
+		return false
+	}
+
+	for {
+		level, rest, more := strings.Cut(path, "/")
+		if level == "#" {
+			return true
+		}
+
+		topicLevel, topicRest, topicMore := strings.Cut(topic, "/")
+		if level != "+" && level != topicLevel {
+			return false
+		}
+
+		if !more || !topicMore {
+			// Both must end at the same level unless the filter ends with a multi-level wildcard
+			return more == topicMore || rest == "#"
+		}
+		path, topic = rest, topicRest
+	}
+}
@@ -0,0 +1,317 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package trie
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// matchCases are the cases of the client's original topic matcher along with cases for $-prefixed topics and shared
+// subscriptions.
+var matchCases = []struct {
+	topic  string
+	filter string
+	want   bool
+}{
+	{topic: "test", filter: "test", want: true},
+	{topic: "teststuff", filter: "test", want: false},
+	{topic: "test", filter: "testextra", want: false},
+	{topic: "test", filter: "#", want: true},
+	{topic: "test", filter: "+", want: true},
+	{topic: "test/extra", filter: "test/extra", want: true},
+	{topic: "test/extra", filter: "test/#", want: true},
+	{topic: "test/extra/stuff", filter: "#", want: true},
+	{topic: "test/extra", filter: "test#", want: false},
+	{topic: "test/extra/stuff", filter: "test/#/stuff", want: false},
+	{topic: "test/extra/stuff", filter: "+/extra/stuff", want: true},
+	{topic: "test/extra/stuff", filter: "test/+/stuff", want: true},
+	{topic: "test/extra/stuff", filter: "test/extra/+", want: true},
+	{topic: "test/extra/stuff", filter: "test/extra+", want: false},
+	{topic: "test/extra/stuff", filter: "+/#", want: true},
+	{topic: "test/extra/stuff", filter: "+#", want: false},
+	{topic: "test/extra/stuff/that/comes/after", filter: "+/extra/#", want: true},
+	{topic: "test/extra/stuff/that/comes/after", filter: "+/extra/stuff/+/comes/after", want: true},
+	{topic: "test/extra/stuff/that/comes/after", filter: "#/extra/stuff/dontmatter/+/after", want: false},
+
+	{topic: "sport", filter: "sport/#", want: true},
+	{topic: "sport", filter: "sport/+", want: false},
+	{topic: "sport/", filter: "sport/+", want: true},
+	{topic: "/finance", filter: "+/+", want: true},
+	{topic: "/finance", filter: "/+", want: true},
+	{topic: "/finance", filter: "+", want: false},
+	{topic: "$SYS/broker/uptime", filter: "#", want: false},
+	{topic: "$SYS/broker/uptime", filter: "+/broker/uptime", want: false},
+	{topic: "$SYS/broker/uptime", filter: "$SYS/#", want: true},
+	{topic: "$SYS/broker/uptime", filter: "$SYS/+/uptime", want: true},
+	{topic: "sensors/a", filter: "$share/group/sensors/+", want: true},
+	{topic: "sensors/a/temperature", filter: "$share/group/sensors/#", want: true},
+	{topic: "group/sensors/a", filter: "$share/group/sensors/a", want: false},
+	{topic: "sensors/a", filter: "$share//sensors/a", want: false},
+}
+
+func TestMatchFilter(t *testing.T) {
+	for _, tt := range matchCases {
+		if got := MatchFilter(tt.topic, tt.filter); got != tt.want {
+			t.Errorf("MatchFilter(%q, %q) = %v, want %v", tt.topic, tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestTrie_Match(t *testing.T) {
+	for _, tt := range matchCases {
+		trie := New[int]()
+		trie.Add(tt.filter, 1)
+
+		if got := len(trie.Match(tt.topic, nil)) == 1; got != tt.want {
+			t.Errorf("Match(%q) with filter %q = %v, want %v", tt.topic, tt.filter, got, tt.want)
+		}
+	}
+}
+
+// baselineMatch is the client's original topic matcher. It is kept as an independent reference for the trie with fixes
+// for the cases where it disagreed with the specification:
+//   - The end of the topic name is detected using the topic position instead of the filter position.
+//   - A single-level wildcard that consumes the last level of the topic name only matches if it is also the last level
+//     of the filter.
+//   - Unprocessed characters in the topic name fail the match even if the topic name and filter have the same length.
+func baselineMatch(topic, filter string) bool {
+	var filterPos int
+	var topicPos int
+	for filterPos < len(filter) {
+		if filter[filterPos] == '#' {
+			// Encountered multi-level wildcard.
+
+			// Quick path
+			if len(filter) == 1 {
+				return true
+			}
+
+			// Look around the wildcard
+			if (filterPos != 0 && filter[filterPos-1] != '/') || filterPos != len(filter)-1 {
+				// Invalid use of # wildcard. Do attempt to match the filter any further
+				return false
+			}
+
+			// Stop and return true
+			return true
+		} else if filter[filterPos] == '+' {
+			// Encountered single-level wildcard
+
+			// Look around the wildcard
+			if (filterPos != 0 && filter[filterPos-1] != '/') || (filterPos != len(filter)-1 && filter[filterPos+1] != '/') {
+				// Invalid use of + wildcard. Do attempt to match the filter any further
+				return false
+			}
+
+			// Fast-forward the topic position to the beginning of the next level
+			for topicPos < len(topic) && topic[topicPos] != '/' {
+				topicPos++
+			}
+
+			if topicPos == len(topic) {
+				// No levels left. Return true if the wildcard is the last level of the filter.
+				return filterPos == len(filter)-1
+			}
+
+			// Advance the filter pos and continue at the beginning of the loop
+			filterPos++
+			continue
+		} else if topicPos >= len(topic) {
+			// The length of the filter exceeded the length of the topic. No way these can match.
+			return false
+		} else if filter[filterPos] != topic[topicPos] {
+			return false
+		}
+
+		filterPos++
+		topicPos++
+	}
+
+	// Check if there is more characters in the topic that went unprocessed
+	if topicPos < len(topic) {
+		// Topic couldn't have matched the filter
+		return false
+	}
+
+	return true
+}
+
+// matchOracle applies the rules that the original matcher predates on top of it: wildcards at the first level do not
+// match $-prefixed topic names and a multi-level wildcard also matches its parent level.
+func matchOracle(topic, filter string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	if strings.HasSuffix(filter, "/#") && baselineMatch(topic+"/", filter) {
+		return true
+	}
+
+	return baselineMatch(topic, filter)
+}
+
+// levels generates every topic name or filter with up to depth levels made of the specified level names.
+func levels(names []string, depth int) (result []string) {
+	prefixes := []string{""}
+	for d := 0; d < depth; d++ {
+		var next []string
+		for _, prefix := range prefixes {
+			for _, name := range names {
+				value := name
+				if d > 0 {
+					value = prefix + "/" + name
+				}
+				next = append(next, value)
+			}
+		}
+		result = append(result, next...)
+		prefixes = next
+	}
+	return result
+}
+
+func TestTrie_MatchEquivalence(t *testing.T) {
+	topics := levels([]string{"a", "b", "", "$c"}, 4)
+	filters := levels([]string{"a", "b", "", "$c", "+", "#"}, 4)
+
+	trie := New[string]()
+	for _, filter := range filters {
+		trie.Add(filter, filter)
+	}
+
+	// The trie must match exactly the filters that the reference matcher matches individually
+	for _, topic := range topics {
+		// Topic names and topic filters must be at least one character long [MQTT-4.7.3-1]
+		if topic == "" {
+			continue
+		}
+
+		got := trie.Match(topic, nil)
+		sort.Strings(got)
+
+		var want []string
+		for _, filter := range filters {
+			if filter != "" && matchOracle(topic, filter) {
+				want = append(want, filter)
+			}
+		}
+		sort.Strings(want)
+
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("Match(%q) = %q, want %q", topic, got, want)
+		}
+	}
+}
+
+func TestTrie_AddRemove(t *testing.T) {
+	trie := New[int]()
+
+	for _, filter := range []string{"sensors/+", "sensors/#", "$share/group/sensors/+"} {
+		if err := trie.Add(filter, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trie.Add("sensors/+", 2)
+	trie.Add("sensors/+", 2)
+
+	if trie.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", trie.Len())
+	}
+	if got := trie.Match("sensors/a", nil); len(got) != 4 {
+		t.Errorf("Match() = %v, want 4 subscribers", got)
+	}
+
+	if err := trie.Add("sensors/#/a", 1); err == nil {
+		t.Error("Add() of an invalid filter succeeded")
+	}
+
+	if !trie.Remove("sensors/+", 2) || trie.Remove("sensors/+", 2) {
+		t.Error("Remove() did not remove the subscription exactly once")
+	}
+	if !trie.RemoveAll("$share/group/sensors/+") {
+		t.Error("RemoveAll() of the shared subscription failed")
+	}
+	if got := trie.Match("sensors/a", nil); len(got) != 2 {
+		t.Errorf("Match() after removal = %v, want 2 subscribers", got)
+	}
+
+	trie.Remove("sensors/+", 1)
+	trie.Remove("sensors/#", 1)
+	if trie.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", trie.Len())
+	}
+
+	// Empty nodes are pruned
+	if len(trie.root.children) != 0 || trie.root.plus != nil {
+		t.Errorf("root still has children after all subscriptions were removed")
+	}
+}
+
+// benchmarkFilters returns n distinct topic filters of the form building/{i}/floor/{j}/+.
+func benchmarkFilters(n int) []string {
+	filters := make([]string, 0, n)
+	for i := 0; len(filters) < n; i++ {
+		switch i % 4 {
+		case 0:
+			filters = append(filters, fmt.Sprintf("building/%d/floor/%d/+", i%100, i))
+		case 1:
+			filters = append(filters, fmt.Sprintf("building/%d/floor/%d/temperature", i%100, i))
+		case 2:
+			filters = append(filters, fmt.Sprintf("building/%d/+/%d/#", i%100, i))
+		default:
+			filters = append(filters, fmt.Sprintf("devices/%d/#", i))
+		}
+	}
+	return filters
+}
+
+func BenchmarkTrie_Match10k(b *testing.B) {
+	trie := New[int]()
+	for i, filter := range benchmarkFilters(10_000) {
+		trie.Add(filter, i)
+	}
+
+	var dst []int
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = trie.Match("building/42/floor/42/temperature", dst[:0])
+	}
+}
+
+func BenchmarkMatchFilter_Linear10k(b *testing.B) {
+	filters := benchmarkFilters(10_000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, filter := range filters {
+			MatchFilter("building/42/floor/42/temperature", filter)
+		}
+	}
+}
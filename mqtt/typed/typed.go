@@ -0,0 +1,102 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Package typed provides generic helpers that publish and subscribe to messages whose payloads are encoded by the codecs
+// registered with the codec package. The codec for each content type in use must be registered by importing its
+// package, such as codec/json or codec/cbor.
+package typed
+
+import (
+	"context"
+
+	"github.com/waj334/tinygo-mqtt/mqtt"
+	"github.com/waj334/tinygo-mqtt/mqtt/codec"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets/primitives"
+)
+
+// PublishJSON encodes v as JSON and publishes it to topic. The content type of the message is set to
+// "application/json" and its payload is marked as UTF-8. The codec/json package must be imported.
+func PublishJSON[T any](ctx context.Context, client *mqtt.Client, topic string, v T, qos packets.QoS) error {
+	return Publish(ctx, client, topic, codec.ContentTypeJSON, v, qos)
+}
+
+// PublishCBOR encodes v as CBOR and publishes it to topic. The content type of the message is set to
+// "application/cbor". The codec/cbor package must be imported. CBOR payloads are more compact than JSON and, as long as
+// codec/json is not imported, encoding/json is not linked into the program, making it better suited for constrained
+// targets.
+func PublishCBOR[T any](ctx context.Context, client *mqtt.Client, topic string, v T, qos packets.QoS) error {
+	return Publish(ctx, client, topic, codec.ContentTypeCBOR, v, qos)
+}
+
+// Publish encodes v using the codec registered for contentType and publishes it to topic.
+func Publish[T any](ctx context.Context, client *mqtt.Client, topic, contentType string, v T, qos packets.QoS) error {
+	pub := &packets.Publish{
+		QoS:   qos,
+		Topic: primitives.PrimitiveString(topic),
+	}
+
+	if err := codec.Encode(pub, contentType, v); err != nil {
+		return err
+	}
+
+	return client.Publish(ctx, pub)
+}
+
+// Subscribe subscribes to filter and calls handler with the decoded payload of each message received on it. The
+// payload is decoded using the codec registered for the content type of the message, or as JSON if the message does not
+// specify one. Handler is called with the zero value of T and the decoding error if a message cannot be decoded into T.
+//
+// Handler is called on a dedicated goroutine for the messages routed to the subscription only. The goroutine exits once
+// the returned event channel is closed, either by Unsubscribe or by CloseEventChannel. The channel can also be passed to
+// UnsubscribeChannel to remove only this subscriber, after which it should be closed with CloseEventChannel.
+func Subscribe[T any](ctx context.Context, client *mqtt.Client, filter string, qos packets.QoS,
+	handler func(v T, pub *packets.Publish, err error)) (channel mqtt.EventChannel, err error) {
+	// Create the channel that the subscription will be bound to
+	channel = client.CreateSubscriptionChannel(10)
+
+	topic := mqtt.Topic{}
+	topic.SetFilter(filter).SetQoS(qos)
+	topic.SetEventChannel(channel)
+
+	if err = client.Subscribe(ctx, []mqtt.Topic{topic}); err != nil {
+		client.CloseEventChannel(channel)
+		return mqtt.EventChannel{}, err
+	}
+
+	go func() {
+		for e := range channel.C {
+			if e.PacketType != packets.PUBLISH {
+				continue
+			}
+
+			pub := e.Data.(*packets.Publish)
+			var v T
+			err := codec.Decode(pub, &v)
+			handler(v, pub, err)
+		}
+	}()
+
+	return channel, nil
+}
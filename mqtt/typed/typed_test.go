@@ -0,0 +1,245 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2022 waj334
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package typed
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/waj334/tinygo-mqtt/mqtt"
+	"github.com/waj334/tinygo-mqtt/mqtt/codec"
+	_ "github.com/waj334/tinygo-mqtt/mqtt/codec/cbor"
+	_ "github.com/waj334/tinygo-mqtt/mqtt/codec/json"
+	"github.com/waj334/tinygo-mqtt/mqtt/packets"
+)
+
+type reading struct {
+	Sensor string  `json:"sensor" cbor:"sensor"`
+	Value  float64 `json:"value" cbor:"value"`
+}
+
+// fakeServer is the server end of an in-memory connection to a client.
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// newTestClient returns a client connected to a fake server. Both ends are closed when the test completes.
+func newTestClient(t *testing.T) (*mqtt.Client, *fakeServer) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	c, s := mqtt.NewClient(clientConn), &fakeServer{t: t, conn: serverConn}
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), &packets.Connect{Version: packets.MQTT5, ClientId: "test", KeepAlive: 60})
+		errChan <- err
+	}()
+
+	s.expect(packets.CONNECT)
+	s.write([]byte{0x20, 0x03, 0x00, 0x00, 0x00})
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+// expect reads the next control packet sent by the client and fails the test if it is not of the specified type.
+func (s *fakeServer) expect(packetType packets.PacketType) (header packets.FixedHeader, body []byte) {
+	s.t.Helper()
+
+	s.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := header.ReadFrom(s.conn); err != nil {
+		s.t.Fatalf("failed to read control packet header: %v", err)
+	}
+
+	body = make([]byte, header.Remaining)
+	if _, err := io.ReadFull(s.conn, body); err != nil {
+		s.t.Fatalf("failed to read control packet body: %v", err)
+	}
+
+	if header.GetType() != packetType {
+		s.t.Fatalf("received %v, want %v", header.GetType(), packetType)
+	}
+	return
+}
+
+// write writes raw bytes to the client.
+func (s *fakeServer) write(raw []byte) {
+	s.t.Helper()
+
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if _, err := s.conn.Write(raw); err != nil {
+		s.t.Fatalf("failed to write to client: %v", err)
+	}
+}
+
+// send encodes a control packet and writes it to the client.
+func (s *fakeServer) send(p *packets.Publish) {
+	s.t.Helper()
+
+	raw, err := p.AppendTo(nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.write(raw)
+}
+
+func TestPublish(t *testing.T) {
+	for _, contentType := range []string{codec.ContentTypeJSON, codec.ContentTypeCBOR} {
+		c, s := newTestClient(t)
+
+		want := reading{Sensor: "temp", Value: 21.5}
+		errChan := make(chan error, 1)
+		go func() {
+			if contentType == codec.ContentTypeJSON {
+				errChan <- PublishJSON(context.Background(), c, "sensors/temp", want, packets.QoS0)
+			} else {
+				errChan <- PublishCBOR(context.Background(), c, "sensors/temp", want, packets.QoS0)
+			}
+		}()
+
+		header, body := s.expect(packets.PUBLISH)
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+
+		pub := packets.Publish{Header: header}
+		if _, err := pub.DecodeFrom(body); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(pub.ContentType) != contentType {
+			t.Errorf("ContentType = %q, want %q", pub.ContentType, contentType)
+		}
+
+		var got reading
+		if err := codec.Decode(&pub, &got); err != nil || got != want {
+			t.Errorf("published %+v, %v, want %+v", got, err, want)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	c, s := newTestClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	// A general event channel tells when a message has been routed to the subscribers
+	general := c.CreateEventChannel(10)
+
+	type received struct {
+		value   reading
+		topic   string
+		decoded bool
+	}
+	receivedChan := make(chan received, 4)
+
+	type result struct {
+		channel mqtt.EventChannel
+		err     error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		channel, err := Subscribe(ctx, c, "sensors/+", packets.QoS0,
+			func(v reading, pub *packets.Publish, err error) {
+				receivedChan <- received{value: v, topic: pub.Topic.String(), decoded: err == nil}
+			})
+		resultChan <- result{channel: channel, err: err}
+	}()
+
+	_, sub := s.expect(packets.SUBSCRIBE)
+	s.write([]byte{0x90, 0x04, sub[0], sub[1], 0x00, 0x00})
+	res := <-resultChan
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	// Send a CBOR message, an undecodable message and a message without a content type which is decoded as JSON
+	pub := &packets.Publish{Topic: "sensors/a"}
+	if err := codec.Encode(pub, codec.ContentTypeCBOR, reading{Sensor: "a", Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+	s.send(pub)
+	s.send(&packets.Publish{Topic: "sensors/b", Payload: []byte("not json")})
+	s.send(&packets.Publish{Topic: "sensors/c", Payload: []byte(`{"sensor":"c","value":3}`)})
+
+	want := []received{
+		{value: reading{Sensor: "a", Value: 1}, topic: "sensors/a", decoded: true},
+		{topic: "sensors/b", decoded: false},
+		{value: reading{Sensor: "c", Value: 3}, topic: "sensors/c", decoded: true},
+	}
+
+	for _, w := range want {
+		select {
+		case got := <-receivedChan:
+			if got != w {
+				t.Errorf("handler received %+v, want %+v", got, w)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for the handler to be called")
+		}
+	}
+
+	// The returned channel removes only this subscriber
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.UnsubscribeChannel(ctx, res.channel, []string{"sensors/+"})
+	}()
+
+	_, body := s.expect(packets.UNSUBSCRIBE)
+	s.write([]byte{0xB0, 0x04, body[0], body[1], 0x00, 0x00})
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler is no longer called for matching messages. The routed event channels are signalled before the general
+	// ones, so anything routed to the handler is pending once the general event channel receives the message.
+	s.send(&packets.Publish{Topic: "sensors/d", Payload: []byte(`{"sensor":"d","value":4}`)})
+	for e := range general.C {
+		if e.PacketType == packets.PUBLISH && e.Data.(*packets.Publish).Topic == "sensors/d" {
+			break
+		}
+	}
+
+	if n := len(res.channel.C); n != 0 {
+		t.Errorf("%d events pending for the handler after UnsubscribeChannel", n)
+	}
+	select {
+	case got := <-receivedChan:
+		t.Errorf("handler received %+v after UnsubscribeChannel", got)
+	default:
+	}
+	c.CloseEventChannel(res.channel)
+}